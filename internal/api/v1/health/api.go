@@ -2,4 +2,12 @@ package health
 
 type HealthResultDto struct {
 	Status string `json:"status"`
+
+	// Components contains the result of each readiness check, it is not filled for the liveness check
+	Components map[string]ComponentHealthDto `json:"components,omitempty"`
+}
+
+type ComponentHealthDto struct {
+	Status  string `json:"status"`            // up, down, or disabled if the component is not configured
+	Details string `json:"details,omitempty"` // why a component is down, or additional state
 }
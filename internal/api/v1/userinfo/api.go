@@ -7,4 +7,8 @@ type UserInfoDto struct {
 	Email         string   `json:"email"`
 	EmailVerified bool     `json:"email_verified"`
 	Groups        []string `json:"groups"`
+	Roles         []string `json:"roles"`
+
+	// the claims listed in security.oidc.extra_claims that the user has, only present if there are any
+	ExtraClaims map[string]interface{} `json:"extra_claims,omitempty"`
 }
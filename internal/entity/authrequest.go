@@ -4,10 +4,23 @@ import (
 	"time"
 )
 
+// the purposes of an auth request, a state can only be redeemed for the flow it was issued for
+const (
+	AuthRequestLogin  = "login"
+	AuthRequestLogout = "logout"
+)
+
 type AuthRequest struct {
-	Application      string
-	State            string
-	ExpiresAt        time.Time
-	DropOffUrl       string
-	PkceCodeVerifier string
+	Application      string    `gorm:"type:varchar(80);NOT NULL"`
+	State            string    `gorm:"type:varchar(80);primaryKey"`
+	ExpiresAt        time.Time `gorm:"NOT NULL;index:auth_request_expires_at_idx"`
+	DropOffUrl       string    `gorm:"type:varchar(2048);NOT NULL"`
+	PkceCodeVerifier string    `gorm:"type:varchar(128);NOT NULL"`
+	// Nonce is sent to the identity provider, which must include it in the id token.
+	Nonce string `gorm:"type:varchar(64);NOT NULL;default:''"`
+	// ExtraParameters holds the allowlisted additional query parameters of the auth request (url encoded),
+	// which are appended to the DropOffUrl after a successful authentication.
+	ExtraParameters string `gorm:"type:varchar(1024);NOT NULL;default:''"`
+	// Purpose tells login flows (AuthRequestLogin) from logout flows (AuthRequestLogout).
+	Purpose string `gorm:"type:varchar(16);NOT NULL;default:''"`
 }
@@ -0,0 +1,22 @@
+package entity
+
+import (
+	"time"
+)
+
+// RevokedSession records that the identity provider ended a session (SessionId set), or all sessions
+// of a subject (only Subject set), through a back-channel logout.
+//
+// Tokens issued at or before RevokedAt for a revoked subject are no longer accepted.
+//
+// LogoutTokenId is the jti of the logout token, it is kept at least until the logout token expires,
+// so the logout token cannot be replayed.
+type RevokedSession struct {
+	ID        uint      `gorm:"primaryKey"`
+	SessionId string    `gorm:"type:varchar(255);NOT NULL;index:revoked_session_session_id_idx"`
+	Subject   string    `gorm:"type:varchar(255);NOT NULL;index:revoked_session_subject_idx"`
+	RevokedAt time.Time `gorm:"NOT NULL"`
+	ExpiresAt time.Time `gorm:"NOT NULL;index:revoked_session_expires_at_idx"`
+
+	LogoutTokenId string `gorm:"type:varchar(255);NOT NULL;default:'';index:revoked_session_logout_token_id_idx"`
+}
@@ -0,0 +1,18 @@
+package entity
+
+import (
+	"time"
+)
+
+// Session holds the tokens of a login for applications using server-side sessions (backend-for-frontend mode).
+//
+// The browser only gets an opaque random session id in a cookie. We never store the session id itself,
+// only its hash, so the contents of the database cannot be used to take over sessions.
+type Session struct {
+	IdHash       string    `gorm:"type:varchar(64);primaryKey"`
+	Application  string    `gorm:"type:varchar(80);NOT NULL"`
+	IdToken      string    `gorm:"type:text;NOT NULL"`
+	AccessToken  string    `gorm:"type:text;NOT NULL"`
+	RefreshToken string    `gorm:"type:text;NOT NULL"`
+	ExpiresAt    time.Time `gorm:"NOT NULL;index:session_expires_at_idx"`
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -10,11 +13,54 @@ func UseEcsLogging() bool {
 	return ecsLogging
 }
 
+func MigrateDatabase() bool {
+	return dbMigrate
+}
+
+func DatabaseUse() DatabaseType {
+	return configuration().Database.Use
+}
+
+func DatabaseMysqlConnectString() string {
+	c := configuration().Database
+	return c.Username + ":" + c.Password + "@" +
+		c.Database + "?" + strings.Join(c.Parameters, "&")
+}
+
+func DatabaseSqliteConnectString() string {
+	c := configuration().Database
+	if len(c.Parameters) == 0 {
+		return c.Database
+	}
+	return c.Database + "?" + strings.Join(c.Parameters, "&")
+}
+
 func ServerAddr() string {
 	c := configuration()
 	return fmt.Sprintf("%s:%s", c.Server.Address, c.Server.Port)
 }
 
+// MetricsAddr is the address of the separate admin server for /metrics, empty if /metrics is not served.
+func MetricsAddr() string {
+	c := configuration()
+	if c.Server.MetricsPort == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", c.Server.Address, c.Server.MetricsPort)
+}
+
+func TracingOtlpEndpoint() string {
+	return configuration().Tracing.OtlpEndpoint
+}
+
+func AuditSink() AuditSinkType {
+	return configuration().Audit.Sink
+}
+
+func AuditFileConfiguration() AuditFileConfig {
+	return configuration().Audit.File
+}
+
 func ServerReadTimeout() time.Duration {
 	return time.Second * time.Duration(configuration().Server.ReadTimeout)
 }
@@ -43,30 +89,43 @@ func SendNonHttpOnlyCookies() bool {
 	return configuration().Security.Cors.DisableHttpOnlyCookies
 }
 
+// TokenEndpoint and the other endpoint accessors without a provider argument refer to the default identity provider,
+// see providers.go for the per provider accessors.
 func TokenEndpoint() string {
-	return configuration().IdentityProvider.TokenEndpoint
+	return ProviderTokenEndpoint(DefaultIdentityProvider)
 }
 
 func AuthorizationEndpoint() string {
-	return configuration().IdentityProvider.AuthorizationEndpoint
+	return ProviderAuthorizationEndpoint(DefaultIdentityProvider)
+}
+
+func EndSessionEndpoint() string {
+	return ProviderEndSessionEndpoint(DefaultIdentityProvider)
+}
+
+func KeySetEndpoint() string {
+	return ProviderKeySetEndpoint(DefaultIdentityProvider)
 }
 
 func DropoffEndpointUrl() string {
 	return configuration().Service.DropoffEndpointUrl
 }
 
-func ErrorUrl() string {
-	return configuration().Service.ErrorUrl
+func LogoutCallbackUrl() string {
+	return configuration().Service.LogoutCallbackUrl
 }
 
-func TokenRequestTimeout() time.Duration {
-	return configuration().IdentityProvider.TokenRequestTimeout
+func ErrorUrl() string {
+	return configuration().Service.ErrorUrl
 }
 
 func AuthRequestTimeout() time.Duration {
 	return configuration().IdentityProvider.AuthRequestTimeout
 }
 
+// ReservedAuthParameters are the query parameters consumed by the auth endpoint itself, they are never passed through.
+var ReservedAuthParameters = []string{"app_name", "dropoff_url"}
+
 func GetApplicationConfig(applicationName string) (ApplicationConfig, error) {
 	appConfig, found := configuration().ApplicationConfigs[applicationName]
 	if found {
@@ -76,6 +135,46 @@ func GetApplicationConfig(applicationName string) (ApplicationConfig, error) {
 	}
 }
 
+// IsApplicationClientId returns true if any application is configured with the given client id.
+func IsApplicationClientId(clientId string) bool {
+	for _, appConfig := range configuration().ApplicationConfigs {
+		if appConfig.ClientId == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplicationsForAudiences returns the names of the applications whose client id is among the audiences of a token.
+//
+// Several applications can share a client id, then all of them are returned.
+func ApplicationsForAudiences(audiences []string) []string {
+	result := make([]string, 0)
+	for name, appConfig := range configuration().ApplicationConfigs {
+		for _, aud := range audiences {
+			if appConfig.ClientId == aud {
+				result = append(result, name)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// RevokedSessionRetention is how long a session revocation needs to be kept.
+//
+// This is the longest cookie expiry of any application, after that no cookie from before the revocation can be around.
+func RevokedSessionRetention() time.Duration {
+	retention := time.Duration(0)
+	for _, appConfig := range configuration().ApplicationConfigs {
+		if appConfig.CookieExpiry > retention {
+			retention = appConfig.CookieExpiry
+		}
+	}
+	return retention
+}
+
 func LoggingSeverity() string {
 	return configuration().Logging.Severity
 }
@@ -88,36 +187,112 @@ func OidcAccessTokenCookieName() string {
 	return configuration().Security.Oidc.AccessTokenCookieName
 }
 
+func OidcRefreshTokenCookieName() string {
+	return configuration().Security.Oidc.RefreshTokenCookieName
+}
+
+func OidcRefreshTokenCookieKey() string {
+	return configuration().Security.Oidc.RefreshTokenCookieKey
+}
+
+func OidcSessionCookieName() string {
+	return configuration().Security.Oidc.SessionCookieName
+}
+
+// SessionCookieName returns the name of the session cookie of an application with server_side_sessions.
+//
+// Each application gets its own cookie, so logging in to one application does not replace the session of another.
+func SessionCookieName(applicationName string) string {
+	return sessionCookieName(configuration().Security.Oidc.SessionCookieName, applicationName)
+}
+
+func sessionCookieName(prefix string, applicationName string) string {
+	return prefix + "_" + applicationName
+}
+
+// ServerSideSessionApplications returns the names of all applications with server_side_sessions, sorted.
+func ServerSideSessionApplications() []string {
+	result := make([]string, 0)
+	for name, ac := range configuration().ApplicationConfigs {
+		if ac.ServerSideSessions {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func OidcFlowCookieKey() string {
+	return configuration().Security.Oidc.FlowCookieKey
+}
+
 func OidcKeySet() []*rsa.PublicKey {
-	return parsedKeySet
+	return ProviderKeySet(DefaultIdentityProvider)
+}
+
+// ClientAssertionKey returns the private key used to sign client assertions for the given application,
+// or nil if it does not use private_key_jwt.
+func ClientAssertionKey(applicationName string) crypto.Signer {
+	return configuration().parsedClientAssertionKeys[applicationName]
 }
 
-func OidcAllowedAudience() string {
-	return configuration().Security.Oidc.Audience
+func OidcAllowMissingAudience() bool {
+	return configuration().Security.Oidc.AllowMissingAudience
 }
 
 func OidcAllowedIssuer() string {
-	return configuration().Security.Oidc.Issuer
+	return ProviderAllowedIssuer(DefaultIdentityProvider)
 }
 
 func OidcUserInfoURL() string {
-	return configuration().Security.Oidc.UserInfoURL
+	return ProviderUserInfoURL(DefaultIdentityProvider)
 }
 
 func OidcTokenIntrospectionURL() string {
-	return configuration().Security.Oidc.TokenIntrospectionURL
+	return ProviderTokenIntrospectionURL(DefaultIdentityProvider)
 }
 
 func OidcUserInfoCacheRetentionTime() time.Duration {
 	return time.Duration(configuration().Security.Oidc.UserInfoCacheSeconds) * time.Second
 }
 
-func OidcUserInfoCacheEnabled() bool {
-	return configuration().Security.Oidc.UserInfoCacheSeconds > 0 &&
-		configuration().Security.Oidc.UserInfoURL != "" &&
-		configuration().Security.Oidc.AccessTokenCookieName != ""
+// OidcIntrospectionCacheRetentionTime is the maximum time an introspection result is cached, 0 disables caching.
+func OidcIntrospectionCacheRetentionTime() time.Duration {
+	return time.Duration(configuration().Security.Oidc.IntrospectionCacheSeconds) * time.Second
+}
+
+func OidcRequiredScopes() []string {
+	return configuration().Security.Oidc.RequiredScopes
 }
 
 func RelevantGroups() map[string][]string {
 	return configuration().Security.Oidc.RelevantGroups
 }
+
+func RoleMappings() []RoleMappingConfig {
+	return configuration().Security.Oidc.RoleMappings
+}
+
+// ExtraClaims lists the claims that the userinfo endpoints pass through in addition to the usual fields.
+func ExtraClaims() []string {
+	return configuration().Security.Oidc.ExtraClaims
+}
+
+// ServiceClients returns the backend services that may call this service without a user.
+func ServiceClients() map[string]ServiceClientConfig {
+	return configuration().Security.ServiceClients
+}
+
+// ServiceClientHasScope is true if the named service client exists and was granted the scope.
+func ServiceClientHasScope(name string, scope ServiceScope) bool {
+	sc, ok := configuration().Security.ServiceClients[name]
+	if !ok {
+		return false
+	}
+	for _, s := range sc.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const wellKnownConfigurationPath = "/.well-known/openid-configuration"
+
+const defaultDiscoveryTimeout = 10 * time.Second
+
+var (
+	// DiscoveryFetcher obtains the OpenID provider metadata. Exposed so tests can replace it.
+	DiscoveryFetcher = fetchDiscoveryDocument
+
+	discoveryTicker *time.Ticker
+	discoveryStop   chan bool
+)
+
+// DiscoveryDocumentUrl returns the full url of the well-known configuration document for an issuer url.
+func DiscoveryDocumentUrl(issuerDiscoveryUrl string) string {
+	if strings.HasSuffix(issuerDiscoveryUrl, wellKnownConfigurationPath) {
+		return issuerDiscoveryUrl
+	}
+	return strings.TrimSuffix(issuerDiscoveryUrl, "/") + wellKnownConfigurationPath
+}
+
+func fetchDiscoveryDocument(ctx context.Context, documentUrl string, timeout time.Duration) (*DiscoveryDocument, error) {
+	if timeout <= 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, documentUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %d, was expecting %d", response.StatusCode, http.StatusOK)
+	}
+
+	document := &DiscoveryDocument{}
+	if err := json.NewDecoder(response.Body).Decode(document); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document: %s", err.Error())
+	}
+	return document, nil
+}
+
+// discover fills in the discovery document of every identity provider that has issuer discovery configured.
+//
+// Leaves the configuration unchanged if discovery is not configured. The named identity providers are
+// placed in a new map, so a shallow copy of the configuration can be discovered without touching the original.
+func discover(ctx context.Context, c *Application) error {
+	if err := discoverProvider(ctx, &c.IdentityProvider); err != nil {
+		return err
+	}
+	if len(c.IdentityProviders) == 0 {
+		return nil
+	}
+
+	providers := make(IdentityProviderConfigs, len(c.IdentityProviders))
+	for name, ipc := range c.IdentityProviders {
+		if err := discoverProvider(ctx, &ipc); err != nil {
+			return fmt.Errorf("identity provider %s: %s", name, err.Error())
+		}
+		providers[name] = ipc
+	}
+	c.IdentityProviders = providers
+	return nil
+}
+
+func discoverProvider(ctx context.Context, ipc *IdentityProviderConfig) error {
+	if ipc.IssuerDiscoveryUrl == "" {
+		return nil
+	}
+
+	documentUrl := DiscoveryDocumentUrl(ipc.IssuerDiscoveryUrl)
+	document, err := DiscoveryFetcher(ctx, documentUrl, ipc.TokenRequestTimeout)
+	if err != nil {
+		return fmt.Errorf("issuer discovery from %s failed: %s", documentUrl, err.Error())
+	}
+
+	ipc.Discovered = document
+	ipc.DiscoveredAt = time.Now()
+	return nil
+}
+
+// validateAgainstDiscovery compares explicitly configured values with the discovered ones.
+//
+// Configured values always take precedence, so if they disagree with what the identity provider
+// publishes, this is almost certainly a configuration error.
+func validateAgainstDiscovery(errs url.Values, key string, configured string, discovered string) {
+	if configured != "" && discovered != "" && configured != discovered {
+		errs.Add(key, fmt.Sprintf("value '%s' does not match value '%s' obtained by issuer discovery", configured, discovered))
+	}
+}
+
+// validateIssuerAgainstDiscovery is validateAgainstDiscovery for issuers, which may differ in a trailing slash.
+func validateIssuerAgainstDiscovery(errs url.Values, key string, configured string, discovered string) {
+	if configured != "" && discovered != "" && !SameIssuer(configured, discovered) {
+		errs.Add(key, fmt.Sprintf("value '%s' does not match value '%s' obtained by issuer discovery", configured, discovered))
+	}
+}
+
+// SameIssuer compares two issuer identifiers, ignoring a trailing slash.
+//
+// Identity providers are not consistent about it between their discovery document, their configuration,
+// and the iss claim of their tokens.
+func SameIssuer(a string, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// defaultIssuer is the issuer of the default identity provider, configured or discovered.
+func defaultIssuer(c *Application) string {
+	return firstNonEmpty(c.Security.Oidc.Issuer, providerDiscovered(c, DefaultIdentityProvider).Issuer)
+}
+
+// --- periodic refresh ---
+
+// StartIssuerDiscoveryRefresh periodically repeats issuer discovery, if configured.
+//
+// A new discovery result is only taken over if it is still consistent with the configuration,
+// otherwise the error is logged and we keep the last good result.
+//
+// With several identity providers, the shortest configured refresh interval applies to all of them.
+func StartIssuerDiscoveryRefresh() {
+	var interval time.Duration
+	for _, provider := range IdentityProviderNames() {
+		if ProviderIssuerDiscoveryEnabled(provider) {
+			refresh := ProviderIssuerDiscoveryRefresh(provider)
+			if interval == 0 || refresh < interval {
+				interval = refresh
+			}
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+
+	discoveryTicker = time.NewTicker(interval)
+	discoveryStop = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-discoveryStop:
+				discoveryTicker.Stop()
+				return
+			case <-discoveryTicker.C:
+				refreshIssuerDiscovery(context.Background())
+			}
+		}
+	}()
+}
+
+func StopIssuerDiscoveryRefresh() {
+	if discoveryStop != nil {
+		discoveryStop <- true
+		discoveryStop = nil
+	}
+}
+
+func refreshIssuerDiscovery(ctx context.Context) {
+	current := configuration()
+	candidate := *current
+	if err := discover(ctx, &candidate); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("keeping previous discovery result: %s", err.Error())
+		return
+	}
+
+	errs := url.Values{}
+	validateIdentityProviderConfiguration(errs, candidate.IdentityProvider)
+	validateOidcAgainstDiscovery(errs, candidate.Security.Oidc, candidate.IdentityProvider.Discovered)
+	validateNamedIdentityProviders(errs, candidate.IdentityProviders, defaultIssuer(&candidate))
+	if err := logValidationErrors(errs); err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Print("identity provider metadata no longer matches configuration, keeping previous discovery result")
+		return
+	}
+
+	// if the configuration was reloaded in the meantime, it has already done its own discovery
+	if !configurationData.CompareAndSwap(current, &candidate) {
+		aulogging.Logger.Ctx(ctx).Info().Print("configuration was reloaded during issuer discovery, discarding result")
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+)
+
+const tstDiscoveryConfig = `service:
+  dropoff_endpoint_url: http://localhost:8081/v1/dropoff
+security:
+  oidc:
+    token_introspection_url: '%s'
+    flow_cookie_key: 'discovery-test-flow-cookie-key-not-for-production'
+identity_provider:
+  issuer_discovery_url: https://identity.example.com/
+  token_endpoint: '%s'
+application_configs:
+  example-service:
+    display_name: Example Service
+    scope: example
+    client_id: some-client
+    client_secret: some-secret
+    default_dropoff_url: https://example.com/app/
+    cookie_name: JWT
+    cookie_domain: example.com
+    cookie_path: /app
+    cookie_expiry: 6h
+`
+
+func tstDiscoveryDocument() *DiscoveryDocument {
+	return &DiscoveryDocument{
+		Issuer:                "https://identity.example.com",
+		AuthorizationEndpoint: "https://identity.example.com/oauth2/auth",
+		TokenEndpoint:         "https://identity.example.com/oauth2/token",
+		UserinfoEndpoint:      "https://identity.example.com/userinfo",
+		JwksUri:               "https://identity.example.com/.well-known/jwks.json",
+		EndSessionEndpoint:    "https://identity.example.com/oauth2/sessions/logout",
+		IntrospectionEndpoint: "https://identity.example.com/oauth2/introspect",
+	}
+}
+
+func tstMockDiscovery(t *testing.T, document *DiscoveryDocument, err error) {
+	original := DiscoveryFetcher
+	DiscoveryFetcher = func(ctx context.Context, documentUrl string, timeout time.Duration) (*DiscoveryDocument, error) {
+		require.Equal(t, "https://identity.example.com/.well-known/openid-configuration", documentUrl)
+		return document, err
+	}
+	t.Cleanup(func() {
+		DiscoveryFetcher = original
+	})
+}
+
+func tstDiscoveryYaml(tokenIntrospectionUrl string, tokenEndpoint string) []byte {
+	return []byte(fmt.Sprintf(tstDiscoveryConfig, tokenIntrospectionUrl, tokenEndpoint))
+}
+
+func TestDiscoveryDocumentUrl(t *testing.T) {
+	docs.Description("the well-known path is appended to the issuer url exactly once")
+	require.Equal(t, "https://identity.example.com/.well-known/openid-configuration", DiscoveryDocumentUrl("https://identity.example.com"))
+	require.Equal(t, "https://identity.example.com/.well-known/openid-configuration", DiscoveryDocumentUrl("https://identity.example.com/"))
+	require.Equal(t, "https://identity.example.com/.well-known/openid-configuration", DiscoveryDocumentUrl("https://identity.example.com/.well-known/openid-configuration"))
+}
+
+func TestFetchDiscoveryDocument(t *testing.T) {
+	docs.Description("the discovery document is read from the identity provider")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/.well-known/openid-configuration", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"issuer":"https://identity.example.com","token_endpoint":"https://identity.example.com/oauth2/token","unknown_field":42}`))
+	}))
+	defer server.Close()
+
+	document, err := fetchDiscoveryDocument(context.Background(), DiscoveryDocumentUrl(server.URL), time.Second)
+	require.Nil(t, err)
+	require.Equal(t, "https://identity.example.com", document.Issuer)
+	require.Equal(t, "https://identity.example.com/oauth2/token", document.TokenEndpoint)
+}
+
+func TestFetchDiscoveryDocument_errorStatus(t *testing.T) {
+	docs.Description("an error status from the identity provider fails discovery")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := fetchDiscoveryDocument(context.Background(), DiscoveryDocumentUrl(server.URL), time.Second)
+	require.NotNil(t, err)
+	require.Equal(t, "unexpected http status 404, was expecting 200", err.Error())
+}
+
+func TestParseAndOverwriteConfig_discoveryFillsUnsetEndpoints(t *testing.T) {
+	docs.Description("endpoints that are not configured are taken from issuer discovery")
+	tstMockDiscovery(t, tstDiscoveryDocument(), nil)
+
+	err := ParseAndOverwriteConfig(tstDiscoveryYaml("", "https://identity.example.com/oauth2/token"))
+	require.Nil(t, err)
+
+	require.Equal(t, "https://identity.example.com/oauth2/auth", AuthorizationEndpoint())
+	require.Equal(t, "https://identity.example.com/oauth2/token", TokenEndpoint())
+	require.Equal(t, "https://identity.example.com/oauth2/sessions/logout", EndSessionEndpoint())
+	require.Equal(t, "https://identity.example.com/.well-known/jwks.json", KeySetEndpoint())
+	require.Equal(t, "https://identity.example.com/userinfo", OidcUserInfoURL())
+	require.Equal(t, "https://identity.example.com/oauth2/introspect", OidcTokenIntrospectionURL())
+	require.Equal(t, "https://identity.example.com", OidcAllowedIssuer())
+}
+
+func TestParseAndOverwriteConfig_discoveryMismatch(t *testing.T) {
+	docs.Description("configured endpoints that disagree with issuer discovery fail configuration loading")
+	tstMockDiscovery(t, tstDiscoveryDocument(), nil)
+
+	err := ParseAndOverwriteConfig(tstDiscoveryYaml("https://identity.example.com/wrong/introspect", "https://identity.example.com/wrong/token"))
+	require.NotNil(t, err)
+	require.Equal(t, "configuration validation error, see log output for details", err.Error())
+}
+
+func TestParseAndOverwriteConfig_discoveryUnreachable(t *testing.T) {
+	docs.Description("failing issuer discovery fails configuration loading")
+	tstMockDiscovery(t, nil, errors.New("connection refused"))
+
+	err := ParseAndOverwriteConfig(tstDiscoveryYaml("", ""))
+	require.NotNil(t, err)
+	require.Equal(t, "issuer discovery from https://identity.example.com/.well-known/openid-configuration failed: connection refused", err.Error())
+}
+
+func TestValidateIdentityProviderConfiguration_discoveryMismatch(t *testing.T) {
+	docs.Description("validation should report every configured endpoint that disagrees with issuer discovery")
+	errs := url.Values{}
+	config := createValidIdentityProviderConfiguration()
+	config.IssuerDiscoveryUrl = "https://identity.example.com/"
+	config.Discovered = tstDiscoveryDocument()
+	config.KeySetEndpoint = "https://identity.example.com/.well-known/jwks.json"
+	validateIdentityProviderConfiguration(errs, config)
+	require.Equal(t, 3, len(errs))
+	require.Equal(t, []string{"value 'https://example.com/auth' does not match value 'https://identity.example.com/oauth2/auth' obtained by issuer discovery"}, errs["identity_provider.authorization_endpoint"])
+	require.Equal(t, []string{"value 'https://example.com/token' does not match value 'https://identity.example.com/oauth2/token' obtained by issuer discovery"}, errs["identity_provider.token_endpoint"])
+	require.Equal(t, []string{"value 'https://example.com/logout' does not match value 'https://identity.example.com/oauth2/sessions/logout' obtained by issuer discovery"}, errs["identity_provider.end_session_endpoint"])
+}
+
+func TestValidateIdentityProviderConfiguration_discoveryIssuerMismatch(t *testing.T) {
+	docs.Description("validation should catch a discovery document published for a different issuer")
+	errs := url.Values{}
+	config := IdentityProviderConfig{
+		IssuerDiscoveryUrl: "https://other.example.com",
+		Discovered:         tstDiscoveryDocument(),
+	}
+	validateIdentityProviderConfiguration(errs, config)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'https://other.example.com' does not match issuer 'https://identity.example.com' obtained by issuer discovery"}, errs["identity_provider.issuer_discovery_url"])
+}
+
+func TestSameIssuer(t *testing.T) {
+	docs.Description("issuers are compared ignoring a trailing slash")
+	require.True(t, SameIssuer("https://identity.example.com", "https://identity.example.com/"))
+	require.True(t, SameIssuer("https://identity.example.com/", "https://identity.example.com/"))
+	require.False(t, SameIssuer("https://identity.example.com", "https://other.example.com"))
+}
+
+func TestValidateOidcAgainstDiscovery_issuerTrailingSlash(t *testing.T) {
+	docs.Description("validation should accept a configured issuer that only differs from the discovered one in a trailing slash")
+	errs := url.Values{}
+	validateOidcAgainstDiscovery(errs, OpenIdConnectConfig{Issuer: "https://identity.example.com/"}, tstDiscoveryDocument())
+	require.Equal(t, 0, len(errs))
+
+	validateOidcAgainstDiscovery(errs, OpenIdConnectConfig{Issuer: "https://other.example.com/"}, tstDiscoveryDocument())
+	require.Equal(t, []string{"value 'https://other.example.com/' does not match value 'https://identity.example.com' obtained by issuer discovery"}, errs["security.oidc.issuer"])
+}
@@ -1,23 +1,25 @@
 package config
 
 import (
-	"crypto/rsa"
+	"context"
 	"errors"
 	"flag"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net/url"
-	"os"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	configurationData     *Application
+	// configurationData is read from many goroutines and replaced on reload, so it must only be accessed atomically
+	configurationData     atomic.Pointer[Application]
 	configurationFilename string
 	ecsLogging            bool
-
-	parsedKeySet []*rsa.PublicKey
+	dbMigrate             bool
+	watchConfig           bool
 )
 
 var (
@@ -26,10 +28,12 @@ var (
 )
 
 func init() {
-	configurationData = &Application{}
+	configurationData.Store(&Application{})
 
 	flag.StringVar(&configurationFilename, "config", "", "config file path")
 	flag.BoolVar(&ecsLogging, "ecs-json-logging", false, "switch to structured json logging")
+	flag.BoolVar(&dbMigrate, "migrate-database", false, "migrate database on startup")
+	flag.BoolVar(&watchConfig, "watch-config", false, "reload the configuration file when it changes (it is always reloaded on SIGHUP)")
 }
 
 // ParseCommandLineFlags is exposed separately so you can skip it for tests
@@ -59,7 +63,7 @@ func logValidationErrors(errs url.Values) error {
 }
 
 func configuration() *Application {
-	return configurationData
+	return configurationData.Load()
 }
 
 func setConfigurationDefaults(c *Application) {
@@ -78,29 +82,35 @@ func setConfigurationDefaults(c *Application) {
 	if c.Logging.Severity == "" {
 		c.Logging.Severity = "INFO"
 	}
-}
-
-const (
-	envOidcClientId     = "REG_SECRET_OIDC_CLIENT_ID"
-	envOidcClientSecret = "REG_SECRET_OIDC_CLIENT_SECRET"
-)
-
-func applyEnvVarOverrides(c *Application) {
-	if c != nil {
-		replacement := make(map[string]ApplicationConfig)
-
-		// in container deployments, we only support using the same application for all configs for now
-		for appKey, appValue := range c.ApplicationConfigs {
-			if oidcClientId := os.Getenv(envOidcClientId); oidcClientId != "" {
-				appValue.ClientId = oidcClientId
-			}
-			if oidcClientSecret := os.Getenv(envOidcClientSecret); oidcClientSecret != "" {
-				appValue.ClientSecret = oidcClientSecret
-			}
-			replacement[appKey] = appValue
+	if c.Database.Use == "" {
+		c.Database.Use = Inmemory
+	}
+	if c.Audit.Sink == "" {
+		c.Audit.Sink = AuditStdout
+	}
+	if c.Audit.File.MaxSizeMB <= 0 {
+		c.Audit.File.MaxSizeMB = 100
+	}
+	if c.Audit.File.MaxBackups <= 0 {
+		c.Audit.File.MaxBackups = 10
+	}
+	if c.IdentityProvider.IssuerDiscoveryRefresh == 0 {
+		c.IdentityProvider.IssuerDiscoveryRefresh = time.Hour
+	}
+	if c.IdentityProvider.KeySetRefresh == 0 {
+		c.IdentityProvider.KeySetRefresh = 15 * time.Minute
+	}
+	for name, ipc := range c.IdentityProviders {
+		if ipc.IssuerDiscoveryRefresh == 0 {
+			ipc.IssuerDiscoveryRefresh = c.IdentityProvider.IssuerDiscoveryRefresh
 		}
-
-		c.ApplicationConfigs = replacement
+		if ipc.KeySetRefresh == 0 {
+			ipc.KeySetRefresh = c.IdentityProvider.KeySetRefresh
+		}
+		if ipc.TokenRequestTimeout == 0 {
+			ipc.TokenRequestTimeout = c.IdentityProvider.TokenRequestTimeout
+		}
+		c.IdentityProviders[name] = ipc
 	}
 }
 
@@ -109,31 +119,64 @@ func validateConfiguration(newConfigurationData *Application) error {
 
 	validateServerConfiguration(errs, newConfigurationData.Server)
 	validateLoggingConfiguration(errs, newConfigurationData.Logging)
-	validateSecurityConfiguration(errs, newConfigurationData.Security)
+	validateDatabaseConfiguration(errs, newConfigurationData.Database)
+	newConfigurationData.parsedKeySet = validateSecurityConfiguration(errs, newConfigurationData.Security)
+	validateFlowCookieKey(errs, newConfigurationData.Security.Oidc)
 	validateDropoffEndpointUrl(errs, newConfigurationData.Service.DropoffEndpointUrl)
 	validateIdentityProviderConfiguration(errs, newConfigurationData.IdentityProvider)
-	validateApplicationConfigurations(errs, newConfigurationData.ApplicationConfigs)
+	validateOidcAgainstDiscovery(errs, newConfigurationData.Security.Oidc, newConfigurationData.IdentityProvider.Discovered)
+	validateDefaultIssuer(errs, newConfigurationData.Security.Oidc, defaultIssuer(newConfigurationData))
+	newConfigurationData.parsedProviderKeySets = validateNamedIdentityProviders(errs, newConfigurationData.IdentityProviders, defaultIssuer(newConfigurationData))
+	newConfigurationData.parsedClientAssertionKeys = validateApplicationConfigurations(errs, newConfigurationData.ApplicationConfigs)
+	validateApplicationIdentityProviders(errs, newConfigurationData.ApplicationConfigs, newConfigurationData.IdentityProviders)
+	validatePushedAuthorizationRequests(errs, newConfigurationData.ApplicationConfigs, newConfigurationData.IdentityProvider, newConfigurationData.IdentityProviders)
+	validateTokenIntrospectionClients(errs, newConfigurationData.ApplicationConfigs, newConfigurationData.IdentityProvider, newConfigurationData.IdentityProviders)
+	validateLogoutCallbackUrl(errs, newConfigurationData.Service.LogoutCallbackUrl, newConfigurationData.ApplicationConfigs)
+	validateServerSideSessions(errs, newConfigurationData.ApplicationConfigs, newConfigurationData.Security.Oidc)
+	validateRoleMappings(errs, newConfigurationData.Security.Oidc.RoleMappings, newConfigurationData.ApplicationConfigs)
+	validateExtraClaims(errs, newConfigurationData.Security.Oidc.ExtraClaims)
+	validateServiceClients(errs, newConfigurationData.Security.ServiceClients, newConfigurationData.ApplicationConfigs)
+	validateTracingConfiguration(errs, newConfigurationData.Tracing)
+	validateAuditConfiguration(errs, newConfigurationData.Audit)
 
 	return logValidationErrors(errs)
 }
 
 func ParseAndOverwriteConfig(yamlFile []byte) error {
+	yamlFile, interpolated, err := interpolateEnvVars(yamlFile)
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("configuration error: %s", err.Error())
+		return err
+	}
+
 	newConfigurationData := &Application{}
-	err := yaml.UnmarshalStrict(yamlFile, newConfigurationData)
+	err = yaml.UnmarshalStrict(yamlFile, newConfigurationData)
 	if err != nil {
 		return err
 	}
 
 	setConfigurationDefaults(newConfigurationData)
 
-	applyEnvVarOverrides(newConfigurationData)
+	sources, err := applyEnvVarOverrides(newConfigurationData)
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("configuration error: %s", err.Error())
+		return err
+	}
+
+	err = discover(context.Background(), newConfigurationData)
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("configuration error: %s", err.Error())
+		return err
+	}
 
 	err = validateConfiguration(newConfigurationData)
 	if err != nil {
 		return err
 	}
 
-	configurationData = newConfigurationData
+	logValueSources(sources, interpolated)
+
+	configurationData.Store(newConfigurationData)
 	return nil
 }
 
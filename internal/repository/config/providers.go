@@ -0,0 +1,205 @@
+package config
+
+import (
+	"crypto/rsa"
+	"sort"
+	"time"
+)
+
+// DefaultIdentityProvider is the name of the identity provider configured in the identity_provider section.
+//
+// Applications that do not select an identity provider use this one.
+const DefaultIdentityProvider = "default"
+
+// IdentityProviderNames returns the names of all configured identity providers, the default one first.
+func IdentityProviderNames() []string {
+	c := configuration()
+	names := make([]string, 0, len(c.IdentityProviders))
+	for name := range c.IdentityProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultIdentityProvider}, names...)
+}
+
+// ApplicationIdentityProvider returns the name of the identity provider used by an application.
+func ApplicationIdentityProvider(applicationName string) string {
+	return applicationIdentityProvider(configuration().ApplicationConfigs[applicationName])
+}
+
+func applicationIdentityProvider(ac ApplicationConfig) string {
+	if ac.IdentityProvider == "" {
+		return DefaultIdentityProvider
+	}
+	return ac.IdentityProvider
+}
+
+// IdentityProviderForIssuer returns the name of the identity provider that issues tokens with the given iss claim.
+//
+// Tokens from unknown issuers are attributed to the default identity provider, whose validation then rejects them.
+func IdentityProviderForIssuer(issuer string) string {
+	if issuer != "" {
+		for _, name := range IdentityProviderNames()[1:] {
+			if SameIssuer(ProviderAllowedIssuer(name), issuer) {
+				return name
+			}
+		}
+	}
+	return DefaultIdentityProvider
+}
+
+func identityProvider(c *Application, name string) IdentityProviderConfig {
+	if name == DefaultIdentityProvider || name == "" {
+		return c.IdentityProvider
+	}
+	return c.IdentityProviders[name]
+}
+
+func providerDiscovered(c *Application, name string) DiscoveryDocument {
+	ipc := identityProvider(c, name)
+	if ipc.Discovered == nil {
+		return DiscoveryDocument{}
+	}
+	return *ipc.Discovered
+}
+
+func ProviderTokenEndpoint(provider string) string {
+	c := configuration()
+	return firstNonEmpty(identityProvider(c, provider).TokenEndpoint, providerDiscovered(c, provider).TokenEndpoint)
+}
+
+// ProviderParEndpoint is the pushed authorization request endpoint (RFC 9126), empty if unknown
+func ProviderParEndpoint(provider string) string {
+	c := configuration()
+	return firstNonEmpty(identityProvider(c, provider).ParEndpoint, providerDiscovered(c, provider).ParEndpoint)
+}
+
+func ProviderAuthorizationEndpoint(provider string) string {
+	c := configuration()
+	return firstNonEmpty(identityProvider(c, provider).AuthorizationEndpoint, providerDiscovered(c, provider).AuthorizationEndpoint)
+}
+
+func ProviderEndSessionEndpoint(provider string) string {
+	c := configuration()
+	return firstNonEmpty(identityProvider(c, provider).EndSessionEndpoint, providerDiscovered(c, provider).EndSessionEndpoint)
+}
+
+func ProviderKeySetEndpoint(provider string) string {
+	c := configuration()
+	return firstNonEmpty(identityProvider(c, provider).KeySetEndpoint, providerDiscovered(c, provider).JwksUri)
+}
+
+func ProviderKeySetRefresh(provider string) time.Duration {
+	return identityProvider(configuration(), provider).KeySetRefresh
+}
+
+func ProviderTokenRequestTimeout(provider string) time.Duration {
+	return identityProvider(configuration(), provider).TokenRequestTimeout
+}
+
+// ProviderIssuerDiscoveryEnabled is true if the identity provider metadata is obtained by issuer discovery.
+func ProviderIssuerDiscoveryEnabled(provider string) bool {
+	return identityProvider(configuration(), provider).IssuerDiscoveryUrl != ""
+}
+
+func ProviderIssuerDiscoveryRefresh(provider string) time.Duration {
+	return identityProvider(configuration(), provider).IssuerDiscoveryRefresh
+}
+
+// ProviderLastIssuerDiscovery returns the time of the last successful issuer discovery (zero if never).
+func ProviderLastIssuerDiscovery(provider string) time.Time {
+	return identityProvider(configuration(), provider).DiscoveredAt
+}
+
+// ProviderKeySet returns the statically configured token signing keys of an identity provider.
+func ProviderKeySet(provider string) []*rsa.PublicKey {
+	c := configuration()
+	if provider == DefaultIdentityProvider {
+		return c.parsedKeySet
+	}
+	return c.parsedProviderKeySets[provider]
+}
+
+func ProviderAllowedIssuer(provider string) string {
+	c := configuration()
+	if provider == DefaultIdentityProvider {
+		return firstNonEmpty(c.Security.Oidc.Issuer, providerDiscovered(c, provider).Issuer)
+	}
+	return firstNonEmpty(identityProvider(c, provider).Issuer, providerDiscovered(c, provider).Issuer)
+}
+
+// ProviderAllowedAudience is the audience that tokens of an identity provider must be issued for, empty if not checked.
+//
+// For the default identity provider, this is security.oidc.audience.
+func ProviderAllowedAudience(provider string) string {
+	c := configuration()
+	if provider == DefaultIdentityProvider {
+		return c.Security.Oidc.Audience
+	}
+	return identityProvider(c, provider).AllowedAudience
+}
+
+func ProviderUserInfoURL(provider string) string {
+	c := configuration()
+	if provider == DefaultIdentityProvider {
+		return firstNonEmpty(c.Security.Oidc.UserInfoURL, providerDiscovered(c, provider).UserinfoEndpoint)
+	}
+	return firstNonEmpty(identityProvider(c, provider).UserInfoEndpoint, providerDiscovered(c, provider).UserinfoEndpoint)
+}
+
+func ProviderTokenIntrospectionURL(provider string) string {
+	c := configuration()
+	if provider == DefaultIdentityProvider {
+		return firstNonEmpty(c.Security.Oidc.TokenIntrospectionURL, providerDiscovered(c, provider).IntrospectionEndpoint)
+	}
+	return firstNonEmpty(identityProvider(c, provider).TokenIntrospectionEndpoint, providerDiscovered(c, provider).IntrospectionEndpoint)
+}
+
+// ProviderTokenIntrospectionClient returns the application whose client credentials authenticate token introspection
+// requests to an identity provider, by default the first application (by name) that uses it, empty if there is none.
+func ProviderTokenIntrospectionClient(provider string) string {
+	c := configuration()
+	if client := identityProvider(c, provider).TokenIntrospectionClient; client != "" {
+		return client
+	}
+	if provider == "" {
+		provider = DefaultIdentityProvider
+	}
+	names := make([]string, 0, len(c.ApplicationConfigs))
+	for name, ac := range c.ApplicationConfigs {
+		if applicationIdentityProvider(ac) == provider {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// ProviderTokenIntrospectionBearerAuth is true if token introspection requests send the introspected token as
+// bearer token instead of authenticating with client credentials (RFC 7662 section 2.1).
+func ProviderTokenIntrospectionBearerAuth(provider string) bool {
+	return identityProvider(configuration(), provider).TokenIntrospectionBearerAuth
+}
+
+func ProviderUserInfoCacheEnabled(provider string) bool {
+	return configuration().Security.Oidc.UserInfoCacheSeconds > 0 &&
+		ProviderUserInfoURL(provider) != "" &&
+		configuration().Security.Oidc.AccessTokenCookieName != ""
+}
+
+// AdminSubjectPlaceholder is replaced with the subject in the admin_user_info_endpoint of an identity provider.
+const AdminSubjectPlaceholder = "{subject}"
+
+// ProviderAdminUserInfoURL is the admin api endpoint that returns the userinfo of any subject, empty if not configured.
+//
+// It still contains the AdminSubjectPlaceholder.
+func ProviderAdminUserInfoURL(provider string) string {
+	return identityProvider(configuration(), provider).AdminUserInfoEndpoint
+}
+
+func ProviderAdminApiToken(provider string) string {
+	return identityProvider(configuration(), provider).AdminApiToken
+}
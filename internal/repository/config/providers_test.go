@@ -0,0 +1,200 @@
+package config
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+)
+
+func tstPublicKeyPEM(t *testing.T) (*rsa.PublicKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	return &key.PublicKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func createValidNamedIdentityProviderConfiguration(t *testing.T) IdentityProviderConfig {
+	_, keyPEM := tstPublicKeyPEM(t)
+	config := createValidIdentityProviderConfiguration()
+	config.Issuer = "https://staff.example.com"
+	config.TokenPublicKeysPEM = []string{keyPEM}
+	return config
+}
+
+func TestValidateNamedIdentityProviders_valid(t *testing.T) {
+	docs.Description("named identity providers with an issuer and keys are accepted, and their keys are parsed")
+	errs := url.Values{}
+	providers := IdentityProviderConfigs{"staff": createValidNamedIdentityProviderConfiguration(t)}
+	parsed := validateNamedIdentityProviders(errs, providers, "https://identity.example.com")
+	require.Equal(t, 0, len(errs))
+	require.Equal(t, 1, len(parsed["staff"]))
+}
+
+func TestValidateNamedIdentityProviders_reservedName(t *testing.T) {
+	docs.Description("the name of the default identity provider cannot be used for a named one")
+	errs := url.Values{}
+	providers := IdentityProviderConfigs{DefaultIdentityProvider: createValidNamedIdentityProviderConfiguration(t)}
+	validateNamedIdentityProviders(errs, providers, "")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"the name 'default' is reserved for the identity provider configured in identity_provider"}, errs["identity_providers.default"])
+}
+
+func TestValidateNamedIdentityProviders_missingIssuer(t *testing.T) {
+	docs.Description("named identity providers need an issuer, so tokens can be attributed to them")
+	errs := url.Values{}
+	config := createValidNamedIdentityProviderConfiguration(t)
+	config.Issuer = ""
+	validateNamedIdentityProviders(errs, IdentityProviderConfigs{"staff": config}, "")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty, tokens are attributed to identity providers by their issuer"}, errs["identity_providers.staff.issuer"])
+}
+
+func TestValidateDefaultIssuer(t *testing.T) {
+	docs.Description("the default identity provider needs an issuer, configured or discovered, so tokens are never accepted from just any issuer")
+	errs := url.Values{}
+	validateDefaultIssuer(errs, OpenIdConnectConfig{}, "https://identity.example.com")
+	require.Equal(t, 0, len(errs))
+
+	validateDefaultIssuer(errs, OpenIdConnectConfig{}, "")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty unless it is obtained by issuer discovery, tokens are only accepted from a known issuer"}, errs["security.oidc.issuer"])
+}
+
+func TestValidateNamedIdentityProviders_duplicateIssuer(t *testing.T) {
+	docs.Description("two identity providers cannot share an issuer")
+	errs := url.Values{}
+	validateNamedIdentityProviders(errs, IdentityProviderConfigs{"staff": createValidNamedIdentityProviderConfiguration(t)}, "https://staff.example.com/")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'https://staff.example.com' is also the issuer of identity provider default"}, errs["identity_providers.staff.issuer"])
+}
+
+func TestValidateNamedIdentityProviders_noKeys(t *testing.T) {
+	docs.Description("named identity providers need static keys or a key set endpoint")
+	errs := url.Values{}
+	config := createValidNamedIdentityProviderConfiguration(t)
+	config.TokenPublicKeysPEM = nil
+	validateNamedIdentityProviders(errs, IdentityProviderConfigs{"staff": config}, "")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"needs token_public_keys_PEM or key_set_endpoint to validate tokens"}, errs["identity_providers.staff"])
+
+	errs = url.Values{}
+	config.KeySetEndpoint = "https://staff.example.com/jwks"
+	validateNamedIdentityProviders(errs, IdentityProviderConfigs{"staff": config}, "")
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateNamedIdentityProviders_missingEndpoint(t *testing.T) {
+	docs.Description("named identity providers are validated like the default one, with their own keys in error messages")
+	errs := url.Values{}
+	config := createValidNamedIdentityProviderConfiguration(t)
+	config.TokenEndpoint = ""
+	validateNamedIdentityProviders(errs, IdentityProviderConfigs{"staff": config}, "")
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot not be empty"}, errs["identity_providers.staff.token_endpoint"])
+}
+
+func TestValidateIdentityProviderConfiguration_namedOnlyFields(t *testing.T) {
+	docs.Description("the default identity provider takes issuer and keys from security.oidc")
+	errs := url.Values{}
+	config := createValidIdentityProviderConfiguration()
+	config.Issuer = "https://identity.example.com"
+	validateIdentityProviderConfiguration(errs, config)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"issuer, allowed_audience, token_introspection_endpoint and token_public_keys_PEM of the default identity provider are configured in security.oidc"}, errs["identity_provider"])
+}
+
+func TestValidateIdentityProviderConfiguration_allowedAudience(t *testing.T) {
+	docs.Description("the audience of the default identity provider is security.oidc.audience")
+	errs := url.Values{}
+	config := createValidIdentityProviderConfiguration()
+	config.AllowedAudience = "reg"
+	validateIdentityProviderConfiguration(errs, config)
+	require.Equal(t, []string{"issuer, allowed_audience, token_introspection_endpoint and token_public_keys_PEM of the default identity provider are configured in security.oidc"}, errs["identity_provider"])
+}
+
+func TestValidateApplicationIdentityProviders_unknown(t *testing.T) {
+	docs.Description("applications can only select configured identity providers")
+	errs := url.Values{}
+	staff := createValidApplicationConfig()
+	staff.IdentityProvider = "staff"
+	other := createValidApplicationConfig()
+	other.IdentityProvider = "other"
+	configs := map[string]ApplicationConfig{"staff-app": staff, "other-app": other, "default-app": createValidApplicationConfig()}
+	validateApplicationIdentityProviders(errs, configs, IdentityProviderConfigs{"staff": {}})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'other' must be the name of an entry in identity_providers"}, errs["application_configs.other-app.identity_provider"])
+}
+
+func TestValidatePushedAuthorizationRequests_namedIdentityProvider(t *testing.T) {
+	docs.Description("the pushed authorization request endpoint is required for the identity provider of the application")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.PushedAuthorizationRequests = ParPreferred
+	config.IdentityProvider = "staff"
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validatePushedAuthorizationRequests(errs, configs, IdentityProviderConfig{ParEndpoint: "https://idp.example.com/par"}, IdentityProviderConfigs{"staff": {}})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty, application_configs.test-application-config uses pushed authorization requests"}, errs["identity_providers.staff.pushed_authorization_request_endpoint"])
+}
+
+func TestValidateTokenIntrospectionClients(t *testing.T) {
+	docs.Description("the token introspection client must be an application of the identity provider")
+	errs := url.Values{}
+	staff := createValidApplicationConfig()
+	staff.IdentityProvider = "staff"
+	configs := map[string]ApplicationConfig{"staff-app": staff, "default-app": createValidApplicationConfig()}
+	validateTokenIntrospectionClients(errs, configs,
+		IdentityProviderConfig{TokenIntrospectionClient: "staff-app"},
+		IdentityProviderConfigs{"staff": {TokenIntrospectionClient: "staff-app"}, "other": {TokenIntrospectionClient: "unknown-app"}})
+	require.Equal(t, 2, len(errs))
+	require.Equal(t, []string{"value 'staff-app' must be an application that uses this identity provider"}, errs["identity_provider.token_introspection_client"])
+	require.Equal(t, []string{"value 'unknown-app' must be the name of an entry in application_configs"}, errs["identity_providers.other.token_introspection_client"])
+}
+
+func TestIdentityProviderSelection(t *testing.T) {
+	docs.Description("applications and tokens are attributed to the configured identity providers")
+	aulogging.SetupNoLoggerForTesting()
+	require.Nil(t, LoadConfiguration("../../../test/resources/config-acceptancetests.yaml"))
+
+	require.Equal(t, []string{DefaultIdentityProvider, "staff"}, IdentityProviderNames())
+	require.Equal(t, "staff", ApplicationIdentityProvider("staff-service"))
+	require.Equal(t, DefaultIdentityProvider, ApplicationIdentityProvider("example-service"))
+	require.Equal(t, "staff", IdentityProviderForIssuer("https://staff.example.com/"))
+	require.Equal(t, DefaultIdentityProvider, IdentityProviderForIssuer("http://identity.localhost/"))
+
+	require.Equal(t, "https://staff.example.com/token", ProviderTokenEndpoint("staff"))
+	require.Equal(t, "https://auth.example.com/token", ProviderTokenEndpoint(DefaultIdentityProvider))
+	require.Equal(t, 1, len(ProviderKeySet("staff")))
+	require.Equal(t, "staff-service", ProviderTokenIntrospectionClient("staff"))
+	require.Equal(t, "bff-service", ProviderTokenIntrospectionClient(DefaultIdentityProvider))
+
+	docs.Then("and named identity providers inherit refresh intervals and timeout from the default one")
+	require.Equal(t, 15*time.Minute, ProviderKeySetRefresh("staff"))
+	require.Equal(t, 5*time.Second, ProviderTokenRequestTimeout("staff"))
+}
+
+func TestDiscover_namedIdentityProvider(t *testing.T) {
+	docs.Description("issuer discovery fills in named identity providers without modifying the map of the original configuration")
+	original := DiscoveryFetcher
+	defer func() { DiscoveryFetcher = original }()
+	DiscoveryFetcher = func(ctx context.Context, documentUrl string, timeout time.Duration) (*DiscoveryDocument, error) {
+		return &DiscoveryDocument{Issuer: "https://staff.example.com", TokenEndpoint: "https://staff.example.com/token"}, nil
+	}
+
+	current := &Application{IdentityProviders: IdentityProviderConfigs{"staff": {IssuerDiscoveryUrl: "https://staff.example.com"}}}
+	candidate := *current
+	require.Nil(t, discover(context.Background(), &candidate))
+
+	require.Equal(t, "https://staff.example.com/token", candidate.IdentityProviders["staff"].Discovered.TokenEndpoint)
+	require.Nil(t, current.IdentityProviders["staff"].Discovered)
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+)
+
+const configWatchInterval = 10 * time.Second
+
+var (
+	reloadMu   sync.Mutex
+	reloadStop chan bool
+	reloadDone sync.WaitGroup
+
+	// called after each successful reload, see StartReloading
+	onReload func()
+)
+
+// Reload reads the configuration file again and swaps in the new configuration if it is valid.
+//
+// If reading, parsing or validation fails, the error is logged and the previous configuration stays in place.
+// Pending logins are not affected, they live in the database.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	aulogging.Logger.NoCtx().Info().Printf("Reloading configuration from %s...", configurationFilename)
+	previous := configuration()
+	if err := LoadConfiguration(configurationFilename); err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("configuration reload failed, keeping previous configuration: %s", err.Error())
+		return err
+	}
+
+	for _, section := range restartRequiredChanges(previous, configuration()) {
+		aulogging.Logger.NoCtx().Warn().Printf("configuration reload: changes to %s only take effect after a restart", section)
+	}
+	if onReload != nil {
+		onReload()
+	}
+	aulogging.Logger.NoCtx().Info().Print("Configuration reloaded successfully")
+	return nil
+}
+
+// StartReloading reloads the configuration on SIGHUP, and additionally whenever the configuration file
+// changes if the -watch-config command line flag is set.
+//
+// callback is called after each successful reload, e.g. to apply a new log level.
+func StartReloading(callback func()) {
+	onReload = callback
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// a nil channel never fires, so without -watch-config we only react to SIGHUP
+	var fileChanged <-chan time.Time
+	var watchTicker *time.Ticker
+	if watchConfig {
+		watchTicker = time.NewTicker(configWatchInterval)
+		fileChanged = watchTicker.C
+	}
+
+	reloadStop = make(chan bool)
+	reloadDone.Add(1)
+	go func() {
+		defer reloadDone.Done()
+		defer signal.Stop(hangup)
+		if watchTicker != nil {
+			defer watchTicker.Stop()
+		}
+		lastModified := configFileVersion()
+		for {
+			select {
+			case <-reloadStop:
+				return
+			case <-hangup:
+				_ = Reload()
+				lastModified = configFileVersion()
+			case <-fileChanged:
+				if current := configFileVersion(); current != lastModified {
+					lastModified = current
+					_ = Reload()
+				}
+			}
+		}
+	}()
+}
+
+func StopReloading() {
+	if reloadStop != nil {
+		reloadStop <- true
+		reloadStop = nil
+		reloadDone.Wait()
+	}
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func configFileVersion() fileVersion {
+	info, err := os.Stat(configurationFilename)
+	if err != nil {
+		aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("cannot check configuration file for changes: %s", err.Error())
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+func startupProviderSettingsChanged(previous IdentityProviderConfig, current IdentityProviderConfig) bool {
+	return previous.IssuerDiscoveryUrl != current.IssuerDiscoveryUrl ||
+		previous.IssuerDiscoveryRefresh != current.IssuerDiscoveryRefresh ||
+		previous.KeySetEndpoint != current.KeySetEndpoint ||
+		previous.KeySetRefresh != current.KeySetRefresh ||
+		previous.TokenRequestTimeout != current.TokenRequestTimeout
+}
+
+// restartRequiredChanges lists the configuration sections that were changed, but are only read at startup.
+func restartRequiredChanges(previous *Application, current *Application) []string {
+	result := make([]string, 0)
+	if !reflect.DeepEqual(previous.Server, current.Server) {
+		result = append(result, "server")
+	}
+	if !reflect.DeepEqual(previous.Database, current.Database) {
+		result = append(result, "database")
+	}
+	if !reflect.DeepEqual(previous.Tracing, current.Tracing) {
+		result = append(result, "tracing")
+	}
+	if !reflect.DeepEqual(previous.Audit, current.Audit) {
+		result = append(result, "audit")
+	}
+	if startupProviderSettingsChanged(previous.IdentityProvider, current.IdentityProvider) {
+		result = append(result, "identity_provider (issuer discovery, key set, refresh intervals, timeout)")
+	}
+	if len(previous.IdentityProviders) != len(current.IdentityProviders) {
+		result = append(result, "identity_providers (added or removed)")
+	} else {
+		for name, ipc := range current.IdentityProviders {
+			if prev, ok := previous.IdentityProviders[name]; !ok || startupProviderSettingsChanged(prev, ipc) {
+				result = append(result, "identity_providers (issuer discovery, key set, refresh intervals, timeout)")
+				break
+			}
+		}
+	}
+	if previous.Security.Oidc.UserInfoCacheSeconds != current.Security.Oidc.UserInfoCacheSeconds {
+		result = append(result, "security.oidc.user_info_cache_seconds")
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+)
+
+const tstAcceptanceConfig = "../../../test/resources/config-acceptancetests.yaml"
+
+const tstAdditionalApplication = `
+  new-service:
+    display_name: New Service
+    scope: example
+    client_id: IAmNew.
+    client_secret: IAmVerySecret!
+    default_dropoff_url: https://example.com/new/
+    cookie_name: JWT
+    cookie_domain: example.com
+    cookie_path: /new
+    cookie_expiry: 6h
+`
+
+// tstReloadableConfig copies the acceptance test configuration to a temporary file and loads it
+func tstReloadableConfig(t *testing.T) string {
+	original, err := os.ReadFile(tstAcceptanceConfig)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(filename, original, 0600))
+
+	previousFilename := configurationFilename
+	configurationFilename = filename
+	t.Cleanup(func() { configurationFilename = previousFilename })
+
+	require.Nil(t, LoadConfiguration(filename))
+	return filename
+}
+
+func tstAppendToFile(t *testing.T, filename string, text string) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = f.WriteString(text)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+}
+
+func TestReload_addsApplication(t *testing.T) {
+	docs.Description("a reload picks up a new application configuration")
+	filename := tstReloadableConfig(t)
+	_, err := GetApplicationConfig("new-service")
+	require.NotNil(t, err)
+
+	tstAppendToFile(t, filename, tstAdditionalApplication)
+	require.Nil(t, Reload())
+
+	applicationConfig, err := GetApplicationConfig("new-service")
+	require.Nil(t, err)
+	require.Equal(t, "IAmNew.", applicationConfig.ClientId)
+}
+
+func TestReload_invalidKeepsPrevious(t *testing.T) {
+	docs.Description("if the new configuration is invalid, the previous one stays in place, including its keys")
+	filename := tstReloadableConfig(t)
+	previous := configuration()
+	require.Equal(t, 1, len(OidcKeySet()))
+
+	original, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	broken := strings.Replace(string(original), "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAu1SU1LfVLPHCozMxH2Mo", "broken", 1)
+	broken = strings.Replace(broken, "scope: example", "scope: ''", 1)
+	require.Nil(t, os.WriteFile(filename, []byte(broken), 0600))
+
+	require.NotNil(t, Reload())
+
+	require.Same(t, previous, configuration())
+	require.Equal(t, 1, len(OidcKeySet()))
+}
+
+func TestReload_concurrentReads(t *testing.T) {
+	docs.Description("configuration can be read while it is being reloaded")
+	filename := tstReloadableConfig(t)
+	tstAppendToFile(t, filename, tstAdditionalApplication)
+
+	stop := make(chan bool)
+	wg := sync.WaitGroup{}
+	failures := atomic.Int64{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					if _, err := GetApplicationConfig("example-service"); err != nil || len(OidcKeySet()) != 1 {
+						failures.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		require.Nil(t, Reload())
+	}
+	close(stop)
+	wg.Wait()
+	require.Equal(t, int64(0), failures.Load())
+}
+
+func TestStartReloading_onSighup(t *testing.T) {
+	docs.Description("the configuration is reloaded on SIGHUP, and the callback is invoked")
+	filename := tstReloadableConfig(t)
+	reloaded := make(chan bool, 1)
+	StartReloading(func() { reloaded <- true })
+	defer StopReloading()
+
+	tstAppendToFile(t, filename, tstAdditionalApplication)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "configuration was not reloaded")
+	}
+	_, err := GetApplicationConfig("new-service")
+	require.Nil(t, err)
+}
+
+func TestRestartRequiredChanges(t *testing.T) {
+	docs.Description("changes to sections that are only read at startup are reported")
+	previous := &Application{}
+	current := &Application{}
+	current.Server.Port = "8082"
+	current.IdentityProvider.KeySetRefresh = time.Minute
+	current.ApplicationConfigs = map[string]ApplicationConfig{"app": {}}
+
+	require.Equal(t, []string{"server", "identity_provider (issuer discovery, key set, refresh intervals, timeout)"}, restartRequiredChanges(previous, current))
+
+	previous = &Application{IdentityProviders: IdentityProviderConfigs{"staff": {KeySetRefresh: time.Minute}}}
+	current = &Application{IdentityProviders: IdentityProviderConfigs{"staff": {KeySetRefresh: time.Hour}}}
+	require.Equal(t, []string{"identity_providers (issuer discovery, key set, refresh intervals, timeout)"}, restartRequiredChanges(previous, current))
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+const (
+	envOidcClientId     = "REG_SECRET_OIDC_CLIENT_ID"
+	envOidcClientSecret = "REG_SECRET_OIDC_CLIENT_SECRET"
+	envDbPassword       = "REG_SECRET_DB_PASSWORD"
+	envRefreshCookieKey = "REG_SECRET_REFRESH_TOKEN_COOKIE_KEY"
+	envFlowCookieKey    = "REG_SECRET_FLOW_COOKIE_KEY"
+	envIdpAdminApiToken = "REG_SECRET_IDP_ADMIN_API_TOKEN"
+
+	// per identity provider overrides are named REG_SECRET_IDP_<NAME>_ADMIN_API_TOKEN
+	envIdpPrefix              = "REG_SECRET_IDP_"
+	envIdpAdminApiTokenSuffix = "_ADMIN_API_TOKEN"
+
+	// per application overrides are named REG_SECRET_APP_<NAME>_CLIENT_ID, REG_SECRET_APP_<NAME>_CLIENT_SECRET
+	// and REG_SECRET_APP_<NAME>_CLIENT_ASSERTION_KEY
+	envAppPrefix          = "REG_SECRET_APP_"
+	envAppClientIdSuffix  = "_CLIENT_ID"
+	envAppClientSecSuffix = "_CLIENT_SECRET"
+	envAppAssertionSuffix = "_CLIENT_ASSERTION_KEY"
+
+	// every secret environment variable X can instead be given as X_FILE, containing the path of a file to read
+	envFileSuffix = "_FILE"
+)
+
+// valueSources maps configuration keys to a description of where their value came from.
+//
+// It never contains the values themselves.
+type valueSources map[string]string
+
+var interpolationPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)}`)
+
+// interpolateEnvVars replaces ${NAME} in the string values of the configuration file with the value of the
+// environment variable NAME.
+//
+// Substitution happens after parsing, so comments and keys are left alone, and a value can never change the
+// structure of the file. Referencing an environment variable that is not set is an error, so a typo does not
+// silently result in an empty value. Returns the re-encoded configuration and the names of all variables used.
+func interpolateEnvVars(yamlFile []byte) ([]byte, []string, error) {
+	var document yaml3.Node
+	if err := yaml3.Unmarshal(yamlFile, &document); err != nil {
+		return nil, nil, err
+	}
+	if document.Kind == 0 {
+		// empty file
+		return yamlFile, nil, nil
+	}
+
+	used := make(map[string]bool)
+	var missing []string
+	interpolateNode(&document, used, &missing)
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("configuration file references undefined environment variables: %s", strings.Join(missing, ", "))
+	}
+	if len(used) == 0 {
+		return yamlFile, nil, nil
+	}
+
+	result, err := yaml3.Marshal(&document)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return result, names, nil
+}
+
+func interpolateNode(node *yaml3.Node, used map[string]bool, missing *[]string) {
+	switch node.Kind {
+	case yaml3.DocumentNode, yaml3.SequenceNode:
+		for _, child := range node.Content {
+			interpolateNode(child, used, missing)
+		}
+	case yaml3.MappingNode:
+		// keys are at even, values at odd indexes
+		for i := 1; i < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i], used, missing)
+		}
+	case yaml3.ScalarNode:
+		if node.ShortTag() != "!!str" || !interpolationPattern.MatchString(node.Value) {
+			return
+		}
+		node.Value = interpolationPattern.ReplaceAllStringFunc(node.Value, func(match string) string {
+			name := interpolationPattern.FindStringSubmatch(match)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*missing = append(*missing, name)
+				return match
+			}
+			used[name] = true
+			return value
+		})
+		if node.Style&(yaml3.DoubleQuotedStyle|yaml3.SingleQuotedStyle|yaml3.LiteralStyle|yaml3.FoldedStyle) == 0 {
+			// an unquoted value gets its type from the substituted text, e.g. a number, just as if it had been written there
+			node.Tag = ""
+		}
+	}
+}
+
+// lookupSecret reads the secret given either directly in the environment variable name, or in the file
+// whose path is given in name_FILE. Trailing line breaks are removed from file contents.
+//
+// Setting both is an error. If neither is set, found is false.
+func lookupSecret(name string) (value string, source string, found bool, err error) {
+	direct := os.Getenv(name)
+	filename := os.Getenv(name + envFileSuffix)
+	if direct != "" && filename != "" {
+		return "", "", false, fmt.Errorf("both %s and %s%s are set, please only use one of them", name, name, envFileSuffix)
+	}
+	if direct != "" {
+		return direct, "environment variable " + name, true, nil
+	}
+	if filename != "" {
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return "", "", false, fmt.Errorf("failed to read secret file given in %s%s: %s", name, envFileSuffix, err.Error())
+		}
+		return strings.TrimRight(string(contents), "\r\n"), fmt.Sprintf("file %s (from %s%s)", filename, name, envFileSuffix), true, nil
+	}
+	return "", "", false, nil
+}
+
+// appEnvName converts an application name to the form used in environment variable names,
+// e.g. "example-service" becomes "EXAMPLE_SERVICE".
+func appEnvName(appName string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, appName)
+}
+
+// applyEnvVarOverrides replaces secrets from the configuration file with values from the environment
+// or from mounted secret files.
+//
+// Per application overrides take precedence over the global REG_SECRET_OIDC_CLIENT_ID/SECRET, which
+// still apply to all applications.
+func applyEnvVarOverrides(c *Application) (valueSources, error) {
+	sources := make(valueSources)
+	if c == nil {
+		return sources, nil
+	}
+
+	override := func(key string, target *string, names ...string) error {
+		// later names take precedence
+		for _, name := range names {
+			value, source, found, err := lookupSecret(name)
+			if err != nil {
+				return err
+			}
+			if found {
+				*target = value
+				sources[key] = source
+			}
+		}
+		return nil
+	}
+
+	if err := override("database.password", &c.Database.Password, envDbPassword); err != nil {
+		return sources, err
+	}
+	if err := override("security.oidc.refresh_token_cookie_key", &c.Security.Oidc.RefreshTokenCookieKey, envRefreshCookieKey); err != nil {
+		return sources, err
+	}
+	if err := override("security.oidc.flow_cookie_key", &c.Security.Oidc.FlowCookieKey, envFlowCookieKey); err != nil {
+		return sources, err
+	}
+
+	if err := override("identity_provider.admin_api_token", &c.IdentityProvider.AdminApiToken, envIdpAdminApiToken); err != nil {
+		return sources, err
+	}
+	providerReplacement := make(IdentityProviderConfigs)
+	for providerKey, providerValue := range c.IdentityProviders {
+		if err := override("identity_providers."+providerKey+".admin_api_token", &providerValue.AdminApiToken, envIdpPrefix+appEnvName(providerKey)+envIdpAdminApiTokenSuffix); err != nil {
+			return sources, err
+		}
+		providerReplacement[providerKey] = providerValue
+	}
+	if c.IdentityProviders != nil {
+		c.IdentityProviders = providerReplacement
+	}
+
+	replacement := make(map[string]ApplicationConfig)
+	for appKey, appValue := range c.ApplicationConfigs {
+		appPrefix := envAppPrefix + appEnvName(appKey)
+		keyPrefix := "application_configs." + appKey
+		if err := override(keyPrefix+".client_id", &appValue.ClientId, envOidcClientId, appPrefix+envAppClientIdSuffix); err != nil {
+			return sources, err
+		}
+		if err := override(keyPrefix+".client_secret", &appValue.ClientSecret, envOidcClientSecret, appPrefix+envAppClientSecSuffix); err != nil {
+			return sources, err
+		}
+		if err := override(keyPrefix+".client_assertion_key_PEM", &appValue.ClientAssertionKeyPEM, appPrefix+envAppAssertionSuffix); err != nil {
+			return sources, err
+		}
+		replacement[appKey] = appValue
+	}
+	c.ApplicationConfigs = replacement
+
+	return sources, nil
+}
+
+func logValueSources(sources valueSources, interpolated []string) {
+	if len(interpolated) > 0 {
+		aulogging.Logger.NoCtx().Info().Printf("configuration file uses environment variables %s", strings.Join(interpolated, ", "))
+	}
+
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		aulogging.Logger.NoCtx().Info().Printf("configuration value %s taken from %s", key, sources[key])
+	}
+}
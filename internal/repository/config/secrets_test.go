@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+	yaml2 "gopkg.in/yaml.v2"
+)
+
+func tstSecretsConfig() *Application {
+	return &Application{
+		ApplicationConfigs: map[string]ApplicationConfig{
+			"example-service": {ClientId: "yaml-id", ClientSecret: "yaml-secret"},
+			"other":           {ClientId: "other-id", ClientSecret: "other-secret"},
+		},
+	}
+}
+
+func tstSecretFile(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "secret")
+	require.Nil(t, os.WriteFile(filename, []byte(contents), 0600))
+	return filename
+}
+
+func TestInterpolateEnvVars(t *testing.T) {
+	docs.Description("${NAME} in the configuration file is replaced by the environment variable, except in comments")
+	t.Setenv("TST_DB_HOST", "db.example.com")
+	yaml := "# uses ${TST_UNSET}\ndatabase:\n  database: '${TST_DB_HOST}:3306/${TST_DB_HOST}' # or ${TST_UNSET_TOO}\n"
+
+	result, used, err := interpolateEnvVars([]byte(yaml))
+	require.Nil(t, err)
+	require.Equal(t, []string{"TST_DB_HOST"}, used)
+	parsed := Application{}
+	require.Nil(t, yaml2.UnmarshalStrict(result, &parsed))
+	require.Equal(t, "db.example.com:3306/db.example.com", parsed.Database.Database)
+}
+
+func TestInterpolateEnvVars_valuesCannotChangeStructure(t *testing.T) {
+	docs.Description("a substituted value stays a single value, even if it contains yaml syntax")
+	t.Setenv("TST_DB_PASSWORD", "secret'\n  username: 'root # not a comment")
+	yaml := "database:\n  username: 'app'\n  password: ${TST_DB_PASSWORD}\n"
+
+	result, _, err := interpolateEnvVars([]byte(yaml))
+	require.Nil(t, err)
+	parsed := Application{}
+	require.Nil(t, yaml2.UnmarshalStrict(result, &parsed))
+	require.Equal(t, "app", parsed.Database.Username)
+	require.Equal(t, "secret'\n  username: 'root # not a comment", parsed.Database.Password)
+}
+
+func TestInterpolateEnvVars_unquotedValueGetsItsType(t *testing.T) {
+	docs.Description("an unquoted placeholder is typed by the substituted text, as if it had been written there")
+	t.Setenv("TST_MAX_AGE", "14")
+	yaml := "audit:\n  file:\n    max_age_days: ${TST_MAX_AGE}\n"
+
+	result, _, err := interpolateEnvVars([]byte(yaml))
+	require.Nil(t, err)
+	parsed := Application{}
+	require.Nil(t, yaml2.UnmarshalStrict(result, &parsed))
+	require.Equal(t, 14, parsed.Audit.File.MaxAgeDays)
+}
+
+func TestInterpolateEnvVars_undefined(t *testing.T) {
+	docs.Description("referencing an undefined environment variable is an error")
+	_, _, err := interpolateEnvVars([]byte("a: ${TST_UNSET_ONE}\nb: ${TST_UNSET_TWO}\n"))
+	require.NotNil(t, err)
+	require.Equal(t, "configuration file references undefined environment variables: TST_UNSET_ONE, TST_UNSET_TWO", err.Error())
+}
+
+func TestAppEnvName(t *testing.T) {
+	docs.Description("application names are converted to upper case with special characters replaced by underscores")
+	require.Equal(t, "EXAMPLE_SERVICE", appEnvName("example-service"))
+	require.Equal(t, "REG_2", appEnvName("reg.2"))
+}
+
+func TestApplyEnvVarOverrides_perApplication(t *testing.T) {
+	docs.Description("per application overrides take precedence over the global ones and only affect their application")
+	t.Setenv(envOidcClientId, "global-id")
+	t.Setenv("REG_SECRET_APP_EXAMPLE_SERVICE_CLIENT_ID", "app-id")
+	t.Setenv("REG_SECRET_APP_EXAMPLE_SERVICE_CLIENT_SECRET", "app-secret")
+	c := tstSecretsConfig()
+
+	sources, err := applyEnvVarOverrides(c)
+	require.Nil(t, err)
+	require.Equal(t, "app-id", c.ApplicationConfigs["example-service"].ClientId)
+	require.Equal(t, "app-secret", c.ApplicationConfigs["example-service"].ClientSecret)
+	require.Equal(t, "global-id", c.ApplicationConfigs["other"].ClientId)
+	require.Equal(t, "other-secret", c.ApplicationConfigs["other"].ClientSecret)
+	require.Equal(t, valueSources{
+		"application_configs.example-service.client_id":     "environment variable REG_SECRET_APP_EXAMPLE_SERVICE_CLIENT_ID",
+		"application_configs.example-service.client_secret": "environment variable REG_SECRET_APP_EXAMPLE_SERVICE_CLIENT_SECRET",
+		"application_configs.other.client_id":               "environment variable " + envOidcClientId,
+	}, sources)
+}
+
+func TestApplyEnvVarOverrides_adminApiTokens(t *testing.T) {
+	docs.Description("the admin api tokens of the identity providers can be set from the environment")
+	t.Setenv(envIdpAdminApiToken, "default-token")
+	t.Setenv("REG_SECRET_IDP_STAFF_ADMIN_API_TOKEN", "staff-token")
+	c := tstSecretsConfig()
+	c.IdentityProviders = IdentityProviderConfigs{"staff": {AdminApiToken: "yaml-token"}, "other": {AdminApiToken: "other-token"}}
+
+	sources, err := applyEnvVarOverrides(c)
+	require.Nil(t, err)
+	require.Equal(t, "default-token", c.IdentityProvider.AdminApiToken)
+	require.Equal(t, "staff-token", c.IdentityProviders["staff"].AdminApiToken)
+	require.Equal(t, "other-token", c.IdentityProviders["other"].AdminApiToken)
+	require.Equal(t, "environment variable REG_SECRET_IDP_STAFF_ADMIN_API_TOKEN", sources["identity_providers.staff.admin_api_token"])
+}
+
+func TestApplyEnvVarOverrides_fromFile(t *testing.T) {
+	docs.Description("secrets can be read from files, with trailing line breaks removed")
+	filename := tstSecretFile(t, "file-password\n")
+	t.Setenv(envDbPassword+"_FILE", filename)
+	c := tstSecretsConfig()
+
+	sources, err := applyEnvVarOverrides(c)
+	require.Nil(t, err)
+	require.Equal(t, "file-password", c.Database.Password)
+	require.Equal(t, "file "+filename+" (from REG_SECRET_DB_PASSWORD_FILE)", sources["database.password"])
+	for _, source := range sources {
+		require.False(t, strings.Contains(source, "file-password"), "sources must not contain secret values")
+	}
+}
+
+func TestApplyEnvVarOverrides_missingFile(t *testing.T) {
+	docs.Description("a secret file that cannot be read is an error")
+	t.Setenv("REG_SECRET_APP_OTHER_CLIENT_SECRET_FILE", filepath.Join(t.TempDir(), "does-not-exist"))
+
+	_, err := applyEnvVarOverrides(tstSecretsConfig())
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "failed to read secret file given in REG_SECRET_APP_OTHER_CLIENT_SECRET_FILE: "))
+}
+
+func TestApplyEnvVarOverrides_bothSet(t *testing.T) {
+	docs.Description("setting a secret both directly and as a file is an error")
+	t.Setenv(envRefreshCookieKey, "direct")
+	t.Setenv(envRefreshCookieKey+"_FILE", tstSecretFile(t, "from-file"))
+
+	_, err := applyEnvVarOverrides(tstSecretsConfig())
+	require.NotNil(t, err)
+	require.Equal(t, "both REG_SECRET_REFRESH_TOKEN_COOKIE_KEY and REG_SECRET_REFRESH_TOKEN_COOKIE_KEY_FILE are set, please only use one of them", err.Error())
+}
@@ -1,16 +1,39 @@
 package config
 
-import "time"
+import (
+	"crypto"
+	"crypto/rsa"
+	"time"
+)
 
 type (
+	DatabaseType  string
+	AuditSinkType string
+	// ClientAuthMethod selects how we authenticate at the token endpoint, see RFC 8414 token_endpoint_auth_method
+	ClientAuthMethod string
+	// ResponseMode selects how the identity provider returns the authorization response to our dropoff endpoint
+	ResponseMode string
+	// ParMode selects whether an application uses pushed authorization requests (RFC 9126)
+	ParMode string
+	// ServiceScope is a permission of a backend service, see ServiceClientConfig
+	ServiceScope string
+
 	// Application is the root configuration type
 	Application struct {
 		Service            ServiceConfig                `yaml:"service"`
 		Server             ServerConfig                 `yaml:"server"`
 		Security           SecurityConfig               `yaml:"security"`
 		Logging            LoggingConfig                `yaml:"logging"`
-		IdentityProvider   IdentityProviderConfig       `yaml:"identity_provider"`
+		Database           DatabaseConfig               `yaml:"database"`
+		IdentityProvider   IdentityProviderConfig       `yaml:"identity_provider"`  // the default identity provider
+		IdentityProviders  IdentityProviderConfigs      `yaml:"identity_providers"` // additional named identity providers that applications can select
 		ApplicationConfigs map[string]ApplicationConfig `yaml:"application_configs"`
+		Tracing            TracingConfig                `yaml:"tracing"`
+		Audit              AuditConfig                  `yaml:"audit"`
+
+		parsedKeySet              []*rsa.PublicKey            // parsed from security.oidc.token_public_keys_PEM during validation
+		parsedClientAssertionKeys map[string]crypto.Signer    // parsed from application_configs.*.client_assertion_key_PEM during validation
+		parsedProviderKeySets     map[string][]*rsa.PublicKey // parsed from identity_providers.*.token_public_keys_PEM during validation
 	}
 
 	// ServiceConfig contains configuration values
@@ -19,6 +42,7 @@ type (
 		Name               string `yaml:"name"`
 		DropoffEndpointUrl string `yaml:"dropoff_endpoint_url"` // externally visible url to my "dropoff" endpoint
 		ErrorUrl           string `yaml:"error_url"`            // externally visible default error url
+		LogoutCallbackUrl  string `yaml:"logout_callback_url"`  // externally visible url to my "logout-callback" endpoint, required for idp_logout
 	}
 
 	// ServerConfig contains all values for http configuration
@@ -28,24 +52,73 @@ type (
 		ReadTimeout  int    `yaml:"read_timeout_seconds"`
 		WriteTimeout int    `yaml:"write_timeout_seconds"`
 		IdleTimeout  int    `yaml:"idle_timeout_seconds"`
+		MetricsPort  string `yaml:"metrics_port"` // if set, /metrics is served on this port, it is never served on the main port
+	}
+
+	// TracingConfig configures OpenTelemetry distributed tracing
+	TracingConfig struct {
+		OtlpEndpoint string `yaml:"otlp_endpoint"` // OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces. If empty, spans are not exported
+	}
+
+	// AuditConfig configures where security audit events are written
+	AuditConfig struct {
+		Sink AuditSinkType   `yaml:"sink"` // stdout (default), file, or none
+		File AuditFileConfig `yaml:"file"`
+	}
+
+	AuditFileConfig struct {
+		Path       string `yaml:"path"`         // required for sink file
+		MaxSizeMB  int    `yaml:"max_size_mb"`  // the file is rotated when it reaches this size, defaults to 100
+		MaxBackups int    `yaml:"max_backups"`  // number of rotated files to keep, defaults to 10
+		MaxAgeDays int    `yaml:"max_age_days"` // rotated files older than this are removed, 0 keeps them regardless of age
 	}
 
 	// SecurityConfig configures everything related to security
 	SecurityConfig struct {
-		Cors CorsConfig          `yaml:"cors"`
-		Oidc OpenIdConnectConfig `yaml:"oidc"`
+		Cors           CorsConfig                     `yaml:"cors"`
+		Oidc           OpenIdConnectConfig            `yaml:"oidc"`
+		ServiceClients map[string]ServiceClientConfig `yaml:"service_clients"` // backend services that call us without a user's token
+	}
+
+	// ServiceClientConfig allows a backend service to call us without a user's token, either with a static
+	// api key in the X-Api-Key header, or with an access token it obtained via the client credentials grant.
+	ServiceClientConfig struct {
+		ApiKeySha256 string         `yaml:"api_key_sha256"` // hex encoded sha256 hash of the api key, so the key itself is not in the configuration
+		ClientId     string         `yaml:"client_id"`      // client_id (or azp) claim of the access tokens of the service
+		Scopes       []ServiceScope `yaml:"scopes"`         // what the service is allowed to do
 	}
 
 	OpenIdConnectConfig struct {
-		IdTokenCookieName     string              `yaml:"id_token_cookie_name"`     // optional, if set, the jwt token is also read from this cookie (useful for mixed web application setups, see reg-auth-service)
-		AccessTokenCookieName string              `yaml:"access_token_cookie_name"` // optional, if set, we place the auth token in a second cookie (used for userinfo endpoint)
-		RelevantGroups        map[string][]string `yaml:"relevant_groups"`          // key is IDP group id, value is list of allowed subjects (all allowed if value is empty list)
-		TokenPublicKeysPEM    []string            `yaml:"token_public_keys_PEM"`    // a list of public RSA keys in PEM format, see https://github.com/Jumpy-Squirrel/jwks2pem for obtaining PEM from openid keyset endpoint
-		UserInfoURL           string              `yaml:"user_info_url"`            // validation of admin accesses uses this endpoint to verify the token is still current and access has not been recently revoked
-		TokenIntrospectionURL string              `yaml:"token_introspection_url"`  // validation of tokens uses this endpoint to obtain scopes and audiences
-		UserInfoCacheSeconds  int                 `yaml:"user_info_cache_seconds"`  // leave at 0 to disable caching
-		Audience              string              `yaml:"audience"`
-		Issuer                string              `yaml:"issuer"`
+		IdTokenCookieName         string              `yaml:"id_token_cookie_name"`              // optional, if set, the jwt token is also read from this cookie (useful for mixed web application setups, see reg-auth-service)
+		AccessTokenCookieName     string              `yaml:"access_token_cookie_name"`          // optional, if set, we place the auth token in a second cookie (used for userinfo endpoint)
+		RefreshTokenCookieName    string              `yaml:"refresh_token_cookie_name"`         // optional, if set, we keep the refresh token in an encrypted cookie, so sessions can be renewed via the refresh endpoint
+		RefreshTokenCookieKey     string              `yaml:"refresh_token_cookie_key"`          // secret used to encrypt the refresh token cookie, at least 32 characters, required if refresh_token_cookie_name is set
+		FlowCookieKey             string              `yaml:"flow_cookie_key"`                   // required, secret used to sign the cookie binding a login flow to the browser, at least 32 characters
+		SessionCookieName         string              `yaml:"session_cookie_name"`               // prefix of the session id cookies of applications with server_side_sessions (suffixed with "_" + application name), required if any application uses them
+		RelevantGroups            map[string][]string `yaml:"relevant_groups"`                   // key is IDP group id, value is list of allowed subjects (all allowed if value is empty list)
+		RoleMappings              []RoleMappingConfig `yaml:"role_mappings"`                     // grant stable role names based on IDP groups or claim values, returned as roles by the userinfo endpoints
+		ExtraClaims               []string            `yaml:"extra_claims"`                      // further claims of the id token or userinfo response to pass through under extra_claims, e.g. preferred_username, locale
+		TokenPublicKeysPEM        []string            `yaml:"token_public_keys_PEM"`             // a list of public RSA keys in PEM format, see https://github.com/Jumpy-Squirrel/jwks2pem for obtaining PEM from openid keyset endpoint
+		UserInfoURL               string              `yaml:"user_info_url"`                     // validation of admin accesses uses this endpoint to verify the token is still current and access has not been recently revoked
+		TokenIntrospectionURL     string              `yaml:"token_introspection_url"`           // validation of tokens uses this endpoint to obtain scopes and audiences
+		UserInfoCacheSeconds      int                 `yaml:"user_info_cache_seconds"`           // leave at 0 to disable caching
+		IntrospectionCacheSeconds int                 `yaml:"token_introspection_cache_seconds"` // leave at 0 to disable caching, never exceeds the expiry of a token
+		RequiredScopes            []string            `yaml:"required_scopes"`                   // access tokens must have all of these scopes, checked during token introspection
+		Audience                  string              `yaml:"audience"`
+		AllowMissingAudience      bool                `yaml:"allow_missing_audience"` // accept introspected access tokens without aud claim, by default they are rejected if audience is set
+		Issuer                    string              `yaml:"issuer"`                 // required unless discovered, tokens from other issuers are rejected
+	}
+
+	// RoleMappingConfig grants a role to users who have one of the groups, or one of the values in the claim.
+	//
+	// A role can be granted by several role mappings, users get it if any of them matches.
+	RoleMappingConfig struct {
+		Role         string   `yaml:"role"`         // the stable role name that downstream services check for
+		Groups       []string `yaml:"groups"`       // IDP group ids that grant the role
+		Claim        string   `yaml:"claim"`        // optional, a claim of the id token or userinfo response, e.g. department
+		Values       []string `yaml:"values"`       // values of the claim that grant the role, for list claims any element counts
+		Subjects     []string `yaml:"subjects"`     // optional, only these subjects can get the role from this mapping
+		Applications []string `yaml:"applications"` // optional, only applies to tokens issued for one of these applications
 	}
 
 	CorsConfig struct {
@@ -60,15 +133,66 @@ type (
 		Severity string `yaml:"severity"`
 	}
 
+	// DatabaseConfig configures which db to use (mysql, sqlite, inmemory)
+	// and how to connect to it (needed for mysql and sqlite only)
+	DatabaseConfig struct {
+		Use        DatabaseType `yaml:"use"`
+		Username   string       `yaml:"username"`   // mysql only
+		Password   string       `yaml:"password"`   // mysql only
+		Database   string       `yaml:"database"`   // mysql: tcp(host:port)/dbname, sqlite: path to the database file
+		Parameters []string     `yaml:"parameters"` // appended to the connect string, separated by '&'
+	}
+
+	// IdentityProviderConfigs maps the names of additional identity providers to their configuration
+	IdentityProviderConfigs map[string]IdentityProviderConfig
+
 	// IdentityProviderConfig provides information about an OpenID Connect identity provider
+	//
+	// If IssuerDiscoveryUrl is set, all endpoints that are left empty are filled in from the
+	// identity provider's /.well-known/openid-configuration, and configured endpoints are checked against it.
+	//
+	// Issuer, AllowedAudience, TokenIntrospectionEndpoint and TokenPublicKeysPEM are only used for the named identity providers,
+	// for the default identity provider they are configured in security.oidc.
 	IdentityProviderConfig struct {
-		AuthorizationEndpoint string        `yaml:"authorization_endpoint"`
-		TokenEndpoint         string        `yaml:"token_endpoint"`
-		EndSessionEndpoint    string        `yaml:"end_session_endpoint"`
-		UserInfoEndpoint      string        `yaml:"user_info_endpoint"`
-		KeySetEndpoint        string        `yaml:"key_set_endpoint"`
-		TokenRequestTimeout   time.Duration `yaml:"token_request_timeout"`
-		AuthRequestTimeout    time.Duration `yaml:"auth_request_timeout"`
+		IssuerDiscoveryUrl     string        `yaml:"issuer_discovery_url"`     // optional, the issuer url, e.g. https://identity.example.com/
+		IssuerDiscoveryRefresh time.Duration `yaml:"issuer_discovery_refresh"` // how often to repeat discovery, defaults to 1h
+		AuthorizationEndpoint  string        `yaml:"authorization_endpoint"`
+		TokenEndpoint          string        `yaml:"token_endpoint"`
+		ParEndpoint            string        `yaml:"pushed_authorization_request_endpoint"` // only needed if an application uses pushed authorization requests
+		EndSessionEndpoint     string        `yaml:"end_session_endpoint"`
+		UserInfoEndpoint       string        `yaml:"user_info_endpoint"`
+		KeySetEndpoint         string        `yaml:"key_set_endpoint"`
+		KeySetRefresh          time.Duration `yaml:"key_set_refresh"` // how often to reload the key set, defaults to 15m
+		TokenRequestTimeout    time.Duration `yaml:"token_request_timeout"`
+		AuthRequestTimeout     time.Duration `yaml:"auth_request_timeout"`
+		AdminUserInfoEndpoint  string        `yaml:"admin_user_info_endpoint"` // optional, admin api that returns the userinfo of the subject that replaces {subject}
+		AdminApiToken          string        `yaml:"admin_api_token"`          // sent as bearer token to the admin api, required if admin_user_info_endpoint is set
+
+		TokenIntrospectionClient     string `yaml:"token_introspection_client"`      // optional, the application whose client credentials authenticate token introspection requests, defaults to the first application (by name) using this identity provider
+		TokenIntrospectionBearerAuth bool   `yaml:"token_introspection_bearer_auth"` // send the introspected token as bearer token instead of client credentials, only for identity providers that accept this
+
+		Issuer                     string   `yaml:"issuer"`                       // named identity providers only, required unless discovered
+		AllowedAudience            string   `yaml:"allowed_audience"`             // named identity providers only, if set, tokens of this identity provider must be issued for this audience
+		TokenIntrospectionEndpoint string   `yaml:"token_introspection_endpoint"` // named identity providers only
+		TokenPublicKeysPEM         []string `yaml:"token_public_keys_PEM"`        // named identity providers only
+
+		Discovered   *DiscoveryDocument `yaml:"-"` // result of issuer discovery, nil if not configured
+		DiscoveredAt time.Time          `yaml:"-"` // time of the last successful issuer discovery
+	}
+
+	// DiscoveryDocument is the part of the OpenID provider metadata we use
+	//
+	// see https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+	DiscoveryDocument struct {
+		// can leave out fields - we are using a tolerant reader
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		ParEndpoint           string `json:"pushed_authorization_request_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
 	}
 
 	// ApplicationConfig configures an OpenID Connect client.
@@ -83,5 +207,50 @@ type (
 		CookieDomain      string        `yaml:"cookie_domain"`
 		CookiePath        string        `yaml:"cookie_path"`
 		CookieExpiry      time.Duration `yaml:"cookie_expiry"`
+		IdpLogout         bool          `yaml:"idp_logout"`             // if set, logout also ends the session at the identity provider
+		PassthroughParams []string      `yaml:"passthrough_parameters"` // additional query parameters of /v1/auth that are appended to the dropoff url, all others are ignored
+
+		TokenEndpointAuthMethod ClientAuthMethod `yaml:"token_endpoint_auth_method"` // client_secret_post (default), client_secret_basic, or private_key_jwt
+		ClientAssertionKeyPEM   string           `yaml:"client_assertion_key_PEM"`   // RSA or EC private key used to sign client assertions, required for private_key_jwt
+		ClientAssertionKeyId    string           `yaml:"client_assertion_key_id"`    // optional, sent as kid header of client assertions
+
+		PushedAuthorizationRequests ParMode      `yaml:"pushed_authorization_requests"` // off (default), preferred (fall back to a normal redirect on errors), or required
+		ResponseMode                ResponseMode `yaml:"response_mode"`                 // query (default), or form_post to keep code and state out of urls
+		IdentityProvider            string       `yaml:"identity_provider"`             // name of an entry in identity_providers, leave empty for the default identity provider
+		ServerSideSessions          bool         `yaml:"server_side_sessions"`          // if set, tokens are kept in the database, and the browser only gets a session id cookie
 	}
 )
+
+const (
+	Inmemory DatabaseType = "inmemory"
+	Mysql    DatabaseType = "mysql"
+	Sqlite   DatabaseType = "sqlite"
+)
+
+const (
+	ClientSecretPost  ClientAuthMethod = "client_secret_post"
+	ClientSecretBasic ClientAuthMethod = "client_secret_basic"
+	PrivateKeyJwt     ClientAuthMethod = "private_key_jwt"
+)
+
+const (
+	ResponseModeQuery    ResponseMode = "query"
+	ResponseModeFormPost ResponseMode = "form_post"
+)
+
+const (
+	ParOff       ParMode = "off"
+	ParPreferred ParMode = "preferred"
+	ParRequired  ParMode = "required"
+)
+
+const (
+	// ScopeUserinfo allows looking up the userinfo of any subject via /v1/userinfo/{subject}
+	ScopeUserinfo ServiceScope = "userinfo"
+)
+
+const (
+	AuditStdout AuditSinkType = "stdout"
+	AuditFile   AuditSinkType = "file"
+	AuditNone   AuditSinkType = "none"
+)
@@ -1,11 +1,14 @@
 package config
 
 import (
+	"crypto"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,7 +17,8 @@ func addError(errs url.Values, key string, value interface{}, message string) {
 	errs[key] = append(errs[key], fmt.Sprintf("value '%v' %s", value, message))
 }
 
-func notInAllowedValues(allowed []string, value string) bool {
+// NotInAllowedValues is true if value is not one of the allowed values.
+func NotInAllowedValues(allowed []string, value string) bool {
 	for _, v := range allowed {
 		if v == value {
 			return false
@@ -29,12 +33,86 @@ func checkIntValueRange(errs *url.Values, min int, max int, key string, value in
 	}
 }
 
+// CheckConfiguration verifies that the configuration in use is complete enough to log users in and validate their tokens.
+//
+// Used by the readiness check. Unlike the validation at load time, this does not log anything.
+func CheckConfiguration() error {
+	c := configuration()
+	if c == nil || len(c.ApplicationConfigs) == 0 {
+		return errors.New("no application configurations loaded")
+	}
+	for _, provider := range IdentityProviderNames() {
+		if ProviderAuthorizationEndpoint(provider) == "" || ProviderTokenEndpoint(provider) == "" {
+			return fmt.Errorf("authorization or token endpoint of identity provider %s unknown", provider)
+		}
+		if len(ProviderKeySet(provider)) == 0 && ProviderKeySetEndpoint(provider) == "" {
+			if provider == DefaultIdentityProvider {
+				return errors.New("no token signing keys configured, need security.oidc.token_public_keys_PEM or identity_provider.key_set_endpoint")
+			}
+			return fmt.Errorf("no token signing keys configured for identity provider %s", provider)
+		}
+	}
+	return nil
+}
+
 func validateDropoffEndpointUrl(errs url.Values, value string) {
 	if value == "" {
 		addError(errs, "dropoff_endpoint_url", value, "cannot not be empty")
 	}
 }
 
+func validateLogoutCallbackUrl(errs url.Values, value string, acs map[string]ApplicationConfig) {
+	for name, ac := range acs {
+		if ac.IdpLogout && value == "" {
+			addError(errs, "service.logout_callback_url", value, fmt.Sprintf("cannot be empty, because application_configs.%s.idp_logout is set", name))
+			return
+		}
+	}
+}
+
+// validateFlowCookieKey requires the key that signs the flow cookie. It must be the same on all instances
+// and across restarts, or logins fail at the dropoff endpoint.
+func validateFlowCookieKey(errs url.Values, c OpenIdConnectConfig) {
+	if len(c.FlowCookieKey) < 32 {
+		errs.Add("security.oidc.flow_cookie_key", "must be at least 32 characters long")
+	}
+}
+
+func validateServerSideSessions(errs url.Values, acs map[string]ApplicationConfig, c OpenIdConnectConfig) {
+	for name, ac := range acs {
+		if ac.ServerSideSessions && c.SessionCookieName == "" {
+			addError(errs, "security.oidc.session_cookie_name", c.SessionCookieName, fmt.Sprintf("cannot be empty, because application_configs.%s.server_side_sessions is set", name))
+			return
+		}
+	}
+	if c.SessionCookieName != "" {
+		for _, other := range []string{c.IdTokenCookieName, c.AccessTokenCookieName, c.RefreshTokenCookieName} {
+			if other == c.SessionCookieName {
+				addError(errs, "security.oidc.session_cookie_name", c.SessionCookieName, "must differ from the names of the token cookies")
+				return
+			}
+		}
+		// the application name becomes part of the session cookie name
+		for name, ac := range acs {
+			if !ac.ServerSideSessions {
+				continue
+			}
+			if !cookieNamePattern.MatchString(name) {
+				addError(errs, fmt.Sprintf("application_configs.%s.server_side_sessions", name), ac.ServerSideSessions, "requires an application name that can be used in a cookie name")
+				continue
+			}
+			for _, other := range []string{c.IdTokenCookieName, c.AccessTokenCookieName, c.RefreshTokenCookieName, ac.CookieName} {
+				if other == sessionCookieName(c.SessionCookieName, name) {
+					addError(errs, "security.oidc.session_cookie_name", c.SessionCookieName, fmt.Sprintf("must not lead to a session cookie name for application_configs.%s that is also used for a token cookie", name))
+				}
+			}
+		}
+	}
+}
+
+// cookieNamePattern matches the characters allowed in cookie names, see RFC 6265 section 4.1.1
+var cookieNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
 func validateServerConfiguration(errs url.Values, sc ServerConfig) {
 	if sc.Port == "" {
 		addError(errs, "server.port", sc.Port, "cannot be empty")
@@ -46,13 +124,47 @@ func validateServerConfiguration(errs url.Values, sc ServerConfig) {
 			addError(errs, "server.port", sc.Port, "must be a nonprivileged port")
 		}
 	}
+	if sc.MetricsPort != "" {
+		port, err := strconv.ParseUint(sc.MetricsPort, 10, 16)
+		if err != nil {
+			addError(errs, "server.metrics_port", sc.MetricsPort, "is not a valid port number")
+		} else if port <= 1024 {
+			addError(errs, "server.metrics_port", sc.MetricsPort, "must be a nonprivileged port")
+		} else if sc.MetricsPort == sc.Port {
+			addError(errs, "server.metrics_port", sc.MetricsPort, "must differ from server.port")
+		}
+	}
 	checkIntValueRange(&errs, 1, 300, "server.read_timeout_seconds", sc.ReadTimeout)
 	checkIntValueRange(&errs, 1, 300, "server.write_timeout_seconds", sc.WriteTimeout)
 	checkIntValueRange(&errs, 1, 300, "server.idle_timeout_seconds", sc.IdleTimeout)
 }
 
-func validateSecurityConfiguration(errs url.Values, c SecurityConfig) {
-	parsedKeySet = make([]*rsa.PublicKey, 0)
+func validateTracingConfiguration(errs url.Values, c TracingConfig) {
+	if c.OtlpEndpoint != "" {
+		u, err := url.Parse(c.OtlpEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addError(errs, "tracing.otlp_endpoint", c.OtlpEndpoint, "must be an absolute http or https url")
+		}
+	}
+}
+
+var allowedAuditSinks = []string{string(AuditStdout), string(AuditFile), string(AuditNone)}
+
+func validateAuditConfiguration(errs url.Values, c AuditConfig) {
+	if NotInAllowedValues(allowedAuditSinks, string(c.Sink)) {
+		errs.Add("audit.sink", "must be one of stdout, file, none")
+	}
+	if c.Sink == AuditFile && c.File.Path == "" {
+		addError(errs, "audit.file.path", c.File.Path, "cannot be empty when using sink file")
+	}
+	if c.File.MaxAgeDays < 0 {
+		addError(errs, "audit.file.max_age_days", c.File.MaxAgeDays, "cannot be negative")
+	}
+}
+
+// validateSecurityConfiguration also returns the parsed token_public_keys_PEM, so they can be swapped in together with the configuration
+func validateSecurityConfiguration(errs url.Values, c SecurityConfig) []*rsa.PublicKey {
+	parsedKeySet := make([]*rsa.PublicKey, 0)
 	for i, keyStr := range c.Oidc.TokenPublicKeysPEM {
 		publicKeyPtr, err := jwt.ParseRSAPublicKeyFromPEM([]byte(keyStr))
 		if err != nil {
@@ -62,38 +174,309 @@ func validateSecurityConfiguration(errs url.Values, c SecurityConfig) {
 		}
 	}
 
+	if c.Oidc.RefreshTokenCookieName != "" {
+		if c.Oidc.AccessTokenCookieName == "" {
+			errs.Add("security.oidc.refresh_token_cookie_name", "requires security.oidc.access_token_cookie_name, refreshing only makes sense if we also hold the access token")
+		}
+		if len(c.Oidc.RefreshTokenCookieKey) < 32 {
+			errs.Add("security.oidc.refresh_token_cookie_key", "must be at least 32 characters long if security.oidc.refresh_token_cookie_name is set")
+		}
+	}
+
+	if c.Oidc.IntrospectionCacheSeconds < 0 {
+		addError(errs, "security.oidc.token_introspection_cache_seconds", c.Oidc.IntrospectionCacheSeconds, "cannot be negative")
+	}
+	for i, scope := range c.Oidc.RequiredScopes {
+		if scope == "" || strings.ContainsAny(scope, " \t") {
+			addError(errs, fmt.Sprintf("security.oidc.required_scopes[%d]", i), scope, "must be a single scope")
+		}
+	}
+
 	if c.Cors.DisableCors && c.Cors.InsecureCookies {
 		errs.Add("security.cors.disable", "not compatible with security.cors.insecure_cookies, because SameSitePolicy None only works with secure cookies")
 	}
+	return parsedKeySet
+}
+
+var allowedServiceScopes = []string{string(ScopeUserinfo)}
+
+var apiKeyHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// validateServiceClients ensures every backend service can be told apart from all others
+func validateServiceClients(errs url.Values, clients map[string]ServiceClientConfig, acs map[string]ApplicationConfig) {
+	apiKeyHashes := make(map[string]string)
+	clientIds := make(map[string]string)
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sc := clients[name]
+		key := "security.service_clients." + name
+		if sc.ApiKeySha256 == "" && sc.ClientId == "" {
+			errs.Add(key, "needs api_key_sha256 or client_id, or the service cannot authenticate")
+		}
+		if sc.ApiKeySha256 != "" {
+			if !apiKeyHashPattern.MatchString(sc.ApiKeySha256) {
+				addError(errs, key+".api_key_sha256", sc.ApiKeySha256, "must be the sha256 hash of the api key, as 64 lower case hex digits")
+			} else if other, ok := apiKeyHashes[sc.ApiKeySha256]; ok {
+				addError(errs, key+".api_key_sha256", sc.ApiKeySha256, "is also used by service client "+other)
+			} else {
+				apiKeyHashes[sc.ApiKeySha256] = name
+			}
+		}
+		if sc.ClientId != "" {
+			if app := applicationWithClientId(acs, sc.ClientId); app != "" {
+				// the access tokens of users logged in to the application would carry the same client_id
+				addError(errs, key+".client_id", sc.ClientId, "is also the client_id of application "+app)
+			} else if other, ok := clientIds[sc.ClientId]; ok {
+				addError(errs, key+".client_id", sc.ClientId, "is also used by service client "+other)
+			} else {
+				clientIds[sc.ClientId] = name
+			}
+		}
+		for i, scope := range sc.Scopes {
+			if NotInAllowedValues(allowedServiceScopes, string(scope)) {
+				addError(errs, fmt.Sprintf("%s.scopes[%d]", key, i), scope, "must be one of "+strings.Join(allowedServiceScopes, ", "))
+			}
+		}
+	}
+}
+
+// validateRoleMappings ensures every role mapping can match something
+func validateRoleMappings(errs url.Values, mappings []RoleMappingConfig, acs map[string]ApplicationConfig) {
+	for i, m := range mappings {
+		key := fmt.Sprintf("security.oidc.role_mappings[%d]", i)
+		if m.Role == "" || strings.ContainsAny(m.Role, " \t\n") {
+			addError(errs, key+".role", m.Role, "must be a role name without spaces")
+		}
+		if len(m.Groups) == 0 && m.Claim == "" {
+			errs.Add(key, "needs groups or a claim, or it never grants the role")
+		}
+		if m.Claim != "" && len(m.Values) == 0 {
+			errs.Add(key+".values", "cannot be empty if claim is set")
+		}
+		if m.Claim == "" && len(m.Values) > 0 {
+			errs.Add(key+".claim", "cannot be empty if values are set")
+		}
+		for j, app := range m.Applications {
+			if _, ok := acs[app]; !ok {
+				addError(errs, fmt.Sprintf("%s.applications[%d]", key, j), app, "must be the name of an application in application_configs")
+			}
+		}
+	}
+}
+
+// claims that are always part of the userinfo response
+var standardUserinfoClaims = []string{"sub", "aud", "name", "email", "email_verified", "groups"}
+
+func validateExtraClaims(errs url.Values, claims []string) {
+	for i, claim := range claims {
+		key := fmt.Sprintf("security.oidc.extra_claims[%d]", i)
+		if claim == "" {
+			errs.Add(key, "cannot be empty")
+		} else if !NotInAllowedValues(standardUserinfoClaims, claim) {
+			addError(errs, key, claim, "is always part of the userinfo response")
+		} else if !NotInAllowedValues(claims[:i], claim) {
+			addError(errs, key, claim, "is listed more than once")
+		}
+	}
+}
+
+func applicationWithClientId(acs map[string]ApplicationConfig, clientId string) string {
+	for name, ac := range acs {
+		if ac.ClientId == clientId {
+			return name
+		}
+	}
+	return ""
 }
 
 var allowedSeverities = []string{"DEBUG", "INFO", "WARN", "ERROR"}
 
 func validateLoggingConfiguration(errs url.Values, c LoggingConfig) {
-	if notInAllowedValues(allowedSeverities[:], c.Severity) {
+	if NotInAllowedValues(allowedSeverities[:], c.Severity) {
 		errs.Add("logging.severity", "must be one of DEBUG, INFO, WARN, ERROR")
 	}
 }
 
+var allowedDatabases = []string{string(Inmemory), string(Mysql), string(Sqlite)}
+
+func validateDatabaseConfiguration(errs url.Values, c DatabaseConfig) {
+	if NotInAllowedValues(allowedDatabases[:], string(c.Use)) {
+		errs.Add("database.use", "must be one of inmemory, mysql, sqlite")
+	}
+	if c.Use == Mysql {
+		if c.Username == "" {
+			addError(errs, "database.username", c.Username, "cannot be empty when using mysql")
+		}
+		if c.Password == "" {
+			errs.Add("database.password", "cannot be empty when using mysql")
+		}
+	}
+	if c.Use == Mysql || c.Use == Sqlite {
+		if c.Database == "" {
+			addError(errs, "database.database", c.Database, "cannot be empty when using mysql or sqlite")
+		}
+	}
+}
+
 func validateIdentityProviderConfiguration(errs url.Values, ipc IdentityProviderConfig) {
-	if ipc.AuthorizationEndpoint == "" {
-		addError(errs, "identity_provider.authorization_endpoint", ipc.AuthorizationEndpoint, "cannot not be empty")
+	validateIdentityProvider(errs, "identity_provider", ipc)
+	if ipc.Issuer != "" || ipc.AllowedAudience != "" || ipc.TokenIntrospectionEndpoint != "" || len(ipc.TokenPublicKeysPEM) > 0 {
+		errs.Add("identity_provider", "issuer, allowed_audience, token_introspection_endpoint and token_public_keys_PEM of the default identity provider are configured in security.oidc")
+	}
+}
+
+func validateIdentityProvider(errs url.Values, key string, ipc IdentityProviderConfig) {
+	d := DiscoveryDocument{}
+	if ipc.Discovered != nil {
+		d = *ipc.Discovered
+		if !SameIssuer(d.Issuer, ipc.IssuerDiscoveryUrl) {
+			addError(errs, key+".issuer_discovery_url", ipc.IssuerDiscoveryUrl, fmt.Sprintf("does not match issuer '%s' obtained by issuer discovery", d.Issuer))
+		}
+	}
+	validateAgainstDiscovery(errs, key+".authorization_endpoint", ipc.AuthorizationEndpoint, d.AuthorizationEndpoint)
+	validateAgainstDiscovery(errs, key+".token_endpoint", ipc.TokenEndpoint, d.TokenEndpoint)
+	validateAgainstDiscovery(errs, key+".pushed_authorization_request_endpoint", ipc.ParEndpoint, d.ParEndpoint)
+	validateAgainstDiscovery(errs, key+".end_session_endpoint", ipc.EndSessionEndpoint, d.EndSessionEndpoint)
+	validateAgainstDiscovery(errs, key+".user_info_endpoint", ipc.UserInfoEndpoint, d.UserinfoEndpoint)
+	validateAgainstDiscovery(errs, key+".key_set_endpoint", ipc.KeySetEndpoint, d.JwksUri)
+
+	if firstNonEmpty(ipc.AuthorizationEndpoint, d.AuthorizationEndpoint) == "" {
+		addError(errs, key+".authorization_endpoint", ipc.AuthorizationEndpoint, "cannot not be empty")
 	}
-	if ipc.TokenEndpoint == "" {
-		addError(errs, "identity_provider.token_endpoint", ipc.TokenEndpoint, "cannot not be empty")
+	if firstNonEmpty(ipc.TokenEndpoint, d.TokenEndpoint) == "" {
+		addError(errs, key+".token_endpoint", ipc.TokenEndpoint, "cannot not be empty")
 	}
-	if ipc.EndSessionEndpoint == "" {
-		addError(errs, "identity_provider.end_session_endpoint", ipc.EndSessionEndpoint, "cannot not be empty")
+	if firstNonEmpty(ipc.EndSessionEndpoint, d.EndSessionEndpoint) == "" {
+		addError(errs, key+".end_session_endpoint", ipc.EndSessionEndpoint, "cannot not be empty")
+	}
+	if ipc.KeySetRefresh < 0 {
+		addError(errs, key+".key_set_refresh", ipc.KeySetRefresh, "cannot be negative")
+	}
+	if ipc.IssuerDiscoveryRefresh < 0 {
+		addError(errs, key+".issuer_discovery_refresh", ipc.IssuerDiscoveryRefresh, "cannot be negative")
 	}
 	if ipc.TokenRequestTimeout < 0 {
-		addError(errs, "identity_provider.token_request_timeout", ipc.TokenRequestTimeout, "cannot be negative")
+		addError(errs, key+".token_request_timeout", ipc.TokenRequestTimeout, "cannot be negative")
 	}
 	if ipc.AuthRequestTimeout < 0 {
-		addError(errs, "identity_provider.auth_request_timeout", ipc.AuthRequestTimeout, "cannot be negative")
+		addError(errs, key+".auth_request_timeout", ipc.AuthRequestTimeout, "cannot be negative")
+	}
+	if ipc.AdminUserInfoEndpoint != "" {
+		if !strings.Contains(ipc.AdminUserInfoEndpoint, AdminSubjectPlaceholder) {
+			addError(errs, key+".admin_user_info_endpoint", ipc.AdminUserInfoEndpoint, "must contain "+AdminSubjectPlaceholder)
+		}
+		if ipc.AdminApiToken == "" {
+			errs.Add(key+".admin_api_token", "cannot be empty if admin_user_info_endpoint is set")
+		}
 	}
 }
 
-func validateApplicationConfigurations(errs url.Values, acs map[string]ApplicationConfig) {
+func validateOidcAgainstDiscovery(errs url.Values, c OpenIdConnectConfig, discovered *DiscoveryDocument) {
+	if discovered == nil {
+		return
+	}
+	validateAgainstDiscovery(errs, "security.oidc.user_info_url", c.UserInfoURL, discovered.UserinfoEndpoint)
+	validateAgainstDiscovery(errs, "security.oidc.token_introspection_url", c.TokenIntrospectionURL, discovered.IntrospectionEndpoint)
+	validateIssuerAgainstDiscovery(errs, "security.oidc.issuer", c.Issuer, discovered.Issuer)
+}
+
+// validateDefaultIssuer ensures id tokens are never accepted from just any issuer
+func validateDefaultIssuer(errs url.Values, c OpenIdConnectConfig, issuer string) {
+	if issuer == "" {
+		addError(errs, "security.oidc.issuer", c.Issuer, "cannot be empty unless it is obtained by issuer discovery, tokens are only accepted from a known issuer")
+	}
+}
+
+// validateNamedIdentityProviders also returns the parsed token_public_keys_PEM of each named identity provider
+//
+// Tokens are attributed to identity providers by their issuer, so every named identity provider needs
+// an issuer that differs from all others.
+func validateNamedIdentityProviders(errs url.Values, providers IdentityProviderConfigs, defaultIssuer string) map[string][]*rsa.PublicKey {
+	parsedKeySets := make(map[string][]*rsa.PublicKey)
+	issuers := map[string]string{strings.TrimSuffix(defaultIssuer, "/"): DefaultIdentityProvider}
+	for name, ipc := range providers {
+		key := "identity_providers." + name
+		if name == DefaultIdentityProvider {
+			errs.Add(key, fmt.Sprintf("the name '%s' is reserved for the identity provider configured in identity_provider", DefaultIdentityProvider))
+			continue
+		}
+		validateIdentityProvider(errs, key, ipc)
+
+		d := DiscoveryDocument{}
+		if ipc.Discovered != nil {
+			d = *ipc.Discovered
+		}
+		validateIssuerAgainstDiscovery(errs, key+".issuer", ipc.Issuer, d.Issuer)
+		validateAgainstDiscovery(errs, key+".token_introspection_endpoint", ipc.TokenIntrospectionEndpoint, d.IntrospectionEndpoint)
+
+		issuer := firstNonEmpty(ipc.Issuer, d.Issuer)
+		if issuer == "" {
+			addError(errs, key+".issuer", ipc.Issuer, "cannot be empty, tokens are attributed to identity providers by their issuer")
+		} else if other, ok := issuers[strings.TrimSuffix(issuer, "/")]; ok {
+			addError(errs, key+".issuer", issuer, fmt.Sprintf("is also the issuer of identity provider %s", other))
+		} else {
+			issuers[strings.TrimSuffix(issuer, "/")] = name
+		}
+
+		parsedKeySet := make([]*rsa.PublicKey, 0)
+		for i, keyStr := range ipc.TokenPublicKeysPEM {
+			publicKeyPtr, err := jwt.ParseRSAPublicKeyFromPEM([]byte(keyStr))
+			if err != nil {
+				errs.Add(fmt.Sprintf("%s.token_public_keys_PEM[%d]", key, i), fmt.Sprintf("failed to parse RSA public key in PEM format: %s", err.Error()))
+			} else {
+				parsedKeySet = append(parsedKeySet, publicKeyPtr)
+			}
+		}
+		if len(parsedKeySet) == 0 && firstNonEmpty(ipc.KeySetEndpoint, d.JwksUri) == "" {
+			errs.Add(key, "needs token_public_keys_PEM or key_set_endpoint to validate tokens")
+		}
+		parsedKeySets[name] = parsedKeySet
+	}
+	return parsedKeySets
+}
+
+// validateApplicationIdentityProviders checks that every application selects a configured identity provider
+func validateApplicationIdentityProviders(errs url.Values, acs map[string]ApplicationConfig, providers IdentityProviderConfigs) {
+	for name, ac := range acs {
+		if ac.IdentityProvider == "" || ac.IdentityProvider == DefaultIdentityProvider {
+			continue
+		}
+		if _, ok := providers[ac.IdentityProvider]; !ok {
+			addError(errs, fmt.Sprintf("application_configs.%s.identity_provider", name), ac.IdentityProvider, "must be the name of an entry in identity_providers")
+		}
+	}
+}
+
+func validateTokenIntrospectionClients(errs url.Values, acs map[string]ApplicationConfig, ipc IdentityProviderConfig, providers IdentityProviderConfigs) {
+	checkClient := func(key string, provider string, client string) {
+		if client == "" {
+			return
+		}
+		ac, ok := acs[client]
+		if !ok {
+			addError(errs, key+".token_introspection_client", client, "must be the name of an entry in application_configs")
+		} else if applicationIdentityProvider(ac) != provider {
+			addError(errs, key+".token_introspection_client", client, "must be an application that uses this identity provider")
+		}
+	}
+	checkClient("identity_provider", DefaultIdentityProvider, ipc.TokenIntrospectionClient)
+	for name, p := range providers {
+		checkClient("identity_providers."+name, name, p.TokenIntrospectionClient)
+	}
+}
+
+var allowedResponseModes = []string{string(ResponseModeQuery), string(ResponseModeFormPost)}
+
+var allowedParModes = []string{string(ParOff), string(ParPreferred), string(ParRequired)}
+
+var allowedClientAuthMethods = []string{string(ClientSecretPost), string(ClientSecretBasic), string(PrivateKeyJwt)}
+
+func validateApplicationConfigurations(errs url.Values, acs map[string]ApplicationConfig) map[string]crypto.Signer {
+	parsedClientAssertionKeys := make(map[string]crypto.Signer)
 	if len(acs) == 0 {
 		addError(errs, "application_configs", acs, "must contain at least one entry")
 	}
@@ -107,7 +490,24 @@ func validateApplicationConfigurations(errs url.Values, acs map[string]Applicati
 		if ac.ClientId == "" {
 			addError(errs, fmt.Sprintf("application_configs.%s.client_id", name), ac.ClientId, "cannot not be empty")
 		}
-		if ac.ClientSecret == "" {
+		if ac.TokenEndpointAuthMethod != "" && NotInAllowedValues(allowedClientAuthMethods, string(ac.TokenEndpointAuthMethod)) {
+			addError(errs, fmt.Sprintf("application_configs.%s.token_endpoint_auth_method", name), ac.TokenEndpointAuthMethod, "must be one of client_secret_post, client_secret_basic, private_key_jwt")
+		}
+		if ac.ResponseMode != "" && NotInAllowedValues(allowedResponseModes, string(ac.ResponseMode)) {
+			addError(errs, fmt.Sprintf("application_configs.%s.response_mode", name), ac.ResponseMode, "must be one of query, form_post")
+		}
+		if ac.PushedAuthorizationRequests != "" && NotInAllowedValues(allowedParModes, string(ac.PushedAuthorizationRequests)) {
+			addError(errs, fmt.Sprintf("application_configs.%s.pushed_authorization_requests", name), ac.PushedAuthorizationRequests, "must be one of off, preferred, required")
+		}
+		if ac.TokenEndpointAuthMethod == PrivateKeyJwt {
+			if ac.ClientAssertionKeyPEM == "" {
+				errs.Add(fmt.Sprintf("application_configs.%s.client_assertion_key_PEM", name), "cannot be empty if token_endpoint_auth_method is private_key_jwt")
+			} else if key, err := parsePrivateKeyFromPEM(ac.ClientAssertionKeyPEM); err != nil {
+				errs.Add(fmt.Sprintf("application_configs.%s.client_assertion_key_PEM", name), fmt.Sprintf("failed to parse RSA or EC private key in PEM format: %s", err.Error()))
+			} else {
+				parsedClientAssertionKeys[name] = key
+			}
+		} else if ac.ClientSecret == "" {
 			addError(errs, fmt.Sprintf("application_configs.%s.client_secret", name), ac.ClientSecret, "cannot not be empty")
 		}
 		if ac.DefaultDropoffUrl == "" {
@@ -130,5 +530,47 @@ func validateApplicationConfigurations(errs url.Values, acs map[string]Applicati
 		if ac.CookieExpiry <= 0 {
 			addError(errs, fmt.Sprintf("application_configs.%s.cookie_expiry", name), ac.CookieExpiry, "must be positive, try '1h' or '5m'")
 		}
+		for i, param := range ac.PassthroughParams {
+			if param == "" {
+				addError(errs, fmt.Sprintf("application_configs.%s.passthrough_parameters[%d]", name, i), param, "cannot be empty")
+			} else if !NotInAllowedValues(ReservedAuthParameters, param) {
+				addError(errs, fmt.Sprintf("application_configs.%s.passthrough_parameters[%d]", name, i), param, "is reserved for the auth endpoint and cannot be passed through")
+			}
+		}
+	}
+	return parsedClientAssertionKeys
+}
+
+// validatePushedAuthorizationRequests requires a pushed authorization request endpoint for the identity provider of
+// every application that uses it
+func validatePushedAuthorizationRequests(errs url.Values, acs map[string]ApplicationConfig, ipc IdentityProviderConfig, providers IdentityProviderConfigs) {
+	for name, ac := range acs {
+		if ac.PushedAuthorizationRequests != ParPreferred && ac.PushedAuthorizationRequests != ParRequired {
+			continue
+		}
+		key := "identity_provider"
+		appIpc := ipc
+		if provider := applicationIdentityProvider(ac); provider != DefaultIdentityProvider {
+			key = "identity_providers." + provider
+			appIpc = providers[provider]
+		}
+		d := DiscoveryDocument{}
+		if appIpc.Discovered != nil {
+			d = *appIpc.Discovered
+		}
+		if firstNonEmpty(appIpc.ParEndpoint, d.ParEndpoint) == "" {
+			addError(errs, key+".pushed_authorization_request_endpoint", appIpc.ParEndpoint, fmt.Sprintf("cannot be empty, application_configs.%s uses pushed authorization requests", name))
+		}
+	}
+}
+
+func parsePrivateKeyFromPEM(keyStr string) (crypto.Signer, error) {
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyStr)); err == nil {
+		return rsaKey, nil
+	}
+	ecKey, err := jwt.ParseECPrivateKeyFromPEM([]byte(keyStr))
+	if err != nil {
+		return nil, err
 	}
+	return ecKey, nil
 }
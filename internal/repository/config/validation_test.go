@@ -1,6 +1,11 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"net/url"
 	"testing"
 	"time"
@@ -42,6 +47,193 @@ func TestValidateServerConfiguration_privileged(t *testing.T) {
 	tstValidatePort(t, "1023", "value '1023' must be a nonprivileged port")
 }
 
+func tstValidateMetricsPort(t *testing.T, value string, errMessage string) {
+	errs := url.Values{}
+	config := ServerConfig{
+		Port:         "8080",
+		MetricsPort:  value,
+		ReadTimeout:  3,
+		WriteTimeout: 3,
+		IdleTimeout:  3,
+	}
+	validateServerConfiguration(errs, config)
+	if errMessage == "" {
+		require.Equal(t, 0, len(errs))
+		return
+	}
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{errMessage}, errs["server.metrics_port"])
+}
+
+func TestValidateServerConfiguration_metricsPortOptional(t *testing.T) {
+	docs.Description("validation should accept an empty or separate metrics port")
+	tstValidateMetricsPort(t, "", "")
+	tstValidateMetricsPort(t, "9090", "")
+}
+
+func TestValidateServerConfiguration_metricsPortInvalid(t *testing.T) {
+	docs.Description("validation should catch an invalid metrics port, or one that clashes with the main port")
+	tstValidateMetricsPort(t, "katze", "value 'katze' is not a valid port number")
+	tstValidateMetricsPort(t, "80", "value '80' must be a nonprivileged port")
+	tstValidateMetricsPort(t, "8080", "value '8080' must differ from server.port")
+}
+
+func TestValidateTracingConfiguration(t *testing.T) {
+	docs.Description("validation should accept an empty or absolute http(s) otlp endpoint")
+	for _, endpoint := range []string{"", "http://localhost:4318/v1/traces", "https://otel.example.com/v1/traces"} {
+		errs := url.Values{}
+		validateTracingConfiguration(errs, TracingConfig{OtlpEndpoint: endpoint})
+		require.Equal(t, 0, len(errs), endpoint)
+	}
+	for _, endpoint := range []string{"localhost:4318", "grpc://localhost:4317", "/v1/traces"} {
+		errs := url.Values{}
+		validateTracingConfiguration(errs, TracingConfig{OtlpEndpoint: endpoint})
+		require.Equal(t, []string{"value '" + endpoint + "' must be an absolute http or https url"}, errs["tracing.otlp_endpoint"])
+	}
+}
+
+func TestValidateAuditConfiguration(t *testing.T) {
+	docs.Description("validation should reject unknown audit sinks, and require a path for the file sink")
+	errs := url.Values{}
+	validateAuditConfiguration(errs, AuditConfig{Sink: AuditStdout})
+	require.Equal(t, 0, len(errs))
+
+	errs = url.Values{}
+	validateAuditConfiguration(errs, AuditConfig{Sink: "syslog"})
+	require.Equal(t, []string{"must be one of stdout, file, none"}, errs["audit.sink"])
+
+	errs = url.Values{}
+	validateAuditConfiguration(errs, AuditConfig{Sink: AuditFile, File: AuditFileConfig{MaxAgeDays: -1}})
+	require.Equal(t, []string{"value '' cannot be empty when using sink file"}, errs["audit.file.path"])
+	require.Equal(t, []string{"value '-1' cannot be negative"}, errs["audit.file.max_age_days"])
+}
+
+func TestValidateLogoutCallbackUrl_notNeeded(t *testing.T) {
+	docs.Description("validation should accept an empty logout callback url if no application uses idp logout")
+	errs := url.Values{}
+	validateLogoutCallbackUrl(errs, "", map[string]ApplicationConfig{"app": {}})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateLogoutCallbackUrl_missing(t *testing.T) {
+	docs.Description("validation should require a logout callback url if an application uses idp logout")
+	errs := url.Values{}
+	validateLogoutCallbackUrl(errs, "", map[string]ApplicationConfig{"app": {IdpLogout: true}})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty, because application_configs.app.idp_logout is set"}, errs["service.logout_callback_url"])
+}
+
+func TestValidateApplicationConfigurations_passthroughParameters(t *testing.T) {
+	docs.Description("validation should reject empty or reserved passthrough parameter names")
+	errs := url.Values{}
+	validateApplicationConfigurations(errs, map[string]ApplicationConfig{"app": {PassthroughParams: []string{"lang", "", "dropoff_url"}}})
+	require.Nil(t, errs["application_configs.app.passthrough_parameters[0]"])
+	require.Equal(t, []string{"value '' cannot be empty"}, errs["application_configs.app.passthrough_parameters[1]"])
+	require.Equal(t, []string{"value 'dropoff_url' is reserved for the auth endpoint and cannot be passed through"}, errs["application_configs.app.passthrough_parameters[2]"])
+}
+
+func TestValidateSecurityConfiguration_refreshTokenValid(t *testing.T) {
+	docs.Description("validation should accept a refresh token cookie with a sufficiently long key")
+	errs := url.Values{}
+	validateSecurityConfiguration(errs, SecurityConfig{Oidc: OpenIdConnectConfig{
+		AccessTokenCookieName:  "AUTH",
+		RefreshTokenCookieName: "REFRESH",
+		RefreshTokenCookieKey:  "0123456789abcdef0123456789abcdef",
+	}})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateSecurityConfiguration_refreshTokenKeyTooShort(t *testing.T) {
+	docs.Description("validation should require a long enough key for the refresh token cookie")
+	errs := url.Values{}
+	validateSecurityConfiguration(errs, SecurityConfig{Oidc: OpenIdConnectConfig{
+		AccessTokenCookieName:  "AUTH",
+		RefreshTokenCookieName: "REFRESH",
+		RefreshTokenCookieKey:  "short",
+	}})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"must be at least 32 characters long if security.oidc.refresh_token_cookie_name is set"}, errs["security.oidc.refresh_token_cookie_key"])
+}
+
+func TestValidateFlowCookieKey_valid(t *testing.T) {
+	docs.Description("validation should accept a sufficiently long key for the flow cookie")
+	errs := url.Values{}
+	validateFlowCookieKey(errs, OpenIdConnectConfig{FlowCookieKey: "0123456789abcdef0123456789abcdef"})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateFlowCookieKey_missing(t *testing.T) {
+	docs.Description("validation should require a key for the flow cookie, a random one would break logins across restarts and instances")
+	errs := url.Values{}
+	validateFlowCookieKey(errs, OpenIdConnectConfig{})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"must be at least 32 characters long"}, errs["security.oidc.flow_cookie_key"])
+}
+
+func TestValidateFlowCookieKey_tooShort(t *testing.T) {
+	docs.Description("validation should require a long enough key for the flow cookie")
+	errs := url.Values{}
+	validateFlowCookieKey(errs, OpenIdConnectConfig{FlowCookieKey: "short"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"must be at least 32 characters long"}, errs["security.oidc.flow_cookie_key"])
+}
+
+func TestValidateSecurityConfiguration_introspection(t *testing.T) {
+	docs.Description("validation should reject a negative introspection cache time and malformed required scopes")
+	errs := url.Values{}
+	validateSecurityConfiguration(errs, SecurityConfig{Oidc: OpenIdConnectConfig{
+		IntrospectionCacheSeconds: -1,
+		RequiredScopes:            []string{"openid", "", "profile email"},
+	}})
+	require.Equal(t, 3, len(errs))
+	require.Equal(t, []string{"value '-1' cannot be negative"}, errs["security.oidc.token_introspection_cache_seconds"])
+	require.Equal(t, []string{"value '' must be a single scope"}, errs["security.oidc.required_scopes[1]"])
+	require.Equal(t, []string{"value 'profile email' must be a single scope"}, errs["security.oidc.required_scopes[2]"])
+}
+
+func TestValidateSecurityConfiguration_refreshTokenWithoutAccessToken(t *testing.T) {
+	docs.Description("validation should require an access token cookie if refresh tokens are kept")
+	errs := url.Values{}
+	validateSecurityConfiguration(errs, SecurityConfig{Oidc: OpenIdConnectConfig{
+		RefreshTokenCookieName: "REFRESH",
+		RefreshTokenCookieKey:  "0123456789abcdef0123456789abcdef",
+	}})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, 1, len(errs["security.oidc.refresh_token_cookie_name"]))
+}
+
+func TestValidateDatabaseConfiguration_inmemory(t *testing.T) {
+	docs.Description("validation should accept the inmemory database without connection settings")
+	errs := url.Values{}
+	validateDatabaseConfiguration(errs, DatabaseConfig{Use: Inmemory})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateDatabaseConfiguration_unknown(t *testing.T) {
+	docs.Description("validation should catch an unsupported database type")
+	errs := url.Values{}
+	validateDatabaseConfiguration(errs, DatabaseConfig{Use: "postgres"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"must be one of inmemory, mysql, sqlite"}, errs["database.use"])
+}
+
+func TestValidateDatabaseConfiguration_mysqlIncomplete(t *testing.T) {
+	docs.Description("validation should catch missing connection settings for mysql")
+	errs := url.Values{}
+	validateDatabaseConfiguration(errs, DatabaseConfig{Use: Mysql})
+	require.Equal(t, 3, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty when using mysql"}, errs["database.username"])
+	require.Equal(t, []string{"cannot be empty when using mysql"}, errs["database.password"])
+	require.Equal(t, []string{"value '' cannot be empty when using mysql or sqlite"}, errs["database.database"])
+}
+
+func TestValidateDatabaseConfiguration_sqlite(t *testing.T) {
+	docs.Description("validation should accept sqlite with only a database file")
+	errs := url.Values{}
+	validateDatabaseConfiguration(errs, DatabaseConfig{Use: Sqlite, Database: "auth.db"})
+	require.Equal(t, 0, len(errs))
+}
+
 func createValidIdentityProviderConfiguration() IdentityProviderConfig {
 	return IdentityProviderConfig{
 		AuthorizationEndpoint: "https://example.com/auth",
@@ -298,3 +490,206 @@ func TestValidateApplicationConfigs_zeroCookieExpiry(t *testing.T) {
 	require.Equal(t, 1, len(errs))
 	require.Equal(t, []string{"value '0s' must be positive, try '1h' or '5m'"}, errs["application_configs.test-application-config.cookie_expiry"])
 }
+
+func TestValidateApplicationConfigs_invalidTokenEndpointAuthMethod(t *testing.T) {
+	docs.Description("validation should catch an unknown token endpoint auth method")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.TokenEndpointAuthMethod = "tls_client_auth"
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'tls_client_auth' must be one of client_secret_post, client_secret_basic, private_key_jwt"}, errs["application_configs.test-application-config.token_endpoint_auth_method"])
+}
+
+func TestValidateApplicationConfigs_privateKeyJwtMissingKey(t *testing.T) {
+	docs.Description("validation should require a client assertion key for private_key_jwt")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.TokenEndpointAuthMethod = PrivateKeyJwt
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"cannot be empty if token_endpoint_auth_method is private_key_jwt"}, errs["application_configs.test-application-config.client_assertion_key_PEM"])
+}
+
+func TestValidateApplicationConfigs_privateKeyJwtInvalidKey(t *testing.T) {
+	docs.Description("validation should catch a client assertion key that is not a private key")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.TokenEndpointAuthMethod = PrivateKeyJwt
+	config.ClientAssertionKeyPEM = "not a key"
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"failed to parse RSA or EC private key in PEM format: invalid key: Key must be a PEM encoded PKCS1 or PKCS8 key"}, errs["application_configs.test-application-config.client_assertion_key_PEM"])
+}
+
+func TestValidateApplicationConfigs_privateKeyJwtValid(t *testing.T) {
+	docs.Description("validation should accept private_key_jwt with an EC key and no client secret, and return the parsed key")
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.ClientSecret = ""
+	config.TokenEndpointAuthMethod = PrivateKeyJwt
+	config.ClientAssertionKeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	parsed := validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 0, len(errs))
+	require.True(t, key.Equal(parsed["test-application-config"]))
+}
+
+func TestValidateApplicationConfigs_invalidPushedAuthorizationRequests(t *testing.T) {
+	docs.Description("validation should catch an unknown pushed authorization request mode")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.PushedAuthorizationRequests = "always"
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'always' must be one of off, preferred, required"}, errs["application_configs.test-application-config.pushed_authorization_requests"])
+}
+
+func TestValidatePushedAuthorizationRequests_missingEndpoint(t *testing.T) {
+	docs.Description("validation should require a pushed authorization request endpoint if an application uses it")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.PushedAuthorizationRequests = ParRequired
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validatePushedAuthorizationRequests(errs, configs, IdentityProviderConfig{}, nil)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty, application_configs.test-application-config uses pushed authorization requests"}, errs["identity_provider.pushed_authorization_request_endpoint"])
+
+	errs = url.Values{}
+	validatePushedAuthorizationRequests(errs, configs, IdentityProviderConfig{Discovered: &DiscoveryDocument{ParEndpoint: "https://idp.example.com/par"}}, nil)
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateApplicationConfigs_invalidResponseMode(t *testing.T) {
+	docs.Description("validation should catch an unknown response mode")
+	errs := url.Values{}
+	config := createValidApplicationConfig()
+	config.ResponseMode = "fragment"
+	configs := map[string]ApplicationConfig{"test-application-config": config}
+	validateApplicationConfigurations(errs, configs)
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'fragment' must be one of query, form_post"}, errs["application_configs.test-application-config.response_mode"])
+}
+
+func TestValidateServerSideSessions_missingCookieName(t *testing.T) {
+	docs.Description("validation should require a session cookie name if an application uses server-side sessions")
+	errs := url.Values{}
+	validateServerSideSessions(errs, map[string]ApplicationConfig{"app": {ServerSideSessions: true}}, OpenIdConnectConfig{IdTokenCookieName: "JWT"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value '' cannot be empty, because application_configs.app.server_side_sessions is set"}, errs["security.oidc.session_cookie_name"])
+}
+
+func TestValidateServerSideSessions_cookieNameClash(t *testing.T) {
+	docs.Description("validation should reject a session cookie name that is also used for a token cookie")
+	errs := url.Values{}
+	validateServerSideSessions(errs, map[string]ApplicationConfig{}, OpenIdConnectConfig{IdTokenCookieName: "JWT", AccessTokenCookieName: "AUTH", SessionCookieName: "AUTH"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'AUTH' must differ from the names of the token cookies"}, errs["security.oidc.session_cookie_name"])
+}
+
+func TestValidateServerSideSessions_valid(t *testing.T) {
+	docs.Description("validation should accept a session cookie name prefix with application names usable in cookie names")
+	errs := url.Values{}
+	validateServerSideSessions(errs, map[string]ApplicationConfig{"bff-service": {ServerSideSessions: true, CookieName: "JWT"}}, OpenIdConnectConfig{IdTokenCookieName: "JWT", SessionCookieName: "SESSION"})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateServerSideSessions_applicationNameNotUsableInCookie(t *testing.T) {
+	docs.Description("validation should reject application names that cannot be part of the session cookie name")
+	errs := url.Values{}
+	validateServerSideSessions(errs, map[string]ApplicationConfig{"bff service": {ServerSideSessions: true}}, OpenIdConnectConfig{SessionCookieName: "SESSION"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'true' requires an application name that can be used in a cookie name"}, errs["application_configs.bff service.server_side_sessions"])
+}
+
+func TestValidateServerSideSessions_applicationCookieNameClash(t *testing.T) {
+	docs.Description("validation should reject a session cookie name of an application that is also used for a token cookie")
+	errs := url.Values{}
+	validateServerSideSessions(errs, map[string]ApplicationConfig{"app": {ServerSideSessions: true, CookieName: "SESSION_app"}}, OpenIdConnectConfig{SessionCookieName: "SESSION"})
+	require.Equal(t, 1, len(errs))
+	require.Equal(t, []string{"value 'SESSION' must not lead to a session cookie name for application_configs.app that is also used for a token cookie"}, errs["security.oidc.session_cookie_name"])
+}
+
+func TestValidateServiceClients_valid(t *testing.T) {
+	docs.Description("validation should accept service clients with an api key hash or a client id")
+	errs := url.Values{}
+	validateServiceClients(errs, map[string]ServiceClientConfig{
+		"payment-service": {ApiKeySha256: "2569434b250b9cebde6d45797fed068370aaf657e56c0fc21e9fca2c5107fb80", Scopes: []ServiceScope{ScopeUserinfo}},
+		"mail-service":    {ClientId: "mail-service-client", Scopes: []ServiceScope{ScopeUserinfo}},
+	}, map[string]ApplicationConfig{"example-service": {ClientId: "example-client"}})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateServiceClients_invalid(t *testing.T) {
+	docs.Description("validation should reject service clients that cannot authenticate, or cannot be told apart")
+	errs := url.Values{}
+	validateServiceClients(errs, map[string]ServiceClientConfig{
+		"a-service": {ApiKeySha256: "not-a-hash"},
+		"b-service": {Scopes: []ServiceScope{"everything"}},
+		"c-service": {ApiKeySha256: "2569434b250b9cebde6d45797fed068370aaf657e56c0fc21e9fca2c5107fb80", ClientId: "example-client"},
+		"d-service": {ApiKeySha256: "2569434b250b9cebde6d45797fed068370aaf657e56c0fc21e9fca2c5107fb80", ClientId: "shared-client"},
+		"e-service": {ClientId: "shared-client"},
+	}, map[string]ApplicationConfig{"example-service": {ClientId: "example-client"}})
+	require.Equal(t, 6, len(errs))
+	require.Equal(t, []string{"value 'not-a-hash' must be the sha256 hash of the api key, as 64 lower case hex digits"}, errs["security.service_clients.a-service.api_key_sha256"])
+	require.Equal(t, []string{"needs api_key_sha256 or client_id, or the service cannot authenticate"}, errs["security.service_clients.b-service"])
+	require.Equal(t, []string{"value 'everything' must be one of userinfo"}, errs["security.service_clients.b-service.scopes[0]"])
+	require.Equal(t, []string{"value 'example-client' is also the client_id of application example-service"}, errs["security.service_clients.c-service.client_id"])
+	require.Equal(t, []string{"value '2569434b250b9cebde6d45797fed068370aaf657e56c0fc21e9fca2c5107fb80' is also used by service client c-service"}, errs["security.service_clients.d-service.api_key_sha256"])
+	require.Equal(t, []string{"value 'shared-client' is also used by service client d-service"}, errs["security.service_clients.e-service.client_id"])
+}
+
+func TestValidateIdentityProviderConfiguration_adminApi(t *testing.T) {
+	docs.Description("validation should require a subject placeholder and a token for the admin api")
+	errs := url.Values{}
+	validateIdentityProviderConfiguration(errs, IdentityProviderConfig{AdminUserInfoEndpoint: "https://identity.example.com/api/users"})
+	require.Equal(t, []string{"value 'https://identity.example.com/api/users' must contain {subject}"}, errs["identity_provider.admin_user_info_endpoint"])
+	require.Equal(t, []string{"cannot be empty if admin_user_info_endpoint is set"}, errs["identity_provider.admin_api_token"])
+}
+
+func TestValidateRoleMappings_valid(t *testing.T) {
+	docs.Description("validation should accept role mappings by group or by claim value")
+	errs := url.Values{}
+	validateRoleMappings(errs, []RoleMappingConfig{
+		{Role: "admin", Groups: []string{"g1"}, Subjects: []string{"101"}},
+		{Role: "badge-printer", Claim: "department", Values: []string{"registration"}, Applications: []string{"example-service"}},
+	}, map[string]ApplicationConfig{"example-service": {ClientId: "example-client"}})
+	require.Equal(t, 0, len(errs))
+}
+
+func TestValidateRoleMappings_invalid(t *testing.T) {
+	docs.Description("validation should reject role mappings that are incomplete or refer to unknown applications")
+	errs := url.Values{}
+	validateRoleMappings(errs, []RoleMappingConfig{
+		{Role: "not a role", Groups: []string{"g1"}},
+		{Role: "nothing"},
+		{Role: "no-values", Claim: "department"},
+		{Role: "no-claim", Groups: []string{"g1"}, Values: []string{"registration"}},
+		{Role: "unknown-app", Groups: []string{"g1"}, Applications: []string{"unknown-service"}},
+	}, map[string]ApplicationConfig{"example-service": {ClientId: "example-client"}})
+	require.Equal(t, 5, len(errs))
+	require.Equal(t, []string{"value 'not a role' must be a role name without spaces"}, errs["security.oidc.role_mappings[0].role"])
+	require.Equal(t, []string{"needs groups or a claim, or it never grants the role"}, errs["security.oidc.role_mappings[1]"])
+	require.Equal(t, []string{"cannot be empty if claim is set"}, errs["security.oidc.role_mappings[2].values"])
+	require.Equal(t, []string{"cannot be empty if values are set"}, errs["security.oidc.role_mappings[3].claim"])
+	require.Equal(t, []string{"value 'unknown-service' must be the name of an application in application_configs"}, errs["security.oidc.role_mappings[4].applications[0]"])
+}
+
+func TestValidateExtraClaims(t *testing.T) {
+	docs.Description("validation should reject extra claims that are empty, duplicate, or always in the userinfo response")
+	errs := url.Values{}
+	validateExtraClaims(errs, []string{"locale", "", "email", "locale", "badge_number"})
+	require.Equal(t, 3, len(errs))
+	require.Equal(t, []string{"cannot be empty"}, errs["security.oidc.extra_claims[1]"])
+	require.Equal(t, []string{"value 'email' is always part of the userinfo response"}, errs["security.oidc.extra_claims[2]"])
+	require.Equal(t, []string{"value 'locale' is listed more than once"}, errs["security.oidc.extra_claims[3]"])
+}
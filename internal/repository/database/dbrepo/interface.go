@@ -2,6 +2,7 @@ package dbrepo
 
 import (
 	"context"
+	"time"
 
 	"github.com/eurofurence/reg-auth-service/internal/entity"
 )
@@ -10,9 +11,39 @@ type Repository interface {
 	Open() error
 	Close()
 
+	Migrate() error
+	// Ping checks that the database can be reached, used by the readiness check.
+	Ping(ctx context.Context) error
+
 	AddAuthRequest(ctx context.Context, ar *entity.AuthRequest) error
 	GetAuthRequestByState(ctx context.Context, state string) (*entity.AuthRequest, error)
 	DeleteAuthRequestByState(ctx context.Context, state string) error
+	// ConsumeAuthRequestByState loads and removes an auth request in one atomic step,
+	// so each state can only be redeemed once, even with concurrent requests.
+	//
+	// An auth request issued for a different purpose is left alone, and reported as not present.
+	ConsumeAuthRequestByState(ctx context.Context, state string, purpose string) (*entity.AuthRequest, error)
 
 	PruneAuthRequests(ctx context.Context) (uint, error)
+	// CountAuthRequests counts the auth requests that have not expired yet.
+	CountAuthRequests(ctx context.Context) (int64, error)
+
+	AddRevokedSession(ctx context.Context, rs *entity.RevokedSession) error
+	// IsSessionRevoked checks a token with the given sid, sub and iat claims against the recorded revocations.
+	//
+	// A token is revoked if its session id was revoked, or if its subject was revoked after the token was issued.
+	IsSessionRevoked(ctx context.Context, sessionId string, subject string, issuedAt time.Time) (bool, error)
+
+	// IsLogoutTokenUsed checks whether a revocation was already recorded for the logout token with the given jti.
+	IsLogoutTokenUsed(ctx context.Context, logoutTokenId string) (bool, error)
+
+	PruneRevokedSessions(ctx context.Context) (uint, error)
+
+	AddSession(ctx context.Context, s *entity.Session) error
+	GetSessionByIdHash(ctx context.Context, idHash string) (*entity.Session, error)
+	// UpdateSessionTokens replaces the tokens of an existing session, e.g. after they were refreshed.
+	UpdateSessionTokens(ctx context.Context, s *entity.Session) error
+	DeleteSessionByIdHash(ctx context.Context, idHash string) error
+
+	PruneSessions(ctx context.Context) (uint, error)
 }
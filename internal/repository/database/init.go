@@ -2,12 +2,14 @@ package database
 
 import (
 	"context"
+	"errors"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"time"
 
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/repository/database/dbrepo"
 	"github.com/eurofurence/reg-auth-service/internal/repository/database/inmemorydb"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database/sqldb"
 )
 
 var (
@@ -16,6 +18,9 @@ var (
 	pruneStop        chan bool
 )
 
+// PruneListener is called after each periodic prune with the kind of records, e.g. to record metrics.
+var PruneListener func(kind string, count uint, err error)
+
 // only exported so you can use it in test code - use Open()
 func SetRepository(repository dbrepo.Repository) {
 	ActiveRepository = repository
@@ -23,9 +28,16 @@ func SetRepository(repository dbrepo.Repository) {
 
 func Open() error {
 	var r dbrepo.Repository
-	aulogging.Logger.NoCtx().Info().Print("Opening inmemory database...")
-	r = inmemorydb.Create()
-	r.Open()
+	if config.DatabaseUse() == config.Mysql || config.DatabaseUse() == config.Sqlite {
+		aulogging.Logger.NoCtx().Info().Printf("Opening %s database...", config.DatabaseUse())
+		r = sqldb.Create()
+	} else {
+		aulogging.Logger.NoCtx().Info().Print("Opening inmemory database...")
+		r = inmemorydb.Create()
+	}
+	if err := r.Open(); err != nil {
+		return err
+	}
 	pruneTicker = time.NewTicker(config.AuthRequestTimeout())
 	pruneStop = make(chan bool)
 	go func() {
@@ -35,7 +47,12 @@ func Open() error {
 				pruneTicker.Stop()
 				return
 			case <-pruneTicker.C:
-				r.PruneAuthRequests(context.Background())
+				count, err := r.PruneAuthRequests(context.Background())
+				notifyPruneListener("auth_requests", count, err)
+				count, err = r.PruneRevokedSessions(context.Background())
+				notifyPruneListener("revoked_sessions", count, err)
+				count, err = r.PruneSessions(context.Background())
+				notifyPruneListener("sessions", count, err)
 			}
 		}
 	}()
@@ -43,6 +60,21 @@ func Open() error {
 	return nil
 }
 
+func notifyPruneListener(kind string, count uint, err error) {
+	if PruneListener != nil {
+		PruneListener(kind, count, err)
+	}
+}
+
+// CountAuthRequests counts the pending auth requests in the open database.
+func CountAuthRequests(ctx context.Context) (int64, error) {
+	repository := ActiveRepository
+	if repository == nil {
+		return 0, errors.New("database not open")
+	}
+	return repository.CountAuthRequests(ctx)
+}
+
 func Close() {
 	aulogging.Logger.NoCtx().Info().Print("Closing database...")
 	pruneStop <- true
@@ -50,6 +82,11 @@ func Close() {
 	SetRepository(nil)
 }
 
+func Migrate() error {
+	aulogging.Logger.NoCtx().Info().Print("Migrating database...")
+	return GetRepository().Migrate()
+}
+
 func GetRepository() dbrepo.Repository {
 	if ActiveRepository == nil {
 		aulogging.Logger.NoCtx().Fatal().Print("You must Open() the database before using it. This is an error in your implementation.")
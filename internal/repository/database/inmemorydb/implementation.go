@@ -2,6 +2,7 @@ package inmemorydb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"sync"
@@ -13,6 +14,11 @@ import (
 
 type InMemoryRepository struct {
 	authRequests sync.Map
+
+	revokedSessionsMu sync.RWMutex
+	revokedSessions   []entity.RevokedSession
+
+	sessions sync.Map
 }
 
 func Create() dbrepo.Repository {
@@ -21,11 +27,29 @@ func Create() dbrepo.Repository {
 
 func (r *InMemoryRepository) Open() error {
 	r.authRequests = sync.Map{}
+	r.revokedSessions = make([]entity.RevokedSession, 0)
+	r.sessions = sync.Map{}
 	return nil
 }
 
 func (r *InMemoryRepository) Close() {
 	r.authRequests = sync.Map{}
+	r.revokedSessions = nil
+	r.sessions = sync.Map{}
+}
+
+func (r *InMemoryRepository) Migrate() error {
+	// nothing to do
+	return nil
+}
+
+func (r *InMemoryRepository) Ping(ctx context.Context) error {
+	r.revokedSessionsMu.RLock()
+	defer r.revokedSessionsMu.RUnlock()
+	if r.revokedSessions == nil {
+		return errors.New("in memory database is not open")
+	}
+	return nil
 }
 
 func (r *InMemoryRepository) AddAuthRequest(ctx context.Context, ar *entity.AuthRequest) error {
@@ -62,6 +86,25 @@ func (r *InMemoryRepository) DeleteAuthRequestByState(ctx context.Context, state
 	}
 }
 
+func (r *InMemoryRepository) ConsumeAuthRequestByState(ctx context.Context, state string, purpose string) (*entity.AuthRequest, error) {
+	ar, ok := r.authRequests.Load(state)
+	if ok && ar.(*entity.AuthRequest).Purpose != purpose {
+		// not ours to consume
+		ok = false
+	}
+	// only the caller that actually removes the entry may use it, this makes concurrent consumption safe
+	if ok && r.authRequests.CompareAndDelete(state, ar) {
+		if ar.(*entity.AuthRequest).ExpiresAt.Before(time.Now()) {
+			return nil, fmt.Errorf("cannot consume auth request '%s' - already expired", state)
+		} else {
+			// no need to copy, the entity is no longer referenced by the in-memory db
+			return ar.(*entity.AuthRequest), nil
+		}
+	} else {
+		return nil, fmt.Errorf("cannot consume auth request '%s' - not present", state)
+	}
+}
+
 func (r *InMemoryRepository) PruneAuthRequests(ctx context.Context) (uint, error) {
 	pruneCount := uint(0)
 
@@ -77,3 +120,134 @@ func (r *InMemoryRepository) PruneAuthRequests(ctx context.Context) (uint, error
 
 	return pruneCount, nil
 }
+
+func (r *InMemoryRepository) CountAuthRequests(ctx context.Context) (int64, error) {
+	count := int64(0)
+	now := time.Now()
+	r.authRequests.Range(func(_, ar interface{}) bool {
+		if !ar.(*entity.AuthRequest).ExpiresAt.Before(now) {
+			count++
+		}
+		return true
+	})
+	return count, nil
+}
+
+func (r *InMemoryRepository) AddRevokedSession(ctx context.Context, rs *entity.RevokedSession) error {
+	r.revokedSessionsMu.Lock()
+	defer r.revokedSessionsMu.Unlock()
+
+	// copy the entity, so later modifications won't also modify it in the in-memory db
+	r.revokedSessions = append(r.revokedSessions, *rs)
+	return nil
+}
+
+func (r *InMemoryRepository) IsSessionRevoked(ctx context.Context, sessionId string, subject string, issuedAt time.Time) (bool, error) {
+	r.revokedSessionsMu.RLock()
+	defer r.revokedSessionsMu.RUnlock()
+
+	for _, rs := range r.revokedSessions {
+		if rs.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		if rs.SessionId != "" {
+			if rs.SessionId == sessionId {
+				return true, nil
+			}
+		} else if rs.Subject != "" && rs.Subject == subject && !issuedAt.After(rs.RevokedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *InMemoryRepository) IsLogoutTokenUsed(ctx context.Context, logoutTokenId string) (bool, error) {
+	r.revokedSessionsMu.RLock()
+	defer r.revokedSessionsMu.RUnlock()
+
+	for _, rs := range r.revokedSessions {
+		if rs.LogoutTokenId == logoutTokenId && !rs.ExpiresAt.Before(time.Now()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *InMemoryRepository) PruneRevokedSessions(ctx context.Context) (uint, error) {
+	r.revokedSessionsMu.Lock()
+	defer r.revokedSessionsMu.Unlock()
+
+	aulogging.Logger.Ctx(ctx).Info().Print("Pruning revoked sessions ...")
+	remaining := make([]entity.RevokedSession, 0, len(r.revokedSessions))
+	for _, rs := range r.revokedSessions {
+		if !rs.ExpiresAt.Before(time.Now()) {
+			remaining = append(remaining, rs)
+		}
+	}
+	pruneCount := uint(len(r.revokedSessions) - len(remaining))
+	r.revokedSessions = remaining
+	aulogging.Logger.Ctx(ctx).Info().Printf("Pruned %d revoked sessions.", pruneCount)
+
+	return pruneCount, nil
+}
+
+func (r *InMemoryRepository) AddSession(ctx context.Context, s *entity.Session) error {
+	// copy the entity, so later modifications won't also modify it in the in-memory db
+	copiedEntity := *s
+	if _, loaded := r.sessions.LoadOrStore(s.IdHash, &copiedEntity); loaded {
+		return errors.New("cannot add session - already present")
+	}
+	return nil
+}
+
+func (r *InMemoryRepository) GetSessionByIdHash(ctx context.Context, idHash string) (*entity.Session, error) {
+	if s, ok := r.sessions.Load(idHash); ok {
+		if s.(*entity.Session).ExpiresAt.Before(time.Now()) {
+			r.sessions.Delete(idHash)
+			return nil, errors.New("cannot get session - already expired")
+		}
+		// copy the entity, so later modifications won't also modify it in the in-memory db
+		copiedEntity := *s.(*entity.Session)
+		return &copiedEntity, nil
+	}
+	return nil, errors.New("cannot get session - not present")
+}
+
+func (r *InMemoryRepository) UpdateSessionTokens(ctx context.Context, s *entity.Session) error {
+	existing, ok := r.sessions.Load(s.IdHash)
+	if !ok {
+		return errors.New("cannot update session - not present")
+	}
+	// replace instead of modifying, so concurrent readers never see a partial update
+	updated := *existing.(*entity.Session)
+	updated.IdToken = s.IdToken
+	updated.AccessToken = s.AccessToken
+	updated.RefreshToken = s.RefreshToken
+	if !r.sessions.CompareAndSwap(s.IdHash, existing, &updated) {
+		return errors.New("cannot update session - concurrently modified or deleted")
+	}
+	return nil
+}
+
+func (r *InMemoryRepository) DeleteSessionByIdHash(ctx context.Context, idHash string) error {
+	if _, ok := r.sessions.LoadAndDelete(idHash); ok {
+		return nil
+	}
+	return errors.New("cannot delete session - not present")
+}
+
+func (r *InMemoryRepository) PruneSessions(ctx context.Context) (uint, error) {
+	pruneCount := uint(0)
+
+	aulogging.Logger.Ctx(ctx).Info().Print("Pruning sessions ...")
+	r.sessions.Range(func(idHash, s interface{}) bool {
+		if s.(*entity.Session).ExpiresAt.Before(time.Now()) {
+			r.sessions.Delete(idHash)
+			pruneCount++
+		}
+		return true
+	})
+	aulogging.Logger.Ctx(ctx).Info().Printf("Pruned %d sessions.", pruneCount)
+
+	return pruneCount, nil
+}
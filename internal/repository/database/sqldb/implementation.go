@@ -0,0 +1,319 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database/dbrepo"
+)
+
+// SqlRepository keeps auth requests in a relational database, so pending logins survive
+// restarts and can be shared between multiple instances of this service.
+//
+// Production deployments use mysql/mariadb, sqlite is useful for local runs and tests.
+type SqlRepository struct {
+	db *gorm.DB
+}
+
+func Create() dbrepo.Repository {
+	return &SqlRepository{}
+}
+
+func (r *SqlRepository) Open() error {
+	switch config.DatabaseUse() {
+	case config.Mysql:
+		return r.open(mysql.Open(config.DatabaseMysqlConnectString()), false)
+	case config.Sqlite:
+		return r.open(sqlite.Open(config.DatabaseSqliteConnectString()), true)
+	default:
+		return fmt.Errorf("unsupported database type '%s' for sql repository", config.DatabaseUse())
+	}
+}
+
+func (r *SqlRepository) open(dialector gorm.Dialector, singleConnection bool) error {
+	gormConfig := &gorm.Config{
+		Logger:         &gormLogger{},
+		TranslateError: true,
+	}
+
+	db, err := gorm.Open(dialector, gormConfig)
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to open database: %s", err.Error())
+		return err
+	}
+
+	sqlDb, err := db.DB()
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to obtain database connection pool: %s", err.Error())
+		return err
+	}
+	if singleConnection {
+		// sqlite does not handle concurrent writers well, and each connection to :memory: is a separate database
+		sqlDb.SetMaxOpenConns(1)
+	} else {
+		sqlDb.SetMaxOpenConns(100)
+		sqlDb.SetMaxIdleConns(50)
+		sqlDb.SetConnMaxLifetime(time.Minute * 30)
+		sqlDb.SetConnMaxIdleTime(time.Minute * 5)
+	}
+
+	r.db = db
+	return nil
+}
+
+func (r *SqlRepository) Close() {
+	if r.db == nil {
+		return
+	}
+	sqlDb, err := r.db.DB()
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to obtain database connection pool during close: %s", err.Error())
+		return
+	}
+	if err := sqlDb.Close(); err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to close database: %s", err.Error())
+	}
+	r.db = nil
+}
+
+func (r *SqlRepository) Migrate() error {
+	err := r.db.AutoMigrate(
+		&entity.AuthRequest{},
+		&entity.RevokedSession{},
+		&entity.Session{},
+	)
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to migrate database schema: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (r *SqlRepository) Ping(ctx context.Context) error {
+	if r.db == nil {
+		return errors.New("database is not open")
+	}
+	sqlDb, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.PingContext(ctx)
+}
+
+func (r *SqlRepository) AddAuthRequest(ctx context.Context, ar *entity.AuthRequest) error {
+	// copy the entity, we always store timestamps in UTC so comparisons work in any database
+	copiedEntity := *ar
+	copiedEntity.ExpiresAt = ar.ExpiresAt.UTC()
+	err := r.db.WithContext(ctx).Create(&copiedEntity).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("cannot add auth request '%s' - already present", ar.State)
+	} else if err != nil {
+		return fmt.Errorf("cannot add auth request '%s' - database error: %s", ar.State, err.Error())
+	}
+	return nil
+}
+
+func (r *SqlRepository) GetAuthRequestByState(ctx context.Context, state string) (*entity.AuthRequest, error) {
+	var ar entity.AuthRequest
+	err := r.db.WithContext(ctx).Where("state = ?", state).Take(&ar).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("cannot get auth request '%s' - not present", state)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot get auth request '%s' - database error: %s", state, err.Error())
+	}
+
+	if ar.ExpiresAt.Before(time.Now()) {
+		_ = r.db.WithContext(ctx).Where("state = ?", state).Delete(&entity.AuthRequest{}).Error
+		return nil, fmt.Errorf("cannot get auth request '%s' - already expired", state)
+	}
+	return &ar, nil
+}
+
+func (r *SqlRepository) DeleteAuthRequestByState(ctx context.Context, state string) error {
+	result := r.db.WithContext(ctx).Where("state = ?", state).Delete(&entity.AuthRequest{})
+	if result.Error != nil {
+		return fmt.Errorf("cannot delete auth request '%s' - database error: %s", state, result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("cannot delete auth request '%s' - not present", state)
+	}
+	return nil
+}
+
+func (r *SqlRepository) ConsumeAuthRequestByState(ctx context.Context, state string, purpose string) (*entity.AuthRequest, error) {
+	var ar entity.AuthRequest
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state = ? AND purpose = ?", state, purpose).Take(&ar).Error; err != nil {
+			return err
+		}
+		// only the caller that actually removes the row may use it, this makes concurrent consumption safe
+		result := tx.Where("state = ? AND purpose = ?", state, purpose).Delete(&entity.AuthRequest{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("cannot consume auth request '%s' - not present", state)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot consume auth request '%s' - database error: %s", state, err.Error())
+	}
+
+	if ar.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("cannot consume auth request '%s' - already expired", state)
+	}
+	return &ar, nil
+}
+
+func (r *SqlRepository) PruneAuthRequests(ctx context.Context) (uint, error) {
+	aulogging.Logger.Ctx(ctx).Info().Print("Pruning auth requests ...")
+	result := r.db.WithContext(ctx).Where("expires_at < ?", time.Now().UTC()).Delete(&entity.AuthRequest{})
+	if result.Error != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(result.Error).Printf("Failed to prune auth requests: %s", result.Error.Error())
+		return 0, result.Error
+	}
+	pruneCount := uint(result.RowsAffected)
+	aulogging.Logger.Ctx(ctx).Info().Printf("Pruned %d auth requests.", pruneCount)
+
+	return pruneCount, nil
+}
+
+func (r *SqlRepository) CountAuthRequests(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&entity.AuthRequest{}).Where("expires_at >= ?", time.Now().UTC()).Count(&count).Error
+	return count, err
+}
+
+func (r *SqlRepository) AddRevokedSession(ctx context.Context, rs *entity.RevokedSession) error {
+	// copy the entity, we always store timestamps in UTC so comparisons work in any database
+	copiedEntity := *rs
+	copiedEntity.ID = 0
+	copiedEntity.RevokedAt = rs.RevokedAt.UTC()
+	copiedEntity.ExpiresAt = rs.ExpiresAt.UTC()
+	err := r.db.WithContext(ctx).Create(&copiedEntity).Error
+	if err != nil {
+		return fmt.Errorf("cannot add revoked session sid='%s' sub='%s' - database error: %s", rs.SessionId, rs.Subject, err.Error())
+	}
+	return nil
+}
+
+func (r *SqlRepository) IsSessionRevoked(ctx context.Context, sessionId string, subject string, issuedAt time.Time) (bool, error) {
+	var count int64
+	query := r.db.WithContext(ctx).Model(&entity.RevokedSession{}).Where("expires_at >= ?", time.Now().UTC())
+	if sessionId != "" {
+		query = query.Where(
+			r.db.Where("session_id = ?", sessionId).
+				Or("session_id = '' AND subject = ? AND revoked_at >= ?", subject, issuedAt.UTC()),
+		)
+	} else {
+		query = query.Where("session_id = '' AND subject = ? AND revoked_at >= ?", subject, issuedAt.UTC())
+	}
+	err := query.Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("cannot check revoked sessions for sid='%s' sub='%s' - database error: %s", sessionId, subject, err.Error())
+	}
+	return count > 0, nil
+}
+
+func (r *SqlRepository) IsLogoutTokenUsed(ctx context.Context, logoutTokenId string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&entity.RevokedSession{}).
+		Where("logout_token_id = ? AND expires_at >= ?", logoutTokenId, time.Now().UTC()).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("cannot check logout token jti='%s' - database error: %s", logoutTokenId, err.Error())
+	}
+	return count > 0, nil
+}
+
+func (r *SqlRepository) PruneRevokedSessions(ctx context.Context) (uint, error) {
+	aulogging.Logger.Ctx(ctx).Info().Print("Pruning revoked sessions ...")
+	result := r.db.WithContext(ctx).Where("expires_at < ?", time.Now().UTC()).Delete(&entity.RevokedSession{})
+	if result.Error != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(result.Error).Printf("Failed to prune revoked sessions: %s", result.Error.Error())
+		return 0, result.Error
+	}
+	pruneCount := uint(result.RowsAffected)
+	aulogging.Logger.Ctx(ctx).Info().Printf("Pruned %d revoked sessions.", pruneCount)
+
+	return pruneCount, nil
+}
+
+func (r *SqlRepository) AddSession(ctx context.Context, s *entity.Session) error {
+	// copy the entity, we always store timestamps in UTC so comparisons work in any database
+	copiedEntity := *s
+	copiedEntity.ExpiresAt = s.ExpiresAt.UTC()
+	err := r.db.WithContext(ctx).Create(&copiedEntity).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return errors.New("cannot add session - already present")
+	} else if err != nil {
+		return fmt.Errorf("cannot add session - database error: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *SqlRepository) GetSessionByIdHash(ctx context.Context, idHash string) (*entity.Session, error) {
+	var s entity.Session
+	err := r.db.WithContext(ctx).Where("id_hash = ?", idHash).Take(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errors.New("cannot get session - not present")
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot get session - database error: %s", err.Error())
+	}
+
+	if s.ExpiresAt.Before(time.Now()) {
+		_ = r.db.WithContext(ctx).Where("id_hash = ?", idHash).Delete(&entity.Session{}).Error
+		return nil, errors.New("cannot get session - already expired")
+	}
+	return &s, nil
+}
+
+func (r *SqlRepository) UpdateSessionTokens(ctx context.Context, s *entity.Session) error {
+	result := r.db.WithContext(ctx).Model(&entity.Session{}).Where("id_hash = ?", s.IdHash).Updates(map[string]interface{}{
+		"id_token":      s.IdToken,
+		"access_token":  s.AccessToken,
+		"refresh_token": s.RefreshToken,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("cannot update session - database error: %s", result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("cannot update session - not present")
+	}
+	return nil
+}
+
+func (r *SqlRepository) DeleteSessionByIdHash(ctx context.Context, idHash string) error {
+	result := r.db.WithContext(ctx).Where("id_hash = ?", idHash).Delete(&entity.Session{})
+	if result.Error != nil {
+		return fmt.Errorf("cannot delete session - database error: %s", result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("cannot delete session - not present")
+	}
+	return nil
+}
+
+func (r *SqlRepository) PruneSessions(ctx context.Context) (uint, error) {
+	aulogging.Logger.Ctx(ctx).Info().Print("Pruning sessions ...")
+	result := r.db.WithContext(ctx).Where("expires_at < ?", time.Now().UTC()).Delete(&entity.Session{})
+	if result.Error != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(result.Error).Printf("Failed to prune sessions: %s", result.Error.Error())
+		return 0, result.Error
+	}
+	pruneCount := uint(result.RowsAffected)
+	aulogging.Logger.Ctx(ctx).Info().Printf("Pruned %d sessions.", pruneCount)
+
+	return pruneCount, nil
+}
@@ -0,0 +1,419 @@
+package sqldb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+var (
+	cut *SqlRepository
+)
+
+func TestMain(m *testing.M) {
+	aulogging.SetupNoLoggerForTesting()
+	cut = &SqlRepository{}
+	code := m.Run()
+	os.Exit(code)
+}
+
+func tstSetup() {
+	if err := cut.open(sqlite.Open(":memory:"), true); err != nil {
+		panic(err)
+	}
+	if err := cut.Migrate(); err != nil {
+		panic(err)
+	}
+}
+
+func tstShutdown() {
+	cut.Close()
+}
+
+func TestOpenClose(t *testing.T) {
+	docs.Description("low level test for open() and Close()")
+	cut2 := &SqlRepository{}
+	err := cut2.open(sqlite.Open(":memory:"), true)
+	require.Nil(t, err)
+	require.NotNil(t, cut2.db)
+	cut2.Close()
+	require.Nil(t, cut2.db)
+}
+
+func TestAddAuthRequest(t *testing.T) {
+	docs.Description("it should be possible to add an auth request and then retrieve it again")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state"
+	ar := &entity.AuthRequest{
+		Application:      "example-service",
+		State:            state,
+		ExpiresAt:        time.Now().Add(time.Hour),
+		DropOffUrl:       "https://example.com/app/?foo=bar",
+		PkceCodeVerifier: "some-verifier",
+	}
+	err := cut.AddAuthRequest(context.TODO(), ar)
+	require.Nil(t, err, "unexpected error during add")
+
+	ar2, err := cut.GetAuthRequestByState(context.TODO(), state)
+	require.Nil(t, err, "unexpected error during get")
+	require.True(t, ar.ExpiresAt.Equal(ar2.ExpiresAt), "comparison failure for expiry")
+	ar2.ExpiresAt = ar.ExpiresAt
+	require.EqualValues(t, *ar, *ar2, "comparison failure")
+}
+
+func TestAddAuthRequestStateAlreadyPresent(t *testing.T) {
+	docs.Description("adding an auth request with a state already present should fail")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state"
+	ar := &entity.AuthRequest{State: state, ExpiresAt: time.Now().Add(time.Hour)}
+	err := cut.AddAuthRequest(context.TODO(), ar)
+	require.Nil(t, err, "unexpected error during add")
+
+	err2 := cut.AddAuthRequest(context.TODO(), ar)
+	require.NotNil(t, err2, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot add auth request '%s' - already present", state), err2.Error(), "unexpected error message")
+}
+
+func TestGetAuthRequestByStateNotFound(t *testing.T) {
+	docs.Description("retrieving a nonexistent auth request should fail")
+	tstSetup()
+	defer tstShutdown()
+	state := "inexistent-state"
+	ar, err := cut.GetAuthRequestByState(context.TODO(), state)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot get auth request '%s' - not present", state), err.Error(), "unexpected error message")
+	require.Nil(t, ar, "result entity should be nil")
+}
+
+func TestGetAuthRequestByStateExpired(t *testing.T) {
+	docs.Description("retrieving an expired auth request should fail and remove it")
+	tstSetup()
+	defer tstShutdown()
+	state := "expired-state"
+	err := cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: state, ExpiresAt: time.Now().Add(-time.Minute)})
+	require.Nil(t, err, "unexpected error during add")
+
+	ar, err := cut.GetAuthRequestByState(context.TODO(), state)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot get auth request '%s' - already expired", state), err.Error(), "unexpected error message")
+	require.Nil(t, ar, "result entity should be nil")
+
+	_, err = cut.GetAuthRequestByState(context.TODO(), state)
+	require.Equal(t, fmt.Sprintf("cannot get auth request '%s' - not present", state), err.Error(), "unexpected error message")
+}
+
+func TestDeleteAuthRequestByState(t *testing.T) {
+	docs.Description("deleting an existing auth request should succeed and it should be gone afterwards")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state"
+	ar := &entity.AuthRequest{State: state, ExpiresAt: time.Now().Add(time.Hour)}
+	err := cut.AddAuthRequest(context.TODO(), ar)
+	require.Nil(t, err, "unexpected error during add")
+
+	err2 := cut.DeleteAuthRequestByState(context.TODO(), state)
+	require.Nil(t, err2, "unexpected error during delete")
+
+	ar2, err3 := cut.GetAuthRequestByState(context.TODO(), state)
+	require.NotNil(t, err3, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot get auth request '%s' - not present", state), err3.Error(), "unexpected error message")
+	require.Nil(t, ar2, "result entity should be nil")
+}
+
+func TestDeleteAuthRequestByStateNotFound(t *testing.T) {
+	docs.Description("deleting a nonexistent auth request should fail")
+	tstSetup()
+	defer tstShutdown()
+	state := "inexistent-state"
+	err := cut.DeleteAuthRequestByState(context.TODO(), state)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot delete auth request '%s' - not present", state), err.Error(), "unexpected error message")
+}
+
+func TestPruneAuthRequestsEmpty(t *testing.T) {
+	docs.Description("it should be possible to prune auth requests even if none are available")
+	tstSetup()
+	defer tstShutdown()
+
+	pruneCount, err := cut.PruneAuthRequests(context.TODO())
+	require.Nil(t, err, "unexpected error during prune")
+	require.Equal(t, uint(0), pruneCount, "unexpected number of pruned entities")
+}
+
+func TestPruneAuthRequestsMultipleExpired(t *testing.T) {
+	docs.Description("it should be possible to prune auth requests when multiple have expired and verify only they have been removed")
+	tstSetup()
+	defer tstShutdown()
+	expiredState1 := "test-state-1-expired"
+	expiredState3 := "test-state-3-expired"
+	_ = cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: expiredState1, ExpiresAt: time.Now().Add(-time.Hour)})
+	_ = cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: "test-state-2", ExpiresAt: time.Now().Add(time.Hour)})
+	_ = cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: expiredState3, ExpiresAt: time.Now().Add(-time.Hour)})
+
+	pruneCount, err := cut.PruneAuthRequests(context.TODO())
+	require.Nil(t, err, "unexpected error during prune")
+	require.Equal(t, uint(2), pruneCount, "unexpected number of pruned entities")
+
+	ar1, err := cut.GetAuthRequestByState(context.TODO(), expiredState1)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot get auth request '%s' - not present", expiredState1), err.Error(), "unexpected error message")
+	require.Nil(t, ar1, "result entity should be nil")
+
+	ar2, err := cut.GetAuthRequestByState(context.TODO(), "test-state-2")
+	require.Nil(t, err, "unexpected error during get")
+	require.NotNil(t, ar2, "unexpired entity should still be present")
+}
+
+func TestCountAuthRequests(t *testing.T) {
+	docs.Description("counting auth requests should only count those that have not expired")
+	tstSetup()
+	defer tstShutdown()
+	cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: "test-state-1", ExpiresAt: time.Now().Add(time.Hour)})
+	cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: "test-state-2-expired", ExpiresAt: time.Now().Add(-time.Hour)})
+	cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: "test-state-3", ExpiresAt: time.Now().Add(time.Hour)})
+
+	count, err := cut.CountAuthRequests(context.TODO())
+	require.Nil(t, err, "unexpected error during count")
+	require.Equal(t, int64(2), count, "unexpected number of pending auth requests")
+}
+
+func TestPing(t *testing.T) {
+	docs.Description("ping should succeed while the database is open, and fail after it was closed")
+	tstSetup()
+	require.Nil(t, cut.Ping(context.TODO()), "unexpected error during ping")
+	tstShutdown()
+	require.NotNil(t, cut.Ping(context.TODO()), "ping should fail after close")
+}
+
+func TestConsumeAuthRequestByState(t *testing.T) {
+	docs.Description("consuming an existing auth request should return it and it should be gone afterwards")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state"
+	ar := &entity.AuthRequest{Application: "example-service", State: state, Purpose: entity.AuthRequestLogin, ExpiresAt: time.Now().Add(time.Hour)}
+	err := cut.AddAuthRequest(context.TODO(), ar)
+	require.Nil(t, err, "unexpected error during add")
+
+	ar2, err := cut.ConsumeAuthRequestByState(context.TODO(), state, entity.AuthRequestLogin)
+	require.Nil(t, err, "unexpected error during consume")
+	require.Equal(t, ar.Application, ar2.Application, "comparison failure")
+
+	ar3, err := cut.ConsumeAuthRequestByState(context.TODO(), state, entity.AuthRequestLogin)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot consume auth request '%s' - not present", state), err.Error(), "unexpected error message")
+	require.Nil(t, ar3, "result entity should be nil")
+}
+
+func TestConsumeAuthRequestByStateOtherPurpose(t *testing.T) {
+	docs.Description("consuming an auth request for a different purpose should fail and leave it alone")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state-logout"
+	err := cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: state, Purpose: entity.AuthRequestLogout, ExpiresAt: time.Now().Add(time.Hour)})
+	require.Nil(t, err, "unexpected error during add")
+
+	ar, err := cut.ConsumeAuthRequestByState(context.TODO(), state, entity.AuthRequestLogin)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot consume auth request '%s' - not present", state), err.Error(), "unexpected error message")
+	require.Nil(t, ar, "result entity should be nil")
+
+	ar2, err := cut.ConsumeAuthRequestByState(context.TODO(), state, entity.AuthRequestLogout)
+	require.Nil(t, err, "unexpected error during consume")
+	require.Equal(t, entity.AuthRequestLogout, ar2.Purpose)
+}
+
+func TestConsumeAuthRequestByStateExpired(t *testing.T) {
+	docs.Description("consuming an expired auth request should fail and remove it")
+	tstSetup()
+	defer tstShutdown()
+	state := "test-state-expired"
+	err := cut.AddAuthRequest(context.TODO(), &entity.AuthRequest{State: state, Purpose: entity.AuthRequestLogin, ExpiresAt: time.Now().Add(-time.Hour)})
+	require.Nil(t, err, "unexpected error during add")
+
+	ar, err := cut.ConsumeAuthRequestByState(context.TODO(), state, entity.AuthRequestLogin)
+	require.NotNil(t, err, "no error occurred, although it should have")
+	require.Equal(t, fmt.Sprintf("cannot consume auth request '%s' - already expired", state), err.Error(), "unexpected error message")
+	require.Nil(t, ar, "result entity should be nil")
+
+	pruneCount, err := cut.PruneAuthRequests(context.TODO())
+	require.Nil(t, err, "unexpected error during prune")
+	require.Equal(t, uint(0), pruneCount, "expired entity should already have been removed")
+}
+
+func TestIsSessionRevokedBySessionId(t *testing.T) {
+	docs.Description("tokens of a revoked session are revoked, tokens of other sessions are not")
+	tstSetup()
+	defer tstShutdown()
+	now := time.Now()
+	err := cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		SessionId: "session-1",
+		Subject:   "101",
+		RevokedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	revoked, err := cut.IsSessionRevoked(context.TODO(), "session-1", "101", now.Add(time.Minute))
+	require.Nil(t, err)
+	require.True(t, revoked, "same session must be revoked even if token is newer")
+
+	revoked, err = cut.IsSessionRevoked(context.TODO(), "session-2", "101", now.Add(-time.Minute))
+	require.Nil(t, err)
+	require.False(t, revoked, "other sessions of the same subject must not be revoked")
+}
+
+func TestIsSessionRevokedBySubject(t *testing.T) {
+	docs.Description("tokens of a revoked subject are revoked if they were issued before the revocation")
+	tstSetup()
+	defer tstShutdown()
+	now := time.Now()
+	err := cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		Subject:   "101",
+		RevokedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	revoked, err := cut.IsSessionRevoked(context.TODO(), "session-1", "101", now.Add(-time.Minute))
+	require.Nil(t, err)
+	require.True(t, revoked, "older token of subject must be revoked")
+
+	revoked, err = cut.IsSessionRevoked(context.TODO(), "session-2", "101", now.Add(time.Minute))
+	require.Nil(t, err)
+	require.False(t, revoked, "token issued after the revocation must not be revoked")
+
+	revoked, err = cut.IsSessionRevoked(context.TODO(), "session-1", "202", now.Add(-time.Minute))
+	require.Nil(t, err)
+	require.False(t, revoked, "other subjects must not be revoked")
+}
+
+func TestIsLogoutTokenUsed(t *testing.T) {
+	docs.Description("the jti of a logout token is remembered as long as its revocation")
+	tstSetup()
+	defer tstShutdown()
+	now := time.Now()
+	err := cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{Subject: "101", RevokedAt: now, ExpiresAt: now.Add(time.Hour), LogoutTokenId: "jti-1"})
+	require.Nil(t, err)
+	err = cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{Subject: "202", RevokedAt: now, ExpiresAt: now.Add(-time.Minute), LogoutTokenId: "jti-expired"})
+	require.Nil(t, err)
+
+	used, err := cut.IsLogoutTokenUsed(context.TODO(), "jti-1")
+	require.Nil(t, err)
+	require.True(t, used, "recorded logout token must be reported as used")
+
+	used, err = cut.IsLogoutTokenUsed(context.TODO(), "jti-2")
+	require.Nil(t, err)
+	require.False(t, used, "other logout tokens must not be reported as used")
+
+	used, err = cut.IsLogoutTokenUsed(context.TODO(), "jti-expired")
+	require.Nil(t, err)
+	require.False(t, used, "logout tokens of expired revocations must no longer be reported as used")
+}
+
+func TestPruneRevokedSessions(t *testing.T) {
+	docs.Description("expired revocations are pruned and no longer apply")
+	tstSetup()
+	defer tstShutdown()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err := cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+			SessionId: fmt.Sprintf("expired-%d", i),
+			RevokedAt: now.Add(-2 * time.Hour),
+			ExpiresAt: now.Add(-time.Hour),
+		})
+		require.Nil(t, err)
+	}
+	err := cut.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		SessionId: "current",
+		RevokedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	require.Nil(t, err)
+
+	revoked, err := cut.IsSessionRevoked(context.TODO(), "expired-0", "", now.Add(-3*time.Hour))
+	require.Nil(t, err)
+	require.False(t, revoked, "expired revocations must not apply even before pruning")
+
+	pruneCount, err := cut.PruneRevokedSessions(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, uint(3), pruneCount)
+
+	revoked, err = cut.IsSessionRevoked(context.TODO(), "current", "", now)
+	require.Nil(t, err)
+	require.True(t, revoked, "current revocation must survive pruning")
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	docs.Description("sessions can be added, retrieved, updated and deleted by the hash of their id")
+	tstSetup()
+	defer tstShutdown()
+	s := &entity.Session{
+		IdHash:       "test-hash",
+		Application:  "test-app",
+		IdToken:      "id",
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}
+	require.Nil(t, cut.AddSession(context.TODO(), s))
+	require.NotNil(t, cut.AddSession(context.TODO(), s), "adding the same session twice must fail")
+
+	err := cut.UpdateSessionTokens(context.TODO(), &entity.Session{IdHash: "test-hash", IdToken: "id2", AccessToken: "access2", RefreshToken: "refresh2"})
+	require.Nil(t, err)
+
+	s2, err := cut.GetSessionByIdHash(context.TODO(), "test-hash")
+	require.Nil(t, err)
+	require.Equal(t, "test-app", s2.Application)
+	require.Equal(t, "id2", s2.IdToken)
+	require.Equal(t, "access2", s2.AccessToken)
+	require.Equal(t, "refresh2", s2.RefreshToken)
+
+	require.Nil(t, cut.DeleteSessionByIdHash(context.TODO(), "test-hash"))
+	_, err = cut.GetSessionByIdHash(context.TODO(), "test-hash")
+	require.Equal(t, "cannot get session - not present", err.Error())
+	require.Equal(t, "cannot update session - not present", cut.UpdateSessionTokens(context.TODO(), s).Error())
+	require.Equal(t, "cannot delete session - not present", cut.DeleteSessionByIdHash(context.TODO(), "test-hash").Error())
+}
+
+func TestPruneSessions(t *testing.T) {
+	docs.Description("expired sessions cannot be retrieved and are pruned")
+	tstSetup()
+	defer tstShutdown()
+	for i := 0; i < 3; i++ {
+		err := cut.AddSession(context.TODO(), &entity.Session{IdHash: fmt.Sprintf("expired-%d", i), ExpiresAt: time.Now().Add(-time.Minute)})
+		require.Nil(t, err)
+	}
+	require.Nil(t, cut.AddSession(context.TODO(), &entity.Session{IdHash: "current", ExpiresAt: time.Now().Add(time.Hour)}))
+
+	_, err := cut.GetSessionByIdHash(context.TODO(), "expired-0")
+	require.Equal(t, "cannot get session - already expired", err.Error())
+
+	pruneCount, err := cut.PruneSessions(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, uint(2), pruneCount, "the session retrieved after expiry is already gone")
+
+	_, err = cut.GetSessionByIdHash(context.TODO(), "current")
+	require.Nil(t, err)
+}
+
+func TestLoggedQueriesOmitValues(t *testing.T) {
+	docs.Description("logged queries should only contain placeholders, never the values, which can be secrets")
+	tstSetup()
+	defer tstShutdown()
+	stmt := cut.db.Session(&gorm.Session{DryRun: true}).Where("state = ?", "secret-state").Find(&entity.AuthRequest{}).Statement
+	sql, vars := (&gormLogger{}).ParamsFilter(context.Background(), stmt.SQL.String(), stmt.Vars...)
+	logged := cut.db.Dialector.Explain(sql, vars...)
+	require.Contains(t, logged, "state = ?")
+	require.NotContains(t, logged, "secret-state")
+}
@@ -0,0 +1,54 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"time"
+)
+
+const slowQueryThreshold = 200 * time.Millisecond
+
+// gormLogger routes gorm's log output through our logging framework, so it ends up
+// in the same place and format as the rest of our logs, including the request id.
+type gormLogger struct{}
+
+func (l *gormLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface {
+	// log levels are controlled via our own logging configuration
+	return l
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	aulogging.Logger.Ctx(ctx).Info().Printf(msg, args...)
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf(msg, args...)
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	aulogging.Logger.Ctx(ctx).Error().Printf(msg, args...)
+}
+
+// ParamsFilter drops the bound values, so logged queries only contain placeholders.
+//
+// The values include states, nonces, PKCE verifiers and tokens, which must never end up in the logs.
+func (l *gormLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	elapsed := time.Since(begin)
+	sql, rows := fc()
+	message := fmt.Sprintf("%s -> %d rows (%d ms)", sql, rows, elapsed.Milliseconds())
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("%s: %s", message, err.Error())
+	} else if elapsed > slowQueryThreshold {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("slow query: %s", message)
+	} else {
+		aulogging.Logger.Ctx(ctx).Debug().Print(message)
+	}
+}
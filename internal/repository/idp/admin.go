@@ -0,0 +1,79 @@
+package idp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/go-http-utils/headers"
+)
+
+type adminTokenKey struct{}
+
+// AdminUserInfoURL returns the admin api url of an identity provider that returns the userinfo of the subject,
+// empty if the identity provider has no admin_user_info_endpoint.
+func AdminUserInfoURL(provider string, subject string) string {
+	endpoint := config.ProviderAdminUserInfoURL(provider)
+	if endpoint == "" {
+		return ""
+	}
+	return strings.ReplaceAll(endpoint, config.AdminSubjectPlaceholder, url.PathEscape(subject))
+}
+
+// isAdminUserInfoURL is true if the url was built from the admin_user_info_endpoint of the identity provider
+func isAdminUserInfoURL(provider string, requestUrl string) bool {
+	endpoint := config.ProviderAdminUserInfoURL(provider)
+	if endpoint == "" {
+		return false
+	}
+	prefix, suffix, _ := strings.Cut(endpoint, config.AdminSubjectPlaceholder)
+	return len(requestUrl) > len(prefix)+len(suffix) && strings.HasPrefix(requestUrl, prefix) && strings.HasSuffix(requestUrl, suffix)
+}
+
+// setAdminAuth sets the Authorization header if AdminUserInfo placed the admin api token in the context.
+//
+// The admin api token is never taken from the request of the caller, it comes from our own configuration.
+func setAdminAuth(ctx context.Context, r *http.Request) {
+	if token, ok := ctx.Value(adminTokenKey{}).(string); ok && r.Method == http.MethodGet {
+		r.Header.Set(headers.Authorization, "Bearer "+token)
+	}
+}
+
+func (i *IdentityProviderClientImpl) AdminUserInfo(ctx context.Context, provider string, subject string) (*UserinfoData, int, error) {
+	provider = providerOrDefault(provider)
+	adminUserinfoUrl := AdminUserInfoURL(provider, subject)
+	if adminUserinfoUrl == "" {
+		return nil, http.StatusInternalServerError, errors.New("no admin userinfo endpoint configured")
+	}
+	ctx = context.WithValue(ctx, adminTokenKey{}, config.ProviderAdminApiToken(provider))
+
+	bodyDto := UserinfoResponseDto{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	err := i.clientFor(provider).Perform(ctx, http.MethodGet, adminUserinfoUrl, nil, &response)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error requesting user info for subject %s from identity provider admin api: %s", subject, err.Error())
+		return nil, http.StatusBadGateway, err
+	}
+	if response.Status == http.StatusNotFound {
+		return nil, response.Status, nil
+	}
+	if response.Status != http.StatusOK {
+		err = fmt.Errorf("unexpected http status %d, was expecting 200 or 404", response.Status)
+		aulogging.Logger.Ctx(ctx).Error().Printf("error requesting user info for subject %s from identity provider admin api: error from response is %s:%s, local error is %s", subject, bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
+		return nil, response.Status, err
+	}
+
+	if bodyDto.Data.Subject != "" {
+		// got old response
+		return &bodyDto.Data, response.Status, nil
+	}
+	return &bodyDto.UserinfoData, response.Status, nil
+}
@@ -2,6 +2,7 @@ package idp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	aurestbreaker "github.com/StephanHCB/go-autumn-restclient-circuitbreaker/implementation/breaker"
@@ -11,23 +12,55 @@ import (
 	aurestlogging "github.com/StephanHCB/go-autumn-restclient/implementation/requestlogging"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/tracing"
 	"github.com/go-http-utils/headers"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"maps"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 )
 
+const requestIdHeader = "X-Request-Id"
+
 type IdentityProviderClientImpl struct {
-	client aurestclientapi.Client
+	mu      sync.Mutex
+	clients map[string]aurestclientapi.Client
 }
 
 // --- instance creation ---
 
+// isUserInfoURL is true if the url is the userinfo endpoint of any configured identity provider
+func isUserInfoURL(url string) bool {
+	for _, provider := range config.IdentityProviderNames() {
+		if url == config.ProviderUserInfoURL(provider) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTokenIntrospectionURL is true if the url is the token introspection endpoint of any configured identity provider
+func isTokenIntrospectionURL(url string) bool {
+	for _, provider := range config.IdentityProviderNames() {
+		if url == config.ProviderTokenIntrospectionURL(provider) {
+			return true
+		}
+	}
+	return false
+}
+
 // useCacheCondition determines whether the cache should be used for a given request
 //
-// we cache only GET requests to the configured userinfo endpoint, and only for users who present a valid auth token
+// we cache only GET requests to the configured userinfo endpoints, and only for users who present a valid auth token
 func useCacheCondition(ctx context.Context, method string, url string, requestBody interface{}) bool {
-	return method == http.MethodGet && url == config.OidcUserInfoURL() && ctxvalues.AccessToken(ctx) != ""
+	return method == http.MethodGet && isUserInfoURL(url) && ctxvalues.AccessToken(ctx) != ""
 }
 
 // storeResponseCondition determines whether to store a response in the cache
@@ -44,35 +77,171 @@ func cacheKeyFunction(ctx context.Context, method string, requestUrl string, req
 	return fmt.Sprintf("%s %s %s", ctxvalues.AccessToken(ctx), method, requestUrl)
 }
 
-// requestManipulator inserts Authorization when we are calling the userinfo endpoint
+// requestManipulator inserts Authorization when we are calling the userinfo endpoint, when an application authenticates
+// at the token or token introspection endpoint using client_secret_basic, when token introspection is configured to use
+// bearer auth, or when we call the admin api
+//
+// it also passes on the request id and the trace context, so a login can be followed into the identity provider
 func requestManipulator(ctx context.Context, r *http.Request) {
-	if r.Method == http.MethodGet {
-		urlStr := r.URL.String()
-		if urlStr != "" && (urlStr == config.OidcUserInfoURL() || urlStr == config.OidcTokenIntrospectionURL()) {
-			r.Header.Set(headers.Authorization, "Bearer "+ctxvalues.AccessToken(ctx))
+	r.Header.Set(requestIdHeader, ctxvalues.RequestId(ctx))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	setBasicAuth(ctx, r)
+	setAdminAuth(ctx, r)
+	setIntrospectionBearerAuth(ctx, r)
+
+	urlStr := r.URL.String()
+	if urlStr != "" && r.Method == http.MethodGet && isUserInfoURL(urlStr) {
+		r.Header.Set(headers.Authorization, "Bearer "+ctxvalues.AccessToken(ctx))
+	}
+}
+
+// operationName maps the url of a request to an identity provider to a metrics label
+func operationName(provider string, requestUrl string) string {
+	switch requestUrl {
+	case config.ProviderTokenEndpoint(provider):
+		return "token"
+	case config.ProviderParEndpoint(provider):
+		return "par"
+	case config.ProviderUserInfoURL(provider):
+		return "userinfo"
+	case config.ProviderTokenIntrospectionURL(provider):
+		return "introspection"
+	case config.ProviderKeySetEndpoint(provider):
+		return "keyset"
+	default:
+		if isAdminUserInfoURL(provider, requestUrl) {
+			return "admin_userinfo"
 		}
+		return "other"
 	}
 }
 
+// metricsClient records the latency of every request that actually goes out to the identity provider,
+// including those that fail without a response
+type metricsClient struct {
+	wrapped  aurestclientapi.Client
+	provider string
+}
+
+func (c *metricsClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	start := time.Now()
+	err := c.wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	metrics.ObserveIdpRequest(c.provider, operationName(c.provider, requestUrl), response.Status, err, time.Since(start))
+	return err
+}
+
+// tracingClient wraps every request that actually goes out to the identity provider in a client span
+type tracingClient struct {
+	wrapped  aurestclientapi.Client
+	provider string
+}
+
+func (c *tracingClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	provider := providerOrDefault(c.provider)
+	operation := operationName(provider, requestUrl)
+	ctx, span := tracing.Tracer().Start(ctx, "idp "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("idp.operation", operation),
+			attribute.String("idp.provider", provider),
+		),
+	)
+	defer span.End()
+
+	err := c.wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	if response.Status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", response.Status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if response.Status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(response.Status))
+	}
+	return err
+}
+
+func providerOrDefault(provider string) string {
+	if provider == "" {
+		return config.DefaultIdentityProvider
+	}
+	return provider
+}
+
+// circuitBreakerStates holds the current state of the circuit breaker of each identity provider
+var circuitBreakerStates sync.Map
+
+// CircuitBreakerState returns the current state of the circuit breaker protecting an identity provider,
+// one of "closed", "half-open" or "open".
+func CircuitBreakerState(provider string) string {
+	if state, ok := circuitBreakerStates.Load(provider); ok {
+		return state.(string)
+	}
+	return "closed"
+}
+
+// circuitBreakerName is the name of the circuit breaker of an identity provider, as used in logging
+func circuitBreakerName(provider string) string {
+	if provider == config.DefaultIdentityProvider {
+		return "identity-provider-breaker"
+	}
+	return "identity-provider-breaker-" + provider
+}
+
+func circuitBreakerStateCallback(provider string) func(circuitBreakerName string, state string) {
+	return func(circuitBreakerName string, state string) {
+		circuitBreakerStates.Store(provider, state)
+		metrics.SetCircuitBreakerState(provider, state)
+	}
+}
+
+func cacheHitCallback(ctx context.Context, method string, requestUrl string, status int, err error, latency time.Duration, size int) {
+	metrics.RecordUserinfoCacheHit()
+}
+
+func cacheMissCallback(ctx context.Context, method string, requestUrl string, status int, err error, latency time.Duration, size int) {
+	metrics.RecordUserinfoCacheMiss()
+}
+
 func New() IdentityProviderClient {
+	return &IdentityProviderClientImpl{
+		clients: make(map[string]aurestclientapi.Client),
+	}
+}
+
+// clientFor returns the client for an identity provider, which is created on first use.
+//
+// Every identity provider gets its own circuit breaker and userinfo cache, so one failing
+// identity provider does not affect the applications that use another.
+func (i *IdentityProviderClientImpl) clientFor(provider string) aurestclientapi.Client {
+	provider = providerOrDefault(provider)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if client, ok := i.clients[provider]; ok {
+		return client
+	}
+
 	httpClient, err := auresthttpclient.New(0, nil, requestManipulator)
 	if err != nil {
 		aulogging.Logger.NoCtx().Fatal().WithErr(err).Printf("Failed to instantiate IDP client - BAILING OUT: %s", err.Error())
 	}
 
-	requestLoggingClient := aurestlogging.New(httpClient)
+	requestLoggingClient := aurestlogging.New(&metricsClient{wrapped: &tracingClient{wrapped: httpClient, provider: provider}, provider: provider})
 
 	circuitBreakerClient := aurestbreaker.New(requestLoggingClient,
-		"identity-provider-breaker",
+		circuitBreakerName(provider),
 		10,
 		2*time.Minute,
 		30*time.Second,
-		config.TokenRequestTimeout(),
+		config.ProviderTokenRequestTimeout(provider),
 	)
+	aurestbreaker.Instrument(circuitBreakerClient, circuitBreakerStateCallback(provider), nil)
 
 	client := circuitBreakerClient
 
-	if config.OidcUserInfoCacheEnabled() {
+	if config.ProviderUserInfoCacheEnabled(provider) {
 		cachingClient := aurestcaching.New(circuitBreakerClient,
 			useCacheCondition,
 			storeResponseCondition,
@@ -80,23 +249,22 @@ func New() IdentityProviderClient {
 			config.OidcUserInfoCacheRetentionTime(),
 			256,
 		)
+		aurestcaching.Instrument(cachingClient, cacheHitCallback, cacheMissCallback, nil)
 		client = cachingClient
 	}
 
-	return &IdentityProviderClientImpl{
-		client: client,
-	}
+	i.clients[provider] = client
+	return client
 }
 
 // --- implementation of repository interface ---
 
 // can leave out fields to demo tolerant reader
 
+// TokenRequestBody builds the token request without client authentication, see authenticateClient
 func TokenRequestBody(appConfig config.ApplicationConfig, authorizationCode string, pkceVerifier string) url.Values {
 	parameters := url.Values{}
 	parameters.Set("grant_type", "authorization_code")
-	parameters.Set("client_id", appConfig.ClientId)
-	parameters.Set("client_secret", appConfig.ClientSecret)
 	parameters.Set("redirect_uri", appConfig.DefaultDropoffUrl)
 	parameters.Set("code", authorizationCode)
 	parameters.Set("code_verifier", pkceVerifier)
@@ -111,12 +279,18 @@ func (i *IdentityProviderClientImpl) TokenWithAuthenticationCodeAndPKCE(ctx cont
 	}
 
 	requestBody := TokenRequestBody(appConfig, authorizationCode, pkceVerifier)
-	tokenEndpoint := config.TokenEndpoint()
+	ctx, err = authenticateClient(ctx, applicationConfigName, appConfig, requestBody)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error preparing token request: %s", err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	provider := config.ApplicationIdentityProvider(applicationConfigName)
+	tokenEndpoint := config.ProviderTokenEndpoint(provider)
 	bodyDto := TokenResponseDto{}
 	response := aurestclientapi.ParsedResponse{
 		Body: &bodyDto,
 	}
-	err = i.client.Perform(ctx, http.MethodPost, tokenEndpoint, requestBody, &response)
+	err = i.clientFor(provider).Perform(ctx, http.MethodPost, tokenEndpoint, requestBody, &response)
 	if err != nil {
 		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error requesting token from identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
 		return nil, http.StatusBadGateway, err
@@ -129,13 +303,96 @@ func (i *IdentityProviderClientImpl) TokenWithAuthenticationCodeAndPKCE(ctx cont
 	return &bodyDto, response.Status, nil
 }
 
+// RefreshTokenRequestBody builds the refresh request without client authentication, see authenticateClient
+func RefreshTokenRequestBody(appConfig config.ApplicationConfig, refreshToken string) url.Values {
+	parameters := url.Values{}
+	parameters.Set("grant_type", "refresh_token")
+	parameters.Set("refresh_token", refreshToken)
+	return parameters
+}
+
+func (i *IdentityProviderClientImpl) RefreshToken(ctx context.Context, applicationConfigName string, refreshToken string) (*TokenResponseDto, int, error) {
+	appConfig, err := config.GetApplicationConfig(applicationConfigName)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Print(err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+
+	requestBody := RefreshTokenRequestBody(appConfig, refreshToken)
+	ctx, err = authenticateClient(ctx, applicationConfigName, appConfig, requestBody)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error preparing token refresh request: %s", err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	provider := config.ApplicationIdentityProvider(applicationConfigName)
+	tokenEndpoint := config.ProviderTokenEndpoint(provider)
+	bodyDto := TokenResponseDto{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	err = i.clientFor(provider).Perform(ctx, http.MethodPost, tokenEndpoint, requestBody, &response)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error refreshing token with identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
+		return nil, http.StatusBadGateway, err
+	}
+	if response.Status != http.StatusOK {
+		err = fmt.Errorf("unexpected http status %d, was expecting %d", response.Status, http.StatusOK)
+		aulogging.Logger.Ctx(ctx).Warn().Printf("error refreshing token with identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
+		return &bodyDto, response.Status, err
+	}
+	return &bodyDto, response.Status, nil
+}
+
+func (i *IdentityProviderClientImpl) PushAuthorizationRequest(ctx context.Context, applicationConfigName string, parameters url.Values) (*PushedAuthorizationResponseDto, int, error) {
+	appConfig, err := config.GetApplicationConfig(applicationConfigName)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Print(err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+
+	provider := config.ApplicationIdentityProvider(applicationConfigName)
+	parEndpoint := config.ProviderParEndpoint(provider)
+	if parEndpoint == "" {
+		return nil, http.StatusInternalServerError, errors.New("no pushed authorization request endpoint configured")
+	}
+	// the caller may still need the parameters for the redirect, so they must not receive our client credentials
+	requestBody := maps.Clone(parameters)
+	ctx, err = authenticateClient(ctx, applicationConfigName, appConfig, requestBody)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error preparing pushed authorization request: %s", err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	bodyDto := PushedAuthorizationResponseDto{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	err = i.clientFor(provider).Perform(ctx, http.MethodPost, parEndpoint, requestBody, &response)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error pushing authorization request to identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
+		return nil, http.StatusBadGateway, err
+	}
+	// RFC 9126 specifies 201, but some identity providers answer 200
+	if response.Status != http.StatusCreated && response.Status != http.StatusOK {
+		err = fmt.Errorf("unexpected http status %d, was expecting %d", response.Status, http.StatusCreated)
+		aulogging.Logger.Ctx(ctx).Warn().Printf("error pushing authorization request to identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
+		return &bodyDto, response.Status, err
+	}
+	if bodyDto.RequestUri == "" {
+		err = errors.New("identity provider did not return a request_uri")
+		aulogging.Logger.Ctx(ctx).Warn().Printf("error pushing authorization request to identity provider: %s", err.Error())
+		return &bodyDto, http.StatusBadGateway, err
+	}
+	return &bodyDto, response.Status, nil
+}
+
 func (i *IdentityProviderClientImpl) UserInfo(ctx context.Context) (*UserinfoData, int, error) {
-	userinfoEndpoint := config.OidcUserInfoURL()
+	provider := providerOrDefault(ctxvalues.IdentityProvider(ctx))
+	userinfoEndpoint := config.ProviderUserInfoURL(provider)
 	bodyDto := UserinfoResponseDto{}
 	response := aurestclientapi.ParsedResponse{
 		Body: &bodyDto,
 	}
-	err := i.client.Perform(ctx, http.MethodGet, userinfoEndpoint, nil, &response)
+	err := i.clientFor(provider).Perform(ctx, http.MethodGet, userinfoEndpoint, nil, &response)
 	if err != nil {
 		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error requesting user info from identity provider: error from response is %s:%s, local error is %s", bodyDto.ErrorCode, bodyDto.ErrorDescription, err.Error())
 		return nil, http.StatusBadGateway, err
@@ -163,16 +420,62 @@ func (i *IdentityProviderClientImpl) UserInfo(ctx context.Context) (*UserinfoDat
 	return &bodyDto.UserinfoData, response.Status, nil
 }
 
+// TokenIntrospectionRequestBody builds the introspection request for an access token, see RFC 7662
+func TokenIntrospectionRequestBody(accessToken string) url.Values {
+	parameters := url.Values{}
+	parameters.Set("token", accessToken)
+	parameters.Set("token_type_hint", "access_token")
+	return parameters
+}
+
+type introspectionBearerKey struct{}
+
+// setIntrospectionBearerAuth sends the introspected token as bearer token if token_introspection_bearer_auth is set
+// for the identity provider.
+func setIntrospectionBearerAuth(ctx context.Context, r *http.Request) {
+	if token, ok := ctx.Value(introspectionBearerKey{}).(string); ok && r.Method == http.MethodPost && isTokenIntrospectionURL(r.URL.String()) {
+		r.Header.Set(headers.Authorization, "Bearer "+token)
+	}
+}
+
+// authenticateIntrospection authenticates a token introspection request (RFC 7662 section 2.1).
+//
+// By default, we use the client credentials of the token_introspection_client of the identity provider.
+func authenticateIntrospection(ctx context.Context, provider string, parameters url.Values) (context.Context, error) {
+	if config.ProviderTokenIntrospectionBearerAuth(provider) {
+		return context.WithValue(ctx, introspectionBearerKey{}, ctxvalues.AccessToken(ctx)), nil
+	}
+	applicationConfigName := config.ProviderTokenIntrospectionClient(provider)
+	if applicationConfigName == "" {
+		return ctx, errors.New("no application configured to authenticate token introspection requests")
+	}
+	appConfig, err := config.GetApplicationConfig(applicationConfigName)
+	if err != nil {
+		return ctx, err
+	}
+	return authenticateClient(ctx, applicationConfigName, appConfig, parameters)
+}
+
 func (i *IdentityProviderClientImpl) TokenIntrospection(ctx context.Context) (*TokenIntrospectionData, int, error) {
-	tokenIntrospectionEndpoint := config.OidcTokenIntrospectionURL()
+	provider := providerOrDefault(ctxvalues.IdentityProvider(ctx))
+	tokenIntrospectionEndpoint := config.ProviderTokenIntrospectionURL(provider)
+	if tokenIntrospectionEndpoint == "" {
+		return nil, http.StatusInternalServerError, errors.New("no token introspection endpoint configured")
+	}
+	parameters := TokenIntrospectionRequestBody(ctxvalues.AccessToken(ctx))
+	ctx, err := authenticateIntrospection(ctx, provider, parameters)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("failed to authenticate token introspection request: %s", err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
 	bodyDto := TokenIntrospectionData{}
 	response := aurestclientapi.ParsedResponse{
 		Body: &bodyDto,
 	}
-	err := i.client.Perform(ctx, http.MethodGet, tokenIntrospectionEndpoint, nil, &response)
+	err = i.clientFor(provider).Perform(ctx, http.MethodPost, tokenIntrospectionEndpoint, parameters, &response)
 
 	if err != nil {
-		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error requesting user info from identity provider: error from response is %s:%v, local error is %s", bodyDto.ErrorMessage, bodyDto.Errors, err.Error())
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error introspecting token with identity provider: error from response is %s:%v, local error is %s", bodyDto.ErrorMessage, bodyDto.Errors, err.Error())
 		return nil, http.StatusBadGateway, err
 	}
 	if bodyDto.ErrorMessage != "" || len(bodyDto.Errors) > 0 {
@@ -180,7 +483,7 @@ func (i *IdentityProviderClientImpl) TokenIntrospection(ctx context.Context) (*T
 	}
 	if response.Status != http.StatusOK && response.Status != http.StatusUnauthorized && response.Status != http.StatusForbidden {
 		err = fmt.Errorf("unexpected http status %d, was expecting 200, 401, or 403", response.Status)
-		aulogging.Logger.Ctx(ctx).Error().Printf("error requesting user info from identity provider: error from response is %s:%v, local error is %s", bodyDto.ErrorMessage, bodyDto.Errors, err.Error())
+		aulogging.Logger.Ctx(ctx).Error().Printf("error introspecting token with identity provider: error from response is %s:%v, local error is %s", bodyDto.ErrorMessage, bodyDto.Errors, err.Error())
 		return nil, response.Status, err
 	}
 	if response.Status == http.StatusOK {
@@ -192,3 +495,25 @@ func (i *IdentityProviderClientImpl) TokenIntrospection(ctx context.Context) (*T
 
 	return &bodyDto, response.Status, nil
 }
+
+func (i *IdentityProviderClientImpl) KeySet(ctx context.Context, provider string) (*KeySetResponseDto, int, error) {
+	keySetEndpoint := config.ProviderKeySetEndpoint(provider)
+	if keySetEndpoint == "" {
+		return nil, http.StatusInternalServerError, errors.New("no key set endpoint configured")
+	}
+	bodyDto := KeySetResponseDto{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	err := i.clientFor(provider).Perform(ctx, http.MethodGet, keySetEndpoint, nil, &response)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("error requesting key set from identity provider: %s", err.Error())
+		return nil, http.StatusBadGateway, err
+	}
+	if response.Status != http.StatusOK {
+		err = fmt.Errorf("unexpected http status %d, was expecting %d", response.Status, http.StatusOK)
+		aulogging.Logger.Ctx(ctx).Error().Printf("error requesting key set from identity provider: %s", err.Error())
+		return nil, response.Status, err
+	}
+	return &bodyDto, response.Status, nil
+}
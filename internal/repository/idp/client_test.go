@@ -0,0 +1,120 @@
+package idp
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func tstSetup(t *testing.T) *tracetest.InMemoryExporter {
+	aulogging.SetupNoLoggerForTesting()
+	require.Nil(t, config.LoadConfiguration("../../../test/resources/config-acceptancetests.yaml"))
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.SetupForTesting(exporter)
+	return exporter
+}
+
+type tstRecordingClient struct {
+	ctx    context.Context
+	status int
+}
+
+func (c *tstRecordingClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.ctx = ctx
+	response.Status = c.status
+	return nil
+}
+
+func TestRequestManipulator_PropagatesTraceAndRequestId(t *testing.T) {
+	tstSetup(t)
+
+	docs.Given("given a request that is part of a trace and has a request id")
+	ctx, span := tracing.Tracer().Start(ctxvalues.CreateContextWithValueMap(context.Background()), "test")
+	defer span.End()
+	ctxvalues.SetRequestId(ctx, "3f2a9c1e-login")
+
+	docs.When("when a request to the identity provider is prepared")
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint(), nil)
+	require.Nil(t, err)
+	requestManipulator(ctx, r)
+
+	docs.Then("then the trace context and the request id are passed on")
+	traceId := span.SpanContext().TraceID().String()
+	spanId := span.SpanContext().SpanID().String()
+	require.Equal(t, "00-"+traceId+"-"+spanId+"-01", r.Header.Get("traceparent"))
+	require.Equal(t, "3f2a9c1e-login", r.Header.Get("X-Request-Id"))
+}
+
+func TestTracingClient_CreatesClientSpan(t *testing.T) {
+	exporter := tstSetup(t)
+
+	docs.Given("given a request that is part of a trace")
+	ctx, parent := tracing.Tracer().Start(context.Background(), "test")
+
+	docs.When("when a token request is sent to the identity provider")
+	wrapped := &tstRecordingClient{status: http.StatusBadGateway}
+	client := &tracingClient{wrapped: wrapped}
+	err := client.Perform(ctx, http.MethodPost, config.TokenEndpoint(), nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	parent.End()
+
+	docs.Then("then the request is sent inside a client span that is a child of the current span")
+	outgoing := trace.SpanContextFromContext(wrapped.ctx)
+	require.Equal(t, parent.SpanContext().TraceID(), outgoing.TraceID())
+
+	spans := exporter.GetSpans()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "idp token", spans[0].Name)
+	require.Equal(t, trace.SpanKindClient, spans[0].SpanKind)
+	require.Equal(t, outgoing.SpanID(), spans[0].SpanContext.SpanID())
+	require.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+
+	docs.Then("and a server error from the identity provider marks the span as failed")
+	require.Equal(t, "Error", spans[0].Status.Code.String())
+}
+
+func TestRequestManipulator_TokenIntrospection(t *testing.T) {
+	tstSetup(t)
+
+	docs.Given("given a request with an access token")
+	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
+	ctxvalues.SetAccessToken(ctx, "access-token")
+
+	docs.When("when a token introspection request to the staff identity provider is prepared")
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, config.ProviderTokenIntrospectionURL("staff"), nil)
+	require.Nil(t, err)
+	requestManipulator(ctx, r)
+
+	docs.Then("then the access token is not sent as the bearer token, the request authenticates with client credentials")
+	require.Equal(t, "", r.Header.Get("Authorization"))
+	require.Equal(t, "access-token", TokenIntrospectionRequestBody("access-token").Get("token"))
+}
+
+func TestRequestManipulator_AdminUserInfo(t *testing.T) {
+	tstSetup(t)
+
+	docs.Given("given a request of a service client, which carries no user tokens")
+	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
+	ctx = context.WithValue(ctx, adminTokenKey{}, config.ProviderAdminApiToken(config.DefaultIdentityProvider))
+
+	docs.When("when an admin api request for a subject is prepared")
+	requestUrl := AdminUserInfoURL(config.DefaultIdentityProvider, "a/b")
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	require.Nil(t, err)
+	requestManipulator(ctx, r)
+
+	docs.Then("then the subject is escaped, and the admin api token is sent as the bearer token")
+	require.Equal(t, "http://localhost:8081/admin/users/a%2Fb", requestUrl)
+	require.Equal(t, "Bearer acceptance-test-admin-token-not-for-production", r.Header.Get("Authorization"))
+	require.Equal(t, "admin_userinfo", operationName(config.DefaultIdentityProvider, requestUrl))
+}
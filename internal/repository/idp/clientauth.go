@@ -0,0 +1,116 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = time.Minute
+)
+
+type basicAuthKey struct{}
+
+type basicAuthCredentials struct {
+	clientId     string
+	clientSecret string
+}
+
+// authenticateClient adds client authentication to a token endpoint request, according to the
+// token_endpoint_auth_method of the application.
+//
+// For client_secret_basic, the credentials are placed in the returned context, and the requestManipulator
+// turns them into an Authorization header.
+func authenticateClient(ctx context.Context, applicationConfigName string, appConfig config.ApplicationConfig, parameters url.Values) (context.Context, error) {
+	switch appConfig.TokenEndpointAuthMethod {
+	case config.ClientSecretBasic:
+		return context.WithValue(ctx, basicAuthKey{}, basicAuthCredentials{
+			clientId:     appConfig.ClientId,
+			clientSecret: appConfig.ClientSecret,
+		}), nil
+	case config.PrivateKeyJwt:
+		assertion, err := ClientAssertion(appConfig, config.ClientAssertionKey(applicationConfigName), config.ProviderTokenEndpoint(config.ApplicationIdentityProvider(applicationConfigName)), time.Now())
+		if err != nil {
+			return ctx, err
+		}
+		parameters.Set("client_id", appConfig.ClientId)
+		parameters.Set("client_assertion_type", clientAssertionType)
+		parameters.Set("client_assertion", assertion)
+		return ctx, nil
+	default:
+		parameters.Set("client_id", appConfig.ClientId)
+		parameters.Set("client_secret", appConfig.ClientSecret)
+		return ctx, nil
+	}
+}
+
+// setBasicAuth sets the Authorization header if authenticateClient asked for client_secret_basic.
+//
+// RFC 6749 section 2.3.1 requires client id and secret to be form encoded before they are base64 encoded.
+func setBasicAuth(ctx context.Context, r *http.Request) {
+	if credentials, ok := ctx.Value(basicAuthKey{}).(basicAuthCredentials); ok && r.Method == http.MethodPost {
+		r.SetBasicAuth(url.QueryEscape(credentials.clientId), url.QueryEscape(credentials.clientSecret))
+	}
+}
+
+// ClientAssertion builds a signed client assertion for private_key_jwt (RFC 7523).
+//
+// Every assertion gets a new unique jti, so the identity provider can reject replays.
+func ClientAssertion(appConfig config.ApplicationConfig, key crypto.Signer, tokenEndpoint string, now time.Time) (string, error) {
+	if key == nil {
+		return "", errors.New("no client assertion key configured")
+	}
+	method, err := signingMethodFor(key)
+	if err != nil {
+		return "", err
+	}
+	jti, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.RegisteredClaims{
+		Issuer:    appConfig.ClientId,
+		Subject:   appConfig.ClientId,
+		Audience:  jwt.ClaimStrings{tokenEndpoint},
+		ID:        jti.String(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if appConfig.ClientAssertionKeyId != "" {
+		token.Header["kid"] = appConfig.ClientAssertionKeyId
+	}
+	return token.SignedString(key)
+}
+
+func signingMethodFor(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return jwt.SigningMethodES256, nil
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported elliptic curve %s for client assertions", k.Curve.Params().Name)
+	default:
+		return nil, fmt.Errorf("unsupported client assertion key type %T", key)
+	}
+}
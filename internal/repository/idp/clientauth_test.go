@@ -0,0 +1,307 @@
+package idp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+const tstClientAuthApplications = `
+  basic-service:
+    display_name: Basic Service
+    scope: example
+    client_id: 'basic:client'
+    client_secret: 'secret&more'
+    default_dropoff_url: https://example.com/basic/
+    cookie_name: JWT
+    cookie_domain: example.com
+    cookie_path: /basic
+    cookie_expiry: 6h
+    token_endpoint_auth_method: client_secret_basic
+  jwt-service:
+    display_name: JWT Service
+    scope: example
+    client_id: IAmSigning.
+    default_dropoff_url: https://example.com/jwt/
+    cookie_name: JWT
+    cookie_domain: example.com
+    cookie_path: /jwt
+    cookie_expiry: 6h
+    token_endpoint_auth_method: private_key_jwt
+    client_assertion_key_id: signing-key-1
+`
+
+type tstTokenRequest struct {
+	form          url.Values
+	basicUser     string
+	basicPass     string
+	hasBasic      bool
+	authorization string
+}
+
+// tstFakeTokenEndpoint records all requests to a fake token (and pushed authorization request) endpoint,
+// and configures the applications in tstClientAuthApplications to use it
+func tstFakeTokenEndpoint(t *testing.T, assertionKeyPEM string) *[]tstTokenRequest {
+	return tstFakeTokenEndpointWithConfig(t, assertionKeyPEM, func(yaml string) string { return yaml })
+}
+
+// tstFakeTokenEndpointWithConfig is tstFakeTokenEndpoint, but allows further changes to the configuration.
+//
+// The token introspection endpoint of the staff identity provider is also faked.
+func tstFakeTokenEndpointWithConfig(t *testing.T, assertionKeyPEM string, modify func(yaml string) string) *[]tstTokenRequest {
+	aulogging.SetupNoLoggerForTesting()
+	requests := make([]tstTokenRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		user, pass, ok := r.BasicAuth()
+		requests = append(requests, tstTokenRequest{form: r.PostForm, basicUser: user, basicPass: pass, hasBasic: ok, authorization: r.Header.Get("Authorization")})
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/par" {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"request_uri":"urn:ietf:params:oauth:request_uri:abc","expires_in":60}`))
+			return
+		}
+		if r.URL.Path == "/introspect" {
+			_, _ = w.Write([]byte(`{"active":true,"sub":"101"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"access","id_token":"id","token_type":"Bearer","expires_in":300}`))
+	}))
+	t.Cleanup(server.Close)
+
+	original, err := os.ReadFile("../../../test/resources/config-acceptancetests.yaml")
+	require.Nil(t, err)
+	yaml := strings.ReplaceAll(string(original), "https://auth.example.com/token", server.URL+"/token")
+	yaml = strings.ReplaceAll(yaml, "https://auth.example.com/par", server.URL+"/par")
+	yaml = strings.ReplaceAll(yaml, "http://localhost:8081/staff-introspect", server.URL+"/introspect")
+	yaml = modify(yaml) + tstClientAuthApplications
+	t.Setenv("REG_SECRET_APP_JWT_SERVICE_CLIENT_ASSERTION_KEY", assertionKeyPEM)
+	require.Nil(t, config.ParseAndOverwriteConfig([]byte(yaml)))
+	t.Cleanup(func() {
+		require.Nil(t, config.LoadConfiguration("../../../test/resources/config-acceptancetests.yaml"))
+	})
+	return &requests
+}
+
+func tstRsaKeyPEM(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func tstEcKeyPEM(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func tstCtx() context.Context {
+	return ctxvalues.CreateContextWithValueMap(context.Background())
+}
+
+func TestClientAuthentication_clientSecretPost(t *testing.T) {
+	docs.Description("client_secret_post sends the client credentials in the form body")
+	_, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpoint(t, keyPEM)
+
+	docs.Given("given an application that uses the default client_secret_post")
+	client := New()
+
+	docs.When("when it exchanges an authorization code")
+	_, status, err := client.TokenWithAuthenticationCodeAndPKCE(tstCtx(), "example-service", "code", "verifier")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	docs.Then("then client id and secret are sent in the form body")
+	require.Equal(t, 1, len(*requests))
+	request := (*requests)[0]
+	require.False(t, request.hasBasic)
+	require.Equal(t, "IAmNotSoSecret.", request.form.Get("client_id"))
+	require.Equal(t, "IAmVerySecret!", request.form.Get("client_secret"))
+	require.Equal(t, "code", request.form.Get("code"))
+}
+
+func TestClientAuthentication_clientSecretBasic(t *testing.T) {
+	docs.Description("client_secret_basic sends the form encoded client credentials as basic auth")
+	_, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpoint(t, keyPEM)
+
+	docs.Given("given an application that uses client_secret_basic")
+	client := New()
+
+	docs.When("when it refreshes a token")
+	_, status, err := client.RefreshToken(tstCtx(), "basic-service", "refresh")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	docs.Then("then the form encoded client id and secret are sent in the Authorization header, and not in the body")
+	require.Equal(t, 1, len(*requests))
+	request := (*requests)[0]
+	require.True(t, request.hasBasic)
+	require.Equal(t, "basic%3Aclient", request.basicUser)
+	require.Equal(t, "secret%26more", request.basicPass)
+	require.Equal(t, "", request.form.Get("client_id"))
+	require.Equal(t, "", request.form.Get("client_secret"))
+	require.Equal(t, "refresh", request.form.Get("refresh_token"))
+}
+
+func TestClientAuthentication_privateKeyJwt(t *testing.T) {
+	docs.Description("private_key_jwt sends a signed client assertion instead of a client secret")
+	key, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpoint(t, keyPEM)
+
+	docs.Given("given an application that uses private_key_jwt")
+	client := New()
+
+	docs.When("when it exchanges two authorization codes")
+	_, _, err := client.TokenWithAuthenticationCodeAndPKCE(tstCtx(), "jwt-service", "code1", "verifier")
+	require.Nil(t, err)
+	_, _, err = client.TokenWithAuthenticationCodeAndPKCE(tstCtx(), "jwt-service", "code2", "verifier")
+	require.Nil(t, err)
+
+	docs.Then("then each request carries a freshly signed client assertion with a unique jti and no client secret")
+	require.Equal(t, 2, len(*requests))
+	jtis := make(map[string]bool)
+	for _, request := range *requests {
+		require.False(t, request.hasBasic)
+		require.Equal(t, "", request.form.Get("client_secret"))
+		require.Equal(t, "IAmSigning.", request.form.Get("client_id"))
+		require.Equal(t, "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", request.form.Get("client_assertion_type"))
+
+		claims := jwt.RegisteredClaims{}
+		token, err := jwt.ParseWithClaims(request.form.Get("client_assertion"), &claims, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		require.Nil(t, err)
+		require.Equal(t, "RS256", token.Method.Alg())
+		require.Equal(t, "signing-key-1", token.Header["kid"])
+		require.Equal(t, "IAmSigning.", claims.Issuer)
+		require.Equal(t, "IAmSigning.", claims.Subject)
+		require.True(t, claims.VerifyAudience(config.TokenEndpoint(), true))
+		require.NotEqual(t, "", claims.ID)
+		jtis[claims.ID] = true
+	}
+	require.Equal(t, 2, len(jtis))
+}
+
+func TestTokenIntrospection_clientCredentials(t *testing.T) {
+	docs.Description("token introspection requests authenticate with the client credentials of an application")
+	_, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpoint(t, keyPEM)
+
+	docs.Given("given an identity provider with a token introspection endpoint")
+	client := New()
+	ctx := tstCtx()
+	ctxvalues.SetIdentityProvider(ctx, "staff")
+	ctxvalues.SetAccessToken(ctx, "access-token")
+
+	docs.When("when an access token is introspected")
+	data, status, err := client.TokenIntrospection(ctx)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, data.Active)
+
+	docs.Then("then the request is authenticated with the client credentials of an application of the identity provider")
+	require.Equal(t, 1, len(*requests))
+	request := (*requests)[0]
+	require.Equal(t, "", request.authorization)
+	require.Equal(t, "IAmStaff.", request.form.Get("client_id"))
+	require.Equal(t, "IAmVerySecret!", request.form.Get("client_secret"))
+	require.Equal(t, "access-token", request.form.Get("token"))
+}
+
+func TestTokenIntrospection_bearerAuth(t *testing.T) {
+	docs.Description("token introspection can send the introspected token as bearer token instead, if configured")
+	_, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpointWithConfig(t, keyPEM, func(yaml string) string {
+		return strings.ReplaceAll(yaml, "    token_introspection_endpoint:", "    token_introspection_bearer_auth: true\n    token_introspection_endpoint:")
+	})
+
+	docs.Given("given an identity provider that is configured to accept the introspected token as bearer token")
+	client := New()
+	ctx := tstCtx()
+	ctxvalues.SetIdentityProvider(ctx, "staff")
+	ctxvalues.SetAccessToken(ctx, "access-token")
+
+	docs.When("when an access token is introspected")
+	_, status, err := client.TokenIntrospection(ctx)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	docs.Then("then the access token is sent as the bearer token, and no client credentials are sent")
+	require.Equal(t, 1, len(*requests))
+	request := (*requests)[0]
+	require.Equal(t, "Bearer access-token", request.authorization)
+	require.Equal(t, "", request.form.Get("client_id"))
+	require.Equal(t, "", request.form.Get("client_secret"))
+}
+
+func TestPushAuthorizationRequest(t *testing.T) {
+	docs.Description("pushed authorization requests authenticate the client like token requests")
+	_, keyPEM := tstRsaKeyPEM(t)
+	requests := tstFakeTokenEndpoint(t, keyPEM)
+
+	docs.Given("given an application that uses the default client_secret_post")
+	client := New()
+	parameters := url.Values{"client_id": []string{"IAmNotSoSecret."}, "state": []string{"some-state"}}
+
+	docs.When("when it pushes an authorization request")
+	response, status, err := client.PushAuthorizationRequest(tstCtx(), "example-service", parameters)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusCreated, status)
+
+	docs.Then("then the identity provider receives the parameters and the client credentials")
+	require.Equal(t, 1, len(*requests))
+	request := (*requests)[0]
+	require.Equal(t, "some-state", request.form.Get("state"))
+	require.Equal(t, "IAmVerySecret!", request.form.Get("client_secret"))
+
+	docs.Then("and the request_uri is returned, while the parameters of the caller remain free of credentials")
+	require.Equal(t, "urn:ietf:params:oauth:request_uri:abc", response.RequestUri)
+	require.Equal(t, "", parameters.Get("client_secret"))
+}
+
+func TestClientAssertion_ecKey(t *testing.T) {
+	docs.Description("client assertions can be signed with an EC key")
+	key, _ := tstEcKeyPEM(t)
+	now := time.Now()
+
+	assertion, err := ClientAssertion(config.ApplicationConfig{ClientId: "ec-client"}, key, "https://idp.example.com/token", now)
+	require.Nil(t, err)
+
+	claims := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(assertion, &claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "ES256", token.Method.Alg())
+	require.Nil(t, token.Header["kid"])
+	require.Equal(t, now.Add(time.Minute).Unix(), claims.ExpiresAt.Unix())
+}
+
+func TestClientAssertion_noKey(t *testing.T) {
+	docs.Description("building a client assertion without a key is an error")
+	_, err := ClientAssertion(config.ApplicationConfig{ClientId: "client"}, nil, "https://idp.example.com/token", time.Now())
+	require.NotNil(t, err)
+	require.Equal(t, "no client assertion key configured", err.Error())
+}
@@ -1,14 +1,21 @@
 package idp
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/golang-jwt/jwt/v4"
+)
 
 type TokenResponseDto struct {
 	// can leave out fields - we are using a tolerant reader
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	IdToken     string `json:"id_token"`
-	Scope       string `json:"scope"`
-	TokenType   string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	TokenType    string `json:"token_type"`
 
 	// in case of error, you get these fields instead
 	ErrorCode        string `json:"error"`
@@ -27,26 +34,54 @@ type UserinfoData struct {
 	IssuedAt      int64    `json:"iat"`
 	RequestedAt   int64    `json:"rat"`
 	Subject       string   `json:"sub"` //
+
+	// all claims of the response by name, including those that have no field above
+	Claims map[string]interface{} `json:"-"`
 }
 
+// TokenIntrospectionData is the response of the token introspection endpoint, see RFC 7662
 type TokenIntrospectionData struct {
-	Active    bool     `json:"active"`
-	Scope     string   `json:"scope"`
-	ClientId  string   `json:"client_id"`
-	Sub       string   `json:"sub"`
-	Exp       int64    `json:"exp"`
-	Iat       int64    `json:"iat"`
-	Nbf       int64    `json:"nbf"`
-	Aud       []string `json:"aud"`
-	Iss       string   `json:"iss"`
-	TokenType string   `json:"token_type"`
-	TokenUse  string   `json:"token_use"`
+	Active    bool             `json:"active"`
+	Scope     string           `json:"scope"` // space separated
+	ClientId  string           `json:"client_id"`
+	Sub       string           `json:"sub"`
+	Exp       int64            `json:"exp"`
+	Iat       int64            `json:"iat"`
+	Nbf       int64            `json:"nbf"`
+	Aud       jwt.ClaimStrings `json:"aud"` // may be a single string or a list
+	Iss       string           `json:"iss"`
+	TokenType string           `json:"token_type"`
+	TokenUse  string           `json:"token_use"`
 
 	// in case of error, you get these fields instead
 	ErrorMessage string              `json:"message"`
 	Errors       map[string][]string `json:"errors"`
 }
 
+type JsonWebKeyDto struct {
+	// can leave out fields - we are using a tolerant reader
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Modulus   string `json:"n"` // RSA only, base64url encoded
+	Exponent  string `json:"e"` // RSA only, base64url encoded
+}
+
+// PushedAuthorizationResponseDto is the response of the pushed authorization request endpoint, see RFC 9126
+type PushedAuthorizationResponseDto struct {
+	RequestUri string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+
+	// in case of error, you get these fields instead
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type KeySetResponseDto struct {
+	Keys []JsonWebKeyDto `json:"keys"`
+}
+
 type UserinfoResponseDto struct {
 	UserinfoData
 
@@ -56,12 +91,34 @@ type UserinfoResponseDto struct {
 	// in case of error, you get these fields instead (old version)
 	ErrorCode        string `json:"error"`
 	ErrorDescription string `json:"error_description"`
+
+	// the response as received, see MarshalJSON
+	raw json.RawMessage
 }
 
 type IdentityProviderClient interface {
 	TokenWithAuthenticationCodeAndPKCE(ctx context.Context, applicationConfigName string, authorizationCode string, pkceVerifier string) (*TokenResponseDto, int, error)
 
+	// RefreshToken obtains new tokens using a refresh token. The response may contain a new (rotated) refresh token.
+	RefreshToken(ctx context.Context, applicationConfigName string, refreshToken string) (*TokenResponseDto, int, error)
+
+	// PushAuthorizationRequest sends the parameters of an authorization request directly to the identity provider,
+	// which returns a request_uri to use in their place in the front-channel redirect.
+	PushAuthorizationRequest(ctx context.Context, applicationConfigName string, parameters url.Values) (*PushedAuthorizationResponseDto, int, error)
+
+	// UserInfo calls the userinfo endpoint of the identity provider set in the context, see ctxvalues.IdentityProvider.
 	UserInfo(ctx context.Context) (*UserinfoData, int, error)
 
+	// TokenIntrospection asks the identity provider set in the context about the access token in the context.
+	//
+	// A 401 or 403 status without an error means the identity provider refused to answer for this token.
 	TokenIntrospection(ctx context.Context) (*TokenIntrospectionData, int, error)
+
+	// AdminUserInfo looks up the userinfo of any subject with the admin api of an identity provider.
+	//
+	// A 404 status without an error means the identity provider does not know the subject.
+	AdminUserInfo(ctx context.Context, provider string, subject string) (*UserinfoData, int, error)
+
+	// KeySet obtains the token signing keys of an identity provider.
+	KeySet(ctx context.Context, provider string) (*KeySetResponseDto, int, error)
 }
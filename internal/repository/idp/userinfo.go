@@ -0,0 +1,36 @@
+package idp
+
+import "encoding/json"
+
+// plainUserinfoResponseDto has the fields of UserinfoResponseDto, but not its json methods
+type plainUserinfoResponseDto UserinfoResponseDto
+
+// UnmarshalJSON also collects all claims of the response, so claims we have no field for can be passed on.
+func (d *UserinfoResponseDto) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*plainUserinfoResponseDto)(d)); err != nil {
+		return err
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	d.UserinfoData.Claims = claims
+	if oldClaims, ok := claims["data"].(map[string]interface{}); ok {
+		// got old response
+		d.Data.Claims = oldClaims
+	}
+
+	d.raw = append(json.RawMessage{}, data...)
+	return nil
+}
+
+// MarshalJSON returns the response as received.
+//
+// The userinfo cache stores responses in marshalled form, which would otherwise lose the claims we have no field for.
+func (d UserinfoResponseDto) MarshalJSON() ([]byte, error) {
+	if d.raw != nil {
+		return d.raw, nil
+	}
+	return json.Marshal(plainUserinfoResponseDto(d))
+}
@@ -0,0 +1,56 @@
+package idp
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserinfoResponse_Claims(t *testing.T) {
+	docs.Description("claims of the userinfo response without a field are kept, so they can be passed through")
+	docs.Given("given a userinfo response with claims we have no field for")
+	body := `{"sub":"101","name":"John Doe","groups":["staff"],"locale":"de-DE","badge_number":1234}`
+
+	docs.When("when it is parsed")
+	dto := UserinfoResponseDto{}
+	require.Nil(t, json.Unmarshal([]byte(body), &dto))
+
+	docs.Then("then those claims are available, as well as the usual fields")
+	require.Equal(t, "101", dto.Subject)
+	require.Equal(t, []string{"staff"}, dto.Groups)
+	require.Equal(t, "de-DE", dto.Claims["locale"])
+	require.Equal(t, float64(1234), dto.Claims["badge_number"])
+}
+
+func TestUserinfoResponse_ClaimsOldVersion(t *testing.T) {
+	docs.Description("claims are also kept for identity providers that wrap the userinfo response in data")
+	docs.Given("given a userinfo response in the old format")
+	body := `{"data":{"sub":"101","locale":"de-DE"}}`
+
+	docs.When("when it is parsed")
+	dto := UserinfoResponseDto{}
+	require.Nil(t, json.Unmarshal([]byte(body), &dto))
+
+	docs.Then("then the claims of the user are available")
+	require.Equal(t, "101", dto.Data.Subject)
+	require.Equal(t, "de-DE", dto.Data.Claims["locale"])
+}
+
+func TestUserinfoResponse_Cached(t *testing.T) {
+	docs.Description("claims without a field are not lost in the userinfo cache")
+	docs.Given("given a parsed userinfo response")
+	dto := UserinfoResponseDto{}
+	require.Nil(t, json.Unmarshal([]byte(`{"sub":"101","badge_number":1234}`), &dto))
+
+	docs.When("when it goes through the userinfo cache, which stores it marshalled")
+	marshalled, err := json.Marshal(&dto)
+	require.Nil(t, err)
+	cached := UserinfoResponseDto{}
+	require.Nil(t, json.Unmarshal(marshalled, &cached))
+
+	docs.Then("then the claims we have no field for survive")
+	require.Equal(t, "101", cached.Subject)
+	require.Equal(t, float64(1234), cached.Claims["badge_number"])
+}
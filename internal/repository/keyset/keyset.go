@@ -0,0 +1,300 @@
+package keyset
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+)
+
+// minimum time between two refreshes caused by tokens with an unknown kid, so
+// tokens with made up key ids cannot be used to hammer the identity provider
+var minRefreshInterval = 30 * time.Second
+
+var (
+	IDPClient idp.IdentityProviderClient
+
+	mu        sync.RWMutex
+	providers = make(map[string]*providerKeySet)
+
+	refreshTicker *time.Ticker
+	refreshStop   chan bool
+)
+
+// providerKeySet holds the keys loaded from the key set endpoint of one identity provider
+type providerKeySet struct {
+	name        string
+	keysByKid   map[string]*rsa.PublicKey
+	lastRefresh time.Time
+	lastAttempt time.Time
+	lastError   error // of the last attempt, nil if it succeeded
+	refreshMu   sync.Mutex
+}
+
+// Setup sets the client used to load the key sets. Exposed separately so you can use it in tests - use Start().
+func Setup(idpClient idp.IdentityProviderClient) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	IDPClient = idpClient
+	providers = make(map[string]*providerKeySet)
+}
+
+// Start loads the key set of every identity provider from its key set endpoint, and then refreshes them periodically.
+//
+// Identity providers without a key set endpoint (configured or discovered) are skipped. For those, only the
+// statically configured token_public_keys_PEM are used. With several identity providers, the shortest configured
+// refresh interval applies to all of them.
+func Start(idpClient idp.IdentityProviderClient) {
+	Setup(idpClient)
+
+	var interval time.Duration
+	for _, provider := range config.IdentityProviderNames() {
+		if config.ProviderKeySetEndpoint(provider) == "" {
+			continue
+		}
+		if err := forProvider(provider).refresh(context.Background()); err != nil {
+			aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to load initial key set of identity provider %s, will retry: %s", provider, err.Error())
+		}
+		if refresh := config.ProviderKeySetRefresh(provider); interval == 0 || refresh < interval {
+			interval = refresh
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+
+	refreshTicker = time.NewTicker(interval)
+	refreshStop = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-refreshStop:
+				refreshTicker.Stop()
+				return
+			case <-refreshTicker.C:
+				for _, provider := range config.IdentityProviderNames() {
+					if config.ProviderKeySetEndpoint(provider) == "" {
+						continue
+					}
+					if err := forProvider(provider).refresh(context.Background()); err != nil {
+						aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("failed to refresh key set of identity provider %s, keeping previous keys: %s", provider, err.Error())
+					}
+				}
+			}
+		}
+	}()
+}
+
+func Stop() {
+	if refreshStop != nil {
+		refreshStop <- true
+		refreshStop = nil
+	}
+}
+
+// Key returns the public key of an identity provider for a key id, or nil if we do not know it.
+//
+// If the key id is unknown, the key set is reloaded, unless this has happened very recently.
+func Key(ctx context.Context, provider string, kid string) *rsa.PublicKey {
+	if kid == "" {
+		return nil
+	}
+	ks := forProvider(provider)
+	if key := ks.lookup(kid); key != nil {
+		return key
+	}
+
+	if ks.refreshAllowed() {
+		if err := ks.refreshUnlessRecent(ctx, kid); err != nil {
+			aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("failed to reload key set: %s", err.Error())
+		}
+	}
+	return ks.lookup(kid)
+}
+
+// CandidateKeys determines which keys of an identity provider to try for validating a token.
+//
+// If the token names a key id that we know from the key set endpoint, only that key is tried.
+// Otherwise, we fall back to trying all statically configured keys of the identity provider.
+func CandidateKeys(ctx context.Context, provider string, tokenString string) []*rsa.PublicKey {
+	unverifiedToken, _, err := jwt.NewParser().ParseUnverified(tokenString, &jwt.RegisteredClaims{})
+	if err == nil {
+		if kid, ok := unverifiedToken.Header["kid"].(string); ok && kid != "" {
+			if key := Key(ctx, provider, kid); key != nil {
+				return []*rsa.PublicKey{key}
+			}
+		}
+	}
+	return config.ProviderKeySet(provider)
+}
+
+// IdentityProviderForToken determines the identity provider that issued a token from its (not yet verified) iss claim.
+//
+// This only selects which keys to validate the token with, so a forged iss claim cannot get a token accepted.
+func IdentityProviderForToken(tokenString string) string {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &claims); err != nil {
+		return config.DefaultIdentityProvider
+	}
+	return config.IdentityProviderForIssuer(claims.Issuer)
+}
+
+// LastRefresh returns the time the key set of an identity provider was last loaded successfully (zero if never).
+func LastRefresh(provider string) time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ks, ok := providers[provider]; ok {
+		return ks.lastRefresh
+	}
+	return time.Time{}
+}
+
+// LastAttempt returns the time of the last attempt to load the key set of an identity provider (zero if never),
+// and its error, nil if it succeeded.
+func LastAttempt(provider string) (time.Time, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ks, ok := providers[provider]; ok {
+		return ks.lastAttempt, ks.lastError
+	}
+	return time.Time{}, nil
+}
+
+// KeyCount returns the number of keys currently known from the key set endpoint of an identity provider.
+func KeyCount(provider string) int {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ks, ok := providers[provider]; ok {
+		return len(ks.keysByKid)
+	}
+	return 0
+}
+
+func forProvider(provider string) *providerKeySet {
+	mu.Lock()
+	defer mu.Unlock()
+	ks, ok := providers[provider]
+	if !ok {
+		ks = &providerKeySet{name: provider, keysByKid: make(map[string]*rsa.PublicKey)}
+		providers[provider] = ks
+	}
+	return ks
+}
+
+func (ks *providerKeySet) lookup(kid string) *rsa.PublicKey {
+	mu.RLock()
+	defer mu.RUnlock()
+	return ks.keysByKid[kid]
+}
+
+func (ks *providerKeySet) refreshAllowed() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return IDPClient != nil && time.Since(ks.lastAttempt) >= minRefreshInterval
+}
+
+// refreshUnlessRecent reloads the key set for an unknown kid, unless another caller has attempted a refresh
+// within minRefreshInterval.
+//
+// refreshAllowed is only a quick check without waiting, callers that arrive at the same time all pass it,
+// so we check again once it is our turn.
+func (ks *providerKeySet) refreshUnlessRecent(ctx context.Context, kid string) error {
+	ks.refreshMu.Lock()
+	defer ks.refreshMu.Unlock()
+
+	if !ks.refreshAllowed() {
+		return nil
+	}
+	aulogging.Logger.Ctx(ctx).Info().Printf("unknown key id %s, reloading key set of identity provider %s", kid, ks.name)
+	return ks.refreshLocked(ctx)
+}
+
+func (ks *providerKeySet) refresh(ctx context.Context) error {
+	// only one refresh at a time, concurrent callers wait and then see the result
+	ks.refreshMu.Lock()
+	defer ks.refreshMu.Unlock()
+
+	return ks.refreshLocked(ctx)
+}
+
+// refreshLocked loads the key set, the caller must hold refreshMu
+func (ks *providerKeySet) refreshLocked(ctx context.Context) error {
+	mu.Lock()
+	client := IDPClient
+	if client != nil {
+		ks.lastAttempt = time.Now()
+	}
+	mu.Unlock()
+
+	if client == nil {
+		return errors.New("key set not set up")
+	}
+
+	response, _, err := client.KeySet(ctx, ks.name)
+	if err != nil {
+		mu.Lock()
+		ks.lastError = err
+		mu.Unlock()
+		return err
+	}
+
+	newKeys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range response.Keys {
+		key, err := parseKey(jwk)
+		if err != nil {
+			aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("skipping key %s from key set: %s", jwk.KeyId, err.Error())
+			continue
+		}
+		if key != nil {
+			newKeys[jwk.KeyId] = key
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	ks.keysByKid = newKeys
+	ks.lastRefresh = time.Now()
+	ks.lastError = nil
+	aulogging.Logger.Ctx(ctx).Info().Printf("loaded %d keys from key set of identity provider %s", len(newKeys), ks.name)
+	return nil
+}
+
+// parseKey converts a json web key into an RSA public key.
+//
+// Returns nil without error for keys we are not interested in (not RSA, or not for signatures).
+func parseKey(jwk idp.JsonWebKeyDto) (*rsa.PublicKey, error) {
+	if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+		return nil, nil
+	}
+	if jwk.KeyId == "" {
+		return nil, errors.New("key has no kid")
+	}
+
+	modulus, err := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %s", err.Error())
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %s", err.Error())
+	}
+	e := new(big.Int).SetBytes(exponent)
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent value")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(e.Int64()),
+	}, nil
+}
@@ -0,0 +1,203 @@
+package keyset
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeIDPClient struct {
+	idp.IdentityProviderClient // only KeySet is implemented
+
+	keys          []idp.JsonWebKeyDto
+	providerKeys  map[string][]idp.JsonWebKeyDto
+	calls         int
+	lastProviders []string
+	err           error
+}
+
+func (f *fakeIDPClient) KeySet(ctx context.Context, provider string) (*idp.KeySetResponseDto, int, error) {
+	f.calls++
+	f.lastProviders = append(f.lastProviders, provider)
+	if f.err != nil {
+		return nil, http.StatusBadGateway, f.err
+	}
+	if keys, ok := f.providerKeys[provider]; ok {
+		return &idp.KeySetResponseDto{Keys: keys}, http.StatusOK, nil
+	}
+	return &idp.KeySetResponseDto{Keys: f.keys}, http.StatusOK, nil
+}
+
+func TestMain(m *testing.M) {
+	aulogging.SetupNoLoggerForTesting()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func tstJwk(t *testing.T, kid string) (idp.JsonWebKeyDto, *rsa.PublicKey) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	publicKey := &privateKey.PublicKey
+	return idp.JsonWebKeyDto{
+		KeyType:   "RSA",
+		KeyId:     kid,
+		Use:       "sig",
+		Algorithm: "RS256",
+		Modulus:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}, publicKey
+}
+
+func TestKey_loadsOnFirstUse(t *testing.T) {
+	docs.Description("keys are looked up by kid, loading the key set when a kid is not yet known")
+	jwk, publicKey := tstJwk(t, "key-1")
+	client := &fakeIDPClient{keys: []idp.JsonWebKeyDto{jwk}}
+	Setup(client)
+
+	key := Key(context.Background(), "default", "key-1")
+	require.NotNil(t, key)
+	require.True(t, publicKey.Equal(key))
+	require.Equal(t, 1, client.calls)
+	require.Equal(t, 1, KeyCount("default"))
+
+	key = Key(context.Background(), "default", "key-1")
+	require.NotNil(t, key)
+	require.Equal(t, 1, client.calls, "known kid must not cause a reload")
+}
+
+func TestKey_unknownKidRateLimited(t *testing.T) {
+	docs.Description("reloads caused by unknown key ids are rate limited")
+	jwk, _ := tstJwk(t, "key-1")
+	client := &fakeIDPClient{keys: []idp.JsonWebKeyDto{jwk}}
+	Setup(client)
+
+	require.Nil(t, Key(context.Background(), "default", "unknown"))
+	require.Nil(t, Key(context.Background(), "default", "unknown"))
+	require.Equal(t, 1, client.calls, "second miss must not cause a reload")
+}
+
+func TestKey_unknownKidRateLimitedConcurrently(t *testing.T) {
+	docs.Description("the rate limit for unknown key ids also holds for requests that arrive at the same time")
+	docs.Given("given a refresh of the key set that is still in progress")
+	jwk, _ := tstJwk(t, "key-1")
+	client := &fakeIDPClient{keys: []idp.JsonWebKeyDto{jwk}}
+	Setup(client)
+	ks := forProvider("default")
+	ks.refreshMu.Lock()
+
+	docs.When("when many tokens with unknown key ids arrive in the meantime")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Key(context.Background(), "default", fmt.Sprintf("unknown-%d", i))
+		}(i)
+	}
+	// give all of them the time to pass the quick check and queue up for the refresh
+	time.Sleep(100 * time.Millisecond)
+	ks.refreshMu.Unlock()
+	wg.Wait()
+
+	docs.Then("then the key set is only loaded once")
+	require.Equal(t, 1, client.calls)
+}
+
+func TestLastAttempt(t *testing.T) {
+	docs.Description("the result of the last attempt to load a key set is kept, so the readiness check can report it")
+	docs.Given("given a key set endpoint that cannot be reached")
+	jwk, _ := tstJwk(t, "key-1")
+	client := &fakeIDPClient{keys: []idp.JsonWebKeyDto{jwk}, err: errors.New("connection refused")}
+	Setup(client)
+
+	docs.When("when the key set is loaded")
+	require.NotNil(t, forProvider("default").refresh(context.Background()))
+
+	docs.Then("then the failed attempt is recorded")
+	lastAttempt, err := LastAttempt("default")
+	require.False(t, lastAttempt.IsZero())
+	require.EqualError(t, err, "connection refused")
+	require.True(t, LastRefresh("default").IsZero())
+
+	docs.Then("and the error is cleared once the key set endpoint can be reached again")
+	client.err = nil
+	require.Nil(t, forProvider("default").refresh(context.Background()))
+	_, err = LastAttempt("default")
+	require.Nil(t, err)
+	require.False(t, LastRefresh("default").IsZero())
+}
+
+func TestKey_rotation(t *testing.T) {
+	docs.Description("a key added by the identity provider is picked up when a token with its kid shows up")
+	jwk1, _ := tstJwk(t, "key-1")
+	jwk2, publicKey2 := tstJwk(t, "key-2")
+	client := &fakeIDPClient{keys: []idp.JsonWebKeyDto{jwk1}}
+	Setup(client)
+	require.NotNil(t, Key(context.Background(), "default", "key-1"))
+
+	client.keys = []idp.JsonWebKeyDto{jwk1, jwk2}
+	original := minRefreshInterval
+	minRefreshInterval = 0
+	defer func() { minRefreshInterval = original }()
+
+	key := Key(context.Background(), "default", "key-2")
+	require.NotNil(t, key)
+	require.True(t, publicKey2.Equal(key))
+	require.Equal(t, 2, client.calls)
+	require.False(t, LastRefresh("default").Before(time.Now().Add(-time.Minute)))
+}
+
+func TestKey_perProvider(t *testing.T) {
+	docs.Description("every identity provider has its own key set, so a kid is only accepted from the identity provider that published it")
+	jwkDefault, _ := tstJwk(t, "default-key")
+	jwkStaff, publicKeyStaff := tstJwk(t, "staff-key")
+	client := &fakeIDPClient{providerKeys: map[string][]idp.JsonWebKeyDto{
+		"default": {jwkDefault},
+		"staff":   {jwkStaff},
+	}}
+	Setup(client)
+
+	key := Key(context.Background(), "staff", "staff-key")
+	require.NotNil(t, key)
+	require.True(t, publicKeyStaff.Equal(key))
+	require.Nil(t, Key(context.Background(), "default", "staff-key"))
+	require.Equal(t, []string{"staff", "default"}, client.lastProviders)
+	require.Equal(t, 1, KeyCount("staff"))
+	require.Equal(t, 1, KeyCount("default"))
+}
+
+func TestParseKey_skipsOtherKeys(t *testing.T) {
+	docs.Description("keys that are not RSA signature keys are ignored")
+	jwk, _ := tstJwk(t, "key-1")
+	jwk.Use = "enc"
+	key, err := parseKey(jwk)
+	require.Nil(t, err)
+	require.Nil(t, key)
+
+	key, err = parseKey(idp.JsonWebKeyDto{KeyType: "EC", KeyId: "ec-key"})
+	require.Nil(t, err)
+	require.Nil(t, key)
+}
+
+func TestParseKey_invalid(t *testing.T) {
+	docs.Description("malformed keys are reported as errors")
+	jwk, _ := tstJwk(t, "key-1")
+	jwk.Modulus = "!!!"
+	_, err := parseKey(jwk)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid modulus")
+}
@@ -1,8 +1,12 @@
 package app
 
 import (
+	"context"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/tracing"
 )
 
 type Application interface {
@@ -24,11 +28,35 @@ func (i *Impl) Run() int {
 	}
 	setLoglevel(config.LoggingSeverity())
 
+	config.StartReloading(func() {
+		setLoglevel(config.LoggingSeverity())
+	})
+	defer config.StopReloading()
+
+	if err := tracing.Setup(); err != nil {
+		return 1
+	}
+	defer tracing.Shutdown(context.Background())
+
+	audit.Setup()
+	defer audit.Close()
+
+	config.StartIssuerDiscoveryRefresh()
+	defer config.StopIssuerDiscoveryRefresh()
+
+	database.PruneListener = metrics.RecordPrune
+	metrics.PendingAuthRequests = database.CountAuthRequests
 	if err := database.Open(); err != nil {
 		return 1
 	}
 	defer database.Close()
 
+	if config.MigrateDatabase() {
+		if err := database.Migrate(); err != nil {
+			return 1
+		}
+	}
+
 	if err := runServerWithGracefulShutdown(); err != nil {
 		return 2
 	}
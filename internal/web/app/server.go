@@ -7,10 +7,12 @@ import (
 	"github.com/StephanHCB/go-autumn-logging-zerolog/loggermiddleware"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/authctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/dropoffctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/healthctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/logoutctl"
+	"github.com/eurofurence/reg-auth-service/internal/web/controller/metricsctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/userinfoctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/middleware"
 	"github.com/go-chi/chi/v5"
@@ -26,7 +28,9 @@ func CreateRouter(ctx context.Context) chi.Router {
 	aulogging.Logger.NoCtx().Debug().Print("Setting up router")
 	server := chi.NewRouter()
 
+	server.Use(middleware.Tracing)
 	server.Use(middleware.AddRequestIdToContextAndResponse)
+	server.Use(middleware.AddClientInfoToContext)
 	server.Use(loggermiddleware.AddZerologLoggerToContext)
 	server.Use(middleware.RequestLogger)
 	server.Use(middleware.PanicRecoverer)
@@ -34,16 +38,26 @@ func CreateRouter(ctx context.Context) chi.Router {
 	server.Use(middleware.TokenValidator)
 
 	idpClient := idp.New()
+	keyset.Start(idpClient)
+	middleware.SetupTokenIntrospection(idpClient)
 
 	healthctl.Create(server)
 	// add your controllers here
-	authctl.Create(server)
+	authctl.Create(server, idpClient)
 	dropoffctl.Create(server, idpClient)
 	userinfoctl.Create(server, idpClient)
 	logoutctl.Create(server)
 	return server
 }
 
+// CreateMetricsRouter sets up the router for the separate admin port, if configured.
+func CreateMetricsRouter() chi.Router {
+	server := chi.NewRouter()
+	server.Use(middleware.PanicRecoverer)
+	metricsctl.Create(server)
+	return server
+}
+
 func newServer(ctx context.Context, router chi.Router) *http.Server {
 	aulogging.Logger.NoCtx().Debug().Print("setting up server")
 	return &http.Server{
@@ -67,14 +81,34 @@ func runServerWithGracefulShutdown() error {
 	handler := CreateRouter(ctx)
 	srv := newServer(ctx, handler)
 
+	var metricsSrv *http.Server
+	if config.MetricsAddr() != "" {
+		metricsSrv = newServer(ctx, CreateMetricsRouter())
+		metricsSrv.Addr = config.MetricsAddr()
+		go func() {
+			aulogging.Logger.NoCtx().Info().Print("Running metrics on ", config.MetricsAddr())
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				aulogging.Logger.NoCtx().Error().WithErr(err).Printf("Metrics server closed unexpectedly: %s", err.Error())
+			}
+		}()
+	} else {
+		aulogging.Logger.NoCtx().Info().Print("Not serving metrics, server.metrics_port is not configured")
+	}
+
 	go func() {
 		<-sig
 		defer cancel()
+		keyset.Stop()
 		aulogging.Logger.NoCtx().Debug().Print("Stopping services now")
 
 		tCtx, tcancel := context.WithTimeout(ctx, time.Second*5)
 		defer tcancel()
 
+		if metricsSrv != nil {
+			if err := metricsSrv.Shutdown(tCtx); err != nil {
+				aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("Couldn't shutdown metrics server gracefully: %s", err.Error())
+			}
+		}
 		if err := srv.Shutdown(tCtx); err != nil {
 			aulogging.Logger.NoCtx().Error().WithErr(err).Printf("Couldn't shutdown server gracefully: %s", err.Error())
 			os.Exit(3)
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
 	"math/big"
 	"net/http"
 	"net/url"
@@ -17,13 +19,24 @@ import (
 	"github.com/eurofurence/reg-auth-service/internal/entity"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
 	"github.com/go-chi/chi/v5"
 )
 
 const responseType = "code"
 const codeChallengeMethod = "S256"
 
-func Create(server chi.Router) {
+// limits for the additional query parameters that are passed through to the dropoff url
+const maxPassthroughValueLength = 256
+const maxPassthroughTotalLength = 1024 // matches the column size in entity.AuthRequest
+const maxDropOffUrlLength = 2048       // matches the column size in entity.AuthRequest
+
+var IDPClient idp.IdentityProviderClient
+
+func Create(server chi.Router, idpClient idp.IdentityProviderClient) {
+	if IDPClient == nil {
+		IDPClient = idpClient
+	}
 	server.Get("/v1/auth", authHandler)
 }
 
@@ -36,8 +49,15 @@ func Create(server chi.Router) {
  *  * dropoff_url  - where to redirect the user after a successfull authentication flow.
  *                    This URL must match the pattern of allowed URLs in the config file.
  *
- * All additional query parameters are appended to the app's redirect_url after a successfull
- * authentication. (not yet implemented)
+ * Additional query parameters listed in the app's passthrough_parameters are appended to the
+ * dropoff_url after a successfull authentication. All other query parameters are ignored.
+ * If the dropoff_url already contains a parameter of the same name, its own value wins.
+ *
+ * A short-lived flow cookie ties the state to this browser, so the flow can only be completed
+ * at the dropoff endpoint by the browser that started it.
+ *
+ * If the app uses pushed authorization requests, the authorization parameters are first sent
+ * to the identity provider directly, and the redirect only carries client_id and request_uri.
  */
 func authHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -65,11 +85,27 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	state, err := generateState()
+	extraParameters, err := extractPassthroughParameters(query, applicationConfig)
+	if err != nil {
+		authErrorHandler(ctx, w, regAppName, dropOffUrl, "", http.StatusBadRequest, err.Error(), "invalid parameters")
+		return
+	}
+	logIgnoredParameters(ctx, query, applicationConfig)
+	if len(dropOffUrl)+1+len(extraParameters) > maxDropOffUrlLength {
+		authErrorHandler(ctx, w, regAppName, dropOffUrl, "", http.StatusBadRequest, "dropoff_url including passthrough parameters is too long", "invalid parameters")
+		return
+	}
+
+	state, err := controller.GenerateState()
 	if err != nil {
 		authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusInternalServerError, "state could not be generated", "internal error")
 		return
 	}
+	nonce, err := controller.GenerateState()
+	if err != nil {
+		authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusInternalServerError, "nonce could not be generated", "internal error")
+		return
+	}
 	codeVerifier, err := generateCodeVerifier()
 	if err != nil {
 		authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusInternalServerError, "verifier could not be generated", "internal error")
@@ -77,26 +113,66 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	codeChallenge := generateCodeChallenge(codeVerifier)
 
-	err = storeFlowState(ctx, regAppName, state, codeVerifier, dropOffUrl)
+	err = storeFlowState(ctx, regAppName, state, nonce, codeVerifier, dropOffUrl, extraParameters)
 	if err != nil {
 		authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusInternalServerError, "could not store flow state", "internal error")
 		return
 	}
 
-	err = redirectToOpenIDProvider(ctx, w, applicationConfig, state, codeChallenge)
+	parameters := authorizationParameters(applicationConfig, state, nonce, codeChallenge)
+	if applicationConfig.PushedAuthorizationRequests == config.ParPreferred || applicationConfig.PushedAuthorizationRequests == config.ParRequired {
+		parameters, err = pushAuthorizationRequest(ctx, regAppName, applicationConfig, parameters)
+		if err != nil {
+			authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusBadGateway, err.Error(), "identity provider error")
+			return
+		}
+	}
+
+	http.SetCookie(w, controller.NewFlowCookie(state, applicationConfig.ResponseMode == config.ResponseModeFormPost))
+	err = redirectToOpenIDProvider(ctx, w, config.ApplicationIdentityProvider(regAppName), parameters)
 	if err != nil {
 		authErrorHandler(ctx, w, regAppName, dropOffUrl, state, http.StatusInternalServerError, err.Error(), "internal error")
 		return
 	}
+	metrics.RecordSuccess("auth", regAppName)
+	audit.Success(ctx, audit.LoginStart, regAppName, "", state)
 	aulogging.Logger.Ctx(ctx).Info().Printf("OK auth(%s,%s)[%s]", regAppName, dropOffUrl, state)
 }
 
 func authErrorHandler(ctx context.Context, w http.ResponseWriter, regAppName string, dropOffUrl string, state string, status int, logMsg string, publicMsg string) {
 	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL auth(%s,%s)[%s]: %s", regAppName, dropOffUrl, state, logMsg)
+	metrics.RecordFailure("auth", regAppName, metrics.ReasonForStatus(status))
+	audit.Failure(ctx, audit.LoginStart, regAppName, "", state, logMsg)
 	w.WriteHeader(status)
 	_, _ = w.Write(controller.ErrorResponse(ctx, publicMsg, ""))
 }
 
+// extractPassthroughParameters returns the url encoded query parameters that are allowlisted for the application.
+func extractPassthroughParameters(query url.Values, applicationConfig config.ApplicationConfig) (string, error) {
+	extra := url.Values{}
+	for _, name := range applicationConfig.PassthroughParams {
+		for _, value := range query[name] {
+			if len(value) > maxPassthroughValueLength {
+				return "", fmt.Errorf("value of parameter %s exceeds %d characters", name, maxPassthroughValueLength)
+			}
+			extra.Add(name, value)
+		}
+	}
+	encoded := extra.Encode()
+	if len(encoded) > maxPassthroughTotalLength {
+		return "", fmt.Errorf("passthrough parameters exceed %d characters", maxPassthroughTotalLength)
+	}
+	return encoded, nil
+}
+
+func logIgnoredParameters(ctx context.Context, query url.Values, applicationConfig config.ApplicationConfig) {
+	for name := range query {
+		if config.NotInAllowedValues(config.ReservedAuthParameters, name) && config.NotInAllowedValues(applicationConfig.PassthroughParams, name) {
+			aulogging.Logger.Ctx(ctx).Info().Printf("ignoring query parameter %s not allowed for application", name)
+		}
+	}
+}
+
 func validateDropOffURL(ctx context.Context, w http.ResponseWriter, exp string, dropOffUrl string) bool {
 	match, err := regexp.MatchString(exp, dropOffUrl)
 	if err != nil {
@@ -106,25 +182,6 @@ func validateDropOffURL(ctx context.Context, w http.ResponseWriter, exp string,
 	return match
 }
 
-/* according to RFC 6749, "state" is defined as one or more characters within
- * the range of US ASCII  %20 - %7E (printable ASCII characters). See here:
- *
- *    https://datatracker.ietf.org/doc/html/rfc6749#appendix-A.5
- */
-func generateState() (string, error) {
-	const letters string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	const length = 40
-	state := make([]byte, length)
-	for i := 0; i < length; i++ {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
-		if err != nil {
-			return "", err
-		}
-		state[i] = letters[num.Int64()]
-	}
-	return string(state), nil
-}
-
 /* according to RFC 7636, the "code verifier" is defined as between 43 and 128
  * characters within the range of US ASCII a-zA-Z0-9 and any of "-", ".", "_" or "~".
  * See here:
@@ -158,29 +215,69 @@ func generateCodeChallenge(verifier string) string {
 	return base64.RawURLEncoding.EncodeToString(hash)
 }
 
-func storeFlowState(ctx context.Context, regAppName string, state string, codeVerifier string, dropOffUrl string) error {
+func storeFlowState(ctx context.Context, regAppName string, state string, nonce string, codeVerifier string, dropOffUrl string, extraParameters string) error {
 	return database.GetRepository().AddAuthRequest(ctx, &entity.AuthRequest{
 		Application:      regAppName,
 		State:            state,
+		Nonce:            nonce,
 		PkceCodeVerifier: codeVerifier,
+		Purpose:          entity.AuthRequestLogin,
 		DropOffUrl:       dropOffUrl,
+		ExtraParameters:  extraParameters,
 		ExpiresAt:        time.Now().Add(config.AuthRequestTimeout()),
 	})
 }
 
-func redirectToOpenIDProvider(ctx context.Context, w http.ResponseWriter, applicationConfig config.ApplicationConfig, state string, codeChallenge string) error {
-	u, err := url.Parse(config.AuthorizationEndpoint())
+func authorizationParameters(applicationConfig config.ApplicationConfig, state string, nonce string, codeChallenge string) url.Values {
+	parameters := url.Values{}
+	parameters.Set("response_type", responseType)
+	parameters.Set("client_id", applicationConfig.ClientId)
+	parameters.Set("scope", applicationConfig.Scope)
+	parameters.Set("state", state)
+	parameters.Set("nonce", nonce)
+	parameters.Set("code_challenge", codeChallenge)
+	parameters.Set("code_challenge_method", codeChallengeMethod)
+	parameters.Set("redirect_url", config.DropoffEndpointUrl())
+	if applicationConfig.ResponseMode == config.ResponseModeFormPost {
+		parameters.Set("response_mode", string(config.ResponseModeFormPost))
+	}
+	return parameters
+}
+
+/* pushAuthorizationRequest sends the authorization parameters to the identity provider's
+ * pushed authorization request endpoint, and returns the parameters for the redirect in their place.
+ * See here:
+ *
+ *    https://datatracker.ietf.org/doc/html/rfc9126
+ *
+ * If the identity provider returns an error, this is an error if the app's pushed_authorization_requests
+ * is set to required. If it is set to preferred, we fall back to sending all parameters in the redirect.
+ */
+func pushAuthorizationRequest(ctx context.Context, regAppName string, applicationConfig config.ApplicationConfig, parameters url.Values) (url.Values, error) {
+	response, _, err := IDPClient.PushAuthorizationRequest(ctx, regAppName, parameters)
+	if err != nil {
+		if applicationConfig.PushedAuthorizationRequests == config.ParRequired {
+			return nil, fmt.Errorf("pushed authorization request failed: %s", err.Error())
+		}
+		aulogging.Logger.Ctx(ctx).Warn().Printf("pushed authorization request failed, falling back to plain redirect: %s", err.Error())
+		return parameters, nil
+	}
+
+	pushed := url.Values{}
+	pushed.Set("client_id", applicationConfig.ClientId)
+	pushed.Set("request_uri", response.RequestUri)
+	return pushed, nil
+}
+
+func redirectToOpenIDProvider(ctx context.Context, w http.ResponseWriter, provider string, parameters url.Values) error {
+	u, err := url.Parse(config.ProviderAuthorizationEndpoint(provider))
 	if err != nil {
 		return fmt.Errorf("could not parse auth endpoint url")
 	}
 	q := u.Query()
-	q.Set("response_type", responseType)
-	q.Set("client_id", applicationConfig.ClientId)
-	q.Set("scope", applicationConfig.Scope)
-	q.Set("state", state)
-	q.Set("code_challenge", codeChallenge)
-	q.Set("code_challenge_method", codeChallengeMethod)
-	q.Set("redirect_url", config.DropoffEndpointUrl())
+	for name, values := range parameters {
+		q[name] = values
+	}
 	u.RawQuery = q.Encode()
 	w.Header().Set("Location", u.String())
 	w.WriteHeader(http.StatusFound)
@@ -1,7 +1,10 @@
 package authctl
 
 import (
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/stretchr/testify/require"
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -13,3 +16,23 @@ func TestVerifierEncode(t *testing.T) {
 
 	require.Equal(t, knownChallenge, actualChallenge)
 }
+
+func TestExtractPassthroughParameters(t *testing.T) {
+	appConfig := config.ApplicationConfig{PassthroughParams: []string{"lang", "step"}}
+	query := url.Values{"app_name": {"app"}, "lang": {"en"}, "step": {"1", "2"}, "other": {"x"}}
+
+	actual, err := extractPassthroughParameters(query, appConfig)
+
+	require.Nil(t, err)
+	require.Equal(t, "lang=en&step=1&step=2", actual)
+}
+
+func TestExtractPassthroughParameters_valueTooLong(t *testing.T) {
+	appConfig := config.ApplicationConfig{PassthroughParams: []string{"lang"}}
+	query := url.Values{"lang": {strings.Repeat("x", maxPassthroughValueLength+1)}}
+
+	_, err := extractPassthroughParameters(query, appConfig)
+
+	require.NotNil(t, err)
+	require.Equal(t, "value of parameter lang exceeds 256 characters", err.Error())
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/session"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/eurofurence/reg-auth-service/internal/entity"
@@ -22,6 +26,8 @@ func Create(server chi.Router, idpClient idp.IdentityProviderClient) {
 		IDPClient = idpClient
 	}
 	server.Get("/v1/dropoff", dropOffHandler)
+	server.Post("/v1/dropoff", dropOffHandler)
+	server.Post("/v1/refresh", refreshHandler)
 }
 
 /* Handle /dropoff requests.
@@ -29,72 +35,170 @@ func Create(server chi.Router, idpClient idp.IdentityProviderClient) {
  * Required parameters are:
  *  * state - random-string identifier of this flow
  *  * code  - temporary credential to obtain the access token from the OIDC
+ *
+ * The state must match the flow cookie set by the auth endpoint, so a flow started in one browser
+ * cannot be completed in another (login CSRF).
+ *
+ * The id token obtained from the OIDC is validated (signature, iss, aud, exp, nonce, at_hash)
+ * before any cookies are set.
+ *
+ * Applications with server_side_sessions keep the tokens in the database, and only get a session id cookie.
+ *
+ * Applications with response_mode form_post receive the parameters as a POST form body
+ * instead of in the query, so code and state never appear in urls.
  */
 func dropOffHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	query := r.URL.Query()
+	formPost := r.Method == http.MethodPost
+	if formPost {
+		if err := r.ParseForm(); err != nil {
+			dropOffErrorHandler(ctx, w, "", "", http.StatusBadRequest, "failed to parse form body: "+err.Error(), "invalid parameters", config.ErrorUrl())
+			return
+		}
+		query = r.PostForm
+	}
 	state := query.Get("state")
 	if state == "" {
-		dropOffErrorHandler(ctx, w, state, http.StatusBadRequest, "state parameter is missing", "invalid parameters", config.ErrorUrl())
+		dropOffErrorHandler(ctx, w, state, "", http.StatusBadRequest, "state parameter is missing", "invalid parameters", config.ErrorUrl())
+		return
+	}
+
+	if err := controller.VerifyFlowCookie(r, state); err != nil {
+		dropOffErrorHandler(ctx, w, state, "", http.StatusForbidden, err.Error(), "please complete the login in the browser you started it in", config.ErrorUrl())
+		return
+	}
+
+	// look at the auth request first, so a request with the wrong response mode does not burn the state
+	pendingRequest, err := database.GetRepository().GetAuthRequestByState(ctx, state)
+	if err != nil {
+		dropOffErrorHandler(ctx, w, state, "", http.StatusNotFound, "couldn't load auth request: "+err.Error(), "auth request not found or timed out", config.ErrorUrl())
 		return
 	}
 
-	authRequest, err := database.GetRepository().GetAuthRequestByState(ctx, state)
+	applicationConfig, err := config.GetApplicationConfig(pendingRequest.Application)
 	if err != nil {
-		dropOffErrorHandler(ctx, w, state, http.StatusNotFound, "couldn't load auth request: "+err.Error(), "auth request not found or timed out", config.ErrorUrl())
+		dropOffErrorHandler(ctx, w, state, pendingRequest.Application, http.StatusInternalServerError, "couldn't load application config: "+err.Error(), "internal error", config.ErrorUrl())
+		return
+	}
+	if formPost != (applicationConfig.ResponseMode == config.ResponseModeFormPost) {
+		dropOffErrorHandler(ctx, w, state, pendingRequest.Application, http.StatusBadRequest, fmt.Sprintf("%s does not match the response_mode of the application", r.Method), "invalid parameters", config.ErrorUrl())
 		return
 	}
 
-	applicationConfig, err := config.GetApplicationConfig(authRequest.Application)
+	// consuming the auth request ensures each state can only be redeemed once
+	authRequest, err := database.GetRepository().ConsumeAuthRequestByState(ctx, state, entity.AuthRequestLogin)
 	if err != nil {
-		dropOffErrorHandler(ctx, w, state, http.StatusInternalServerError, "couldn't load application config: "+err.Error(), "internal error", config.ErrorUrl())
+		dropOffErrorHandler(ctx, w, state, pendingRequest.Application, http.StatusNotFound, "couldn't load auth request: "+err.Error(), "auth request not found or timed out", config.ErrorUrl())
 		return
 	}
 
 	errorCode := query.Get("error")
 	errorDescription := query.Get("error_description")
 	if errorCode != "" {
-		dropOffErrorHandler(ctx, w, state, http.StatusBadRequest, fmt.Sprintf("error parameter set (%s|%s)", errorCode, errorDescription), fmt.Sprintf("%s: %s", errorCode, errorDescription), applicationConfig.DefaultDropoffUrl)
+		dropOffErrorHandler(ctx, w, state, authRequest.Application, http.StatusBadRequest, fmt.Sprintf("error parameter set (%s|%s)", errorCode, errorDescription), fmt.Sprintf("%s: %s", errorCode, errorDescription), applicationConfig.DefaultDropoffUrl)
 		return
 	}
 
 	authCode := query.Get("code")
 	if authCode == "" {
-		dropOffErrorHandler(ctx, w, state, http.StatusBadRequest, "authorization_code parameter is missing", "invalid parameters", config.ErrorUrl())
+		dropOffErrorHandler(ctx, w, state, authRequest.Application, http.StatusBadRequest, "authorization_code parameter is missing", "invalid parameters", config.ErrorUrl())
 		return
 	}
 
-	idToken, accessToken, httpstatus, err := fetchToken(ctx, authCode, *authRequest)
+	tokens, httpstatus, err := fetchToken(ctx, authCode, *authRequest)
 	if err != nil {
-		dropOffErrorHandler(ctx, w, state, httpstatus, "couldn't fetch access codes: "+err.Error(), "failed to fetch token", config.ErrorUrl())
+		dropOffErrorHandler(ctx, w, state, authRequest.Application, httpstatus, "couldn't fetch access codes: "+err.Error(), "failed to fetch token", config.ErrorUrl())
 		return
 	}
 
-	err = setCookiesAndRedirectToDropOffUrl(ctx, w, idToken, accessToken, *authRequest, applicationConfig)
+	subject, err := validateIdToken(ctx, tokens.IdToken, tokens.AccessToken, *authRequest, applicationConfig)
 	if err != nil {
-		dropOffErrorHandler(ctx, w, state, http.StatusInternalServerError, err.Error(), "internal error", "")
+		dropOffErrorHandler(ctx, w, state, authRequest.Application, http.StatusUnauthorized, "id token failed validation: "+err.Error(), "identity provider returned an invalid id token", config.ErrorUrl())
 		return
 	}
+
+	http.SetCookie(w, controller.ExpiredFlowCookie(state, formPost))
+	err = setCookiesAndRedirectToDropOffUrl(ctx, w, tokens, subject, *authRequest, applicationConfig)
+	if err != nil {
+		dropOffErrorHandler(ctx, w, state, authRequest.Application, http.StatusInternalServerError, err.Error(), "internal error", "")
+		return
+	}
+	metrics.RecordSuccess("dropoff", authRequest.Application)
+	audit.Success(ctx, audit.LoginSuccess, authRequest.Application, subject, state)
 	aulogging.Logger.Ctx(ctx).Info().Printf("OK dropoff[%s]", state)
 }
 
-func dropOffErrorHandler(ctx context.Context, w http.ResponseWriter, state string, status int, logMsg string, publicMsg string, retryUrl string) {
+func dropOffErrorHandler(ctx context.Context, w http.ResponseWriter, state string, regAppName string, status int, logMsg string, publicMsg string, retryUrl string) {
 	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL dropoff[%s]: %s", state, logMsg)
+	metrics.RecordFailure("dropoff", regAppName, metrics.ReasonForStatus(status))
+	audit.Failure(ctx, audit.LoginFailure, regAppName, "", state, logMsg)
 	w.WriteHeader(status)
 	_, _ = w.Write(controller.ErrorResponse(ctx, publicMsg, retryUrl))
 }
 
-func fetchToken(ctx context.Context, authCode string, ar entity.AuthRequest) (string, string, int, error) {
+func fetchToken(ctx context.Context, authCode string, ar entity.AuthRequest) (*idp.TokenResponseDto, int, error) {
 	response, httpstatus, err := IDPClient.TokenWithAuthenticationCodeAndPKCE(ctx, ar.Application, authCode, ar.PkceCodeVerifier)
 	if err != nil {
-		return "", "", httpstatus, err
+		return nil, httpstatus, err
 	}
-	return response.IdToken, response.AccessToken, httpstatus, nil
+	return response, httpstatus, nil
+}
+
+func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWriter, tokens *idp.TokenResponseDto, subject string, authRequest entity.AuthRequest, applicationConfig config.ApplicationConfig) error {
+	err := setCookies(ctx, w, tokens, subject, authRequest.Application, applicationConfig)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", appendPassthroughParameters(ctx, authRequest.DropOffUrl, authRequest.ExtraParameters))
+	if applicationConfig.ResponseMode == config.ResponseModeFormPost {
+		// makes the browser follow up the form post with a GET
+		w.WriteHeader(http.StatusSeeOther)
+	} else {
+		w.WriteHeader(http.StatusFound)
+	}
+	return nil
 }
 
-func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWriter, idToken string, accessToken string, authRequest entity.AuthRequest, applicationConfig config.ApplicationConfig) error {
-	sameSite := http.SameSiteStrictMode
+// appendPassthroughParameters adds the extra parameters of the auth request to the dropoff url.
+//
+// Parameters already present in the dropoff url take precedence, the existing query and fragment are left untouched.
+func appendPassthroughParameters(ctx context.Context, dropOffUrl string, extraParameters string) string {
+	if extraParameters == "" {
+		return dropOffUrl
+	}
+	extra, err := url.ParseQuery(extraParameters)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("dropping unparseable passthrough parameters: %s", err.Error())
+		return dropOffUrl
+	}
+	u, err := url.Parse(dropOffUrl)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("dropping passthrough parameters, dropoff url unparseable: %s", err.Error())
+		return dropOffUrl
+	}
+	existing := u.Query()
+	for name := range extra {
+		if _, collides := existing[name]; collides {
+			aulogging.Logger.Ctx(ctx).Info().Printf("dropping passthrough parameter %s, already present in dropoff url", name)
+			delete(extra, name)
+		}
+	}
+	if len(extra) == 0 {
+		return dropOffUrl
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = extra.Encode()
+	} else {
+		u.RawQuery = u.RawQuery + "&" + extra.Encode()
+	}
+	return u.String()
+}
+
+func setCookies(ctx context.Context, w http.ResponseWriter, tokens *idp.TokenResponseDto, subject string, applicationName string, applicationConfig config.ApplicationConfig) error {
+	sameSite := controller.CookieSameSite(applicationConfig)
 	httpOnly := true // https://stackoverflow.com/questions/71819265/httponly-cookie-and-fetch
 	secure := true
 	if config.SendInsecureCookies() {
@@ -102,7 +206,6 @@ func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWrite
 		aulogging.Logger.Ctx(ctx).Warn().Print("sending insecure cookies. This configuration is not intended for production use, only for local development!")
 	}
 	if config.IsCorsDisabled() {
-		sameSite = http.SameSiteNoneMode
 		aulogging.Logger.Ctx(ctx).Warn().Print("sending Same Site Policy None cookies to work with disabled CORS. This configuration is not intended for production use, only for local development!")
 	}
 	if config.SendNonHttpOnlyCookies() {
@@ -110,10 +213,30 @@ func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWrite
 		aulogging.Logger.Ctx(ctx).Warn().Print("sending non-http-only cookies. This configuration is not intended for production use, only for local development!")
 	}
 
+	if applicationConfig.ServerSideSessions {
+		// the tokens stay with us, the browser only gets the session id
+		sessionId, err := session.New(ctx, applicationName, tokens.IdToken, tokens.AccessToken, tokens.RefreshToken, applicationConfig.CookieExpiry)
+		if err != nil {
+			return fmt.Errorf("failed to store session: %s", err.Error())
+		}
+		http.SetCookie(w, controller.NewSessionCookie(applicationName, applicationConfig, sessionId))
+		return nil
+	}
+
+	// if the identity provider does not rotate refresh tokens, we keep the cookie we already have
+	encryptedRefreshToken := ""
+	if config.OidcRefreshTokenCookieName() != "" && tokens.RefreshToken != "" {
+		var err error
+		encryptedRefreshToken, err = encryptRefreshToken(tokens.RefreshToken, subject, applicationName)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt refresh token: %s", err.Error())
+		}
+	}
+
 	// first set the cookie wanted by the application
 	applicationCookie := &http.Cookie{
 		Name:     applicationConfig.CookieName,
-		Value:    idToken,
+		Value:    tokens.IdToken,
 		Domain:   applicationConfig.CookieDomain,
 		Expires:  time.Now().Add(applicationConfig.CookieExpiry),
 		Path:     applicationConfig.CookiePath,
@@ -127,7 +250,7 @@ func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWrite
 		// additional cookie needed for this service
 		accessCookie := &http.Cookie{
 			Name:     config.OidcAccessTokenCookieName(),
-			Value:    accessToken,
+			Value:    tokens.AccessToken,
 			Domain:   applicationConfig.CookieDomain,
 			Expires:  time.Now().Add(applicationConfig.CookieExpiry),
 			Path:     applicationConfig.CookiePath,
@@ -138,7 +261,19 @@ func setCookiesAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWrite
 		http.SetCookie(w, accessCookie)
 	}
 
-	w.Header().Set("Location", authRequest.DropOffUrl)
-	w.WriteHeader(http.StatusFound)
+	if encryptedRefreshToken != "" {
+		refreshCookie := &http.Cookie{
+			Name:     config.OidcRefreshTokenCookieName(),
+			Value:    encryptedRefreshToken,
+			Domain:   applicationConfig.CookieDomain,
+			Expires:  time.Now().Add(applicationConfig.CookieExpiry),
+			Path:     applicationConfig.CookiePath,
+			Secure:   secure,
+			HttpOnly: true, // never needed by javascript, not even during local development
+			SameSite: sameSite,
+		}
+		http.SetCookie(w, refreshCookie)
+	}
+
 	return nil
 }
@@ -0,0 +1,145 @@
+package dropoffctl
+
+import (
+	"context"
+	"crypto"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce  string `json:"nonce"`
+	AtHash string `json:"at_hash,omitempty"`
+}
+
+// validateIdToken checks the id token returned by the token endpoint before we hand it out in a cookie.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func validateIdToken(ctx context.Context, idToken string, accessToken string, authRequest entity.AuthRequest, applicationConfig config.ApplicationConfig) (subject string, err error) {
+	claims, method, err := parseIdToken(ctx, idToken, authRequest.Application)
+	if err != nil {
+		return "", err
+	}
+	provider := config.ApplicationIdentityProvider(authRequest.Application)
+	if err := checkIdTokenClaims(claims, method, config.ProviderAllowedIssuer(provider), applicationConfig.ClientId, authRequest.Nonce, accessToken); err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// validateRefreshedIdToken checks the id token returned by a refresh before we hand it out in a cookie
+// or store it in a session.
+//
+// There is no nonce to compare against, but the token must still be for the same user.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokenResponse
+func validateRefreshedIdToken(ctx context.Context, idToken string, accessToken string, applicationName string, applicationConfig config.ApplicationConfig, subject string) error {
+	claims, method, err := parseIdToken(ctx, idToken, applicationName)
+	if err != nil {
+		return err
+	}
+	provider := config.ApplicationIdentityProvider(applicationName)
+	return checkRefreshedIdTokenClaims(claims, method, config.ProviderAllowedIssuer(provider), applicationConfig.ClientId, subject, accessToken)
+}
+
+// parseIdToken verifies the signature of an id token against the keys of the identity provider
+// the application logs in with.
+func parseIdToken(ctx context.Context, idToken string, applicationName string) (*idTokenClaims, jwt.SigningMethod, error) {
+	tokenString := strings.TrimSpace(idToken)
+	if tokenString == "" {
+		return nil, nil, errors.New("token response contains no id token")
+	}
+
+	provider := config.ApplicationIdentityProvider(applicationName)
+	errorMessage := "no keys available to validate token"
+	for _, key := range keyset.CandidateKeys(ctx, provider, tokenString) {
+		claims := idTokenClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+			return key, nil
+		}, jwt.WithValidMethods([]string{"RS256", "RS512"}))
+		if err != nil {
+			errorMessage = err.Error()
+			continue
+		}
+		if !token.Valid {
+			errorMessage = "token parsed but invalid"
+			continue
+		}
+		return &claims, token.Method, nil
+	}
+	return nil, nil, errors.New(errorMessage)
+}
+
+func checkIdTokenClaims(claims *idTokenClaims, method jwt.SigningMethod, issuer string, clientId string, nonce string, accessToken string) error {
+	if err := checkCommonIdTokenClaims(claims, method, issuer, clientId, accessToken); err != nil {
+		return err
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return errors.New("token nonce does not match")
+	}
+	return nil
+}
+
+func checkRefreshedIdTokenClaims(claims *idTokenClaims, method jwt.SigningMethod, issuer string, clientId string, subject string, accessToken string) error {
+	if err := checkCommonIdTokenClaims(claims, method, issuer, clientId, accessToken); err != nil {
+		return err
+	}
+	if subject == "" || claims.Subject != subject {
+		return errors.New("token subject does not match")
+	}
+	return nil
+}
+
+func checkCommonIdTokenClaims(claims *idTokenClaims, method jwt.SigningMethod, issuer string, clientId string, accessToken string) error {
+	if issuer == "" {
+		// configuration validation prevents this, but we never accept tokens from just any issuer
+		return errors.New("no issuer known for the identity provider")
+	}
+	if !config.SameIssuer(claims.Issuer, issuer) {
+		return errors.New("token issuer does not match")
+	}
+	if !claims.VerifyAudience(clientId, true) {
+		return errors.New("token audience does not contain client id")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no exp claim")
+	}
+	if claims.AtHash != "" {
+		expected, err := accessTokenHash(method, accessToken)
+		if err != nil {
+			return err
+		}
+		if claims.AtHash != expected {
+			return errors.New("token at_hash does not match access token")
+		}
+	}
+	return nil
+}
+
+// accessTokenHash is the base64url encoded left half of the hash of the access token, using the
+// hash algorithm of the id token signature.
+func accessTokenHash(method jwt.SigningMethod, accessToken string) (string, error) {
+	var hash crypto.Hash
+	switch method.Alg() {
+	case "RS256":
+		hash = crypto.SHA256
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return "", fmt.Errorf("cannot verify at_hash for signing method %s", method.Alg())
+	}
+	h := hash.New()
+	h.Write([]byte(accessToken))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
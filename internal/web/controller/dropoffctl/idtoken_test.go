@@ -0,0 +1,119 @@
+package dropoffctl
+
+import (
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAccessTokenHash(t *testing.T) {
+	docs.Description("the at_hash of an id token is the left half of the hash of the access token")
+	docs.When("when the at_hash of an access token is calculated for RS256")
+	actual, err := accessTokenHash(jwt.SigningMethodRS256, "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ")
+
+	docs.Then("then it is based on sha256")
+	require.Nil(t, err)
+	require.Equal(t, "eQCFxsuC7BZhcBcJgb12rQ", actual)
+}
+
+func TestAccessTokenHash_RS512(t *testing.T) {
+	docs.Description("the hash function for the at_hash depends on the signing method of the id token")
+	docs.When("when the at_hash of an access token is calculated for RS512")
+	actual, err := accessTokenHash(jwt.SigningMethodRS512, "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ")
+
+	docs.Then("then it is based on sha512")
+	require.Nil(t, err)
+	require.Equal(t, "jHHb1GmmMDhjqVTTD3_jMhVmkJ3m2s_BlRSdbJ58wAI", actual)
+}
+
+func tstValidIdTokenClaims() *idTokenClaims {
+	return &idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "http://identity.localhost/",
+			Audience:  jwt.ClaimStrings{"client"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Nonce:  "nonce",
+		AtHash: "eQCFxsuC7BZhcBcJgb12rQ",
+	}
+}
+
+func TestCheckIdTokenClaims_valid(t *testing.T) {
+	docs.Description("id tokens with matching issuer, audience, nonce and at_hash are accepted")
+	docs.When("when the claims of a valid id token are checked")
+	err := checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost/", "client", "nonce", "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ")
+
+	docs.Then("then they are accepted")
+	require.Nil(t, err)
+}
+
+func TestCheckIdTokenClaims_issuerTrailingSlash(t *testing.T) {
+	docs.Description("issuers that only differ in a trailing slash are the same issuer")
+	docs.When("when the issuer is configured without the trailing slash the token has")
+	err := checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost", "client", "nonce", "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ")
+
+	docs.Then("then the id token is accepted")
+	require.Nil(t, err)
+}
+
+func TestCheckIdTokenClaims_noAtHash(t *testing.T) {
+	docs.Description("the at_hash claim is optional in id tokens from the token endpoint")
+	docs.Given("given an id token without at_hash")
+	claims := tstValidIdTokenClaims()
+	claims.AtHash = ""
+
+	docs.When("when its claims are checked")
+	err := checkIdTokenClaims(claims, jwt.SigningMethodRS256, "http://identity.localhost/", "client", "nonce", "some_access_token")
+
+	docs.Then("then they are accepted with any access token")
+	require.Nil(t, err)
+}
+
+func TestCheckIdTokenClaims_invalid(t *testing.T) {
+	docs.Description("id tokens are rejected if any of the checked claims does not match")
+	accessToken := "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ"
+
+	docs.Then("then issuer, audience, nonce and at_hash must match")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://other.localhost/", "client", "nonce", accessToken),
+		"token issuer does not match")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost/", "other-client", "nonce", accessToken),
+		"token audience does not contain client id")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost/", "client", "other-nonce", accessToken),
+		"token nonce does not match")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost/", "client", "", accessToken),
+		"token nonce does not match")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "http://identity.localhost/", "client", "nonce", "other_access_token"),
+		"token at_hash does not match access token")
+
+	docs.Then("and tokens are never accepted if no issuer is known for the identity provider")
+	require.EqualError(t, checkIdTokenClaims(tstValidIdTokenClaims(), jwt.SigningMethodRS256, "", "client", "nonce", accessToken),
+		"no issuer known for the identity provider")
+
+	docs.Then("and the exp claim is required")
+	noExpiry := tstValidIdTokenClaims()
+	noExpiry.ExpiresAt = nil
+	require.EqualError(t, checkIdTokenClaims(noExpiry, jwt.SigningMethodRS256, "http://identity.localhost/", "client", "nonce", accessToken),
+		"token has no exp claim")
+}
+
+func TestCheckRefreshedIdTokenClaims(t *testing.T) {
+	docs.Description("id tokens from a refresh must belong to the subject of the session and carry no nonce")
+	docs.Given("given the claims of an id token returned by a refresh")
+	accessToken := "jHkWEdUXMU1BwAsC4vtUsZwnNTUNMT0rWBzkEgFYHDQ"
+	claims := tstValidIdTokenClaims()
+	claims.Subject = "101"
+	claims.Nonce = ""
+
+	docs.Then("then they are accepted for the same subject")
+	require.Nil(t, checkRefreshedIdTokenClaims(claims, jwt.SigningMethodRS256, "http://identity.localhost/", "client", "101", accessToken))
+
+	docs.Then("and rejected for another or unknown subject, or another issuer")
+	require.EqualError(t, checkRefreshedIdTokenClaims(claims, jwt.SigningMethodRS256, "http://identity.localhost/", "client", "102", accessToken),
+		"token subject does not match")
+	require.EqualError(t, checkRefreshedIdTokenClaims(claims, jwt.SigningMethodRS256, "http://identity.localhost/", "client", "", accessToken),
+		"token subject does not match")
+	require.EqualError(t, checkRefreshedIdTokenClaims(claims, jwt.SigningMethodRS256, "http://other.localhost/", "client", "101", accessToken),
+		"token issuer does not match")
+}
@@ -0,0 +1,266 @@
+package dropoffctl
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/errorapi"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/controller"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/session"
+	"github.com/go-http-utils/headers"
+	"github.com/golang-jwt/jwt/v4"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/* Handle /refresh requests.
+ *
+ * Renews the id and access token cookies using the refresh token kept in the (encrypted) refresh
+ * token cookie, without sending the user agent through the identity provider. Call this via fetch/XHR
+ * before the tokens expire, or when you get a 401 response.
+ *
+ * For applications with server_side_sessions, the tokens in the session are renewed instead.
+ *
+ * Required parameters are:
+ *  * app_name  - the name of the application that the user is logged in to
+ *
+ * Responds with 204 and updated cookies on success, and 401 if the session cannot be renewed
+ * (in which case you need to send the user through /auth again).
+ */
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	regAppName := r.URL.Query().Get("app_name")
+	if regAppName == "" {
+		refreshErrorHandler(ctx, w, http.StatusBadRequest, "auth.refresh.invalid", "app_name parameter is missing", "app_name parameter is missing")
+		return
+	}
+
+	applicationConfig, err := config.GetApplicationConfig(regAppName)
+	if err != nil {
+		refreshErrorHandler(ctx, w, http.StatusNotFound, "auth.refresh.invalid", "app_name is unknown", err.Error())
+		return
+	}
+
+	if applicationConfig.ServerSideSessions {
+		refreshSession(ctx, w, r, regAppName, applicationConfig)
+		return
+	}
+
+	if config.OidcRefreshTokenCookieName() == "" {
+		refreshErrorHandler(ctx, w, http.StatusNotFound, "auth.refresh.disabled", "refresh tokens are not enabled", "refresh called but security.oidc.refresh_token_cookie_name is not configured")
+		return
+	}
+
+	refreshCookie, _ := r.Cookie(config.OidcRefreshTokenCookieName())
+	if refreshCookie == nil || refreshCookie.Value == "" {
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "no refresh token available, please log in again", "refresh token cookie missing")
+		return
+	}
+
+	refreshToken, subject, err := decryptRefreshToken(refreshCookie.Value, regAppName)
+	if err != nil {
+		clearRefreshCookie(w, applicationConfig)
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "invalid refresh token, please log in again", "failed to decrypt refresh token cookie: "+err.Error())
+		return
+	}
+
+	tokens, httpstatus, err := IDPClient.RefreshToken(ctx, regAppName, refreshToken)
+	if err != nil {
+		if httpstatus == http.StatusBadRequest || httpstatus == http.StatusUnauthorized {
+			// refresh token expired or revoked (invalid_grant), the user needs to log in again
+			clearRefreshCookie(w, applicationConfig)
+			refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "identity provider rejected the refresh token, please log in again", err.Error())
+			return
+		}
+		refreshErrorHandler(ctx, w, http.StatusBadGateway, "auth.idp.error", "identity provider could not be reached - see log for details", err.Error())
+		return
+	}
+
+	err = validateRefreshedIdToken(ctx, tokens.IdToken, tokens.AccessToken, regAppName, applicationConfig, subject)
+	if err != nil {
+		clearRefreshCookie(w, applicationConfig)
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "identity provider returned an invalid id token, please log in again", "refreshed id token failed validation: "+err.Error())
+		return
+	}
+
+	err = setCookies(ctx, w, tokens, subject, regAppName, applicationConfig)
+	if err != nil {
+		refreshErrorHandler(ctx, w, http.StatusInternalServerError, "auth.internal.error", "internal error", err.Error())
+		return
+	}
+	w.Header().Set(headers.CacheControl, "no-store")
+	w.WriteHeader(http.StatusNoContent)
+	aulogging.Logger.Ctx(ctx).Info().Printf("OK v1/refresh(%s) -> %d", regAppName, http.StatusNoContent)
+}
+
+// refreshSession renews the tokens kept in a server-side session. The session id stays the same.
+func refreshSession(ctx context.Context, w http.ResponseWriter, r *http.Request, regAppName string, applicationConfig config.ApplicationConfig) {
+	sessionId := session.IdFromCookie(r, regAppName)
+	if sessionId == "" {
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "no session available, please log in again", "session cookie missing")
+		return
+	}
+
+	s, err := session.Get(ctx, sessionId)
+	if err != nil {
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "session not found or expired, please log in again", err.Error())
+		return
+	}
+	if s.Application != regAppName {
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "session belongs to another application, please log in again", "session was created for application "+s.Application)
+		return
+	}
+	if s.RefreshToken == "" {
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "no refresh token available, please log in again", "identity provider did not issue a refresh token for this session")
+		return
+	}
+
+	tokens, httpstatus, err := IDPClient.RefreshToken(ctx, regAppName, s.RefreshToken)
+	if err != nil {
+		if httpstatus == http.StatusBadRequest || httpstatus == http.StatusUnauthorized {
+			// refresh token expired or revoked (invalid_grant), the user needs to log in again
+			_ = session.Delete(ctx, sessionId)
+			refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "identity provider rejected the refresh token, please log in again", err.Error())
+			return
+		}
+		refreshErrorHandler(ctx, w, http.StatusBadGateway, "auth.idp.error", "identity provider could not be reached - see log for details", err.Error())
+		return
+	}
+
+	subject, err := subjectOfIdToken(s.IdToken)
+	if err == nil {
+		err = validateRefreshedIdToken(ctx, tokens.IdToken, tokens.AccessToken, regAppName, applicationConfig, subject)
+	}
+	if err != nil {
+		_ = session.Delete(ctx, sessionId)
+		refreshErrorHandler(ctx, w, http.StatusUnauthorized, "auth.unauthorized", "identity provider returned an invalid id token, please log in again", "refreshed id token failed validation: "+err.Error())
+		return
+	}
+
+	// if the identity provider does not rotate refresh tokens, we keep the one we already have
+	refreshToken := s.RefreshToken
+	if tokens.RefreshToken != "" {
+		refreshToken = tokens.RefreshToken
+	}
+	err = session.UpdateTokens(ctx, sessionId, tokens.IdToken, tokens.AccessToken, refreshToken)
+	if err != nil {
+		refreshErrorHandler(ctx, w, http.StatusInternalServerError, "auth.internal.error", "internal error", err.Error())
+		return
+	}
+	w.Header().Set(headers.CacheControl, "no-store")
+	w.WriteHeader(http.StatusNoContent)
+	aulogging.Logger.Ctx(ctx).Info().Printf("OK v1/refresh(%s) -> %d", regAppName, http.StatusNoContent)
+}
+
+func refreshErrorHandler(ctx context.Context, w http.ResponseWriter, status int, msg string, details string, logMsg string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL v1/refresh -> %d: %s", status, logMsg)
+	timestamp := time.Now().Format(time.RFC3339)
+	response := errorapi.ErrorDto{Message: msg, Timestamp: timestamp, Details: url.Values{"details": []string{details}}, RequestId: ctxvalues.RequestId(ctx)}
+	w.Header().Set(headers.ContentType, media.ContentTypeApplicationJson)
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("error while encoding json response: %s", err.Error())
+	}
+}
+
+func clearRefreshCookie(w http.ResponseWriter, applicationConfig config.ApplicationConfig) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.OidcRefreshTokenCookieName(),
+		Value:    "",
+		Domain:   applicationConfig.CookieDomain,
+		Expires:  time.Now(),
+		MaxAge:   -1,
+		Path:     applicationConfig.CookiePath,
+		Secure:   !config.SendInsecureCookies(),
+		HttpOnly: true,
+		SameSite: controller.CookieSameSite(applicationConfig),
+	})
+}
+
+// subjectOfIdToken reads the subject of an id token we validated when we stored it.
+func subjectOfIdToken(idToken string) (string, error) {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, &claims); err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// --- refresh token cookie encryption ---
+
+// the refresh token is a long-lived credential, so unlike the id and access tokens, it is never handed
+// to the browser in clear text. We use AES-256-GCM with a key derived from the configured secret,
+// and bind the ciphertext to the application, so a cookie obtained for one application cannot be
+// used to refresh tokens for another one.
+
+func refreshTokenCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(config.OidcRefreshTokenCookieKey()))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// refreshCookieContent is what we encrypt into the refresh token cookie. We keep the subject
+// of the login, so refreshed id tokens can be checked to be for the same user.
+type refreshCookieContent struct {
+	Subject      string `json:"sub"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func encryptRefreshToken(refreshToken string, subject string, applicationName string) (string, error) {
+	aead, err := refreshTokenCipher()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(refreshCookieContent{Subject: subject, RefreshToken: refreshToken})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(applicationName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func decryptRefreshToken(encrypted string, applicationName string) (refreshToken string, subject string, err error) {
+	aead, err := refreshTokenCipher()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid encoding: %s", err.Error())
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", "", errors.New("value too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(applicationName))
+	if err != nil {
+		return "", "", err
+	}
+	content := refreshCookieContent{}
+	if err := json.Unmarshal(plaintext, &content); err != nil {
+		return "", "", fmt.Errorf("invalid content: %s", err.Error())
+	}
+	return content.RefreshToken, content.Subject, nil
+}
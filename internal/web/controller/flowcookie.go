@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+)
+
+const flowCookiePrefix = "reg_auth_flow_"
+
+/* The flow cookie binds a login flow to the browser that started it, which protects against login CSRF.
+ *
+ * Without it, an attacker could start a flow, log in with their own account at the identity provider,
+ * and then get a victim to open the dropoff link, which would log the victim into the attacker's account.
+ *
+ * The cookie name is derived from the state, so parallel logins in the same browser do not overwrite
+ * each other's cookie. Its value is "expiry.hash.signature", where hash is the sha256 of the state,
+ * and signature is an HMAC-SHA256 over expiry and hash, keyed with security.oidc.flow_cookie_key.
+ */
+
+// NewFlowCookie returns the cookie to set when starting the login flow with the given state.
+func NewFlowCookie(state string, formPost bool) *http.Cookie {
+	expires := time.Now().Add(config.AuthRequestTimeout())
+	payload := fmt.Sprintf("%d.%s", expires.Unix(), flowStateHash(state))
+	return flowCookie(state, payload+"."+flowSignature(payload), expires, formPost)
+}
+
+// ExpiredFlowCookie returns a cookie that removes the flow cookie for the given state from the browser.
+func ExpiredFlowCookie(state string, formPost bool) *http.Cookie {
+	cookie := flowCookie(state, "", time.Unix(0, 0), formPost)
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// VerifyFlowCookie checks that the request carries a valid flow cookie for the given state.
+func VerifyFlowCookie(r *http.Request, state string) error {
+	cookie, err := r.Cookie(flowCookieName(state))
+	if err != nil {
+		return errors.New("no flow cookie for this state, the login was started in another browser or the cookie has expired")
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed flow cookie")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(flowSignature(payload))) {
+		return errors.New("flow cookie has an invalid signature")
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[1]), []byte(flowStateHash(state))) != 1 {
+		return errors.New("flow cookie does not match the state")
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return errors.New("flow cookie has expired")
+	}
+	return nil
+}
+
+func flowCookie(state string, value string, expires time.Time, formPost bool) *http.Cookie {
+	secure := !config.SendInsecureCookies()
+	// the identity provider sends the browser back to us with a cross-site top level navigation, which includes
+	// lax cookies for GET. A form post is a cross-site POST, though, which only includes cookies without restrictions.
+	sameSite := http.SameSiteLaxMode
+	if formPost {
+		if secure {
+			sameSite = http.SameSiteNoneMode
+		} else {
+			// browsers reject SameSite None without Secure, so we leave it to their default during local development
+			sameSite = http.SameSiteDefaultMode
+		}
+	}
+	return &http.Cookie{
+		Name:     flowCookieName(state),
+		Value:    value,
+		Path:     flowCookiePath(),
+		Expires:  expires,
+		Secure:   secure,
+		HttpOnly: true, // never needed by javascript, not even during local development
+		SameSite: sameSite,
+	}
+}
+
+func flowCookieName(state string) string {
+	return flowCookiePrefix + flowStateHash(state)[:16]
+}
+
+// flowCookiePath restricts the cookie to our dropoff endpoint, as seen by the browser.
+func flowCookiePath() string {
+	u, err := url.Parse(config.DropoffEndpointUrl())
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+func flowStateHash(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func flowSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.OidcFlowCookieKey()))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
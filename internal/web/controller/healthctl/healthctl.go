@@ -3,27 +3,191 @@ package healthctl
 import (
 	"context"
 	"encoding/json"
-	aulogging "github.com/StephanHCB/go-autumn-logging"
-	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
+	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/health"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-http-utils/headers"
 )
 
+const (
+	statusUp       = "up"
+	statusDown     = "down"
+	statusDisabled = "disabled"
+)
+
+// the background refreshes may fail once without taking the instance out of rotation
+const staleAfterRefreshes = 2
+
+const pingTimeout = 3 * time.Second
+
+// CircuitBreakerState is exposed so tests can simulate an open circuit breaker.
+var CircuitBreakerState = idp.CircuitBreakerState
+
 func Create(server chi.Router) {
 	server.Get("/", healthGet)
+	server.Get("/health/live", healthGet)
+	server.Get("/health/ready", readinessGet)
 }
 
+// healthGet is the liveness check, it only tells whether the process is able to answer requests at all.
 func healthGet(w http.ResponseWriter, r *http.Request) {
-	dto := health.HealthResultDto{Status: "up"}
+	dto := health.HealthResultDto{Status: statusUp}
 
 	w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
 	w.WriteHeader(http.StatusOK)
 	writeJson(r.Context(), w, dto)
 }
 
+// readinessGet checks everything this instance needs to log users in. If any check fails, we respond
+// with 503, so the instance is taken out of rotation.
+//
+// The identity provider is not called here, so frequent probes cannot add to its load, or trip the circuit breaker
+// that protects logins. Instead, we look at the results of the background refreshes of the issuer discovery and
+// the key set, which tell whether the identity provider was reachable, and at the circuit breaker for all other
+// requests to it.
+func readinessGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	dto := health.HealthResultDto{
+		Status: statusUp,
+		Components: map[string]health.ComponentHealthDto{
+			"configuration": checkConfiguration(),
+			"repository":    checkRepository(ctx),
+		},
+	}
+	for _, provider := range config.IdentityProviderNames() {
+		dto.Components[componentName("issuer_discovery", provider)] = checkIssuerDiscovery(provider)
+		dto.Components[componentName("key_set", provider)] = checkKeySet(provider)
+		dto.Components[componentName("circuit_breaker", provider)] = checkCircuitBreaker(provider)
+	}
+
+	failed := make([]string, 0)
+	for name, component := range dto.Components {
+		if component.Status == statusDown {
+			failed = append(failed, name)
+		}
+	}
+
+	status := http.StatusOK
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		aulogging.Logger.Ctx(ctx).Warn().Printf("readiness check failed for %s", strings.Join(failed, ", "))
+		dto.Status = statusDown
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
+	w.WriteHeader(status)
+	writeJson(ctx, w, dto)
+}
+
+func checkConfiguration() health.ComponentHealthDto {
+	if err := config.CheckConfiguration(); err != nil {
+		return down(err.Error())
+	}
+	return up("")
+}
+
+func checkRepository(ctx context.Context) health.ComponentHealthDto {
+	// not GetRepository(), which bails out if the database is not open
+	repository := database.ActiveRepository
+	if repository == nil {
+		return down("database not open")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := repository.Ping(ctx); err != nil {
+		return down(err.Error())
+	}
+	return up("")
+}
+
+// componentName keeps the component names of the default identity provider unchanged, and
+// adds the name of the identity provider for all others, e.g. key_set.staff
+func componentName(check string, provider string) string {
+	if provider == config.DefaultIdentityProvider {
+		return check
+	}
+	return check + "." + provider
+}
+
+func checkIssuerDiscovery(provider string) health.ComponentHealthDto {
+	if !config.ProviderIssuerDiscoveryEnabled(provider) {
+		return health.ComponentHealthDto{Status: statusDisabled}
+	}
+	return checkFreshness("issuer discovery", config.ProviderLastIssuerDiscovery(provider), config.ProviderIssuerDiscoveryRefresh(provider))
+}
+
+func checkKeySet(provider string) health.ComponentHealthDto {
+	if config.ProviderKeySetEndpoint(provider) == "" {
+		return health.ComponentHealthDto{Status: statusDisabled}
+	}
+	lastSuccess := keyset.LastRefresh(provider)
+	result := checkFreshness("key set", lastSuccess, config.ProviderKeySetRefresh(provider))
+	lastAttempt, err := keyset.LastAttempt(provider)
+	result = withFailedAttempt(result, lastSuccess, lastAttempt, err)
+	if result.Status == statusUp && keyset.KeyCount(provider) == 0 && len(config.ProviderKeySet(provider)) == 0 {
+		return down("key set contains no usable signing keys")
+	}
+	return result
+}
+
+func checkFreshness(what string, lastSuccess time.Time, refresh time.Duration) health.ComponentHealthDto {
+	if lastSuccess.IsZero() {
+		return down(fmt.Sprintf("%s has not succeeded yet", what))
+	}
+	details := fmt.Sprintf("last successful at %s", lastSuccess.UTC().Format(time.RFC3339))
+	if time.Since(lastSuccess) > staleAfterRefreshes*refresh {
+		return down(fmt.Sprintf("%s is stale, %s", what, details))
+	}
+	return up(details)
+}
+
+// withFailedAttempt adds the error to the details if the most recent attempt of a background refresh failed,
+// so it is visible even while the previous result is still fresh enough
+func withFailedAttempt(result health.ComponentHealthDto, lastSuccess time.Time, lastAttempt time.Time, err error) health.ComponentHealthDto {
+	if err == nil || !lastAttempt.After(lastSuccess) {
+		return result
+	}
+	failure := fmt.Sprintf("last attempt at %s failed: %s", lastAttempt.UTC().Format(time.RFC3339), err.Error())
+	if result.Details == "" {
+		result.Details = failure
+	} else {
+		result.Details += ", " + failure
+	}
+	return result
+}
+
+func checkCircuitBreaker(provider string) health.ComponentHealthDto {
+	state := CircuitBreakerState(provider)
+	if state == "open" {
+		if provider == config.DefaultIdentityProvider {
+			return down("circuit breaker for the identity provider is open")
+		}
+		return down(fmt.Sprintf("circuit breaker for identity provider %s is open", provider))
+	}
+	return up(state)
+}
+
+func up(details string) health.ComponentHealthDto {
+	return health.ComponentHealthDto{Status: statusUp, Details: details}
+}
+
+func down(details string) health.ComponentHealthDto {
+	return health.ComponentHealthDto{Status: statusDown, Details: details}
+}
+
 func writeJson(ctx context.Context, w http.ResponseWriter, v interface{}) {
 	encoder := json.NewEncoder(w)
 	encoder.SetEscapeHTML(false)
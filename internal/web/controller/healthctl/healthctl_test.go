@@ -0,0 +1,79 @@
+package healthctl
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFreshness_neverSucceeded(t *testing.T) {
+	docs.Description("a background refresh that has never succeeded makes the instance not ready")
+	docs.When("when the freshness of a key set that was never loaded is checked")
+	actual := checkFreshness("key set", time.Time{}, 15*time.Minute)
+
+	docs.Then("then the component is down")
+	require.Equal(t, "down", actual.Status)
+	require.Equal(t, "key set has not succeeded yet", actual.Details)
+}
+
+func TestCheckFreshness_oneRefreshMissed(t *testing.T) {
+	docs.Description("a single failed background refresh does not take the instance out of rotation")
+	docs.When("when the freshness of a key set that missed one refresh is checked")
+	actual := checkFreshness("key set", time.Now().Add(-20*time.Minute), 15*time.Minute)
+
+	docs.Then("then the component is still up")
+	require.Equal(t, "up", actual.Status)
+}
+
+func TestCheckFreshness_stale(t *testing.T) {
+	docs.Description("a background refresh that failed repeatedly makes the instance not ready")
+	docs.Given("given an issuer discovery that last succeeded long ago")
+	lastSuccess := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	docs.When("when its freshness is checked")
+	actual := checkFreshness("issuer discovery", lastSuccess, time.Hour)
+
+	docs.Then("then the component is down, and the details tell when it last succeeded")
+	require.Equal(t, "down", actual.Status)
+	require.Equal(t, "issuer discovery is stale, last successful at 2024-01-02T03:04:05Z", actual.Details)
+}
+
+func TestWithFailedAttempt_failedAfterSuccess(t *testing.T) {
+	docs.Description("a failed attempt to reach the identity provider is reported, even while the last result is still fresh")
+	docs.Given("given a key set that was loaded successfully, but whose most recent refresh failed")
+	lastSuccess := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lastAttempt := lastSuccess.Add(15 * time.Minute)
+
+	docs.When("when the key set is checked")
+	actual := withFailedAttempt(up("last successful at 2024-01-02T03:04:05Z"), lastSuccess, lastAttempt, errors.New("connection refused"))
+
+	docs.Then("then the component is still up, and the details tell about the failed attempt")
+	require.Equal(t, "up", actual.Status)
+	require.Equal(t, "last successful at 2024-01-02T03:04:05Z, last attempt at 2024-01-02T03:19:05Z failed: connection refused", actual.Details)
+}
+
+func TestWithFailedAttempt_neverSucceeded(t *testing.T) {
+	docs.Description("if the identity provider has never been reached, the error tells why")
+	docs.Given("given a key set that could never be loaded")
+	lastAttempt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	docs.When("when the key set is checked")
+	actual := withFailedAttempt(down("key set has not succeeded yet"), time.Time{}, lastAttempt, errors.New("connection refused"))
+
+	docs.Then("then the component is down, and the details contain the error")
+	require.Equal(t, "down", actual.Status)
+	require.Equal(t, "key set has not succeeded yet, last attempt at 2024-01-02T03:04:05Z failed: connection refused", actual.Details)
+}
+
+func TestWithFailedAttempt_succeeded(t *testing.T) {
+	docs.Description("an earlier failure is no longer reported once a later attempt succeeded")
+	docs.When("when the most recent attempt succeeded")
+	lastSuccess := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	actual := withFailedAttempt(up("last successful at 2024-01-02T03:04:05Z"), lastSuccess, lastSuccess, nil)
+
+	docs.Then("then the details are unchanged")
+	require.Equal(t, up("last successful at 2024-01-02T03:04:05Z"), actual)
+}
@@ -0,0 +1,189 @@
+package logoutctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/errorapi"
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
+	"github.com/go-http-utils/headers"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logout tokens must be sent right after they were issued, older ones are rejected
+const maxLogoutTokenAge = 5 * time.Minute
+
+// allowed difference between our clock and the clock of the identity provider
+const logoutTokenClockSkew = 30 * time.Second
+
+type logoutTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionId string                 `json:"sid,omitempty"`
+	Events    map[string]interface{} `json:"events"`
+	Nonce     *string                `json:"nonce,omitempty"`
+}
+
+/* Handle /backchannel-logout requests.
+ *
+ * The identity provider calls this directly (not via the user agent) when a session has ended,
+ * for example because an admin terminated it, or the user logged out in another application.
+ *
+ * Required form parameters are:
+ *  * logout_token - signed token identifying the session (sid) and/or the user (sub)
+ *
+ * From then on, id tokens belonging to the session are no longer accepted. If the logout token
+ * only names a subject, all id tokens of the subject issued up to now are no longer accepted.
+ *
+ * Logout tokens must have been issued recently, must expire, and are only accepted once (by jti).
+ *
+ * See https://openid.net/specs/openid-connect-backchannel-1_0.html
+ */
+func backchannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set(headers.CacheControl, "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusBadRequest, "failed to parse form: "+err.Error(), "invalid parameters")
+		return
+	}
+	logoutToken := r.PostForm.Get("logout_token")
+	if logoutToken == "" {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusBadRequest, "logout_token parameter is missing", "invalid parameters")
+		return
+	}
+
+	claims, err := validateLogoutToken(ctx, logoutToken)
+	if err != nil {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusBadRequest, "invalid logout token: "+err.Error(), "invalid logout token")
+		return
+	}
+
+	used, err := database.GetRepository().IsLogoutTokenUsed(ctx, claims.ID)
+	if err != nil {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusInternalServerError, err.Error(), "internal error")
+		return
+	}
+	if used {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusBadRequest, fmt.Sprintf("logout token jti=%s has already been used", claims.ID), "invalid logout token")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(config.RevokedSessionRetention())
+	if claims.ExpiresAt.Time.After(expiresAt) {
+		// the jti must be remembered until the logout token expires
+		expiresAt = claims.ExpiresAt.Time
+	}
+	err = database.GetRepository().AddRevokedSession(ctx, &entity.RevokedSession{
+		SessionId:     claims.SessionId,
+		Subject:       claims.Subject,
+		RevokedAt:     now,
+		ExpiresAt:     expiresAt,
+		LogoutTokenId: claims.ID,
+	})
+	if err != nil {
+		backchannelLogoutErrorHandler(ctx, w, http.StatusInternalServerError, err.Error(), "internal error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	audit.Success(ctx, audit.BackchannelLogout, "", claims.Subject, "")
+	aulogging.Logger.Ctx(ctx).Info().Printf("OK v1/backchannel-logout(sid=%s, sub=%s) -> %d", claims.SessionId, claims.Subject, http.StatusOK)
+}
+
+func validateLogoutToken(ctx context.Context, logoutToken string) (*logoutTokenClaims, error) {
+	tokenString := strings.TrimSpace(logoutToken)
+
+	provider := keyset.IdentityProviderForToken(tokenString)
+	errorMessage := "no keys available to validate token"
+	for _, key := range keyset.CandidateKeys(ctx, provider, tokenString) {
+		claims := logoutTokenClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+			return key, nil
+		}, jwt.WithValidMethods([]string{"RS256", "RS512"}))
+		if err != nil {
+			errorMessage = err.Error()
+			continue
+		}
+		if !token.Valid {
+			errorMessage = "token parsed but invalid"
+			continue
+		}
+		return &claims, checkLogoutTokenClaims(&claims, config.ProviderAllowedIssuer(provider), config.ProviderAllowedAudience(provider), time.Now())
+	}
+	return nil, errors.New(errorMessage)
+}
+
+func checkLogoutTokenClaims(claims *logoutTokenClaims, issuer string, allowedAudience string, now time.Time) error {
+	if issuer != "" && !config.SameIssuer(claims.Issuer, issuer) {
+		return errors.New("token issuer does not match")
+	}
+	if !logoutTokenAudienceMatches(claims.Audience, allowedAudience) {
+		return errors.New("token audience does not match")
+	}
+	if claims.IssuedAt == nil {
+		return errors.New("token has no iat claim")
+	}
+	if claims.IssuedAt.Time.Before(now.Add(-maxLogoutTokenAge)) || claims.IssuedAt.Time.After(now.Add(logoutTokenClockSkew)) {
+		return errors.New("token iat claim is not recent")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no exp claim")
+	}
+	if claims.ID == "" {
+		return errors.New("token has no jti claim")
+	}
+	if event, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return fmt.Errorf("token events claim does not contain %s", backchannelLogoutEvent)
+	} else if _, isObject := event.(map[string]interface{}); !isObject {
+		return fmt.Errorf("token events claim member %s is not a json object", backchannelLogoutEvent)
+	}
+	if claims.SessionId == "" && claims.Subject == "" {
+		return errors.New("token has neither sid nor sub claim")
+	}
+	if claims.Nonce != nil {
+		return errors.New("token must not have a nonce claim")
+	}
+	return nil
+}
+
+// logoutTokenAudienceMatches accepts logout tokens issued for any of our applications, or for the allowed audience of the identity provider.
+func logoutTokenAudienceMatches(audience jwt.ClaimStrings, allowedAudience string) bool {
+	for _, aud := range audience {
+		if (allowedAudience != "" && aud == allowedAudience) || config.IsApplicationClientId(aud) {
+			return true
+		}
+	}
+	return false
+}
+
+func backchannelLogoutErrorHandler(ctx context.Context, w http.ResponseWriter, status int, logMsg string, details string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL v1/backchannel-logout -> %d: %s", status, logMsg)
+	audit.Failure(ctx, audit.BackchannelLogout, "", "", "", logMsg)
+	timestamp := time.Now().Format(time.RFC3339)
+	response := errorapi.ErrorDto{Message: "auth.logout.invalid", Timestamp: timestamp, Details: url.Values{"details": []string{details}}, RequestId: ctxvalues.RequestId(ctx)}
+	if status == http.StatusInternalServerError {
+		response.Message = "auth.internal.error"
+	}
+	w.Header().Set(headers.ContentType, media.ContentTypeApplicationJson)
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("error while encoding json response: %s", err.Error())
+	}
+}
@@ -2,17 +2,26 @@ package logoutctl
 
 import (
 	"context"
+	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/eurofurence/reg-auth-service/internal/entity"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/session"
 	"github.com/go-chi/chi/v5"
 )
 
 func Create(server chi.Router) {
 	server.Get("/v1/logout", logoutHandler)
+	server.Get("/v1/logout-callback", logoutCallbackHandler)
+	server.Post("/v1/backchannel-logout", backchannelLogoutHandler)
 }
 
 /* Handle /logout requests.
@@ -20,7 +29,11 @@ func Create(server chi.Router) {
  * Required parameters are:
  *  * app_name  - the name of the application that the user wants to be authenticated for
  *
- * Redirects to app_name's default dropoff url after cookie deletion.
+ * Redirects to app_name's default dropoff url after cookie deletion. For applications with
+ * server_side_sessions, the session is removed as well.
+ *
+ * If idp_logout is configured for the application, redirects to the identity provider's
+ * end_session_endpoint instead, which then sends the user agent to /logout-callback.
  */
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -28,31 +41,113 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	regAppName := query.Get("app_name")
 	if regAppName == "" {
-		logoutErrorHandler(ctx, w, regAppName, http.StatusBadRequest, "app_name parameter is missing", "invalid parameters")
+		logoutErrorHandler(ctx, w, "logout", regAppName, http.StatusBadRequest, "app_name parameter is missing", "invalid parameters")
 		return
 	}
 
 	applicationConfig, err := config.GetApplicationConfig(regAppName)
 	if err != nil {
-		logoutErrorHandler(ctx, w, regAppName, http.StatusNotFound, "app_name is unknown", "invalid parameters")
+		logoutErrorHandler(ctx, w, "logout", regAppName, http.StatusNotFound, "app_name is unknown", "invalid parameters")
 		return
 	}
 
-	err = clearCookieAndRedirectToDropOffUrl(ctx, w, applicationConfig)
+	// must read this before clearing the cookie
+	idTokenHint := idTokenFromCookie(r, applicationConfig)
+	if applicationConfig.ServerSideSessions {
+		idTokenHint = endSession(ctx, r, regAppName)
+	}
+
+	clearCookies(w, regAppName, applicationConfig)
+
+	if applicationConfig.IdpLogout {
+		err = redirectToEndSessionEndpoint(ctx, w, regAppName, applicationConfig, idTokenHint)
+	} else {
+		err = redirectToDropOffUrl(w, applicationConfig)
+	}
 	if err != nil {
-		logoutErrorHandler(ctx, w, regAppName, http.StatusInternalServerError, err.Error(), "internal error")
+		logoutErrorHandler(ctx, w, "logout", regAppName, http.StatusInternalServerError, err.Error(), "internal error")
 		return
 	}
+	metrics.RecordSuccess("logout", regAppName)
+	audit.Success(ctx, audit.Logout, regAppName, "", "")
 	aulogging.Logger.Ctx(ctx).Info().Printf("OK v1/logout(%s)-> %d", regAppName, http.StatusFound)
 }
 
-func logoutErrorHandler(ctx context.Context, w http.ResponseWriter, appName string, status int, logMsg string, publicMsg string) {
-	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL v1/logout(%s) -> %d: %s", appName, status, logMsg)
+/* Handle /logout-callback requests.
+ *
+ * The identity provider redirects here after ending its session.
+ *
+ * Required parameters are:
+ *  * state - random-string identifier of this logout flow
+ *
+ * Redirects to the default dropoff url of the application the logout was started for.
+ */
+func logoutCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		logoutErrorHandler(ctx, w, "logout-callback", "?", http.StatusBadRequest, "state parameter is missing", "invalid parameters")
+		return
+	}
+
+	logoutRequest, err := database.GetRepository().ConsumeAuthRequestByState(ctx, state, entity.AuthRequestLogout)
+	if err != nil {
+		logoutErrorHandler(ctx, w, "logout-callback", "?", http.StatusNotFound, "couldn't load logout request: "+err.Error(), "logout request not found or timed out")
+		return
+	}
+
+	applicationConfig, err := config.GetApplicationConfig(logoutRequest.Application)
+	if err != nil {
+		logoutErrorHandler(ctx, w, "logout-callback", logoutRequest.Application, http.StatusInternalServerError, "couldn't load application config: "+err.Error(), "internal error")
+		return
+	}
+
+	err = redirectToDropOffUrl(w, applicationConfig)
+	if err != nil {
+		logoutErrorHandler(ctx, w, "logout-callback", logoutRequest.Application, http.StatusInternalServerError, err.Error(), "internal error")
+		return
+	}
+	metrics.RecordSuccess("logout-callback", logoutRequest.Application)
+	aulogging.Logger.Ctx(ctx).Info().Printf("OK v1/logout-callback(%s)-> %d", logoutRequest.Application, http.StatusFound)
+}
+
+func logoutErrorHandler(ctx context.Context, w http.ResponseWriter, endpoint string, appName string, status int, logMsg string, publicMsg string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("FAIL v1/%s(%s) -> %d: %s", endpoint, appName, status, logMsg)
+	metrics.RecordFailure(endpoint, appName, metrics.ReasonForStatus(status))
+	if endpoint == "logout" {
+		// the callback only redirects back to the application, the cookies are already gone by then
+		audit.Failure(ctx, audit.Logout, appName, "", "", logMsg)
+	}
 	w.WriteHeader(status)
 	_, _ = w.Write(controller.ErrorResponse(ctx, publicMsg, ""))
 }
 
-func clearCookieAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWriter, applicationConfig config.ApplicationConfig) error {
+func idTokenFromCookie(r *http.Request, applicationConfig config.ApplicationConfig) string {
+	cookie, err := r.Cookie(applicationConfig.CookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// endSession removes the server-side session of the application, if any, and returns its id token.
+func endSession(ctx context.Context, r *http.Request, regAppName string) string {
+	sessionId := session.IdFromCookie(r, regAppName)
+	if sessionId == "" {
+		return ""
+	}
+	s, err := session.Get(ctx, sessionId)
+	if err != nil || s.Application != regAppName {
+		return ""
+	}
+	if err := session.Delete(ctx, sessionId); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("failed to delete session during logout: %s", err.Error())
+	}
+	return s.IdToken
+}
+
+func clearCookies(w http.ResponseWriter, regAppName string, applicationConfig config.ApplicationConfig) {
 	cookie := &http.Cookie{
 		Name:     applicationConfig.CookieName,
 		Value:    "",
@@ -80,7 +175,67 @@ func clearCookieAndRedirectToDropOffUrl(ctx context.Context, w http.ResponseWrit
 		http.SetCookie(w, accessCookie)
 	}
 
+	if applicationConfig.ServerSideSessions {
+		http.SetCookie(w, controller.ExpiredSessionCookie(regAppName, applicationConfig))
+	}
+
+	if config.OidcRefreshTokenCookieName() != "" {
+		refreshCookie := &http.Cookie{
+			Name:     config.OidcRefreshTokenCookieName(),
+			Value:    "",
+			Domain:   applicationConfig.CookieDomain,
+			Expires:  time.Now(),
+			MaxAge:   -1,
+			Path:     applicationConfig.CookiePath,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: controller.CookieSameSite(applicationConfig),
+		}
+		http.SetCookie(w, refreshCookie)
+	}
+}
+
+func redirectToDropOffUrl(w http.ResponseWriter, applicationConfig config.ApplicationConfig) error {
 	w.Header().Set("Location", applicationConfig.DefaultDropoffUrl)
 	w.WriteHeader(http.StatusFound)
 	return nil
 }
+
+// redirectToEndSessionEndpoint implements RP-initiated logout
+//
+// See https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func redirectToEndSessionEndpoint(ctx context.Context, w http.ResponseWriter, regAppName string, applicationConfig config.ApplicationConfig, idTokenHint string) error {
+	u, err := url.Parse(config.ProviderEndSessionEndpoint(config.ApplicationIdentityProvider(regAppName)))
+	if err != nil {
+		return fmt.Errorf("could not parse end session endpoint url")
+	}
+
+	state, err := controller.GenerateState()
+	if err != nil {
+		return fmt.Errorf("state could not be generated")
+	}
+
+	// we keep track of logouts in progress just like logins, so the callback can only be used once
+	err = database.GetRepository().AddAuthRequest(ctx, &entity.AuthRequest{
+		Application: regAppName,
+		State:       state,
+		Purpose:     entity.AuthRequestLogout,
+		DropOffUrl:  applicationConfig.DefaultDropoffUrl,
+		ExpiresAt:   time.Now().Add(config.AuthRequestTimeout()),
+	})
+	if err != nil {
+		return fmt.Errorf("could not store logout state: %s", err.Error())
+	}
+
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	q.Set("client_id", applicationConfig.ClientId)
+	q.Set("post_logout_redirect_uri", config.LogoutCallbackUrl())
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
@@ -0,0 +1,13 @@
+package metricsctl
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Create adds the prometheus /metrics endpoint to the admin router.
+//
+// It must not be added to the main router, the endpoint is not authenticated.
+func Create(server chi.Router) {
+	server.Get("/metrics", promhttp.Handler().ServeHTTP)
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+)
+
+// CookieSameSite returns the SameSite policy for the token and session cookies of an application.
+func CookieSameSite(applicationConfig config.ApplicationConfig) http.SameSite {
+	if config.IsCorsDisabled() {
+		return http.SameSiteNoneMode
+	}
+	if applicationConfig.ResponseMode == config.ResponseModeFormPost {
+		// the browser arrives at the dropoff endpoint via a cross-site form post from the identity provider. Strict cookies
+		// would not be sent when it follows our redirect to the dropoff url, so the user would appear logged out.
+		return http.SameSiteLaxMode
+	}
+	return http.SameSiteStrictMode
+}
+
+// NewSessionCookie returns the cookie that hands the session id to the browser, for applications with server_side_sessions.
+func NewSessionCookie(applicationName string, applicationConfig config.ApplicationConfig, sessionId string) *http.Cookie {
+	return sessionCookie(applicationName, applicationConfig, sessionId, time.Now().Add(applicationConfig.CookieExpiry))
+}
+
+// ExpiredSessionCookie returns a cookie that removes the session cookie of the application from the browser.
+//
+// Browsers only replace a cookie with one that has the same attributes, so it must match NewSessionCookie.
+func ExpiredSessionCookie(applicationName string, applicationConfig config.ApplicationConfig) *http.Cookie {
+	cookie := sessionCookie(applicationName, applicationConfig, "", time.Now())
+	cookie.MaxAge = -1
+	return cookie
+}
+
+func sessionCookie(applicationName string, applicationConfig config.ApplicationConfig, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     config.SessionCookieName(applicationName),
+		Value:    value,
+		Domain:   applicationConfig.CookieDomain,
+		Expires:  expires,
+		Path:     applicationConfig.CookiePath,
+		Secure:   !config.SendInsecureCookies(),
+		HttpOnly: true, // never needed by javascript, not even during local development
+		SameSite: CookieSameSite(applicationConfig),
+	}
+}
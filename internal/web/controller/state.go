@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+/* according to RFC 6749, "state" is defined as one or more characters within
+ * the range of US ASCII  %20 - %7E (printable ASCII characters). See here:
+ *
+ *    https://datatracker.ietf.org/doc/html/rfc6749#appendix-A.5
+ *
+ * The same format is also used for the OpenID Connect "nonce", which has no restrictions on its format.
+ */
+func GenerateState() (string, error) {
+	const letters string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	const length = 40
+	state := make([]byte, length)
+	for i := 0; i < length; i++ {
+		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			return "", err
+		}
+		state[i] = letters[num.Int64()]
+	}
+	return string(state), nil
+}
@@ -0,0 +1,19 @@
+package userinfoctl
+
+// extraClaims picks the claims listed in security.oidc.extra_claims, see config.ExtraClaims.
+//
+// Claims the user does not have are left out. Returns nil if none are left, so the response omits extra_claims.
+func extraClaims(names []string, claims map[string]interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	for _, name := range names {
+		value, ok := claims[name]
+		if !ok || value == nil {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]interface{})
+		}
+		result[name] = value
+	}
+	return result
+}
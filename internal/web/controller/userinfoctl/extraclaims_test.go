@@ -0,0 +1,49 @@
+package userinfoctl
+
+import (
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtraClaims(t *testing.T) {
+	docs.Description("only the configured extra claims are passed through, and only if they have a value")
+	docs.Given("given claims of a user, some of which are configured as extra claims")
+	claims := map[string]interface{}{
+		"sub":                "101",
+		"preferred_username": "johnny",
+		"badge_number":       float64(1234),
+		"picture":            nil,
+	}
+
+	docs.When("when the extra claims are selected")
+	actual := extraClaims([]string{"preferred_username", "badge_number", "picture", "locale"}, claims)
+
+	docs.Then("then the configured claims with values are returned")
+	require.Equal(t, map[string]interface{}{"preferred_username": "johnny", "badge_number": float64(1234)}, actual)
+}
+
+func TestExtraClaims_none(t *testing.T) {
+	docs.Description("extra claims are left out of the response if there are none")
+	docs.When("when no extra claims are configured, or the user has none of them")
+	noneConfigured := extraClaims(nil, map[string]interface{}{"locale": "de-DE"})
+	noneFound := extraClaims([]string{"locale"}, map[string]interface{}{"sub": "101"})
+
+	docs.Then("then the result is nil, so it is omitted from the response")
+	require.Nil(t, noneConfigured)
+	require.Nil(t, noneFound)
+}
+
+func TestMapRoles_userinfoExtraClaim(t *testing.T) {
+	docs.Description("role mappings can use claims of the userinfo response that have no field")
+	docs.Given("given a userinfo response with a department claim")
+	data := &idp.UserinfoData{Subject: "202", Claims: map[string]interface{}{"sub": "202", "department": "registration"}}
+
+	docs.When("when the role mappings are evaluated")
+	actual := mapRoles(tstRoleMappings, roleClaims{subject: data.Subject, claims: userinfoClaims(data)})
+
+	docs.Then("then the role for the department is granted")
+	require.Equal(t, []string{"registration"}, actual)
+}
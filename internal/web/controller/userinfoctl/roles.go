@@ -0,0 +1,142 @@
+package userinfoctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Role mappings (security.oidc.role_mappings) translate IDP group ids and claim values into stable role names,
+ * so downstream services do not need to know the group ids of the identity provider.
+ *
+ * Unlike the groups, roles are not limited to relevant_groups. They are evaluated against all groups of the user.
+ */
+
+// roleClaims is what the role mappings are evaluated against
+type roleClaims struct {
+	subject      string
+	groups       []string
+	applications []string // the applications the token was issued for, empty if not known
+	claims       map[string]interface{}
+}
+
+// mapRoles returns the union of the roles granted by all matching role mappings, sorted
+func mapRoles(mappings []config.RoleMappingConfig, user roleClaims) []string {
+	result := make([]string, 0)
+	for _, m := range mappings {
+		if roleMappingMatches(m, user) && !slices.Contains(result, m.Role) {
+			result = append(result, m.Role)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func roleMappingMatches(m config.RoleMappingConfig, user roleClaims) bool {
+	if len(m.Subjects) > 0 && !slices.Contains(m.Subjects, user.subject) {
+		return false
+	}
+	if len(m.Applications) > 0 && !containsAny(m.Applications, user.applications) {
+		return false
+	}
+	if containsAny(m.Groups, user.groups) {
+		return true
+	}
+	return m.Claim != "" && containsAny(m.Values, claimValues(user.claims[m.Claim]))
+}
+
+func containsAny(allowed []string, actual []string) bool {
+	for _, value := range actual {
+		if slices.Contains(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimValues turns a claim into the list of its values. Claims can be strings, numbers, booleans, or lists of those.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case float64:
+		// json numbers, which would otherwise turn into exponent notation
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, element := range v {
+			result = append(result, claimValues(element)...)
+		}
+		return result
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// idTokenClaims returns all claims of the id token in the context.
+//
+// Only call this after the security middleware has validated the id token, its signature is not checked here.
+func idTokenClaims(ctx context.Context) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if ctxvalues.IdToken(ctx) == "" {
+		return claims
+	}
+	if _, _, err := jwt.NewParser().ParseUnverified(ctxvalues.IdToken(ctx), &claims); err != nil {
+		return jwt.MapClaims{}
+	}
+	return claims
+}
+
+// idTokenRoleClaims is used when the user information comes from the id token
+func idTokenRoleClaims(ctx context.Context) roleClaims {
+	claims := idTokenClaims(ctx)
+	return roleClaims{
+		subject:      ctxvalues.Subject(ctx),
+		groups:       claimValues(claims["groups"]),
+		applications: config.ApplicationsForAudiences(claimValues(claims["aud"])),
+		claims:       claims,
+	}
+}
+
+// userinfoRoleClaims is used when the user information comes from the identity provider.
+//
+// If the identity provider does not tell us the audiences, we take them from the id token, if there is one.
+func userinfoRoleClaims(ctx context.Context, data *idp.UserinfoData) roleClaims {
+	audiences := data.Audience
+	if len(audiences) == 0 {
+		audiences = claimValues(idTokenClaims(ctx)["aud"])
+	}
+	return roleClaims{
+		subject:      data.Subject,
+		groups:       data.Groups,
+		applications: config.ApplicationsForAudiences(audiences),
+		claims:       userinfoClaims(data),
+	}
+}
+
+// userinfoClaims makes the claims of a userinfo response available by their json names
+func userinfoClaims(data *idp.UserinfoData) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if raw, err := json.Marshal(data); err == nil {
+		_ = json.Unmarshal(raw, &claims)
+	}
+	// claims we have no field for
+	for name, value := range data.Claims {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+	return claims
+}
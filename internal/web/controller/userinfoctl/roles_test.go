@@ -0,0 +1,100 @@
+package userinfoctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/stretchr/testify/require"
+)
+
+var tstRoleMappings = []config.RoleMappingConfig{
+	{Role: "staff", Groups: []string{"staff-group"}},
+	{Role: "staff", Groups: []string{"director-group"}},
+	{Role: "director", Groups: []string{"director-group"}},
+	{Role: "admin", Groups: []string{"admin-group"}, Subjects: []string{"101"}},
+	{Role: "kiosk-operator", Groups: []string{"staff-group"}, Applications: []string{"kiosk-service"}},
+	{Role: "registration", Claim: "department", Values: []string{"registration", "security"}},
+	{Role: "veteran", Claim: "attendances", Values: []string{"10"}},
+}
+
+func TestMapRoles_none(t *testing.T) {
+	docs.Description("users without matching groups or claims get an empty list of roles")
+	docs.Given("given a user with a group that no role mapping grants a role for")
+	docs.When("when the role mappings are evaluated")
+	actual := mapRoles(tstRoleMappings, roleClaims{subject: "101", groups: []string{"other-group"}})
+
+	docs.Then("then the roles are an empty list, not nil")
+	require.NotNil(t, actual)
+	require.Empty(t, actual)
+}
+
+func TestMapRoles_union(t *testing.T) {
+	docs.Description("users get the union of the roles of all matching role mappings")
+	docs.Given("given a user with two groups that both grant the staff role")
+	docs.When("when the role mappings are evaluated")
+	actual := mapRoles(tstRoleMappings, roleClaims{subject: "202", groups: []string{"staff-group", "director-group"}})
+
+	docs.Then("then every role is listed once, sorted")
+	require.Equal(t, []string{"director", "staff"}, actual)
+}
+
+func TestMapRoles_subjectRestricted(t *testing.T) {
+	docs.Description("role mappings limited to subjects only grant the role to those subjects")
+	docs.Given("given two users with the admin group, only one of which is listed in the role mapping")
+	docs.When("when the role mappings are evaluated")
+	allowed := mapRoles(tstRoleMappings, roleClaims{subject: "101", groups: []string{"admin-group"}})
+	notAllowed := mapRoles(tstRoleMappings, roleClaims{subject: "202", groups: []string{"admin-group"}})
+
+	docs.Then("then only the listed user gets the role")
+	require.Equal(t, []string{"admin"}, allowed)
+	require.Empty(t, notAllowed)
+}
+
+func TestMapRoles_perApplication(t *testing.T) {
+	docs.Description("role mappings limited to applications only apply to tokens issued for those applications")
+	docs.Given("given a staff user with tokens for different applications")
+	docs.When("when the role mappings are evaluated")
+	kiosk := mapRoles(tstRoleMappings, roleClaims{subject: "202", groups: []string{"staff-group"}, applications: []string{"kiosk-service"}})
+	other := mapRoles(tstRoleMappings, roleClaims{subject: "202", groups: []string{"staff-group"}, applications: []string{"example-service"}})
+	unknown := mapRoles(tstRoleMappings, roleClaims{subject: "202", groups: []string{"staff-group"}})
+
+	docs.Then("then the application specific role is only granted for its application")
+	require.Equal(t, []string{"kiosk-operator", "staff"}, kiosk)
+	require.Equal(t, []string{"staff"}, other)
+	require.Equal(t, []string{"staff"}, unknown)
+}
+
+func TestMapRoles_claimValues(t *testing.T) {
+	docs.Description("role mappings can grant roles based on the values of a claim")
+	docs.Given("given users with single, list and numeric claim values")
+	docs.When("when the role mappings are evaluated")
+	single := mapRoles(tstRoleMappings, roleClaims{subject: "202", claims: map[string]interface{}{"department": "security"}})
+	list := mapRoles(tstRoleMappings, roleClaims{subject: "202", claims: map[string]interface{}{"department": []interface{}{"finance", "registration"}}})
+	numeric := mapRoles(tstRoleMappings, roleClaims{subject: "202", claims: map[string]interface{}{"attendances": float64(10)}})
+	other := mapRoles(tstRoleMappings, roleClaims{subject: "202", claims: map[string]interface{}{"department": "finance"}})
+
+	docs.Then("then the role is granted if any value of the claim matches")
+	require.Equal(t, []string{"registration"}, single)
+	require.Equal(t, []string{"registration"}, list)
+	require.Equal(t, []string{"veteran"}, numeric)
+	require.Empty(t, other)
+}
+
+func TestUserinfoRoleClaims_claims(t *testing.T) {
+	docs.Description("role mappings see the claims of the userinfo response, including those without a field")
+	docs.Given("given a userinfo response whose department claim only appears in the raw claims")
+	data := &idp.UserinfoData{
+		Subject: "202",
+		Groups:  []string{"other-group"},
+		Claims:  map[string]interface{}{"sub": "202", "department": []interface{}{"finance", "security"}},
+	}
+
+	docs.When("when the role mappings are evaluated against the userinfo response")
+	actual := mapRoles(tstRoleMappings, userinfoRoleClaims(context.Background(), data))
+
+	docs.Then("then the role is granted based on the claim")
+	require.Equal(t, []string{"registration"}, actual)
+}
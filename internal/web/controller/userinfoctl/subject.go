@@ -0,0 +1,88 @@
+package userinfoctl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/go-chi/chi/v5"
+)
+
+// subjectUserinfoHandler lets backend services look up the userinfo of any subject via the admin api
+// of the identity provider, see security.service_clients.
+//
+// There is no user token involved here, so the identity provider is chosen by the identity_provider
+// query parameter, and defaults to the default identity provider.
+func subjectUserinfoHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	serviceClient := ctxvalues.ServiceClient(ctx)
+	subject := chi.URLParam(r, "subject")
+
+	if serviceClient == "" || !config.ServiceClientHasScope(serviceClient, config.ScopeUserinfo) {
+		forbiddenError(ctx, w, r, serviceClient, subject, "this endpoint is only available to service clients with the userinfo scope")
+		return
+	}
+
+	provider := r.URL.Query().Get("identity_provider")
+	if provider == "" {
+		provider = config.DefaultIdentityProvider
+	}
+	if !slices.Contains(config.IdentityProviderNames(), provider) {
+		userinfoRequestError(ctx, w, r, http.StatusBadRequest, "auth.userinfo.invalid", "identity_provider is unknown", fmt.Sprintf("unknown identity provider %s", provider))
+		return
+	}
+	if config.ProviderAdminUserInfoURL(provider) == "" {
+		userinfoRequestError(ctx, w, r, http.StatusNotFound, "auth.userinfo.notfound", "identity provider does not support looking up users", fmt.Sprintf("identity provider %s has no admin_user_info_endpoint", provider))
+		return
+	}
+
+	idpUserinfo, status, err := IDPClient.AdminUserInfo(ctx, provider, subject)
+	if err != nil {
+		idpDownstreamError(ctx, w, r, "identity provider could not be reached - see log for details", err.Error())
+		return
+	}
+	if status == http.StatusNotFound {
+		userinfoRequestError(ctx, w, r, http.StatusNotFound, "auth.userinfo.notfound", "subject is unknown to the identity provider", fmt.Sprintf("identity provider %s does not know subject %s", provider, subject))
+		return
+	}
+	if idpUserinfo.Subject != subject {
+		idpDownstreamError(ctx, w, r, "identity provider returned the wrong user - see log for details", fmt.Sprintf("admin api returned subject %s when asked for %s", idpUserinfo.Subject, subject))
+		return
+	}
+
+	response := userinfo.UserInfoDto{
+		Audiences:     idpUserinfo.Audience,
+		Email:         idpUserinfo.Email,
+		EmailVerified: idpUserinfo.EmailVerified,
+		Name:          idpUserinfo.Name,
+		Subject:       idpUserinfo.Subject,
+		Groups:        filterRelevantAndAllowlistedGroups(idpUserinfo.Groups, idpUserinfo.Subject),
+	}
+	// there is no token, so role mappings limited to applications do not apply
+	lookupClaims := userinfoRoleClaims(ctx, idpUserinfo)
+	lookupClaims.applications = nil
+	response.Roles = mapRoles(config.RoleMappings(), lookupClaims)
+	response.ExtraClaims = extraClaims(config.ExtraClaims(), idpUserinfo.Claims)
+
+	audit.Success(ctx, audit.ServiceUserinfoLookup, serviceClient, subject, "")
+	writeUserinfo(ctx, w, r, response)
+}
+
+func forbiddenError(ctx context.Context, w http.ResponseWriter, r *http.Request, serviceClient string, subject string, details string) {
+	logMessage := fmt.Sprintf("service client '%s' is not allowed to look up users", serviceClient)
+	aulogging.Logger.Ctx(ctx).Warn().Print(logMessage)
+	audit.Failure(ctx, audit.ServiceUserinfoLookup, serviceClient, subject, "", logMessage)
+	errorHandler(ctx, w, r, "auth.forbidden", http.StatusForbidden, url.Values{"details": []string{details}})
+}
+
+func userinfoRequestError(ctx context.Context, w http.ResponseWriter, r *http.Request, status int, msg string, details string, logMessage string) {
+	aulogging.Logger.Ctx(ctx).Info().Print(logMessage)
+	errorHandler(ctx, w, r, msg, status, url.Values{"details": []string{details}})
+}
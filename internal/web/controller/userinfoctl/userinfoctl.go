@@ -9,14 +9,19 @@ import (
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/errorapi"
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
 	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-http-utils/headers"
+	"github.com/golang-jwt/jwt/v4"
 	"net/http"
 	"net/url"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -28,6 +33,7 @@ func Create(server chi.Router, idpClient idp.IdentityProviderClient) {
 	}
 	server.Get("/v1/userinfo", userinfoHandler)
 	server.Get("/v1/frontend-userinfo", frontendUserinfoHandler)
+	server.Get("/v1/userinfo/{subject}", subjectUserinfoHandler)
 }
 
 func filterRelevantAndAllowlistedGroups(groupsBeforeFiltering []string, userSubject string) []string {
@@ -90,6 +96,8 @@ func localUserinfoHelper(ctx context.Context, w http.ResponseWriter, r *http.Req
 		}
 	}
 	response.Groups = filterRelevantAndAllowlistedGroups(unfilteredGroups, response.Subject)
+	response.Roles = mapRoles(config.RoleMappings(), idTokenRoleClaims(ctx))
+	response.ExtraClaims = extraClaims(config.ExtraClaims(), idTokenClaims(ctx))
 
 	return response, nil
 }
@@ -97,7 +105,8 @@ func localUserinfoHelper(ctx context.Context, w http.ResponseWriter, r *http.Req
 func userinfoHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	if config.OidcUserInfoURL() == "" {
+	// the security middleware has determined the identity provider from the token
+	if config.ProviderUserInfoURL(identityProvider(ctx)) == "" {
 		response, err := localUserinfoHelper(ctx, w, r)
 		if err != nil {
 			// unauthenticatedError sent already
@@ -105,10 +114,10 @@ func userinfoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// we must accept the token info, or local testing won't work
-		aulogging.Logger.Ctx(ctx).Warn().Print("skipping token validation with IDP and taking info from token - this is not safe for production!")
-		w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
-		w.WriteHeader(http.StatusOK)
-		writeJson(ctx, w, response)
+		if config.ProviderTokenIntrospectionURL(identityProvider(ctx)) == "" {
+			aulogging.Logger.Ctx(ctx).Warn().Print("skipping token validation with IDP and taking info from token - this is not safe for production!")
+		}
+		writeUserinfo(ctx, w, r, response)
 		return
 	}
 
@@ -132,6 +141,17 @@ func userinfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the identity provider may not know yet, or we may have gotten a cached response
+	revoked, err := accessTokenRevoked(ctx, idpUserinfo.Subject)
+	if err != nil {
+		internalError(ctx, w, r, "failed to check for logged out sessions - see log for details", err.Error())
+		return
+	}
+	if revoked {
+		unauthenticatedError(ctx, w, r, "your session has been logged out - see log for details", "access token belongs to a session that has been logged out")
+		return
+	}
+
 	response := userinfo.UserInfoDto{
 		Audiences:     idpUserinfo.Audience,
 		Email:         idpUserinfo.Email,
@@ -142,14 +162,44 @@ func userinfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	// TODO if IDP's userinfo does not respond with an audience list, we just have to assume it's correct
 	if len(idpUserinfo.Audience) == 0 {
-		response.Audiences = []string{config.OidcAllowedAudience()}
+		response.Audiences = []string{config.ProviderAllowedAudience(identityProvider(ctx))}
 	}
 
 	response.Groups = filterRelevantAndAllowlistedGroups(idpUserinfo.Groups, idpUserinfo.Subject)
+	response.Roles = mapRoles(config.RoleMappings(), userinfoRoleClaims(ctx, idpUserinfo))
+	response.ExtraClaims = extraClaims(config.ExtraClaims(), idpUserinfo.Claims)
 
-	w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
-	w.WriteHeader(http.StatusOK)
-	writeJson(ctx, w, response)
+	writeUserinfo(ctx, w, r, response)
+}
+
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"sid,omitempty"`
+}
+
+// accessTokenRevoked checks whether the access token belongs to a session that has ended at the identity provider.
+//
+// Only call this after the identity provider has accepted the token, its signature is not checked here.
+// Opaque access tokens cannot be checked locally.
+func accessTokenRevoked(ctx context.Context, subject string) (bool, error) {
+	claims := accessTokenClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(ctxvalues.AccessToken(ctx), &claims)
+	if err != nil {
+		return false, nil
+	}
+	if claims.IssuedAt == nil {
+		// cannot tell whether the token was issued before or after a revocation for the subject
+		if claims.SessionId == "" {
+			return false, nil
+		}
+		subject = ""
+	}
+
+	issuedAt := time.Time{}
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	return database.GetRepository().IsSessionRevoked(ctx, claims.SessionId, subject, issuedAt)
 }
 
 func frontendUserinfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -161,9 +211,7 @@ func frontendUserinfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
-	w.WriteHeader(http.StatusOK)
-	writeJson(ctx, w, response)
+	writeUserinfo(ctx, w, r, response)
 }
 
 func idpDownstreamError(ctx context.Context, w http.ResponseWriter, r *http.Request, details string, logMessage string) {
@@ -171,12 +219,19 @@ func idpDownstreamError(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	errorHandler(ctx, w, r, "auth.idp.error", http.StatusBadGateway, url.Values{"details": []string{details}})
 }
 
+func internalError(ctx context.Context, w http.ResponseWriter, r *http.Request, details string, logMessage string) {
+	aulogging.Logger.Ctx(ctx).Error().Print(logMessage)
+	errorHandler(ctx, w, r, "auth.internal.error", http.StatusInternalServerError, url.Values{"details": []string{details}})
+}
+
 func unauthenticatedError(ctx context.Context, w http.ResponseWriter, r *http.Request, details string, logMessage string) {
 	aulogging.Logger.Ctx(ctx).Warn().Print(logMessage)
+	audit.Failure(ctx, audit.UserinfoDenied, "", ctxvalues.Subject(ctx), "", logMessage)
 	errorHandler(ctx, w, r, "auth.unauthorized", http.StatusUnauthorized, url.Values{"details": []string{details}})
 }
 
 func errorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, msg string, status int, details url.Values) {
+	metrics.RecordFailure(endpointName(r), application(ctx, nil), msg)
 	timestamp := time.Now().Format(time.RFC3339)
 	response := errorapi.ErrorDto{Message: msg, Timestamp: timestamp, Details: details, RequestId: ctxvalues.RequestId(ctx)}
 	w.Header().Set(headers.ContentType, media.ContentTypeApplicationJson)
@@ -184,6 +239,35 @@ func errorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, m
 	writeJson(ctx, w, response)
 }
 
+func writeUserinfo(ctx context.Context, w http.ResponseWriter, r *http.Request, response userinfo.UserInfoDto) {
+	metrics.RecordSuccess(endpointName(r), application(ctx, response.Audiences))
+	w.Header().Add(headers.ContentType, media.ContentTypeApplicationJson)
+	w.WriteHeader(http.StatusOK)
+	writeJson(ctx, w, response)
+}
+
+// endpointName is used as the metrics label, the route pattern keeps path parameters out of it
+func endpointName(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return strings.TrimPrefix(rctx.RoutePattern(), "/v1/")
+	}
+	return strings.TrimPrefix(r.URL.Path, "/v1/")
+}
+
+// application is used as the metrics label, it is resolved from the token audiences like the role mappings do it.
+//
+// Without audiences, we take them from the id token, if there is one. If several applications share the client id,
+// the first one is used.
+func application(ctx context.Context, audiences []string) string {
+	if len(audiences) == 0 {
+		audiences = claimValues(idTokenClaims(ctx)["aud"])
+	}
+	if apps := config.ApplicationsForAudiences(audiences); len(apps) > 0 {
+		return apps[0]
+	}
+	return ""
+}
+
 func writeJson(ctx context.Context, w http.ResponseWriter, v interface{}) {
 	encoder := json.NewEncoder(w)
 	encoder.SetEscapeHTML(false)
@@ -192,3 +276,10 @@ func writeJson(ctx context.Context, w http.ResponseWriter, v interface{}) {
 		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("error while encoding json response: %s", err.Error())
 	}
 }
+
+func identityProvider(ctx context.Context) string {
+	if provider := ctxvalues.IdentityProvider(ctx); provider != "" {
+		return provider
+	}
+	return config.DefaultIdentityProvider
+}
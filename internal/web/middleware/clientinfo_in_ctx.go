@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/go-http-utils/headers"
+	"net"
+	"net/http"
+)
+
+// AddClientInfoToContext records the client address and user agent for the audit log.
+//
+// Must come after AddRequestIdToContextAndResponse, which sets up the context value map.
+func AddClientInfoToContext(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		clientIp, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIp = r.RemoteAddr
+		}
+		ctxvalues.SetClientIp(ctx, clientIp)
+		ctxvalues.SetUserAgent(ctx, r.Header.Get(headers.UserAgent))
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
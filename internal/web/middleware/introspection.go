@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+)
+
+/* Access tokens are validated with the token introspection endpoint (RFC 7662) of their identity provider,
+ * if it has one. Without one, access tokens are passed on unchecked, and only the identity provider's
+ * userinfo endpoint finds out whether they are any good.
+ *
+ * Results for active tokens are cached for security.oidc.token_introspection_cache_seconds, but never
+ * beyond the expiry of the token. Inactive tokens are not cached, so made up tokens cannot fill the cache.
+ */
+
+// maximum number of cached introspection results, further results are not cached until some have expired
+const introspectionCacheMaxEntries = 4096
+
+var errIdentityProviderUnavailable = errors.New("identity provider could not be reached")
+
+var (
+	IDPClient idp.IdentityProviderClient
+
+	introspectionMu    sync.Mutex
+	introspectionCache = make(map[string]introspectionCacheEntry)
+)
+
+type introspectionCacheEntry struct {
+	data      idp.TokenIntrospectionData
+	expiresAt time.Time
+}
+
+// SetupTokenIntrospection sets the client used to introspect access tokens, and clears the cache.
+func SetupTokenIntrospection(idpClient idp.IdentityProviderClient) {
+	introspectionMu.Lock()
+	defer introspectionMu.Unlock()
+
+	IDPClient = idpClient
+	introspectionCache = make(map[string]introspectionCacheEntry)
+}
+
+// introspectAccessToken_MustReturnOnError checks the access token in the context with the
+// identity provider in the context, if that identity provider offers token introspection.
+//
+// If expectedSubject is not empty, the access token must belong to that subject, e.g. the subject of the
+// id token it came with.
+func introspectAccessToken_MustReturnOnError(ctx context.Context, expectedSubject string) error {
+	provider := ctxvalues.IdentityProvider(ctx)
+	if provider == "" {
+		provider = config.DefaultIdentityProvider
+	}
+	if config.ProviderTokenIntrospectionURL(provider) == "" || IDPClient == nil {
+		return nil
+	}
+
+	data, err := introspectionResult(ctx, provider)
+	if err != nil {
+		return err
+	}
+	return checkIntrospectionResult(data, provider, expectedSubject, time.Now())
+}
+
+func introspectionResult(ctx context.Context, provider string) (*idp.TokenIntrospectionData, error) {
+	now := time.Now()
+	retention := config.OidcIntrospectionCacheRetentionTime()
+	key := introspectionCacheKey(provider, ctxvalues.AccessToken(ctx))
+	if retention > 0 {
+		if data, ok := cachedIntrospectionResult(key, now); ok {
+			metrics.RecordIntrospectionCacheHit()
+			return data, nil
+		}
+		metrics.RecordIntrospectionCacheMiss()
+	}
+
+	data, status, err := IDPClient.TokenIntrospection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errIdentityProviderUnavailable, err.Error())
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return nil, fmt.Errorf("identity provider refused to introspect the token with status %d", status)
+	}
+
+	storeIntrospectionResult(key, data, introspectionCacheTTL(data, retention, now), now)
+	return data, nil
+}
+
+// checkIntrospectionResult applies the same checks as for id tokens. Claims the identity provider
+// leaves out of its answer are not checked, it has just vouched for the token after all, except for
+// the audience and the expected subject.
+func checkIntrospectionResult(data *idp.TokenIntrospectionData, provider string, expectedSubject string, now time.Time) error {
+	if !data.Active {
+		return errors.New("token is not active")
+	}
+	if data.Exp != 0 && now.Unix() >= data.Exp {
+		return errors.New("token is expired")
+	}
+	if data.Nbf != 0 && now.Unix() < data.Nbf {
+		return errors.New("token is not valid yet")
+	}
+	if allowedIssuer := config.ProviderAllowedIssuer(provider); allowedIssuer != "" && data.Iss != "" {
+		if !config.SameIssuer(data.Iss, allowedIssuer) {
+			return errors.New("token issuer does not match")
+		}
+	}
+	if err := checkIntrospectedAudience(data.Aud, config.ProviderAllowedAudience(provider), config.OidcAllowMissingAudience()); err != nil {
+		return err
+	}
+	if expectedSubject != "" && data.Sub != expectedSubject {
+		return errors.New("token subject does not match the id token")
+	}
+	scopes := strings.Fields(data.Scope)
+	for _, required := range config.OidcRequiredScopes() {
+		if !slices.Contains(scopes, required) {
+			return fmt.Errorf("token lacks required scope %s", required)
+		}
+	}
+	return nil
+}
+
+// checkIntrospectedAudience requires the allowed audience, if configured, to be among the audiences of the token.
+//
+// Tokens without aud claim are only accepted if security.oidc.allow_missing_audience is set.
+func checkIntrospectedAudience(aud []string, allowedAudience string, allowMissing bool) error {
+	if allowedAudience == "" {
+		return nil
+	}
+	if len(aud) == 0 {
+		if allowMissing {
+			return nil
+		}
+		return errors.New("token has no audience")
+	}
+	if !slices.Contains(aud, allowedAudience) {
+		return errors.New("token audience does not match")
+	}
+	return nil
+}
+
+// introspectionCacheTTL limits the retention time to the remaining lifetime of the token
+func introspectionCacheTTL(data *idp.TokenIntrospectionData, retention time.Duration, now time.Time) time.Duration {
+	if !data.Active {
+		return 0
+	}
+	if data.Exp != 0 {
+		if remaining := time.Unix(data.Exp, 0).Sub(now); remaining < retention {
+			return remaining
+		}
+	}
+	return retention
+}
+
+// introspectionCacheKey does not keep the tokens themselves in memory longer than necessary
+func introspectionCacheKey(provider string, accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return provider + " " + base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func cachedIntrospectionResult(key string, now time.Time) (*idp.TokenIntrospectionData, bool) {
+	introspectionMu.Lock()
+	defer introspectionMu.Unlock()
+
+	entry, ok := introspectionCache[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(introspectionCache, key)
+		return nil, false
+	}
+	data := entry.data
+	return &data, true
+}
+
+func storeIntrospectionResult(key string, data *idp.TokenIntrospectionData, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+
+	introspectionMu.Lock()
+	defer introspectionMu.Unlock()
+
+	if len(introspectionCache) >= introspectionCacheMaxEntries {
+		for k, entry := range introspectionCache {
+			if !now.Before(entry.expiresAt) {
+				delete(introspectionCache, k)
+			}
+		}
+		if len(introspectionCache) >= introspectionCacheMaxEntries {
+			return
+		}
+	}
+	introspectionCache[key] = introspectionCacheEntry{data: *data, expiresAt: now.Add(ttl)}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospectionCacheTTL(t *testing.T) {
+	docs.Description("introspection results are cached for the retention time, but never beyond the expiry of the token")
+	now := time.Now()
+	require.Equal(t, time.Minute, introspectionCacheTTL(&idp.TokenIntrospectionData{Active: true}, time.Minute, now))
+	require.Equal(t, time.Minute, introspectionCacheTTL(&idp.TokenIntrospectionData{Active: true, Exp: now.Add(time.Hour).Unix()}, time.Minute, now))
+	require.Equal(t, 10*time.Second, introspectionCacheTTL(&idp.TokenIntrospectionData{Active: true, Exp: now.Unix() + 10}, time.Minute, time.Unix(now.Unix(), 0)))
+	require.Equal(t, time.Duration(0), introspectionCacheTTL(&idp.TokenIntrospectionData{Active: false}, time.Minute, now))
+}
+
+func TestIntrospectionCache_expires(t *testing.T) {
+	docs.Description("cached introspection results are dropped once their time is up")
+	SetupTokenIntrospection(nil)
+	now := time.Now()
+	key := introspectionCacheKey("staff", "some-access-token")
+	storeIntrospectionResult(key, &idp.TokenIntrospectionData{Active: true, Sub: "101"}, 10*time.Second, now)
+
+	data, ok := cachedIntrospectionResult(key, now.Add(9*time.Second))
+	require.True(t, ok)
+	require.Equal(t, "101", data.Sub)
+
+	_, ok = cachedIntrospectionResult(key, now.Add(10*time.Second))
+	require.False(t, ok)
+	require.Empty(t, introspectionCache)
+}
+
+func TestIntrospectionCache_perProvider(t *testing.T) {
+	docs.Description("introspection results are cached per identity provider and token, without keeping the token itself")
+	require.NotEqual(t, introspectionCacheKey("staff", "some-access-token"), introspectionCacheKey("default", "some-access-token"))
+	require.NotContains(t, introspectionCacheKey("staff", "some-access-token"), "some-access-token")
+}
+
+func TestCheckIntrospectedAudience(t *testing.T) {
+	docs.Description("tokens without audience are rejected if an audience is configured, unless explicitly allowed")
+	require.Nil(t, checkIntrospectedAudience(nil, "", false))
+	require.Nil(t, checkIntrospectedAudience([]string{"other", "reg"}, "reg", false))
+	require.EqualError(t, checkIntrospectedAudience([]string{"other"}, "reg", true), "token audience does not match")
+	require.EqualError(t, checkIntrospectedAudience(nil, "reg", false), "token has no audience")
+	require.Nil(t, checkIntrospectedAudience(nil, "reg", true))
+}
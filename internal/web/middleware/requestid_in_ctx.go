@@ -3,19 +3,26 @@ package middleware
 import (
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
+	"regexp"
 )
 
 const TraceIdHeader = "X-Request-Id"
 
+// incoming request ids are passed on to the identity provider, so only accept harmless values
+var validRequestId = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
 func AddRequestIdToContextAndResponse(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
 		reqIdStr := r.Header.Get(TraceIdHeader)
-		if reqIdStr == "" || len(reqIdStr) > 8 {
-			reqUuid, err := uuid.NewRandom()
-			if err == nil {
+		if !validRequestId.MatchString(reqIdStr) {
+			if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+				// use the trace id, so log entries can be matched to traces
+				reqIdStr = spanContext.TraceID().String()
+			} else if reqUuid, err := uuid.NewRandom(); err == nil {
 				reqIdStr = reqUuid.String()[:8]
 			} else {
 				// this should not normally ever happen, but continue with this fixed requestId rather than none
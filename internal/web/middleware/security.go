@@ -9,8 +9,12 @@ import (
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/errorapi"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/media"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/session"
 	"github.com/go-http-utils/headers"
 	"github.com/golang-jwt/jwt/v4"
 	"net/http"
@@ -36,6 +40,32 @@ func fromCookie(r *http.Request, cookieName string) string {
 	return authCookie.Value
 }
 
+// fromSession resolves the session cookie of applications with server-side sessions to the tokens kept for it,
+// so they can be validated just as if they had been sent in cookies.
+//
+// Each application has its own session cookie. If the browser sends several, the first valid one wins.
+func fromSession(ctx context.Context, r *http.Request) (idToken string, accessToken string) {
+	for _, applicationName := range config.ServerSideSessionApplications() {
+		sessionId := session.IdFromCookie(r, applicationName)
+		if sessionId == "" {
+			continue
+		}
+
+		s, err := session.Get(ctx, sessionId)
+		if err != nil {
+			// an expired session is not considered an error, same as a missing cookie
+			aulogging.Logger.Ctx(ctx).Info().Printf("ignoring session cookie: %s", err.Error())
+			continue
+		}
+		if s.Application != applicationName {
+			aulogging.Logger.Ctx(ctx).Info().Printf("ignoring session cookie of application %s: session was created for application %s", applicationName, s.Application)
+			continue
+		}
+		return s.IdToken, s.AccessToken
+	}
+	return "", ""
+}
+
 func fromAuthHeader(r *http.Request) string {
 	headerValue := r.Header.Get(headers.Authorization)
 
@@ -50,12 +80,18 @@ func fromAuthHeader(r *http.Request) string {
 
 // important - if any of these return an error, you must abort processing via "return" and log the error message
 
-func recordAccessTokenInContextUnchecked(ctx context.Context, accessTokenValue string) (success bool) {
-	if accessTokenValue != "" {
-		ctxvalues.SetAccessToken(ctx, accessTokenValue) // required for userinfo call to IDP
-		return true
+// recordAccessTokenInContext_MustReturnOnError also validates the access token if its identity provider offers token introspection
+//
+// expectedSubject is the subject of the id token the access token came with, empty if there is none.
+func recordAccessTokenInContext_MustReturnOnError(ctx context.Context, accessTokenValue string, expectedSubject string) (success bool, err error) {
+	if accessTokenValue == "" {
+		return false, nil
+	}
+	ctxvalues.SetAccessToken(ctx, accessTokenValue) // required for userinfo and introspection calls to IDP
+	if err := introspectAccessToken_MustReturnOnError(ctx, expectedSubject); err != nil {
+		return false, err
 	}
-	return false
+	return true, nil
 }
 
 func keyFuncForKey(rsaPublicKey *rsa.PublicKey) func(token *jwt.Token) (interface{}, error) {
@@ -69,6 +105,7 @@ type CustomClaims struct {
 	EmailVerified bool     `json:"email_verified"`
 	Groups        []string `json:"groups,omitempty"`
 	Name          string   `json:"name"`
+	SessionId     string   `json:"sid,omitempty"`
 }
 
 type AllClaims struct {
@@ -80,26 +117,32 @@ func checkIdToken_MustReturnOnError(ctx context.Context, idTokenValue string) (s
 	if idTokenValue != "" {
 		tokenString := strings.TrimSpace(idTokenValue)
 
-		errorMessage := ""
-		for _, key := range config.OidcKeySet() {
+		provider := keyset.IdentityProviderForToken(tokenString)
+		errorMessage := "no keys available to validate token"
+		for _, key := range keyset.CandidateKeys(ctx, provider, tokenString) {
 			claims := AllClaims{}
 			token, err := jwt.ParseWithClaims(tokenString, &claims, keyFuncForKey(key), jwt.WithValidMethods([]string{"RS256", "RS512"}))
 			if err == nil && token.Valid {
 				parsedClaims, ok := token.Claims.(*AllClaims)
 				if ok {
-					if config.OidcAllowedAudience() != "" {
-						if len(parsedClaims.Audience) != 1 || parsedClaims.Audience[0] != config.OidcAllowedAudience() {
+					if allowedAudience := config.ProviderAllowedAudience(provider); allowedAudience != "" {
+						if len(parsedClaims.Audience) != 1 || parsedClaims.Audience[0] != allowedAudience {
 							return false, errors.New("token audience does not match")
 						}
 					}
 
-					if config.OidcAllowedIssuer() != "" {
-						if parsedClaims.Issuer != config.OidcAllowedIssuer() {
+					if allowedIssuer := config.ProviderAllowedIssuer(provider); allowedIssuer != "" {
+						if !config.SameIssuer(parsedClaims.Issuer, allowedIssuer) {
 							return false, errors.New("token issuer does not match")
 						}
 					}
 
-					ctxvalues.SetAudience(ctx, config.OidcAllowedAudience())
+					if err := checkNotRevoked(ctx, parsedClaims); err != nil {
+						return false, err
+					}
+
+					ctxvalues.SetAudience(ctx, config.ProviderAllowedAudience(provider))
+					ctxvalues.SetIdentityProvider(ctx, provider)
 					ctxvalues.SetIdToken(ctx, idTokenValue)
 					ctxvalues.SetEmail(ctx, parsedClaims.Email)
 					ctxvalues.SetEmailVerified(ctx, parsedClaims.EmailVerified)
@@ -123,6 +166,40 @@ func checkIdToken_MustReturnOnError(ctx context.Context, idTokenValue string) (s
 	return false, nil
 }
 
+// checkNotRevoked rejects tokens whose session has ended at the identity provider (see back-channel logout)
+func checkNotRevoked(ctx context.Context, claims *AllClaims) error {
+	issuedAt := time.Time{}
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	revoked, err := database.GetRepository().IsSessionRevoked(ctx, claims.SessionId, claims.Subject, issuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errors.New("token belongs to a session that has been logged out")
+	}
+	return nil
+}
+
+// checkAccessTokenNotRevoked applies checkNotRevoked to access tokens that are JWTs.
+//
+// Opaque access tokens cannot be checked locally. The signature is not checked here, the claims are only ever used to reject the token.
+func checkAccessTokenNotRevoked(ctx context.Context, accessTokenValue string) error {
+	claims := AllClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessTokenValue, &claims); err != nil {
+		return nil
+	}
+	if claims.IssuedAt == nil {
+		// cannot tell whether the token was issued before or after a revocation for the subject
+		if claims.SessionId == "" {
+			return nil
+		}
+		claims.Subject = ""
+	}
+	return checkNotRevoked(ctx, &claims)
+}
+
 func allow(actualMethod string, actualUrlPath string, allowedMethod string, allowedUrlPath string) bool {
 	return actualMethod == allowedMethod && actualUrlPath == allowedUrlPath
 }
@@ -131,30 +208,67 @@ func skipAuthCheckCompletely(method string, urlPath string) bool {
 	// positive list for request URLs and Methods where the complete check can be skipped
 	return allow(method, urlPath, http.MethodGet, "/v1/auth") || // login step 1
 		allow(method, urlPath, http.MethodGet, "/v1/dropoff") || // login step 2
+		allow(method, urlPath, http.MethodPost, "/v1/dropoff") || // login step 2 with response_mode form_post
 		allow(method, urlPath, http.MethodGet, "/v1/logout") || // logout
+		allow(method, urlPath, http.MethodGet, "/v1/logout-callback") || // logout at idp completed
+		allow(method, urlPath, http.MethodPost, "/v1/backchannel-logout") || // logout notification from idp, carries its own token
+		allow(method, urlPath, http.MethodPost, "/v1/refresh") || // session renewal, the id token may already have expired
+		allow(method, urlPath, http.MethodGet, "/health/live") || // liveness check
+		allow(method, urlPath, http.MethodGet, "/health/ready") || // readiness check
 		allow(method, urlPath, http.MethodGet, "/") // healthcheck
 }
 
 // --- top level ---
 
-func checkAllAuthentication_MustReturnOnError(ctx context.Context, method string, urlPath string, authHeaderValue string, idTokenCookieValue string, accessTokenCookieValue string) error {
+func checkAllAuthentication_MustReturnOnError(ctx context.Context, method string, urlPath string, apiKeyValue string, authHeaderValue string, idTokenCookieValue string, accessTokenCookieValue string) error {
 	if skipAuthCheckCompletely(method, urlPath) {
 		return nil
 	}
 
+	// try api key of a service client
+	success, err := checkApiKey_MustReturnOnError(ctx, apiKeyValue)
+	if err != nil {
+		return fmt.Errorf("invalid api key: %s", err.Error())
+	}
+	if success {
+		return nil
+	}
+
+	// try access token of a service client (client credentials grant)
+	success, err = checkServiceToken_MustReturnOnError(ctx, authHeaderValue)
+	if err != nil {
+		return fmt.Errorf("invalid service token in authorization header: %s", err.Error())
+	}
+	if success {
+		return nil
+	}
+
 	// try authorization header (gives only access token, so MUST use userinfo endpoint in controller to return useful info)
-	success := recordAccessTokenInContextUnchecked(ctx, authHeaderValue)
+	if authHeaderValue != "" {
+		// opaque access tokens are attributed to the default identity provider
+		ctxvalues.SetIdentityProvider(ctx, keyset.IdentityProviderForToken(authHeaderValue))
+		if err := checkAccessTokenNotRevoked(ctx, authHeaderValue); err != nil {
+			return fmt.Errorf("invalid access token in authorization header: %w", err)
+		}
+	}
+	success, err = recordAccessTokenInContext_MustReturnOnError(ctx, authHeaderValue, "")
+	if err != nil {
+		return fmt.Errorf("invalid access token in authorization header: %w", err)
+	}
 	if success {
 		return nil
 	}
 
 	// now try cookie pair
-	success, err := checkIdToken_MustReturnOnError(ctx, idTokenCookieValue)
+	success, err = checkIdToken_MustReturnOnError(ctx, idTokenCookieValue)
 	if err != nil {
 		return fmt.Errorf("invalid id token in cookie: %s", err.Error())
 	}
 	if success {
-		success2 := recordAccessTokenInContextUnchecked(ctx, accessTokenCookieValue)
+		success2, err := recordAccessTokenInContext_MustReturnOnError(ctx, accessTokenCookieValue, ctxvalues.Subject(ctx))
+		if err != nil {
+			return fmt.Errorf("invalid access token in cookie: %w", err)
+		}
 		if success2 {
 			return nil
 		}
@@ -170,17 +284,29 @@ func TokenValidator(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		apiKeyValue := fromApiKeyHeader(r)
 		authHeaderValue := fromAuthHeader(r)
 		idTokenCookieValue := fromCookie(r, config.OidcIdTokenCookieName())
 		accessTokenCookieValue := fromCookie(r, config.OidcAccessTokenCookieName())
+		if !skipAuthCheckCompletely(r.Method, r.URL.Path) {
+			if sessionIdToken, sessionAccessToken := fromSession(ctx, r); sessionIdToken != "" {
+				idTokenCookieValue, accessTokenCookieValue = sessionIdToken, sessionAccessToken
+			}
+		}
 
-		err := checkAllAuthentication_MustReturnOnError(ctx, r.Method, r.URL.Path, authHeaderValue, idTokenCookieValue, accessTokenCookieValue)
+		err := checkAllAuthentication_MustReturnOnError(ctx, r.Method, r.URL.Path, apiKeyValue, authHeaderValue, idTokenCookieValue, accessTokenCookieValue)
 		if err != nil {
+			audit.Failure(ctx, audit.TokenValidationFailure, "", "", "", err.Error())
+			if errors.Is(err, errIdentityProviderUnavailable) {
+				aulogging.Logger.Ctx(ctx).Warn().Print(err.Error())
+				ErrorHandler(ctx, w, r, "auth.idp.error", http.StatusBadGateway, url.Values{"details": []string{"identity provider could not be reached - see log for details"}})
+				return
+			}
 			UnauthenticatedError(ctx, w, r, "authorization failed to check out during local validation - please see logs for details", err.Error())
 			return
 		}
 
-		// WARNING - at this point we might still have an unverified access token!
+		// WARNING - at this point we might still have an unverified access token, unless its identity provider offers token introspection!
 
 		next.ServeHTTP(w, r)
 		return
@@ -2,14 +2,25 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/entity"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database/inmemorydb"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/require"
+	"math/big"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 // --- test setup ---
@@ -23,6 +34,9 @@ func TestMain(m *testing.M) {
 func tstSetup() {
 	aulogging.SetupNoLoggerForTesting()
 	config.LoadConfiguration("../../../test/resources/config-acceptancetests.yaml")
+	repository := inmemorydb.Create()
+	_ = repository.Open()
+	database.SetRepository(repository)
 }
 
 // --- tokens ---
@@ -58,28 +72,35 @@ func tstRequire(t *testing.T, actualErr error, expectedErr string) {
 
 func tstSkipTestCase(t *testing.T) context.Context {
 	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
-	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/auth", "", "", "")
+	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/auth", "", "", "", "")
 	tstRequire(t, actualErr, "")
 	return ctx
 }
 
 func tstNothingTestCase(t *testing.T, expectedErr string) context.Context {
 	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
-	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", "", "", "")
+	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", "", "", "", "")
 	tstRequire(t, actualErr, expectedErr)
 	return ctx
 }
 
 func tstAuthHeaderTestCase(t *testing.T, authHeaderValue string, expectedLoggedErr string) context.Context {
 	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
-	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", authHeaderValue, "", "")
+	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", "", authHeaderValue, "", "")
 	tstRequire(t, actualErr, expectedLoggedErr)
 	return ctx
 }
 
 func tstCookiesTestCase(t *testing.T, idTokenCookieValue string, accessTokenCookieValue string, expectedLoggedErr string) context.Context {
 	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
-	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", "", idTokenCookieValue, accessTokenCookieValue)
+	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo", "", "", idTokenCookieValue, accessTokenCookieValue)
+	tstRequire(t, actualErr, expectedLoggedErr)
+	return ctx
+}
+
+func tstApiKeyTestCase(t *testing.T, apiKeyValue string, expectedLoggedErr string) context.Context {
+	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
+	actualErr := checkAllAuthentication_MustReturnOnError(ctx, http.MethodGet, "/v1/userinfo/101", apiKeyValue, "", "", "")
 	tstRequire(t, actualErr, expectedLoggedErr)
 	return ctx
 }
@@ -141,3 +162,217 @@ func TestCookiesExpiredJwt(t *testing.T) {
 	require.Equal(t, "", ctxvalues.AccessToken(ctx))
 	require.False(t, ctxvalues.IsAuthorizedAsGroup(ctx, "admin"))
 }
+
+func TestCookiesRevokedSession(t *testing.T) {
+	docs.Description("Valid cookies are rejected once their session has been logged out via back-channel logout")
+	repository := inmemorydb.Create()
+	_ = repository.Open()
+	database.SetRepository(repository)
+	defer tstSetup()
+	_ = repository.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		SessionId: "d7b8fe7a-079a-4596-8e53-a60f86a08ac6",
+		RevokedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	ctx := tstCookiesTestCase(t, valid_JWT_id_is_admin_sub1234567890, valid_access_token, "invalid id token in cookie: token belongs to a session that has been logged out")
+	require.Equal(t, "", ctxvalues.IdToken(ctx))
+	require.False(t, ctxvalues.IsAuthorizedAsGroup(ctx, "admin"))
+}
+
+func TestCookiesRevokedSubject(t *testing.T) {
+	docs.Description("Valid cookies are rejected if all sessions of their subject have been logged out after they were issued")
+	repository := inmemorydb.Create()
+	_ = repository.Open()
+	database.SetRepository(repository)
+	defer tstSetup()
+	_ = repository.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		Subject:   "1234567890",
+		RevokedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	ctx := tstCookiesTestCase(t, valid_JWT_id_is_admin_sub1234567890, valid_access_token, "invalid id token in cookie: token belongs to a session that has been logged out")
+	require.Equal(t, "", ctxvalues.IdToken(ctx))
+
+	ctx2 := tstCookiesTestCase(t, valid_JWT_id_is_staff_sub202, valid_access_token, "")
+	require.Equal(t, valid_JWT_id_is_staff_sub202, ctxvalues.IdToken(ctx2))
+}
+
+func TestAuthHeaderRevokedSession(t *testing.T) {
+	docs.Description("JWT access tokens in the authorization header are rejected once their session has been logged out via back-channel logout")
+	repository := inmemorydb.Create()
+	_ = repository.Open()
+	database.SetRepository(repository)
+	defer tstSetup()
+	_ = repository.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		SessionId: "d7b8fe7a-079a-4596-8e53-a60f86a08ac6",
+		RevokedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	ctx := tstAuthHeaderTestCase(t, valid_JWT_id_is_admin_sub1234567890, "invalid access token in authorization header: token belongs to a session that has been logged out")
+	require.Equal(t, "", ctxvalues.AccessToken(ctx))
+}
+
+func TestAuthHeaderRevokedSubject(t *testing.T) {
+	docs.Description("JWT access tokens in the authorization header are rejected if all sessions of their subject have been logged out after they were issued")
+	repository := inmemorydb.Create()
+	_ = repository.Open()
+	database.SetRepository(repository)
+	defer tstSetup()
+	_ = repository.AddRevokedSession(context.TODO(), &entity.RevokedSession{
+		Subject:   "1234567890",
+		RevokedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	ctx := tstAuthHeaderTestCase(t, valid_JWT_id_is_admin_sub1234567890, "invalid access token in authorization header: token belongs to a session that has been logged out")
+	require.Equal(t, "", ctxvalues.AccessToken(ctx))
+
+	ctx2 := tstAuthHeaderTestCase(t, valid_JWT_id_is_staff_sub202, "")
+	require.Equal(t, valid_JWT_id_is_staff_sub202, ctxvalues.AccessToken(ctx2))
+
+	// opaque access tokens cannot be checked locally and are left to the identity provider
+	ctx3 := tstAuthHeaderTestCase(t, valid_access_token, "")
+	require.Equal(t, valid_access_token, ctxvalues.AccessToken(ctx3))
+}
+
+type keySetIDPClient struct {
+	idp.IdentityProviderClient // only KeySet is implemented
+
+	keys []idp.JsonWebKeyDto
+}
+
+func (c *keySetIDPClient) KeySet(ctx context.Context, provider string) (*idp.KeySetResponseDto, int, error) {
+	return &idp.KeySetResponseDto{Keys: c.keys}, http.StatusOK, nil
+}
+
+func tstSignedTokenWithKid(t *testing.T, kid string, subject string) (string, idp.JsonWebKeyDto) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	claims := AllClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "http://identity.localhost/",
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		CustomClaims: CustomClaims{
+			Name:   "John Rotated",
+			Groups: []string{"admin"},
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privateKey)
+	require.Nil(t, err)
+
+	return signed, idp.JsonWebKeyDto{
+		KeyType:  "RSA",
+		KeyId:    kid,
+		Use:      "sig",
+		Modulus:  base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+		Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.PublicKey.E)).Bytes()),
+	}
+}
+
+func TestCookiesValidKeyFromKeySet(t *testing.T) {
+	docs.Description("tokens signed with a key from the key set endpoint are validated using the key matching their kid")
+	signed, jwk := tstSignedTokenWithKid(t, "rotated-key", "1234567890")
+	keyset.Setup(&keySetIDPClient{keys: []idp.JsonWebKeyDto{jwk}})
+	defer keyset.Setup(nil)
+
+	ctx := tstCookiesTestCase(t, signed, valid_access_token, "")
+	require.Equal(t, signed, ctxvalues.IdToken(ctx))
+	require.Equal(t, "1234567890", ctxvalues.Subject(ctx))
+	require.True(t, ctxvalues.IsAuthorizedAsGroup(ctx, "admin"))
+}
+
+func TestCookiesUnknownKid(t *testing.T) {
+	docs.Description("tokens with a kid not in the key set fall back to the configured keys, and are rejected if none match")
+	signed, _ := tstSignedTokenWithKid(t, "unknown-key", "1234567890")
+	keyset.Setup(&keySetIDPClient{})
+	defer keyset.Setup(nil)
+
+	ctx := tstCookiesTestCase(t, signed, valid_access_token, "invalid id token in cookie: crypto/rsa: verification error")
+	require.Equal(t, "", ctxvalues.IdToken(ctx))
+}
+
+func TestApiKeyValid(t *testing.T) {
+	docs.Description("the api key of a service client is accepted, and identifies the service client")
+	ctx := tstApiKeyTestCase(t, valid_api_token, "")
+	require.Equal(t, "payment-service", ctxvalues.ServiceClient(ctx))
+	require.Equal(t, "", ctxvalues.AccessToken(ctx))
+	require.Equal(t, "", ctxvalues.Subject(ctx))
+}
+
+func TestApiKeyInvalid(t *testing.T) {
+	docs.Description("an api key that belongs to no service client is rejected")
+	ctx := tstApiKeyTestCase(t, invalid_api_token, "invalid api key: api key does not belong to any service client")
+	require.Equal(t, "", ctxvalues.ServiceClient(ctx))
+}
+
+func tstSignedServiceToken(t *testing.T, kid string, clientId string, expires bool) (string, idp.JsonWebKeyDto) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	claims := ServiceClaims{ClientId: clientId}
+	claims.Issuer = "http://identity.localhost/"
+	if expires {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privateKey)
+	require.Nil(t, err)
+
+	return signed, idp.JsonWebKeyDto{
+		KeyType:  "RSA",
+		KeyId:    kid,
+		Use:      "sig",
+		Modulus:  base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+		Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.PublicKey.E)).Bytes()),
+	}
+}
+
+func TestServiceTokenValid(t *testing.T) {
+	docs.Description("an access token issued to a service client via the client credentials grant identifies the service client")
+	signed, jwk := tstSignedServiceToken(t, "service-key", "IAmTheMailService.", true)
+	keyset.Setup(&keySetIDPClient{keys: []idp.JsonWebKeyDto{jwk}})
+	defer keyset.Setup(nil)
+
+	ctx := tstAuthHeaderTestCase(t, signed, "")
+	require.Equal(t, "mail-service", ctxvalues.ServiceClient(ctx))
+	require.Equal(t, "", ctxvalues.AccessToken(ctx))
+}
+
+func TestServiceTokenWithoutExpiry(t *testing.T) {
+	docs.Description("access tokens of service clients must expire")
+	signed, jwk := tstSignedServiceToken(t, "service-key", "IAmTheMailService.", false)
+	keyset.Setup(&keySetIDPClient{keys: []idp.JsonWebKeyDto{jwk}})
+	defer keyset.Setup(nil)
+
+	ctx := tstAuthHeaderTestCase(t, signed, "invalid service token in authorization header: service token does not expire")
+	require.Equal(t, "", ctxvalues.ServiceClient(ctx))
+}
+
+func TestServiceTokenWrongSignature(t *testing.T) {
+	docs.Description("access tokens that claim to belong to a service client must be signed by the identity provider")
+	signed, _ := tstSignedServiceToken(t, "unknown-key", "IAmTheMailService.", true)
+	keyset.Setup(&keySetIDPClient{})
+	defer keyset.Setup(nil)
+
+	ctx := tstAuthHeaderTestCase(t, signed, "invalid service token in authorization header: crypto/rsa: verification error")
+	require.Equal(t, "", ctxvalues.ServiceClient(ctx))
+	require.Equal(t, "", ctxvalues.AccessToken(ctx))
+}
+
+func TestServiceTokenOtherClient(t *testing.T) {
+	docs.Description("access tokens of clients that are not service clients are left to the user token checks")
+	signed, _ := tstSignedServiceToken(t, "unknown-key", "IAmNotSoSecret.", true)
+
+	ctx := tstAuthHeaderTestCase(t, signed, "")
+	require.Equal(t, "", ctxvalues.ServiceClient(ctx))
+	require.Equal(t, signed, ctxvalues.AccessToken(ctx))
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Backend services call us without a user, see security.service_clients. They authenticate either with
+ * a static api key in the X-Api-Key header, or with an access token they obtained from the identity provider
+ * using the client credentials grant.
+ *
+ * Requests of service clients carry no user tokens, so the endpoints meant for users reject them.
+ * Which endpoints a service client may call is controlled by its scopes, see ctxvalues.ServiceClient.
+ */
+
+const apiKeyHeader = "X-Api-Key"
+
+func fromApiKeyHeader(r *http.Request) string {
+	return r.Header.Get(apiKeyHeader)
+}
+
+// checkApiKey_MustReturnOnError compares the hash of the api key with those of all service clients.
+func checkApiKey_MustReturnOnError(ctx context.Context, apiKeyValue string) (success bool, err error) {
+	if apiKeyValue == "" {
+		return false, nil
+	}
+
+	hash := sha256.Sum256([]byte(apiKeyValue))
+	actual := []byte(hex.EncodeToString(hash[:]))
+	for name, sc := range config.ServiceClients() {
+		if sc.ApiKeySha256 == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare(actual, []byte(strings.ToLower(sc.ApiKeySha256))) == 1 {
+			ctxvalues.SetServiceClient(ctx, name)
+			return true, nil
+		}
+	}
+	return false, errors.New("api key does not belong to any service client")
+}
+
+type ServiceClaims struct {
+	jwt.RegisteredClaims
+	ClientId        string `json:"client_id"`
+	AuthorizedParty string `json:"azp"`
+}
+
+// serviceClientForClientId returns the name of the service client with the client id, empty if there is none.
+func serviceClientForClientId(clientId string) string {
+	if clientId == "" {
+		return ""
+	}
+	for name, sc := range config.ServiceClients() {
+		if sc.ClientId == clientId {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkServiceToken_MustReturnOnError validates the access token in the authorization header, if it was issued
+// to a service client via the client credentials grant.
+//
+// Any other token is left to the checks for user tokens.
+func checkServiceToken_MustReturnOnError(ctx context.Context, authHeaderValue string) (success bool, err error) {
+	if authHeaderValue == "" {
+		return false, nil
+	}
+	tokenString := strings.TrimSpace(authHeaderValue)
+
+	unverified := ServiceClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &unverified); err != nil {
+		// opaque tokens cannot be attributed to a service client
+		return false, nil
+	}
+	name := serviceClientForClientId(unverified.ClientId)
+	if name == "" {
+		name = serviceClientForClientId(unverified.AuthorizedParty)
+	}
+	if name == "" {
+		return false, nil
+	}
+
+	// from here on, the token claims to belong to a service client, so it must check out
+	provider := keyset.IdentityProviderForToken(tokenString)
+	errorMessage := "no keys available to validate token"
+	for _, key := range keyset.CandidateKeys(ctx, provider, tokenString) {
+		claims := ServiceClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, &claims, keyFuncForKey(key), jwt.WithValidMethods([]string{"RS256", "RS512"}))
+		if err != nil {
+			errorMessage = err.Error()
+			continue
+		}
+		if !token.Valid {
+			errorMessage = "token parsed but invalid"
+			continue
+		}
+
+		if claims.ExpiresAt == nil {
+			return false, errors.New("service token does not expire")
+		}
+		if allowedIssuer := config.ProviderAllowedIssuer(provider); allowedIssuer != "" {
+			if !config.SameIssuer(claims.Issuer, allowedIssuer) {
+				return false, errors.New("service token issuer does not match")
+			}
+		}
+		if allowedAudience := config.ProviderAllowedAudience(provider); allowedAudience != "" && len(claims.Audience) > 0 {
+			if !slices.Contains(claims.Audience, allowedAudience) {
+				return false, errors.New("service token audience does not match")
+			}
+		}
+
+		ctxvalues.SetIdentityProvider(ctx, provider)
+		ctxvalues.SetServiceClient(ctx, name)
+		return true, nil
+	}
+	return false, errors.New(errorMessage)
+}
@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+)
+
+type EventType string
+
+const (
+	LoginStart             EventType = "login_start"
+	LoginSuccess           EventType = "login_success"
+	LoginFailure           EventType = "login_failure"
+	Logout                 EventType = "logout"
+	BackchannelLogout      EventType = "backchannel_logout"
+	UserinfoDenied         EventType = "userinfo_denied"
+	TokenValidationFailure EventType = "token_validation_failure"
+	ServiceUserinfoLookup  EventType = "service_userinfo_lookup"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// limits for values that come straight from the request, so they cannot bloat the audit log
+const (
+	maxAppNameLength   = 64
+	maxUserAgentLength = 256
+)
+
+// Event is one entry in the audit log. The schema is fixed, so incident response can rely on it.
+type Event struct {
+	Timestamp string    `json:"timestamp"`
+	Type      EventType `json:"event"`
+	AppName   string    `json:"app_name"`
+	Subject   string    `json:"subject"`
+	StateHash string    `json:"state_hash"`
+	ClientIp  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason"`
+	RequestId string    `json:"request_id"`
+}
+
+// Sink receives audit events. Implementations must be safe for concurrent use.
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+var (
+	sinkMu sync.RWMutex
+	sink   Sink = noSink{}
+)
+
+// Setup creates the sink configured in audit.sink.
+func Setup() {
+	var newSink Sink = noSink{}
+	switch config.AuditSink() {
+	case config.AuditStdout:
+		newSink = NewStdoutSink()
+	case config.AuditFile:
+		newSink = NewFileSink(config.AuditFileConfiguration())
+	}
+	SetSink(newSink)
+}
+
+// SetSink replaces the sink, closing the previous one. Exposed so tests (or other
+// deployments) can plug in their own sink - use Setup().
+func SetSink(newSink Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	if err := sink.Close(); err != nil {
+		aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("failed to close audit sink: %s", err.Error())
+	}
+	sink = newSink
+}
+
+// Close flushes and closes the sink, any further events are dropped.
+func Close() {
+	SetSink(noSink{})
+}
+
+// Success records a successful event. Request id, client ip and user agent are taken from the context.
+func Success(ctx context.Context, eventType EventType, appName string, subject string, state string) {
+	record(ctx, eventType, appName, subject, state, OutcomeSuccess, "")
+}
+
+// Failure records a failed event. Request id, client ip and user agent are taken from the context.
+func Failure(ctx context.Context, eventType EventType, appName string, subject string, state string, reason string) {
+	record(ctx, eventType, appName, subject, state, OutcomeFailure, reason)
+}
+
+func record(ctx context.Context, eventType EventType, appName string, subject string, state string, outcome string, reason string) {
+	event := Event{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Type:      eventType,
+		AppName:   truncate(appName, maxAppNameLength),
+		Subject:   subject,
+		StateHash: HashState(state),
+		ClientIp:  ctxvalues.ClientIp(ctx),
+		UserAgent: truncate(ctxvalues.UserAgent(ctx), maxUserAgentLength),
+		Outcome:   outcome,
+		Reason:    reason,
+		RequestId: ctxvalues.RequestId(ctx),
+	}
+
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	if err := sink.Write(event); err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("failed to write audit event %s: %s", eventType, err.Error())
+	}
+}
+
+// HashState allows correlating the events of one login flow without putting the state itself in the audit log.
+func HashState(state string) string {
+	if state == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(hash[:])
+}
+
+func truncate(value string, maxLength int) string {
+	if len(value) > maxLength {
+		return value[:maxLength]
+	}
+	return value
+}
+
+type noSink struct{}
+
+func (noSink) Write(Event) error {
+	return nil
+}
+
+func (noSink) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/stretchr/testify/require"
+)
+
+func tstContext() context.Context {
+	ctx := ctxvalues.CreateContextWithValueMap(context.Background())
+	ctxvalues.SetRequestId(ctx, "a1b2c3d4")
+	ctxvalues.SetClientIp(ctx, "192.0.2.7")
+	ctxvalues.SetUserAgent(ctx, "Mozilla/5.0 "+strings.Repeat("x", 300))
+	return ctx
+}
+
+func TestHashState(t *testing.T) {
+	docs.Description("audit events contain a hash of the state, so it can be correlated without being disclosed")
+	require.Equal(t, "", HashState(""))
+	require.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", HashState("foo"))
+}
+
+func TestFailure_writesJsonLine(t *testing.T) {
+	docs.Description("each audit event is written as one line of json")
+	docs.Given("given an audit sink writing to a buffer")
+	buffer := &bytes.Buffer{}
+	SetSink(&jsonSink{writer: buffer})
+	defer Close()
+
+	docs.When("when a failed login is recorded")
+	Failure(tstContext(), LoginFailure, "example-service", "", "foo", "id token failed validation: token nonce does not match")
+
+	docs.Then("then a single json line with the request information and a truncated user agent is written")
+	require.True(t, strings.HasSuffix(buffer.String(), "}\n"))
+	event := Event{}
+	require.Nil(t, json.Unmarshal(buffer.Bytes(), &event))
+	require.NotEmpty(t, event.Timestamp)
+	event.Timestamp = ""
+	expected := Event{
+		Type:      LoginFailure,
+		AppName:   "example-service",
+		StateHash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		ClientIp:  "192.0.2.7",
+		UserAgent: ("Mozilla/5.0 " + strings.Repeat("x", 300))[:256],
+		Outcome:   OutcomeFailure,
+		Reason:    "id token failed validation: token nonce does not match",
+		RequestId: "a1b2c3d4",
+	}
+	require.Equal(t, expected, event)
+}
+
+func TestFileSink(t *testing.T) {
+	docs.Description("audit events can be written to a file")
+	docs.Given("given an audit sink writing to a file")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	SetSink(NewFileSink(config.AuditFileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 1}))
+
+	docs.When("when two events are recorded")
+	Success(tstContext(), LoginStart, "example-service", "", "foo")
+	Success(tstContext(), LoginSuccess, "example-service", "101", "foo")
+	Close()
+
+	docs.Then("then the file contains one line per event")
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Equal(t, 2, len(lines))
+	require.Contains(t, lines[0], `"event":"login_start"`)
+	require.Contains(t, lines[1], `"event":"login_success"`)
+	require.Contains(t, lines[1], `"subject":"101"`)
+	require.Contains(t, lines[1], `"outcome":"success"`)
+}
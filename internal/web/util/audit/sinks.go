@@ -0,0 +1,59 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// jsonSink writes each event as one line of json
+type jsonSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewStdoutSink writes events to standard output, one json object per line.
+func NewStdoutSink() Sink {
+	return &jsonSink{writer: os.Stdout}
+}
+
+// NewFileSink writes events to a file, one json object per line.
+//
+// The file is rotated when it reaches the configured size, and old files are removed
+// according to the configured number of backups and maximum age.
+func NewFileSink(c config.AuditFileConfig) Sink {
+	logger := &lumberjack.Logger{
+		Filename:   c.Path,
+		MaxSize:    c.MaxSizeMB,
+		MaxBackups: c.MaxBackups,
+		MaxAge:     c.MaxAgeDays,
+	}
+	return &jsonSink{writer: logger, closer: logger}
+}
+
+func (s *jsonSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer.Write(line)
+	return err
+}
+
+func (s *jsonSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closer.Close()
+}
@@ -17,6 +17,10 @@ const ContextEmail = "email"
 const ContextEmailVerified = "emailverified"
 const ContextName = "name"
 const ContextSubject = "subject"
+const ContextClientIp = "clientip"
+const ContextUserAgent = "useragent"
+const ContextIdentityProvider = "identityprovider"
+const ContextServiceClient = "serviceclient"
 
 func CreateContextWithValueMap(ctx context.Context) context.Context {
 	// this is so we can add values to our context, like ... I don't know ... the http status from the response!
@@ -115,6 +119,42 @@ func SetSubject(ctx context.Context, Subject string) {
 	setValue(ctx, ContextSubject, Subject)
 }
 
+func ClientIp(ctx context.Context) string {
+	return valueOrDefault(ctx, ContextClientIp, "")
+}
+
+func SetClientIp(ctx context.Context, clientIp string) {
+	setValue(ctx, ContextClientIp, clientIp)
+}
+
+func UserAgent(ctx context.Context) string {
+	return valueOrDefault(ctx, ContextUserAgent, "")
+}
+
+func SetUserAgent(ctx context.Context, userAgent string) {
+	setValue(ctx, ContextUserAgent, userAgent)
+}
+
+// IdentityProvider is the name of the identity provider that issued the token of the current request,
+// empty if not known, which means the default identity provider.
+func IdentityProvider(ctx context.Context) string {
+	return valueOrDefault(ctx, ContextIdentityProvider, "")
+}
+
+func SetIdentityProvider(ctx context.Context, provider string) {
+	setValue(ctx, ContextIdentityProvider, provider)
+}
+
+// ServiceClient is the name of the backend service that made the current request, see security.service_clients,
+// empty if the request was made on behalf of a user.
+func ServiceClient(ctx context.Context) string {
+	return valueOrDefault(ctx, ContextServiceClient, "")
+}
+
+func SetServiceClient(ctx context.Context, name string) {
+	setValue(ctx, ContextServiceClient, name)
+}
+
 func IsAuthorizedAsGroup(ctx context.Context, group string) bool {
 	value := valueOrDefault(ctx, fmt.Sprintf("%s-%s", ContextAuthorizedAs, group), "")
 	return value == group
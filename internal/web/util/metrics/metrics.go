@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "reg_auth"
+
+// UnknownApp is the app label used when the application is not (yet) known, or not configured.
+const UnknownApp = "unknown"
+
+var circuitBreakerStates = []string{"closed", "half-open", "open"}
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Outcomes of the login, logout and userinfo endpoints by application and error reason.",
+	}, []string{"endpoint", "app", "outcome", "reason"})
+
+	idpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "idp_request_duration_seconds",
+		Help:      "Latency of requests to the identity providers.",
+		Buckets:   []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"provider", "operation", "status"})
+
+	idpCircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "idp_circuit_breaker_state",
+		Help:      "State of the circuit breaker protecting each identity provider (1 for the current state, 0 otherwise).",
+	}, []string{"provider", "state"})
+
+	userinfoCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "userinfo_cache_requests_total",
+		Help:      "Userinfo cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	introspectionCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "introspection_cache_requests_total",
+		Help:      "Token introspection cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	prunedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pruned_total",
+		Help:      "Number of expired entries removed from the database by kind.",
+	}, []string{"kind"})
+
+	pruneErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prune_errors_total",
+		Help:      "Number of failed prune runs by kind.",
+	}, []string{"kind"})
+
+	// PendingAuthRequests is called when the metrics are scraped. Set during application setup.
+	PendingAuthRequests func(ctx context.Context) (int64, error)
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pending_auth_requests",
+		Help:      "Number of login flows that have been started but not yet completed or expired.",
+	}, pendingAuthRequests)
+)
+
+func init() {
+	SetCircuitBreakerState(config.DefaultIdentityProvider, "closed")
+}
+
+// RecordSuccess counts a successful request to one of our endpoints.
+func RecordSuccess(endpoint string, app string) {
+	requestsTotal.WithLabelValues(endpoint, appLabel(app), "success", "").Inc()
+}
+
+// RecordFailure counts a failed request to one of our endpoints.
+//
+// The reason must come from a small fixed set of values, never pass user input here.
+func RecordFailure(endpoint string, app string, reason string) {
+	requestsTotal.WithLabelValues(endpoint, appLabel(app), "failure", reason).Inc()
+}
+
+// ReasonForStatus turns a http status into an error reason, e.g. "not_found" for 404.
+func ReasonForStatus(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return strconv.Itoa(status)
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+// ObserveIdpRequest records the latency of a request to an identity provider.
+func ObserveIdpRequest(provider string, operation string, status int, err error, latency time.Duration) {
+	statusLabel := strconv.Itoa(status)
+	if err != nil && status == 0 {
+		statusLabel = "error"
+	}
+	idpRequestDuration.WithLabelValues(provider, operation, statusLabel).Observe(latency.Seconds())
+}
+
+// SetCircuitBreakerState records the current state of the circuit breaker of an identity provider ("closed", "half-open" or "open").
+func SetCircuitBreakerState(provider string, state string) {
+	for _, s := range circuitBreakerStates {
+		value := 0.0
+		if s == state {
+			value = 1.0
+		}
+		idpCircuitBreakerState.WithLabelValues(provider, s).Set(value)
+	}
+}
+
+func RecordUserinfoCacheHit() {
+	userinfoCacheTotal.WithLabelValues("hit").Inc()
+}
+
+func RecordUserinfoCacheMiss() {
+	userinfoCacheTotal.WithLabelValues("miss").Inc()
+}
+
+func RecordIntrospectionCacheHit() {
+	introspectionCacheTotal.WithLabelValues("hit").Inc()
+}
+
+func RecordIntrospectionCacheMiss() {
+	introspectionCacheTotal.WithLabelValues("miss").Inc()
+}
+
+// RecordPrune records the result of a prune run, kind is "auth_requests", "revoked_sessions" or "sessions".
+func RecordPrune(kind string, count uint, err error) {
+	if err != nil {
+		pruneErrorsTotal.WithLabelValues(kind).Inc()
+		return
+	}
+	prunedTotal.WithLabelValues(kind).Add(float64(count))
+}
+
+// appLabel only uses configured application names, so unknown app_name parameters cannot blow up the label set.
+func appLabel(app string) string {
+	if _, err := config.GetApplicationConfig(app); err != nil {
+		return UnknownApp
+	}
+	return app
+}
+
+func pendingAuthRequests() float64 {
+	if PendingAuthRequests == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count, err := PendingAuthRequests(ctx)
+	if err != nil {
+		aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("failed to count pending auth requests: %s", err.Error())
+		return 0
+	}
+	return float64(count)
+}
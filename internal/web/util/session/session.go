@@ -0,0 +1,171 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+)
+
+// server-side sessions (backend-for-frontend mode) keep the tokens in the database, and the browser only
+// gets an opaque random session id. Only the hash of the session id is stored.
+//
+// The tokens are encrypted with AES-256-GCM, using a key derived from the session id. So whoever gets hold
+// of the database still cannot use the tokens, unless they also have the session cookie.
+
+const idLength = 32
+
+// New stores a session with the given tokens and returns its id, which is what goes into the session cookie.
+func New(ctx context.Context, applicationName string, idToken string, accessToken string, refreshToken string, expiry time.Duration) (string, error) {
+	raw := make([]byte, idLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	s := &entity.Session{
+		IdHash:      idHash(id),
+		Application: applicationName,
+		ExpiresAt:   time.Now().Add(expiry),
+	}
+	if err := encryptTokens(s, id, idToken, accessToken, refreshToken); err != nil {
+		return "", err
+	}
+	if err := database.GetRepository().AddSession(ctx, s); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Get loads the session with the given id, with its tokens decrypted.
+func Get(ctx context.Context, id string) (*entity.Session, error) {
+	s, err := database.GetRepository().GetSessionByIdHash(ctx, idHash(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptTokens(s, id); err != nil {
+		return nil, fmt.Errorf("failed to decrypt session tokens: %s", err.Error())
+	}
+	return s, nil
+}
+
+// UpdateTokens replaces the tokens of the session with the given id.
+func UpdateTokens(ctx context.Context, id string, idToken string, accessToken string, refreshToken string) error {
+	s := &entity.Session{
+		IdHash: idHash(id),
+	}
+	if err := encryptTokens(s, id, idToken, accessToken, refreshToken); err != nil {
+		return err
+	}
+	return database.GetRepository().UpdateSessionTokens(ctx, s)
+}
+
+// Delete removes the session with the given id.
+func Delete(ctx context.Context, id string) error {
+	return database.GetRepository().DeleteSessionByIdHash(ctx, idHash(id))
+}
+
+// IdFromCookie returns the session id from the session cookie of the application, or "" if there is none.
+func IdFromCookie(r *http.Request, applicationName string) string {
+	if config.OidcSessionCookieName() == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(config.SessionCookieName(applicationName))
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func idHash(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// --- token encryption ---
+
+func tokenCipher(id string) (cipher.AEAD, error) {
+	// must differ from idHash, which is stored next to the ciphertext
+	key := sha256.Sum256([]byte("session-tokens:" + id))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptTokens(s *entity.Session, id string, idToken string, accessToken string, refreshToken string) error {
+	aead, err := tokenCipher(id)
+	if err != nil {
+		return err
+	}
+	if s.IdToken, err = encryptToken(aead, idToken, s.IdHash); err != nil {
+		return err
+	}
+	if s.AccessToken, err = encryptToken(aead, accessToken, s.IdHash); err != nil {
+		return err
+	}
+	if s.RefreshToken, err = encryptToken(aead, refreshToken, s.IdHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decryptTokens(s *entity.Session, id string) error {
+	aead, err := tokenCipher(id)
+	if err != nil {
+		return err
+	}
+	if s.IdToken, err = decryptToken(aead, s.IdToken, s.IdHash); err != nil {
+		return err
+	}
+	if s.AccessToken, err = decryptToken(aead, s.AccessToken, s.IdHash); err != nil {
+		return err
+	}
+	if s.RefreshToken, err = decryptToken(aead, s.RefreshToken, s.IdHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+func encryptToken(aead cipher.AEAD, token string, hash string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(hash))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func decryptToken(aead cipher.AEAD, encrypted string, hash string) (string, error) {
+	if encrypted == "" {
+		return "", nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("invalid encoding: %s", err.Error())
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("value too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(hash))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
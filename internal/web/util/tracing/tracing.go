@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/eurofurence/reg-auth-service"
+
+var provider *sdktrace.TracerProvider
+
+// Setup installs the tracer provider and the W3C trace context propagator.
+//
+// Spans are exported via OTLP/HTTP to tracing.otlp_endpoint. If that is not configured, spans are still
+// created (so trace context is propagated to the identity provider), but never exported.
+func Setup() error {
+	if config.TracingOtlpEndpoint() == "" {
+		setup()
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.TracingOtlpEndpoint()))
+	if err != nil {
+		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to set up OTLP trace exporter: %s", err.Error())
+		return err
+	}
+	setup(sdktrace.WithBatcher(exporter))
+	aulogging.Logger.NoCtx().Info().Printf("exporting traces to %s", config.TracingOtlpEndpoint())
+	return nil
+}
+
+// SetupForTesting installs a tracer provider that synchronously hands every finished span to the given exporter,
+// e.g. an in-memory exporter from go.opentelemetry.io/otel/sdk/trace/tracetest.
+//
+// Only intended for tests - use Setup().
+func SetupForTesting(exporter sdktrace.SpanExporter) {
+	setup(sdktrace.WithSyncer(exporter))
+}
+
+func setup(options ...sdktrace.TracerProviderOption) {
+	options = append(options, sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "reg-auth-service"))))
+	provider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Shutdown flushes any spans not yet exported.
+func Shutdown(ctx context.Context) {
+	if provider == nil {
+		return
+	}
+	if err := provider.Shutdown(ctx); err != nil {
+		aulogging.Logger.NoCtx().Warn().WithErr(err).Printf("failed to flush traces on shutdown: %s", err.Error())
+	}
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
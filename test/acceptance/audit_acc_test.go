@@ -0,0 +1,152 @@
+package acceptance
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/stretchr/testify/require"
+)
+
+// -------------------------------------
+// acceptance tests for the audit log
+// -------------------------------------
+
+/* Security relevant events are written to the audit log with a fixed schema.
+ */
+
+type tstAuditSink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *tstAuditSink) Write(event audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *tstAuditSink) Close() error {
+	return nil
+}
+
+// tstAuditEvents returns the recorded events without the fields that vary between runs
+func tstAuditEvents() []audit.Event {
+	tstAudit.mu.Lock()
+	defer tstAudit.mu.Unlock()
+	result := make([]audit.Event, 0)
+	for _, event := range tstAudit.events {
+		event.Timestamp = ""
+		event.ClientIp = ""
+		event.RequestId = ""
+		result = append(result, event)
+	}
+	return result
+}
+
+func TestAudit_LoginFlow(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user completes the login flow")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/auth?app_name=example-service", tstWithFlowCookie(http.Header{"User-Agent": []string{"audit-test-agent"}}, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, response.StatusCode)
+	response = tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(http.Header{"User-Agent": []string{"audit-test-agent"}}, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, response.StatusCode)
+
+	docs.Then("then the start of the login and its success are audited")
+	events := tstAuditEvents()
+	require.Equal(t, 2, len(events))
+	require.Equal(t, audit.LoginStart, events[0].Type)
+	require.Equal(t, "example-service", events[0].AppName)
+	require.Equal(t, audit.OutcomeSuccess, events[0].Outcome)
+	require.Equal(t, "audit-test-agent", events[0].UserAgent)
+	require.Len(t, events[0].StateHash, 64)
+	require.Equal(t, audit.Event{
+		Type:      audit.LoginSuccess,
+		AppName:   "example-service",
+		Subject:   "101",
+		StateHash: audit.HashState(tstAuthRequest.State),
+		UserAgent: "audit-test-agent",
+		Outcome:   audit.OutcomeSuccess,
+	}, events[1])
+
+	docs.Then("and the client ip and request id are recorded")
+	require.Equal(t, "127.0.0.1", tstAudit.events[1].ClientIp)
+	require.Equal(t, response.Header.Get("X-Request-Id"), tstAudit.events[1].RequestId)
+}
+
+func TestAudit_LoginFailure(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the identity provider reports an error at dropoff")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&error=access_denied", tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	docs.Then("then the failed login is audited with the reason")
+	events := tstAuditEvents()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, audit.LoginFailure, events[0].Type)
+	require.Equal(t, "example-service", events[0].AppName)
+	require.Equal(t, audit.OutcomeFailure, events[0].Outcome)
+	require.Equal(t, "error parameter set (access_denied|)", events[0].Reason)
+	require.Equal(t, audit.HashState(tstAuthRequest.State), events[0].StateHash)
+}
+
+func TestAudit_Logout(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user logs out")
+	response := tstPerformGetNoRedirect("/v1/logout?app_name=example-service")
+	require.Equal(t, http.StatusFound, response.StatusCode)
+
+	docs.Then("then the logout is audited")
+	events := tstAuditEvents()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, audit.Logout, events[0].Type)
+	require.Equal(t, "example-service", events[0].AppName)
+	require.Equal(t, audit.OutcomeSuccess, events[0].Outcome)
+}
+
+func TestAudit_TokenValidationFailure(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the userinfo endpoint is called with an id token with a broken signature")
+	brokenToken := valid_JWT_id_is_not_staff_sub101[:len(valid_JWT_id_is_not_staff_sub101)-8] + "AAAAAAAA"
+	response := tstPerformGetWithCookies("/v1/userinfo", brokenToken, "access_mock_value 101")
+	require.Equal(t, http.StatusUnauthorized, response.status)
+
+	docs.Then("then the token validation failure is audited")
+	events := tstAuditEvents()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, audit.TokenValidationFailure, events[0].Type)
+	require.Equal(t, audit.OutcomeFailure, events[0].Outcome)
+	require.Contains(t, events[0].Reason, "verification error")
+}
+
+func TestAudit_UserinfoDenied(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the identity provider rejects the access token of a user with a valid id token")
+	response := tstPerformGetWithCookies("/v1/userinfo", valid_JWT_id_is_not_staff_sub101, "rejected_by_idp")
+	require.Equal(t, http.StatusUnauthorized, response.status)
+
+	docs.Then("then the userinfo denial is audited with the subject")
+	events := tstAuditEvents()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, audit.UserinfoDenied, events[0].Type)
+	require.Equal(t, "101", events[0].Subject)
+	require.Equal(t, "idp returned rejection status 401", events[0].Reason)
+}
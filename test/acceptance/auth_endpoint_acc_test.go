@@ -5,7 +5,9 @@ import (
 	"github.com/eurofurence/reg-auth-service/internal/repository/database"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/eurofurence/reg-auth-service/docs"
 	"github.com/stretchr/testify/require"
@@ -30,8 +32,8 @@ import (
  *  * dropoff_url   - where to redirect the user after a successfull authentication flow.
  *                    This URL must match the pattern of allowed URLs in the config file.
  *
- * All additional query parameters are appended to the app's dropoff_url after a successfull
- * authentication.
+ * Additional query parameters listed in the app's passthrough_parameters are appended to the
+ * dropoff_url after a successfull authentication. All other query parameters are ignored.
  */
 
 func TestAuth_Success_DropoffUrlSpecified(t *testing.T) {
@@ -66,10 +68,15 @@ func TestAuth_Success_DropoffUrlSpecified(t *testing.T) {
 	state := values.Get("state")
 	require.NotEmpty(t, state, "missing state (nonce) parameter")
 
-	docs.Then("and the provided dropoff url is stored internally for this state")
+	nonce := values.Get("nonce")
+	require.NotEmpty(t, nonce, "missing nonce parameter")
+	require.NotEqual(t, state, nonce, "nonce must be generated independently of the state")
+
+	docs.Then("and the provided dropoff url and the nonce are stored internally for this state")
 	internalStateData, err := database.GetRepository().GetAuthRequestByState(context.TODO(), state)
 	require.Nil(t, err)
 	require.Equal(t, "https://example.com/app/?foo=abc", internalStateData.DropOffUrl)
+	require.Equal(t, nonce, internalStateData.Nonce)
 }
 
 func TestAuth_Success_DefaultDropoffUrl(t *testing.T) {
@@ -154,3 +161,196 @@ func TestAuth_Failure_InvalidDropoffUrl(t *testing.T) {
 	responseBody := tstResponseBodyString(&response)
 	require.Contains(t, responseBody, "<b>error:</b> invalid parameters")
 }
+
+func TestAuth_Success_PassthroughParameters(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow with additional query parameters, some of which are not allowlisted")
+	testUrl := "/v1/auth?app_name=example-service&lang=de-DE&foo=bar&unknown=ignored"
+	response := tstPerformGetNoRedirect(testUrl)
+
+	docs.Then("then the user agent is redirected to the OpenID Connect auth URL without the additional parameters")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	values := loc.Query()
+	require.Empty(t, values.Get("lang"))
+	require.Empty(t, values.Get("unknown"))
+
+	docs.Then("and only the allowlisted parameters are stored internally for this state")
+	internalStateData, err := database.GetRepository().GetAuthRequestByState(context.TODO(), values.Get("state"))
+	require.Nil(t, err)
+	require.Equal(t, "foo=bar&lang=de-DE", internalStateData.ExtraParameters)
+}
+
+func TestAuth_Failure_PassthroughParameterTooLong(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow with an allowlisted parameter that has an overly long value")
+	testUrl := "/v1/auth?app_name=example-service&lang=" + strings.Repeat("x", 257)
+	response := tstPerformGetNoRedirect(testUrl)
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> invalid parameters")
+}
+
+func TestAuth_Failure_PassthroughParametersTooLong(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow with allowlisted parameters that are too long in total")
+	testUrl := "/v1/auth?app_name=example-service"
+	for i := 0; i < 5; i++ {
+		testUrl = testUrl + "&lang=" + strings.Repeat("x", 250)
+	}
+	response := tstPerformGetNoRedirect(testUrl)
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> invalid parameters")
+}
+
+func TestAuth_Success_PushedAuthorizationRequest(t *testing.T) {
+	docs.Given("given an application that uses pushed authorization requests")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=par-service")
+
+	docs.Then("then the authorization parameters are pushed to the identity provider")
+	pushed := idpMock.lastPushedParameters
+	require.Equal(t, "IAmPushing.", pushed.Get("client_id"))
+	require.Equal(t, "S256", pushed.Get("code_challenge_method"))
+	require.NotEmpty(t, pushed.Get("code_challenge"))
+	state := pushed.Get("state")
+	require.NotEmpty(t, state)
+
+	docs.Then("and the user agent is redirected with only the client_id and the request_uri")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "/auth", loc.Path)
+	require.Equal(t, url.Values{
+		"client_id":   []string{"IAmPushing."},
+		"request_uri": []string{"urn:ietf:params:oauth:request_uri:mock-" + state},
+	}, loc.Query())
+
+	docs.Then("and the flow state is stored internally")
+	_, err = database.GetRepository().GetAuthRequestByState(context.TODO(), state)
+	require.Nil(t, err)
+}
+
+func TestAuth_Failure_PushedAuthorizationRequestRejected(t *testing.T) {
+	docs.Given("given an application that requires pushed authorization requests, and an identity provider that rejects them")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	idpMock.parFailure = true
+
+	docs.When("when they start an auth flow")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=par-service")
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusBadGateway, response.StatusCode, "unexpected http response status, must be HTTP 502")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> identity provider error")
+}
+
+func TestAuth_Success_PushedAuthorizationRequestFallback(t *testing.T) {
+	docs.Given("given an application that prefers pushed authorization requests, and an identity provider that rejects them")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	idpMock.parFailure = true
+
+	docs.When("when they start an auth flow")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=par-fallback-service")
+
+	docs.Then("then the user agent is redirected with all authorization parameters in the url")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	values := loc.Query()
+	require.Equal(t, "IAmPushingMaybe.", values.Get("client_id"))
+	require.Equal(t, "S256", values.Get("code_challenge_method"))
+	require.Equal(t, idpMock.lastPushedParameters.Get("state"), values.Get("state"))
+	require.Empty(t, values.Get("request_uri"))
+	require.Empty(t, values.Get("client_secret"))
+}
+
+func TestAuth_Success_ResponseModeFormPost(t *testing.T) {
+	docs.Given("given an application that uses response_mode form_post")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=form-post-service")
+
+	docs.Then("then the identity provider is asked to post the authorization response")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "form_post", loc.Query().Get("response_mode"))
+}
+
+func TestAuth_Success_SecondIdentityProvider(t *testing.T) {
+	docs.Given("given an application that logs in with a second identity provider")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=staff-service")
+
+	docs.Then("then the user agent is redirected to the authorization endpoint of that identity provider")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "staff.example.com", loc.Host)
+	require.Equal(t, "/auth", loc.Path)
+	require.Equal(t, "IAmStaff.", loc.Query().Get("client_id"))
+}
+
+func TestAuth_Success_SetsFlowCookie(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they start an auth flow")
+	state, cookie := tstStartAuthFlow(t, "example-service")
+
+	docs.Then("then a short-lived http only flow cookie is set, restricted to the dropoff endpoint")
+	require.NotNil(t, cookie, "flow cookie must be present")
+	require.True(t, strings.HasPrefix(cookie.Name, "reg_auth_flow_"))
+	require.Equal(t, "/v1/dropoff", cookie.Path)
+	require.True(t, cookie.HttpOnly)
+	require.Equal(t, http.SameSiteLaxMode, cookie.SameSite, "must be sent along with the redirect back from the identity provider")
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), cookie.Expires, time.Minute, "must expire together with the auth request")
+
+	docs.Then("and it contains a hash of the state, not the state itself")
+	require.NotContains(t, cookie.Value, state)
+}
+
+// tstStartAuthFlow calls the auth endpoint like a browser would, and returns the state and the flow cookie that was set
+func tstStartAuthFlow(t *testing.T, appName string) (string, *http.Cookie) {
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=" + appName)
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	state := loc.Query().Get("state")
+	require.NotEmpty(t, state)
+
+	var flowCookie *http.Cookie
+	for _, cookie := range response.Cookies() {
+		if strings.HasPrefix(cookie.Name, "reg_auth_flow_") {
+			flowCookie = cookie
+		}
+	}
+	return state, flowCookie
+}
@@ -0,0 +1,180 @@
+package acceptance
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// ------------------------------------------------------
+// acceptance tests for the back-channel logout endpoint
+// ------------------------------------------------------
+
+/* The identity provider calls the /backchannel-logout endpoint directly (not via the user agent)
+ * when a session has ended. From then on, tokens belonging to the session are no longer accepted.
+ *
+ * Required form parameters are:
+ *  * logout_token - signed token identifying the session (sid) and/or the user (sub)
+ */
+
+const tstSessionIdOfTestTokens = "d7b8fe7a-079a-4596-8e53-a60f86a08ac6"
+
+func TestBackchannelLogout_Session(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the identity provider sends a valid logout token for a session")
+	response := tstPerformBackchannelLogout(tstLogoutClaims(tstSessionIdOfTestTokens, "101"))
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+
+	docs.Then("and id tokens belonging to the session are no longer accepted")
+	userinfoResponse := tstPerformGetWithCookies("/v1/frontend-userinfo", valid_JWT_id_is_not_staff_sub101, "access_mock_value 101")
+	tstRequireErrorResponse(t, userinfoResponse, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+}
+
+func TestBackchannelLogout_Subject(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the identity provider sends a valid logout token for a subject without a session id")
+	response := tstPerformBackchannelLogout(tstLogoutClaims("", "101"))
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+
+	docs.Then("and id tokens of the subject are no longer accepted")
+	userinfoResponse := tstPerformGetWithCookies("/v1/frontend-userinfo", valid_JWT_id_is_not_staff_sub101, "access_mock_value 101")
+	require.Equal(t, http.StatusUnauthorized, userinfoResponse.status, "unexpected http response status")
+
+	docs.Then("but id tokens of other subjects are still accepted")
+	userinfoResponse2 := tstPerformGetWithCookies("/v1/frontend-userinfo", valid_JWT_id_is_staff_sub202, "access_mock_value 202")
+	require.Equal(t, http.StatusOK, userinfoResponse2.status, "unexpected http response status")
+}
+
+func TestBackchannelLogout_Failure_TokenMissing(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the back-channel logout endpoint is called without a logout token")
+	response := tstPerformPostForm("/v1/backchannel-logout", url.Values{})
+
+	docs.Then("then the request is rejected")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "auth.logout.invalid", "invalid parameters")
+}
+
+func TestBackchannelLogout_Failure_WrongSignature(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the back-channel logout endpoint is called with a logout token signed by an unknown key")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, tstLogoutClaims(tstSessionIdOfTestTokens, "101"))
+	token.Header["kid"] = tstIdpKid
+	signed, err := token.SignedString(otherKey)
+	require.Nil(t, err)
+	response := tstPerformPostForm("/v1/backchannel-logout", url.Values{"logout_token": []string{signed}})
+
+	docs.Then("then the request is rejected and the session stays valid")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "auth.logout.invalid", "invalid logout token")
+	userinfoResponse := tstPerformGetWithCookies("/v1/frontend-userinfo", valid_JWT_id_is_not_staff_sub101, "access_mock_value 101")
+	require.Equal(t, http.StatusOK, userinfoResponse.status, "unexpected http response status")
+}
+
+func TestBackchannelLogout_Failure_InvalidClaims(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	invalidClaims := map[string]jwt.MapClaims{
+		"wrong audience": tstModifiedLogoutClaims(func(c jwt.MapClaims) { c["aud"] = "someone-else" }),
+		"missing events": tstModifiedLogoutClaims(func(c jwt.MapClaims) { delete(c, "events") }),
+		"wrong event":    tstModifiedLogoutClaims(func(c jwt.MapClaims) { c["events"] = map[string]interface{}{"other": map[string]interface{}{}} }),
+		"event is not object": tstModifiedLogoutClaims(func(c jwt.MapClaims) {
+			c["events"] = map[string]interface{}{"http://schemas.openid.net/event/backchannel-logout": "yes"}
+		}),
+		"nonce present":        tstModifiedLogoutClaims(func(c jwt.MapClaims) { c["nonce"] = "abc" }),
+		"neither sid nor sub":  tstModifiedLogoutClaims(func(c jwt.MapClaims) { delete(c, "sid"); delete(c, "sub") }),
+		"missing issued at":    tstModifiedLogoutClaims(func(c jwt.MapClaims) { delete(c, "iat") }),
+		"expired logout token": tstModifiedLogoutClaims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }),
+		"missing expiry":       tstModifiedLogoutClaims(func(c jwt.MapClaims) { delete(c, "exp") }),
+		"missing jti":          tstModifiedLogoutClaims(func(c jwt.MapClaims) { delete(c, "jti") }),
+		"old issued at":        tstModifiedLogoutClaims(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-time.Hour).Unix() }),
+	}
+
+	for name, claims := range invalidClaims {
+		docs.When("when the back-channel logout endpoint is called with a logout token with " + name)
+		response := tstPerformBackchannelLogout(claims)
+
+		docs.Then("then the request is rejected")
+		require.Equal(t, http.StatusBadRequest, response.status, "unexpected http response status for "+name)
+	}
+
+	docs.Then("and the session stays valid")
+	userinfoResponse := tstPerformGetWithCookies("/v1/frontend-userinfo", valid_JWT_id_is_not_staff_sub101, "access_mock_value 101")
+	require.Equal(t, http.StatusOK, userinfoResponse.status, "unexpected http response status")
+}
+
+func TestBackchannelLogout_Failure_Replayed(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the identity provider has sent a valid logout token for a subject")
+	claims := tstLogoutClaims("", "101")
+	response := tstPerformBackchannelLogout(claims)
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status for first logout")
+
+	docs.When("when the same logout token is sent again")
+	response2 := tstPerformBackchannelLogout(claims)
+
+	docs.Then("then the request is rejected")
+	tstRequireErrorResponse(t, response2, http.StatusBadRequest, "auth.logout.invalid", "invalid logout token")
+}
+
+// helper functions
+
+func tstLogoutClaims(sid string, sub string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss": "http://identity.localhost/",
+		"aud": "IAmNotSoSecret.",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(2 * time.Minute).Unix(),
+		"jti": strconv.FormatInt(time.Now().UnixNano(), 36),
+		"events": map[string]interface{}{
+			"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{},
+		},
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	if sub != "" {
+		claims["sub"] = sub
+	}
+	return claims
+}
+
+func tstModifiedLogoutClaims(modify func(c jwt.MapClaims)) jwt.MapClaims {
+	claims := tstLogoutClaims(tstSessionIdOfTestTokens, "101")
+	modify(claims)
+	return claims
+}
+
+func tstPerformBackchannelLogout(claims jwt.MapClaims) tstWebResponse {
+	signed := tstSignWithIdpKey(claims, "logout+jwt")
+	return tstPerformPostForm("/v1/backchannel-logout", url.Values{"logout_token": []string{signed}})
+}
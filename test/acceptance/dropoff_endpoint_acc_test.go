@@ -1,9 +1,18 @@
 package acceptance
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/golang-jwt/jwt/v4"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/eurofurence/reg-auth-service/docs"
 	"github.com/stretchr/testify/require"
@@ -37,7 +46,7 @@ func TestDropoff_Success(t *testing.T) {
 	docs.When("when they call the dropoff endpoint with valid state and valid authorization_code")
 	test_url := "/v1/dropoff?state=" + tstAuthRequest.State
 	test_url = test_url + "&code=" + tstAuthorizationCode
-	response := tstPerformGetNoRedirect(test_url)
+	response := tstPerformGetNoRedirectWithHeaders(test_url, tstWithFlowCookie(nil, tstAuthRequest.State))
 
 	docs.Then("then the user agent is redirected to the drop off URL")
 	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
@@ -65,10 +74,130 @@ func TestDropoff_Success(t *testing.T) {
 	}
 	require.NotNil(t, id, "Id token cookie must be present")
 	require.NotNil(t, ac, "Auth token cookie must be present")
-	require.Equal(t, "dummy_mock_value", id.Value)
+	require.Equal(t, idpMock.lastIdToken, id.Value)
 	require.Equal(t, "example.com", id.Domain)
 	require.Equal(t, "access_mock_value", ac.Value)
 	require.Equal(t, "example.com", ac.Domain)
+
+	rt := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be present")
+	require.NotEmpty(t, rt.Value)
+	require.NotContains(t, rt.Value, "refresh_mock_value", "refresh token must not be sent to the browser in clear text")
+	require.True(t, rt.HttpOnly)
+}
+
+func TestDropoff_Success_PassthroughParameters(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an auth request with passthrough parameters, one of which is also present in the dropoff url")
+	authRequest := *tstAuthRequest
+	authRequest.State = "PassthroughState0123456789"
+	authRequest.DropOffUrl = "https://example.com/drop_off_url?dingbaz=5#section"
+	authRequest.ExtraParameters = "dingbaz=7&lang=de-DE"
+	require.Nil(t, database.GetRepository().AddAuthRequest(context.TODO(), &authRequest))
+
+	docs.When("when they call the dropoff endpoint with valid state and valid authorization_code")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+authRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, authRequest.State))
+
+	docs.Then("then the user agent is redirected to the drop off URL with the passthrough parameters appended")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "/drop_off_url", loc.Path)
+	require.Equal(t, "section", loc.Fragment, "fragment of the dropoff url must be kept")
+	values := loc.Query()
+	require.Equal(t, []string{"5"}, values["dingbaz"], "parameter of the dropoff url must take precedence")
+	require.Equal(t, "de-DE", values.Get("lang"))
+}
+
+func TestDropoff_Failure_InvalidIdToken(t *testing.T) {
+	invalidClaims := map[string]func(c jwt.MapClaims){
+		"wrong audience":  func(c jwt.MapClaims) { c["aud"] = "someone-else" },
+		"wrong nonce":     func(c jwt.MapClaims) { c["nonce"] = "replayed-nonce" },
+		"missing nonce":   func(c jwt.MapClaims) { delete(c, "nonce") },
+		"expired":         func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"missing expiry":  func(c jwt.MapClaims) { delete(c, "exp") },
+		"wrong at_hash":   func(c jwt.MapClaims) { c["at_hash"] = tstAccessTokenHash("other_access_token") },
+		"future issuance": func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+	}
+
+	for name, modifier := range invalidClaims {
+		docs.Given("given the standard test configuration")
+		tstSetup(tstDefaultConfigFile)
+
+		docs.Given("given the identity provider returns an id token with " + name)
+		idpMock.idTokenModifier = modifier
+
+		docs.When("when they call the dropoff endpoint with valid state and valid authorization_code")
+		response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+
+		docs.Then("then the correct error is displayed and no cookies are set")
+		require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status for "+name)
+		responseBody := tstResponseBodyString(&response)
+		require.Contains(t, responseBody, "<b>error:</b> identity provider returned an invalid id token")
+		require.Empty(t, response.Cookies(), "no cookies must be set for "+name)
+
+		tstShutdown()
+	}
+}
+
+func TestDropoff_Failure_IdTokenWrongSignature(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the identity provider returns an id token signed with a key that is not in its key set")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	idpMock.keys[0].Modulus = base64.RawURLEncoding.EncodeToString(otherKey.PublicKey.N.Bytes())
+
+	docs.When("when they call the dropoff endpoint with valid state and valid authorization_code")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+
+	docs.Then("then the correct error is displayed and no cookies are set")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status, must be HTTP 401")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> identity provider returned an invalid id token")
+	require.Empty(t, response.Cookies())
+}
+
+func TestDropoff_Failure_StateReplayed(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a dropoff has already been completed successfully for a state")
+	test_url := "/v1/dropoff?state=" + tstAuthRequest.State
+	response := tstPerformGetNoRedirectWithHeaders(test_url+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status for first dropoff, must be HTTP 302 MOVED")
+
+	docs.When("when they call the dropoff endpoint again with the same state and another authorization_code")
+	response2 := tstPerformGetNoRedirectWithHeaders(test_url+"&code=someothercode", tstWithFlowCookie(nil, tstAuthRequest.State))
+
+	docs.Then("then the second dropoff is rejected and no cookies are set")
+	require.Equal(t, http.StatusNotFound, response2.StatusCode, "unexpected http response status, must be HTTP 404")
+	responseBody := tstResponseBodyString(&response2)
+	require.Contains(t, responseBody, "<b>error:</b> auth request not found or timed out")
+	require.Empty(t, response2.Cookies(), "no cookies must be set on a replayed dropoff")
+}
+
+func TestDropoff_Failure_StateReplayedAfterError(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a dropoff has already failed with an error from the identity provider for a state")
+	test_url := "/v1/dropoff?state=" + tstAuthRequest.State
+	response := tstPerformGetNoRedirectWithHeaders(test_url+"&error=access_denied&error_description=denied", tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status for first dropoff, must be HTTP 400")
+
+	docs.When("when they call the dropoff endpoint again with the same state and a valid authorization_code")
+	response2 := tstPerformGetNoRedirectWithHeaders(test_url+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+
+	docs.Then("then the second dropoff is rejected as well")
+	require.Equal(t, http.StatusNotFound, response2.StatusCode, "unexpected http response status, must be HTTP 404")
 }
 
 func TestDropoff_Failure_IDPError(t *testing.T) {
@@ -78,7 +207,7 @@ func TestDropoff_Failure_IDPError(t *testing.T) {
 
 	docs.When("when they call the dropoff endpoint with an error")
 	test_url := "/v1/dropoff?state=" + tstAuthRequest.State + "&error=request_unauthorized&error_description=The+request+could+not+be+authorized"
-	response := tstPerformGetNoRedirect(test_url)
+	response := tstPerformGetNoRedirectWithHeaders(test_url, tstWithFlowCookie(nil, tstAuthRequest.State))
 
 	docs.Then("then the correct error is displayed")
 	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
@@ -109,7 +238,7 @@ func TestDropoff_Failure_CodeMissing(t *testing.T) {
 
 	docs.When("when they call the dropoff endpoint without a code parameter")
 	test_url := "/v1/dropoff?state=" + tstAuthRequest.State
-	response := tstPerformGetNoRedirect(test_url)
+	response := tstPerformGetNoRedirectWithHeaders(test_url, tstWithFlowCookie(nil, tstAuthRequest.State))
 
 	docs.Then("then the correct error is displayed")
 	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
@@ -125,10 +254,248 @@ func TestDropoff_Failure_StateNotFound(t *testing.T) {
 	docs.When("when they call the dropoff endpoint with a state parameter that is not in the internal storage (possibly expired)")
 	test_url := "/v1/dropoff?state=notthere"
 	test_url = test_url + "&code=" + tstAuthorizationCode
-	response := tstPerformGetNoRedirect(test_url)
+	response := tstPerformGetNoRedirectWithHeaders(test_url, tstWithFlowCookie(nil, "notthere"))
 
 	docs.Then("then the correct error is displayed")
 	require.Equal(t, http.StatusNotFound, response.StatusCode, "unexpected http response status, must be HTTP 404")
 	responseBody := tstResponseBodyString(&response)
 	require.Contains(t, responseBody, "<b>error:</b> auth request not found or timed out")
 }
+
+// tstAddFormPostAuthRequest stores an auth request for the application that uses response_mode form_post
+func tstAddFormPostAuthRequest(t *testing.T) string {
+	state := "Fp7RkLq2mx903nlcfkjHd39cdh"
+	err := database.GetRepository().AddAuthRequest(context.TODO(), &entity.AuthRequest{
+		Application:      "form-post-service",
+		State:            state,
+		Nonce:            tstAuthRequest.Nonce,
+		PkceCodeVerifier: tstAuthRequest.PkceCodeVerifier,
+		Purpose:          entity.AuthRequestLogin,
+		DropOffUrl:       "https://example.com/form-post/",
+		ExpiresAt:        time.Now().Add(time.Minute),
+	})
+	require.Nil(t, err)
+	idpMock.idTokenModifier = func(claims jwt.MapClaims) {
+		claims["aud"] = "IAmPosting."
+	}
+	return state
+}
+
+func TestDropoff_Success_FormPost(t *testing.T) {
+	docs.Given("given an auth request for an application that uses response_mode form_post")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	state := tstAddFormPostAuthRequest(t)
+
+	docs.When("when the identity provider posts valid state and authorization_code to the dropoff endpoint")
+	response := tstPerformPostFormNoRedirectWithHeaders("/v1/dropoff", url.Values{
+		"state": []string{state},
+		"code":  []string{tstAuthorizationCode},
+	}, tstWithFlowCookie(nil, state))
+
+	docs.Then("then the user agent is redirected to the drop off URL with a GET")
+	require.Equal(t, http.StatusSeeOther, response.StatusCode, "unexpected http response status, must be HTTP 303 SEE OTHER")
+	require.Equal(t, "https://example.com/form-post/", response.Header.Get("Location"))
+
+	docs.Then("and the cookies are sent with SameSite Lax, so they survive the cross-site form post")
+	id := tstResponseCookie(&response, "JWT")
+	require.NotNil(t, id, "Id token cookie must be present")
+	require.Equal(t, idpMock.lastIdToken, id.Value)
+	require.Equal(t, http.SameSiteLaxMode, id.SameSite)
+	ac := tstResponseCookie(&response, "AUTH")
+	require.NotNil(t, ac, "Auth token cookie must be present")
+	require.Equal(t, http.SameSiteLaxMode, ac.SameSite)
+}
+
+func TestDropoff_Failure_FormPostAppCalledWithGet(t *testing.T) {
+	docs.Given("given an auth request for an application that uses response_mode form_post")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	state := tstAddFormPostAuthRequest(t)
+
+	docs.When("when the dropoff endpoint is called with code and state in the url")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+state+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, state))
+
+	docs.Then("then the request is rejected and no cookies are set")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
+	require.Nil(t, tstResponseCookie(&response, "JWT"))
+	require.Contains(t, tstResponseBodyString(&response), "<b>error:</b> invalid parameters")
+
+	docs.Then("and the state has not been used up, so the identity provider can still post it")
+	response2 := tstPerformPostFormNoRedirectWithHeaders("/v1/dropoff", url.Values{
+		"state": []string{state},
+		"code":  []string{tstAuthorizationCode},
+	}, tstWithFlowCookie(nil, state))
+	require.Equal(t, http.StatusSeeOther, response2.StatusCode, "unexpected http response status, must be HTTP 303 SEE OTHER")
+}
+
+func TestDropoff_Failure_QueryAppCalledWithPost(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the dropoff endpoint is posted to for an application that does not use response_mode form_post")
+	response := tstPerformPostFormNoRedirectWithHeaders("/v1/dropoff", url.Values{
+		"state": []string{tstAuthRequest.State},
+		"code":  []string{tstAuthorizationCode},
+	}, tstWithFlowCookie(nil, tstAuthRequest.State))
+
+	docs.Then("then the request is rejected and no cookies are set")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
+	require.Nil(t, tstResponseCookie(&response, "JWT"))
+
+	docs.Then("and the state has not been used up")
+	_, err := database.GetRepository().GetAuthRequestByState(context.TODO(), tstAuthRequest.State)
+	require.Nil(t, err)
+}
+
+// tstAddStaffAuthRequest stores an auth request for the application that uses the second identity provider
+func tstAddStaffAuthRequest(t *testing.T) string {
+	state := "St4fFq2mx903nlcfkjHd39cdh"
+	err := database.GetRepository().AddAuthRequest(context.TODO(), &entity.AuthRequest{
+		Application:      "staff-service",
+		State:            state,
+		Nonce:            tstAuthRequest.Nonce,
+		PkceCodeVerifier: tstAuthRequest.PkceCodeVerifier,
+		Purpose:          entity.AuthRequestLogin,
+		DropOffUrl:       "https://example.com/staff/",
+		ExpiresAt:        time.Now().Add(time.Minute),
+	})
+	require.Nil(t, err)
+	return state
+}
+
+func TestDropoff_Success_SecondIdentityProvider(t *testing.T) {
+	docs.Given("given an auth request for an application that uses a second identity provider")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	state := tstAddStaffAuthRequest(t)
+	idpMock.idTokenModifier = func(claims jwt.MapClaims) {
+		claims["iss"] = "https://staff.example.com"
+		claims["aud"] = "IAmStaff."
+	}
+
+	docs.When("when that identity provider returns an id token it issued")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+state+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, state))
+
+	docs.Then("then the user agent is redirected to the drop off URL with the tokens in cookies")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	require.Equal(t, "https://example.com/staff/", response.Header.Get("Location"))
+	id := tstResponseCookie(&response, "JWT")
+	require.NotNil(t, id, "Id token cookie must be present")
+	require.Equal(t, idpMock.lastIdToken, id.Value)
+}
+
+func TestDropoff_Failure_SecondIdentityProviderWrongIssuer(t *testing.T) {
+	docs.Given("given an auth request for an application that uses a second identity provider")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+	state := tstAddStaffAuthRequest(t)
+	idpMock.idTokenModifier = func(claims jwt.MapClaims) {
+		claims["aud"] = "IAmStaff."
+	}
+
+	docs.When("when the id token was issued by a different identity provider")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+state+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, state))
+
+	docs.Then("then the login fails and no cookies are set")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status, must be HTTP 401")
+	require.Contains(t, tstResponseBodyString(&response), "<b>error:</b> identity provider returned an invalid id token")
+	require.Empty(t, response.Cookies())
+}
+
+func TestDropoff_Success_SameBrowser(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a browser that has started an auth flow and received the flow cookie")
+	state, flowCookie := tstStartAuthFlow(t, "example-service")
+	tstIdTokenNonceForState(t, state)
+
+	docs.When("when the same browser arrives at the dropoff endpoint with the state of that flow")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+state+"&code="+tstAuthorizationCode,
+		http.Header{"Cookie": []string{flowCookie.Name + "=" + flowCookie.Value}})
+
+	docs.Then("then the login succeeds and the flow cookie is removed")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	require.NotNil(t, tstResponseCookie(&response, "JWT"), "Id token cookie must be present")
+	removed := tstResponseCookie(&response, flowCookie.Name)
+	require.NotNil(t, removed, "flow cookie must be removed")
+	require.Empty(t, removed.Value)
+	require.Equal(t, -1, removed.MaxAge)
+}
+
+func TestDropoff_Failure_OtherBrowser(t *testing.T) {
+	otherBrowsers := map[string]func(attackerCookie *http.Cookie, victimCookie *http.Cookie) http.Header{
+		"no flow cookie": func(attackerCookie *http.Cookie, victimCookie *http.Cookie) http.Header {
+			return http.Header{}
+		},
+		"flow cookie of another flow": func(attackerCookie *http.Cookie, victimCookie *http.Cookie) http.Header {
+			return http.Header{"Cookie": []string{victimCookie.Name + "=" + victimCookie.Value}}
+		},
+		"flow cookie of another flow renamed": func(attackerCookie *http.Cookie, victimCookie *http.Cookie) http.Header {
+			return http.Header{"Cookie": []string{attackerCookie.Name + "=" + victimCookie.Value}}
+		},
+		"flow cookie with extended expiry": func(attackerCookie *http.Cookie, victimCookie *http.Cookie) http.Header {
+			parts := strings.SplitN(attackerCookie.Value, ".", 2)
+			return http.Header{"Cookie": []string{attackerCookie.Name + "=9" + parts[0] + "." + parts[1]}}
+		},
+	}
+
+	for name, otherBrowser := range otherBrowsers {
+		docs.Given("given the standard test configuration")
+		tstSetup(tstDefaultConfigFile)
+
+		docs.Given("given an attacker has started an auth flow, and the victim has started an auth flow of their own")
+		attackerState, attackerCookie := tstStartAuthFlow(t, "example-service")
+		_, victimCookie := tstStartAuthFlow(t, "example-service")
+		tstIdTokenNonceForState(t, attackerState)
+
+		docs.When("when the victim's browser is sent to the dropoff endpoint with the state of the attacker's flow, with " + name)
+		response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+attackerState+"&code="+tstAuthorizationCode,
+			otherBrowser(attackerCookie, victimCookie))
+
+		docs.Then("then the login is rejected and no cookies are set")
+		require.Equal(t, http.StatusForbidden, response.StatusCode, "unexpected http response status for "+name)
+		require.Contains(t, tstResponseBodyString(&response), "<b>error:</b> please complete the login in the browser you started it in")
+		require.Empty(t, response.Cookies(), "no cookies must be set for "+name)
+
+		docs.Then("and the flow can still be completed in the browser that started it")
+		response = tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+attackerState+"&code="+tstAuthorizationCode,
+			http.Header{"Cookie": []string{attackerCookie.Name + "=" + attackerCookie.Value}})
+		require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status in the original browser for "+name)
+
+		tstShutdown()
+	}
+}
+
+// tstIdTokenNonceForState makes the identity provider return the nonce of the auth request stored for the given state
+func tstIdTokenNonceForState(t *testing.T, state string) {
+	authRequest, err := database.GetRepository().GetAuthRequestByState(context.TODO(), state)
+	require.Nil(t, err)
+	idpMock.idTokenModifier = func(claims jwt.MapClaims) {
+		claims["nonce"] = authRequest.Nonce
+	}
+}
+
+func TestDropoff_Failure_LogoutState(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a logout at the identity provider has been started")
+	state := tstStartIdpLogout(t, "kiosk-service")
+
+	docs.When("when they call the dropoff endpoint with the state of the logout")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+url.QueryEscape(state)+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, state))
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusNotFound, response.StatusCode, "unexpected http response status, must be HTTP 404")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> auth request not found or timed out")
+
+	docs.Then("and the logout can still be completed")
+	callbackResponse := tstPerformGetNoRedirect("/v1/logout-callback?state=" + url.QueryEscape(state))
+	require.Equal(t, http.StatusFound, callbackResponse.StatusCode, "unexpected http response status for logout callback, must be HTTP 302 MOVED")
+}
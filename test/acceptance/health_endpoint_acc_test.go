@@ -0,0 +1,107 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/health"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/eurofurence/reg-auth-service/internal/web/controller/healthctl"
+	"github.com/stretchr/testify/require"
+)
+
+// -------------------------------------------------
+// acceptance tests for the health check endpoints
+// -------------------------------------------------
+
+/* The liveness check only tells whether the service answers at all, the readiness check
+ * looks at everything the service needs to log users in.
+ */
+
+func TestHealth_Liveness(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	for _, path := range []string{"/", "/health/live"} {
+		docs.When("when the liveness endpoint is called")
+		response := tstPerformGetWithCookies(path, "", "")
+
+		docs.Then("then the service reports it is up without any details")
+		require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+		dto := health.HealthResultDto{}
+		tstParseJson(response.body, &dto)
+		require.Equal(t, health.HealthResultDto{Status: "up"}, dto)
+	}
+}
+
+func TestHealth_Ready(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when the readiness endpoint is called")
+	response := tstPerformGetWithCookies("/health/ready", "", "")
+
+	docs.Then("then the service reports it is ready, and lists each component, per identity provider")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	dto := health.HealthResultDto{}
+	tstParseJson(response.body, &dto)
+	expected := health.HealthResultDto{
+		Status: "up",
+		Components: map[string]health.ComponentHealthDto{
+			"configuration":          {Status: "up"},
+			"repository":             {Status: "up"},
+			"issuer_discovery":       {Status: "disabled"},
+			"key_set":                {Status: "disabled"},
+			"circuit_breaker":        {Status: "up", Details: "closed"},
+			"issuer_discovery.staff": {Status: "disabled"},
+			"key_set.staff":          {Status: "disabled"},
+			"circuit_breaker.staff":  {Status: "up", Details: "closed"},
+		},
+	}
+	require.Equal(t, expected, dto)
+}
+
+func TestHealth_NotReady_DatabaseDown(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the database has become unavailable")
+	database.GetRepository().Close()
+	defer database.GetRepository().Open()
+
+	docs.When("when the readiness endpoint is called")
+	response := tstPerformGetWithCookies("/health/ready", "", "")
+
+	docs.Then("then the service reports it is not ready because of the repository")
+	require.Equal(t, http.StatusServiceUnavailable, response.status, "unexpected http response status")
+	dto := health.HealthResultDto{}
+	tstParseJson(response.body, &dto)
+	require.Equal(t, "down", dto.Status)
+	require.Equal(t, health.ComponentHealthDto{Status: "down", Details: "in memory database is not open"}, dto.Components["repository"])
+	require.Equal(t, "up", dto.Components["configuration"].Status)
+}
+
+func TestHealth_NotReady_CircuitBreakerOpen(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the circuit breaker for the identity provider has opened")
+	healthctl.CircuitBreakerState = func(provider string) string { return "open" }
+	defer func() { healthctl.CircuitBreakerState = idp.CircuitBreakerState }()
+
+	docs.When("when the readiness endpoint is called")
+	response := tstPerformGetWithCookies("/health/ready", "", "")
+
+	docs.Then("then the service reports it is not ready because of the circuit breaker")
+	require.Equal(t, http.StatusServiceUnavailable, response.status, "unexpected http response status")
+	dto := health.HealthResultDto{}
+	tstParseJson(response.body, &dto)
+	require.Equal(t, "down", dto.Status)
+	require.Equal(t, health.ComponentHealthDto{Status: "down", Details: "circuit breaker for the identity provider is open"}, dto.Components["circuit_breaker"])
+}
@@ -85,3 +85,133 @@ func TestLogout_Failure_UnknownAppName(t *testing.T) {
 	responseBody := tstResponseBodyString(&response)
 	require.Contains(t, responseBody, "<b>error:</b> invalid parameters")
 }
+
+/* If idp_logout is configured for the app, the /logout endpoint additionally redirects to the
+ * end_session_endpoint of the identity provider (RP-initiated logout). The identity provider
+ * then sends the user agent to the /logout-callback endpoint, which redirects to the app's
+ * default dropoff url.
+ */
+
+func TestLogout_IdpLogout_Success(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the logout endpoint with an app_name that has idp_logout configured and a valid id token cookie")
+	testUrl := "/v1/logout?app_name=kiosk-service"
+	response := tstPerformGetNoRedirectWithCookies(testUrl, valid_JWT_id_is_not_staff_sub101, "")
+
+	docs.Then("then the user agent is redirected to the end session endpoint of the identity provider and the cookies deleted")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "https://auth.example.com/logout", loc.Scheme+"://"+loc.Host+loc.Path, "unexpected Location, must match the configured end session endpoint")
+	values := loc.Query()
+	require.Equal(t, valid_JWT_id_is_not_staff_sub101, values.Get("id_token_hint"))
+	require.Equal(t, "IAmTheKiosk.", values.Get("client_id"))
+	require.Equal(t, "http://localhost:8081/v1/logout-callback", values.Get("post_logout_redirect_uri"))
+	require.NotEmpty(t, values.Get("state"))
+
+	cookies := response.Cookies()
+	require.Equal(t, 3, len(cookies))
+	for _, cookie := range cookies {
+		require.Equal(t, "", cookie.Value)
+		require.Equal(t, "/kiosk", cookie.Path)
+	}
+}
+
+func TestLogout_IdpLogout_NoCookie(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the logout endpoint with an app_name that has idp_logout configured but without an id token cookie")
+	testUrl := "/v1/logout?app_name=kiosk-service"
+	response := tstPerformGetNoRedirect(testUrl)
+
+	docs.Then("then the user agent is redirected to the end session endpoint without an id_token_hint")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	require.Equal(t, "auth.example.com", loc.Host)
+	_, present := loc.Query()["id_token_hint"]
+	require.False(t, present, "id_token_hint must not be sent if no id token is available")
+	require.NotEmpty(t, loc.Query().Get("state"))
+}
+
+func TestLogoutCallback_Success(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a logout at the identity provider has been started")
+	state := tstStartIdpLogout(t, "kiosk-service")
+
+	docs.When("when the identity provider redirects the user agent to the logout callback endpoint")
+	response := tstPerformGetNoRedirect("/v1/logout-callback?state=" + url.QueryEscape(state))
+
+	docs.Then("then the user agent is redirected to the default drop off URL of the app")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	require.Equal(t, "https://example.com/kiosk/", response.Header.Get("Location"))
+}
+
+func TestLogoutCallback_Failure_StateReplayed(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a logout at the identity provider has been completed")
+	state := tstStartIdpLogout(t, "kiosk-service")
+	response := tstPerformGetNoRedirect("/v1/logout-callback?state=" + url.QueryEscape(state))
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status for first callback, must be HTTP 302 MOVED")
+
+	docs.When("when they call the logout callback endpoint again with the same state")
+	response2 := tstPerformGetNoRedirect("/v1/logout-callback?state=" + url.QueryEscape(state))
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusNotFound, response2.StatusCode, "unexpected http response status, must be HTTP 404")
+	responseBody := tstResponseBodyString(&response2)
+	require.Contains(t, responseBody, "<b>error:</b> logout request not found or timed out")
+}
+
+func TestLogoutCallback_Failure_LoginState(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the logout callback endpoint with the state of a pending login")
+	response := tstPerformGetNoRedirect("/v1/logout-callback?state=" + url.QueryEscape(tstAuthRequest.State))
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusNotFound, response.StatusCode, "unexpected http response status, must be HTTP 404")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> logout request not found or timed out")
+
+	docs.Then("and the login can still be completed")
+	dropoffResponse := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, dropoffResponse.StatusCode, "unexpected http response status for dropoff, must be HTTP 302 MOVED")
+}
+
+func TestLogoutCallback_Failure_StateMissing(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the logout callback endpoint without a state parameter")
+	response := tstPerformGetNoRedirect("/v1/logout-callback")
+
+	docs.Then("then the correct error is displayed")
+	require.Equal(t, http.StatusBadRequest, response.StatusCode, "unexpected http response status, must be HTTP 400")
+	responseBody := tstResponseBodyString(&response)
+	require.Contains(t, responseBody, "<b>error:</b> invalid parameters")
+}
+
+// helper functions
+
+func tstStartIdpLogout(t *testing.T, appName string) string {
+	response := tstPerformGetNoRedirect("/v1/logout?app_name=" + appName)
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	loc, err := url.Parse(response.Header.Get("Location"))
+	require.Nil(t, err, "Location header could not be parsed as a URL")
+	return loc.Query().Get("state")
+}
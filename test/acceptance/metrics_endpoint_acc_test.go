@@ -0,0 +1,97 @@
+package acceptance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/web/app"
+	"github.com/stretchr/testify/require"
+)
+
+// -----------------------------------------
+// acceptance tests for the metrics endpoint
+// -----------------------------------------
+
+/* The /metrics endpoint exposes prometheus metrics about login flows and the identity provider.
+ *
+ * It is not authenticated, so it is only served on the separate admin port (server.metrics_port).
+ */
+
+func TestMetrics_LoginFlow(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user has started an auth flow, and completed another one")
+	response := tstPerformGetNoRedirect("/v1/auth?app_name=example-service")
+	require.Equal(t, http.StatusFound, response.StatusCode)
+	response = tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, response.StatusCode)
+
+	docs.Given("given someone tried to start an auth flow for an unknown application")
+	response = tstPerformGetNoRedirect("/v1/auth?app_name=made-up-service")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	docs.When("when the metrics endpoint is scraped on the admin port")
+	metricsResponse := tstPerformGetMetrics(t)
+
+	docs.Then("then the request is successful and the login flow outcomes are counted by app and reason")
+	require.Equal(t, http.StatusOK, metricsResponse.status, "unexpected http response status")
+	require.Contains(t, metricsResponse.body, `reg_auth_requests_total{app="example-service",endpoint="auth",outcome="success",reason=""}`)
+	require.Contains(t, metricsResponse.body, `reg_auth_requests_total{app="example-service",endpoint="dropoff",outcome="success",reason=""}`)
+	require.Contains(t, metricsResponse.body, `reg_auth_requests_total{app="unknown",endpoint="auth",outcome="failure",reason="not_found"}`)
+	require.NotContains(t, metricsResponse.body, "made-up-service", "unknown app names must not become label values")
+
+	docs.Then("and the number of pending auth requests is reported")
+	require.Contains(t, metricsResponse.body, "reg_auth_pending_auth_requests 1")
+}
+
+func TestMetrics_Userinfo(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user logged in to the example-service has called the frontend-userinfo endpoint")
+	claims := tstIdTokenClaims("")
+	delete(claims, "at_hash")
+	idToken := tstSignWithIdpKey(claims, "JWT")
+	response := tstPerformGetWithCookies("/v1/frontend-userinfo", idToken, "access_mock_value 101")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Given("given the user has called the userinfo endpoint while the idp is down")
+	response = tstPerformGetWithCookies("/v1/userinfo", idToken, "idp_is_down")
+	require.Equal(t, http.StatusBadGateway, response.status)
+
+	docs.When("when the metrics endpoint is scraped on the admin port")
+	metricsResponse := tstPerformGetMetrics(t)
+
+	docs.Then("then the userinfo outcomes are counted for the application the token was issued for")
+	require.Equal(t, http.StatusOK, metricsResponse.status, "unexpected http response status")
+	require.Contains(t, metricsResponse.body, `reg_auth_requests_total{app="example-service",endpoint="frontend-userinfo",outcome="success",reason=""}`)
+	require.Contains(t, metricsResponse.body, `reg_auth_requests_total{app="example-service",endpoint="userinfo",outcome="failure",reason="auth.idp.error"}`)
+}
+
+func TestMetrics_NotOnMainPort(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when someone tries to scrape the metrics endpoint on the main port")
+	response := tstPerformGetWithCookies("/metrics", "", "")
+
+	docs.Then("then the request is rejected, because metrics are only served on the admin port")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+}
+
+// --- helpers
+
+func tstPerformGetMetrics(t *testing.T) tstWebResponse {
+	metricsServer := httptest.NewServer(app.CreateMetricsRouter())
+	defer metricsServer.Close()
+
+	response, err := http.Get(metricsServer.URL + "/metrics")
+	require.Nil(t, err)
+	return tstWebResponseFromResponse(response)
+}
@@ -2,31 +2,119 @@ package acceptance
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/web/util/ctxvalues"
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"math/big"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
 )
 
 type mockIDPClient struct {
 	recording []string
+	keys      []idp.JsonWebKeyDto
+
+	// modifies the claims of the id token returned by the token endpoint, used to simulate invalid id tokens
+	idTokenModifier func(claims jwt.MapClaims)
+	lastIdToken     string
+
+	// modifies the claims of the id token returned by a refresh
+	refreshedIdTokenModifier func(claims jwt.MapClaims)
+	lastRefreshedIdToken     string
+
+	// trace id seen by the token endpoint, to check that the trace reaches the identity provider client
+	lastTraceId string
+
+	// parameters seen by the pushed authorization request endpoint, and whether it should fail
+	lastPushedParameters url.Values
+	parFailure           bool
+
+	// identity provider of the last userinfo call, as determined by the security middleware
+	lastUserInfoProvider string
+
+	// access tokens seen by the token introspection endpoint, and a modifier for its answer
+	introspections        []string
+	introspectionModifier func(data *idp.TokenIntrospectionData)
+
+	// subjects looked up with the admin api, prefixed with the identity provider
+	adminLookups []string
 }
 
 func (m *mockIDPClient) TokenWithAuthenticationCodeAndPKCE(ctx context.Context, applicationConfigName string, authorizationCode string, pkceVerifier string) (*idp.TokenResponseDto, int, error) {
+	m.lastTraceId = trace.SpanContextFromContext(ctx).TraceID().String()
+	claims := tstIdTokenClaims(tstAuthRequest.Nonce)
+	if m.idTokenModifier != nil {
+		m.idTokenModifier(claims)
+	}
+	m.lastIdToken = tstSignWithIdpKey(claims, "JWT")
+	ret := &idp.TokenResponseDto{
+		IdToken:      m.lastIdToken,
+		AccessToken:  "access_mock_value",
+		RefreshToken: "refresh_mock_value",
+	}
+	return ret, http.StatusOK, nil
+}
+
+func (m *mockIDPClient) RefreshToken(ctx context.Context, applicationConfigName string, refreshToken string) (*idp.TokenResponseDto, int, error) {
+	m.recording = append(m.recording, "refresh "+refreshToken)
+	if refreshToken != "refresh_mock_value" {
+		ret := &idp.TokenResponseDto{
+			ErrorCode:        "invalid_grant",
+			ErrorDescription: "simulated situation: refresh token expired",
+		}
+		return ret, http.StatusBadRequest, errors.New("unexpected http status 400, was expecting 200")
+	}
+	claims := tstIdTokenClaims("")
+	delete(claims, "nonce")
+	claims["at_hash"] = tstAccessTokenHash("access_refreshed_value")
+	if applicationConfig, err := config.GetApplicationConfig(applicationConfigName); err == nil {
+		claims["aud"] = applicationConfig.ClientId
+	}
+	if m.refreshedIdTokenModifier != nil {
+		m.refreshedIdTokenModifier(claims)
+	}
+	m.lastRefreshedIdToken = tstSignWithIdpKey(claims, "JWT")
 	ret := &idp.TokenResponseDto{
-		IdToken:     "dummy_mock_value",
-		AccessToken: "access_mock_value",
+		IdToken:      m.lastRefreshedIdToken,
+		AccessToken:  "access_refreshed_value",
+		RefreshToken: "refresh_rotated_value",
 	}
 	return ret, http.StatusOK, nil
 }
 
+func (m *mockIDPClient) PushAuthorizationRequest(ctx context.Context, applicationConfigName string, parameters url.Values) (*idp.PushedAuthorizationResponseDto, int, error) {
+	m.lastPushedParameters = parameters
+	if m.parFailure {
+		ret := &idp.PushedAuthorizationResponseDto{
+			ErrorCode:        "invalid_request",
+			ErrorDescription: "simulated situation: pushed authorization request rejected",
+		}
+		return ret, http.StatusBadRequest, errors.New("unexpected http status 400, was expecting 201")
+	}
+	ret := &idp.PushedAuthorizationResponseDto{
+		RequestUri: "urn:ietf:params:oauth:request_uri:mock-" + parameters.Get("state"),
+		ExpiresIn:  60,
+	}
+	return ret, http.StatusCreated, nil
+}
+
 func (m *mockIDPClient) UserInfo(ctx context.Context) (*idp.UserinfoData, int, error) {
 	ret := idp.UserinfoData{}
 
 	token := ctxvalues.AccessToken(ctx)
 	m.recording = append(m.recording, token)
+	m.lastUserInfoProvider = ctxvalues.IdentityProvider(ctx)
 	if token == "idp_is_down" {
 		return &ret, http.StatusBadGateway, errors.New("simulated situation: idp unreachable")
 	}
@@ -51,6 +139,33 @@ func (m *mockIDPClient) UserInfo(ctx context.Context) (*idp.UserinfoData, int, e
 			Name:          "John Staff",
 			Groups:        []string{"comedian", "somethingelse"}, // not staff!
 		}
+	} else if token == "access_mock_value 303" {
+		ret = idp.UserinfoData{
+			Audience:      []string{"12345-123"},
+			Subject:       "303",
+			Email:         "jsquirrel_github_9a6d@packetloss.de",
+			EmailVerified: true,
+			Name:          "John Badge",
+			Claims: map[string]interface{}{
+				"sub":                "303",
+				"preferred_username": "johnny",
+				"badge_number":       float64(1234),
+				"zoneinfo":           "Europe/Berlin", // not in extra_claims
+			},
+		}
+	} else if token == "access_mock_value 505" {
+		ret = idp.UserinfoData{
+			Audience:      []string{"12345-123"},
+			Subject:       "505",
+			Email:         "jsquirrel_github_9a6d@packetloss.de",
+			EmailVerified: true,
+			Name:          "John Security",
+			Groups:        []string{"comedian"},
+			Claims: map[string]interface{}{
+				"sub":        "505",
+				"department": []interface{}{"finance", "security"},
+			},
+		}
 	} else if token == "access_mock_value 444" {
 		ret = idp.UserinfoData{
 			Audience:      []string{"12345-123"},
@@ -75,6 +190,99 @@ func (m *mockIDPClient) UserInfo(ctx context.Context) (*idp.UserinfoData, int, e
 
 func (m *mockIDPClient) TokenIntrospection(ctx context.Context) (*idp.TokenIntrospectionData, int, error) {
 	ret := idp.TokenIntrospectionData{}
-	// TODO implement
+
+	token := ctxvalues.AccessToken(ctx)
+	m.introspections = append(m.introspections, token)
+	if token == "idp_is_down" {
+		return nil, http.StatusBadGateway, errors.New("simulated situation: idp unreachable")
+	}
+	if strings.HasPrefix(token, "access_mock_value") {
+		ret = idp.TokenIntrospectionData{
+			Active: true,
+			Scope:  "openid profile email groups",
+			Sub:    strings.TrimSpace(strings.TrimPrefix(token, "access_mock_value")),
+			Aud:    jwt.ClaimStrings{"IAmStaff."},
+			Exp:    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	if m.introspectionModifier != nil {
+		m.introspectionModifier(&ret)
+	}
+	return &ret, http.StatusOK, nil
+}
+
+func (m *mockIDPClient) AdminUserInfo(ctx context.Context, provider string, subject string) (*idp.UserinfoData, int, error) {
+	m.adminLookups = append(m.adminLookups, provider+" "+subject)
+	if subject == "idp_is_down" {
+		return nil, http.StatusBadGateway, errors.New("simulated situation: idp unreachable")
+	}
+	if subject != "101" {
+		return nil, http.StatusNotFound, nil
+	}
+	ret := idp.UserinfoData{
+		Audience:      []string{"12345-123"},
+		Subject:       "101",
+		Email:         "jsquirrel_github_9a6d@packetloss.de",
+		EmailVerified: true,
+		Name:          "John Doe",
+		Groups:        []string{"comedian", "fursuiter"},
+	}
 	return &ret, http.StatusOK, nil
 }
+
+func (m *mockIDPClient) KeySet(ctx context.Context, provider string) (*idp.KeySetResponseDto, int, error) {
+	return &idp.KeySetResponseDto{Keys: m.keys}, http.StatusOK, nil
+}
+
+// signing key of the simulated identity provider, served by the key set endpoint of the mock
+
+const tstIdpKid = "idp-signing-key"
+
+var tstIdpPrivateKey *rsa.PrivateKey
+
+func tstSetupIdpSigningKey(m *mockIDPClient) {
+	if tstIdpPrivateKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tstIdpPrivateKey = key
+	}
+	m.keys = []idp.JsonWebKeyDto{
+		{
+			KeyType:  "RSA",
+			KeyId:    tstIdpKid,
+			Use:      "sig",
+			Modulus:  base64.RawURLEncoding.EncodeToString(tstIdpPrivateKey.PublicKey.N.Bytes()),
+			Exponent: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(tstIdpPrivateKey.PublicKey.E)).Bytes()),
+		},
+	}
+}
+
+func tstSignWithIdpKey(claims jwt.MapClaims, typ string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = tstIdpKid
+	token.Header["typ"] = typ
+	signed, err := token.SignedString(tstIdpPrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return signed
+}
+
+func tstIdTokenClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":     "http://identity.localhost/",
+		"aud":     "IAmNotSoSecret.",
+		"sub":     "101",
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"nonce":   nonce,
+		"at_hash": tstAccessTokenHash("access_mock_value"),
+	}
+}
+
+func tstAccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
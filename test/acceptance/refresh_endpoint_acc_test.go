@@ -0,0 +1,200 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// -----------------------------------------
+// acceptance tests for the refresh endpoint
+// -----------------------------------------
+
+/* The /refresh endpoint renews the id and access token cookies using the refresh token
+ * kept in the encrypted refresh token cookie, without sending the user agent through
+ * the identity provider.
+ *
+ * Required parameters are:
+ *  * app_name  - the name of the application that the user is logged in to
+ */
+
+func TestRefresh_Success(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in and received a refresh token cookie")
+	refreshCookie := tstLoginAndGetRefreshCookie(t)
+
+	docs.When("when they call the refresh endpoint")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{refreshCookie})
+
+	docs.Then("then the request is successful and the cookies are rotated")
+	require.Equal(t, http.StatusNoContent, response.StatusCode, "unexpected http response status")
+	id := tstResponseCookie(&response, "JWT")
+	require.NotNil(t, id, "Id token cookie must be present")
+	require.Equal(t, idpMock.lastRefreshedIdToken, id.Value)
+	ac := tstResponseCookie(&response, "AUTH")
+	require.NotNil(t, ac, "Access token cookie must be present")
+	require.Equal(t, "access_refreshed_value", ac.Value)
+	rt := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be present")
+	require.NotEqual(t, refreshCookie.Value, rt.Value, "rotated refresh token must be stored")
+
+	docs.Then("and the expected calls to the IDP have been made")
+	require.EqualValues(t, []string{"refresh refresh_mock_value"}, idpMock.recording)
+}
+
+func TestRefresh_Failure_NoCookie(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the refresh endpoint without a refresh token cookie")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", nil)
+
+	docs.Then("then the request is rejected and the IDP is not called")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusUnauthorized, "auth.unauthorized", "no refresh token available, please log in again")
+	require.Empty(t, idpMock.recording)
+}
+
+func TestRefresh_Failure_TamperedCookie(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the refresh endpoint with a refresh token cookie that was not issued by us")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{{Name: "REFRESH", Value: "refresh_mock_value"}})
+
+	docs.Then("then the request is rejected, the cookie is cleared, and the IDP is not called")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status")
+	rt := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be cleared")
+	require.Equal(t, "", rt.Value)
+	require.Empty(t, idpMock.recording)
+}
+
+func TestRefresh_Failure_TamperedCookie_FormPost(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the refresh endpoint of an application with response_mode form_post with a refresh token cookie that was not issued by us")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=form-post-service", []*http.Cookie{{Name: "REFRESH", Value: "refresh_mock_value"}})
+
+	docs.Then("then the cookie is cleared with the same SameSite policy it was set with")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status")
+	rt := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be cleared")
+	require.Equal(t, "", rt.Value)
+	require.Equal(t, http.SameSiteLaxMode, rt.SameSite)
+}
+
+func TestRefresh_Failure_OtherApplication(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to one application and received a refresh token cookie")
+	refreshCookie := tstLoginAndGetRefreshCookie(t)
+
+	docs.When("when they call the refresh endpoint for another application")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=kiosk-service", []*http.Cookie{refreshCookie})
+
+	docs.Then("then the request is rejected and the IDP is not called")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status")
+	require.Empty(t, idpMock.recording)
+}
+
+func TestRefresh_Failure_RejectedByIDP(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user whose refresh token has been rotated already")
+	refreshCookie := tstLoginAndGetRefreshCookie(t)
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{refreshCookie})
+	require.Equal(t, http.StatusNoContent, response.StatusCode, "unexpected http response status for first refresh")
+	rotatedCookie := tstResponseCookie(&response, "REFRESH")
+
+	docs.When("when they call the refresh endpoint with the rotated refresh token, which the IDP does not accept")
+	response2 := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{rotatedCookie})
+
+	docs.Then("then the request is rejected and the cookie is cleared")
+	require.Equal(t, http.StatusUnauthorized, response2.StatusCode, "unexpected http response status")
+	rt := tstResponseCookie(&response2, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be cleared")
+	require.Equal(t, "", rt.Value)
+	require.Nil(t, tstResponseCookie(&response2, "JWT"), "id token cookie must not be touched")
+}
+
+func TestRefresh_Failure_OtherSubject(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in and received a refresh token cookie")
+	refreshCookie := tstLoginAndGetRefreshCookie(t)
+
+	docs.Given("given an identity provider that answers the refresh with an id token for another user")
+	idpMock.refreshedIdTokenModifier = func(claims jwt.MapClaims) {
+		claims["sub"] = "102"
+	}
+
+	docs.When("when they call the refresh endpoint")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{refreshCookie})
+
+	docs.Then("then the request is rejected, the refresh cookie is cleared, and no tokens are handed out")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusUnauthorized, "auth.unauthorized", "identity provider returned an invalid id token, please log in again")
+	rt := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, rt, "Refresh token cookie must be cleared")
+	require.Equal(t, "", rt.Value)
+	require.Nil(t, tstResponseCookie(&response, "JWT"), "id token cookie must not be set")
+	require.Nil(t, tstResponseCookie(&response, "AUTH"), "access token cookie must not be set")
+}
+
+func TestRefresh_Failure_OtherAudience(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in and received a refresh token cookie")
+	refreshCookie := tstLoginAndGetRefreshCookie(t)
+
+	docs.Given("given an identity provider that answers the refresh with an id token issued for another client")
+	idpMock.refreshedIdTokenModifier = func(claims jwt.MapClaims) {
+		claims["aud"] = "some-other-client"
+	}
+
+	docs.When("when they call the refresh endpoint")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=example-service", []*http.Cookie{refreshCookie})
+
+	docs.Then("then the request is rejected and no tokens are handed out")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusUnauthorized, "auth.unauthorized", "identity provider returned an invalid id token, please log in again")
+	require.Nil(t, tstResponseCookie(&response, "JWT"), "id token cookie must not be set")
+}
+
+func TestRefresh_Failure_AppNameMissing(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the refresh endpoint without an app_name")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh", nil)
+
+	docs.Then("then the request is rejected")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusBadRequest, "auth.refresh.invalid", "app_name parameter is missing")
+}
+
+// helper functions
+
+func tstLoginAndGetRefreshCookie(t *testing.T) *http.Cookie {
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, tstAuthRequest.State))
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status for dropoff")
+	refreshCookie := tstResponseCookie(&response, "REFRESH")
+	require.NotNil(t, refreshCookie, "Refresh token cookie must be present after dropoff")
+	return &http.Cookie{Name: refreshCookie.Name, Value: refreshCookie.Value}
+}
@@ -0,0 +1,279 @@
+package acceptance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/eurofurence/reg-auth-service/internal/entity"
+	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/session"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// --------------------------------------------------------------
+// acceptance tests for server-side sessions (backend-for-frontend)
+// --------------------------------------------------------------
+
+/* Applications with server_side_sessions keep the tokens in the database of this service.
+ * The browser only receives an opaque session id cookie, which the other endpoints resolve
+ * to the tokens transparently.
+ */
+
+// each application with server-side sessions has its own session cookie, named security.oidc.session_cookie_name + "_" + app name
+const tstBffSessionCookieName = "SESSION_bff-service"
+
+func TestServerSideSessions_Dropoff(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user logs in to an application with server-side sessions")
+	response := tstPerformServerSideSessionDropoff(t)
+
+	docs.Then("then the user agent is redirected to the drop off URL")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status, must be HTTP 302 MOVED")
+	require.Equal(t, "https://example.com/bff/", response.Header.Get("Location"))
+
+	docs.Then("and only an opaque http only session cookie is set, no token cookies")
+	sc := tstResponseCookie(&response, tstBffSessionCookieName)
+	require.NotNil(t, sc, "Session cookie must be present")
+	require.True(t, sc.HttpOnly)
+	require.Equal(t, "example.com", sc.Domain)
+	require.Equal(t, "/bff", sc.Path)
+	require.NotContains(t, idpMock.lastIdToken, sc.Value)
+	require.Nil(t, tstResponseCookie(&response, "JWT"), "Id token must not be sent to the browser")
+	require.Nil(t, tstResponseCookie(&response, "AUTH"), "Access token must not be sent to the browser")
+	require.Nil(t, tstResponseCookie(&response, "REFRESH"), "Refresh token must not be sent to the browser")
+}
+
+func TestServerSideSessions_TokensEncryptedAtRest(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user logs in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.Then("then the session in the database does not contain the tokens in clear text")
+	idHash := sha256.Sum256([]byte(sessionCookie.Value))
+	stored, err := database.GetRepository().GetSessionByIdHash(context.TODO(), base64.RawURLEncoding.EncodeToString(idHash[:]))
+	require.Nil(t, err)
+	require.NotEmpty(t, stored.IdToken)
+	require.NotEqual(t, idpMock.lastIdToken, stored.IdToken)
+	require.NotContains(t, stored.AccessToken, "access_mock_value")
+	require.NotContains(t, stored.RefreshToken, "refresh_mock_value")
+
+	docs.Then("and the session cookie resolves to the original tokens")
+	s, err := session.Get(context.TODO(), sessionCookie.Value)
+	require.Nil(t, err)
+	require.Equal(t, idpMock.lastIdToken, s.IdToken)
+	require.Equal(t, "access_mock_value", s.AccessToken)
+	require.Equal(t, "refresh_mock_value", s.RefreshToken)
+}
+
+func TestServerSideSessions_Failure_OtherApplicationsCookie(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.When("when the session id is sent in the session cookie of another application")
+	response := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", &http.Cookie{Name: "SESSION_example-service", Value: sessionCookie.Value})
+
+	docs.Then("then the request is rejected")
+	require.Equal(t, http.StatusUnauthorized, response.status, "unexpected http response status")
+}
+
+func TestServerSideSessions_FrontendUserinfo(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.When("when they call the frontend-userinfo endpoint with the session cookie")
+	response := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", sessionCookie)
+
+	docs.Then("then the session is resolved to its tokens and the request is successful")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	actualResponse := userinfo.UserInfoDto{}
+	tstParseJson(response.body, &actualResponse)
+	require.Equal(t, "101", actualResponse.Subject)
+}
+
+func TestServerSideSessions_Userinfo(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.When("when they call the userinfo endpoint with the session cookie")
+	response := tstPerformGetWithSessionCookie("/v1/userinfo", sessionCookie)
+
+	docs.Then("then the identity provider is called with the access token kept in the session")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	require.EqualValues(t, []string{"access_mock_value"}, idpMock.recording)
+}
+
+func TestServerSideSessions_Failure_UnknownSession(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when they call the frontend-userinfo endpoint with a session cookie that does not belong to any session")
+	response := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", &http.Cookie{Name: tstBffSessionCookieName, Value: "not-a-session"})
+
+	docs.Then("then the request is rejected")
+	require.Equal(t, http.StatusUnauthorized, response.status, "unexpected http response status")
+}
+
+func TestServerSideSessions_Refresh(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.When("when they call the refresh endpoint with the session cookie")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=bff-service", []*http.Cookie{sessionCookie})
+
+	docs.Then("then the tokens in the session are renewed, without sending any cookies")
+	require.Equal(t, http.StatusNoContent, response.StatusCode, "unexpected http response status")
+	require.Empty(t, response.Cookies())
+	require.EqualValues(t, []string{"refresh refresh_mock_value"}, idpMock.recording)
+
+	docs.When("when they call the refresh endpoint again")
+	response = tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=bff-service", []*http.Cookie{sessionCookie})
+
+	docs.Then("then the rotated refresh token from the session is used")
+	require.EqualValues(t, []string{"refresh refresh_mock_value", "refresh refresh_rotated_value"}, idpMock.recording)
+
+	docs.Then("and since the identity provider rejects it, the session ends")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode, "unexpected http response status")
+	userinfoResponse := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, userinfoResponse.status, "unexpected http response status")
+}
+
+func TestServerSideSessions_Failure_RefreshOtherSubject(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.Given("given an identity provider that answers the refresh with an id token for another user")
+	idpMock.refreshedIdTokenModifier = func(claims jwt.MapClaims) {
+		claims["sub"] = "102"
+	}
+
+	docs.When("when they call the refresh endpoint with the session cookie")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=bff-service", []*http.Cookie{sessionCookie})
+
+	docs.Then("then the request is rejected and the session ends")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusUnauthorized, "auth.unauthorized", "identity provider returned an invalid id token, please log in again")
+	userinfoResponse := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, userinfoResponse.status, "unexpected http response status")
+}
+
+func TestServerSideSessions_Failure_RefreshOtherApplication(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a server-side session that was created for another application")
+	sessionId, err := session.New(context.TODO(), "kiosk-service", idpMock.lastIdToken, "access_mock_value", "refresh_mock_value", time.Hour)
+	require.Nil(t, err)
+
+	docs.When("when it is used to refresh the tokens of an application with server-side sessions")
+	response := tstPerformPostNoRedirectWithCookies("/v1/refresh?app_name=bff-service", []*http.Cookie{{Name: tstBffSessionCookieName, Value: sessionId}})
+
+	docs.Then("then the request is rejected and the IDP is not called")
+	tstRequireErrorResponse(t, tstWebResponseFromResponse(&response), http.StatusUnauthorized, "auth.unauthorized", "session belongs to another application, please log in again")
+	require.Empty(t, idpMock.recording)
+}
+
+func TestServerSideSessions_Logout(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a user who has logged in to an application with server-side sessions")
+	sessionCookie := tstLoginWithServerSideSession(t)
+
+	docs.When("when they log out")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/logout?app_name=bff-service", http.Header{"Cookie": []string{sessionCookie.Name + "=" + sessionCookie.Value}})
+
+	docs.Then("then the session cookie is deleted, with the same attributes it was set with")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status")
+	sc := tstResponseCookie(&response, tstBffSessionCookieName)
+	require.NotNil(t, sc, "Session cookie must be deleted")
+	require.Empty(t, sc.Value)
+	require.Equal(t, sessionCookie.Domain, sc.Domain)
+	require.Equal(t, sessionCookie.Path, sc.Path)
+	require.Equal(t, sessionCookie.Secure, sc.Secure)
+	require.Equal(t, sessionCookie.HttpOnly, sc.HttpOnly)
+	require.Equal(t, sessionCookie.SameSite, sc.SameSite)
+
+	docs.Then("and the session no longer exists, even if the browser keeps sending the cookie")
+	userinfoResponse := tstPerformGetWithSessionCookie("/v1/frontend-userinfo", sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, userinfoResponse.status, "unexpected http response status")
+}
+
+// --- helpers
+
+// tstPerformServerSideSessionDropoff completes a login for the application with server-side sessions
+func tstPerformServerSideSessionDropoff(t *testing.T) http.Response {
+	state := "Bff5RkLq2mx903nlcfkjHd39cdh"
+	err := database.GetRepository().AddAuthRequest(context.TODO(), &entity.AuthRequest{
+		Application:      "bff-service",
+		State:            state,
+		Nonce:            tstAuthRequest.Nonce,
+		PkceCodeVerifier: tstAuthRequest.PkceCodeVerifier,
+		Purpose:          entity.AuthRequestLogin,
+		DropOffUrl:       "https://example.com/bff/",
+		ExpiresAt:        time.Now().Add(time.Minute),
+	})
+	require.Nil(t, err)
+	idpMock.idTokenModifier = func(claims jwt.MapClaims) {
+		claims["aud"] = "IAmBff."
+	}
+	return tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+state+"&code="+tstAuthorizationCode, tstWithFlowCookie(nil, state))
+}
+
+func tstLoginWithServerSideSession(t *testing.T) *http.Cookie {
+	response := tstPerformServerSideSessionDropoff(t)
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status for login")
+	sessionCookie := tstResponseCookie(&response, tstBffSessionCookieName)
+	require.NotNil(t, sessionCookie, "Session cookie must be present")
+	require.False(t, strings.Contains(sessionCookie.Value, "."), "session id must be opaque")
+	return sessionCookie
+}
+
+func tstPerformGetWithSessionCookie(relativeUrlWithLeadingSlash string, sessionCookie *http.Cookie) tstWebResponse {
+	request, err := http.NewRequest(http.MethodGet, ts.URL+relativeUrlWithLeadingSlash, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: sessionCookie.Name, Value: sessionCookie.Value})
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tstWebResponseFromResponse(response)
+}
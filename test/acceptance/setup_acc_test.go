@@ -3,8 +3,14 @@ package acceptance
 import (
 	"context"
 	"github.com/eurofurence/reg-auth-service/internal/web/app"
+	"github.com/eurofurence/reg-auth-service/internal/web/controller/authctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/dropoffctl"
 	"github.com/eurofurence/reg-auth-service/internal/web/controller/userinfoctl"
+	"github.com/eurofurence/reg-auth-service/internal/web/middleware"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/metrics"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"log"
 	"net/http/httptest"
 	"time"
@@ -12,6 +18,7 @@ import (
 	"github.com/eurofurence/reg-auth-service/internal/entity"
 	"github.com/eurofurence/reg-auth-service/internal/repository/config"
 	"github.com/eurofurence/reg-auth-service/internal/repository/database"
+	"github.com/eurofurence/reg-auth-service/internal/repository/keyset"
 )
 
 // placing these here because they are package global
@@ -26,15 +33,29 @@ const tstDefaultConfigFile = "../../test/resources/config-acceptancetests.yaml"
 
 var idpMock *mockIDPClient
 
+// collects finished spans instead of exporting them
+var tstSpans *tracetest.InMemoryExporter
+
+// collects audit events instead of writing them
+var tstAudit *tstAuditSink
+
 func tstSetup(configFilePath string) {
 	tstSetupConfig(configFilePath)
+	tstSpans = tracetest.NewInMemoryExporter()
+	tracing.SetupForTesting(tstSpans)
+	tstAudit = &tstAuditSink{}
+	audit.SetSink(tstAudit)
 	tstSetupHttpTestServer()
+	database.PruneListener = metrics.RecordPrune
+	metrics.PendingAuthRequests = database.CountAuthRequests
 	database.Open()
 
 	tstAuthRequest = &entity.AuthRequest{
 		Application:      "example-service",
 		State:            "Km9NNMK2mx903nlcfkjHd39cdh",
+		Nonce:            "n0nc3Gk29bXcL3mqPw7RtYv5HsD8aFj1",
 		PkceCodeVerifier: "Nbk2bKbd3klbkkiNKG2cv093hklHKMIHOLKHJacfwklm30m9ym23oHHGGFDSHu9",
+		Purpose:          entity.AuthRequestLogin,
 		DropOffUrl:       "https://example.com/drop_off_url?dingbaz=5",
 		ExpiresAt:        time.Now().Add(config.AuthRequestTimeout()),
 	}
@@ -44,8 +65,12 @@ func tstSetup(configFilePath string) {
 	idpMock = &mockIDPClient{
 		recording: make([]string, 0),
 	}
+	tstSetupIdpSigningKey(idpMock)
+	authctl.IDPClient = idpMock
 	dropoffctl.IDPClient = idpMock
 	userinfoctl.IDPClient = idpMock
+	keyset.Setup(idpMock)
+	middleware.SetupTokenIntrospection(idpMock)
 }
 
 func tstSetupConfig(configFilePath string) {
@@ -0,0 +1,128 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/repository/idp"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// --------------------------------------------------------------
+// acceptance tests for access token validation via token introspection
+// --------------------------------------------------------------
+
+/* In the test configuration, only the staff identity provider has a token introspection endpoint,
+ * access tokens must have the openid scope, and they must be issued for the allowed_audience of the staff identity provider.
+ */
+
+func TestIntrospection_Success(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user logged in with an identity provider that offers token introspection calls the userinfo endpoint")
+	response := tstPerformGetWithCookies("/v1/userinfo", tstStaffIdToken(), "access_mock_value 101")
+
+	docs.Then("then the access token is introspected, and the request is successful")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	require.EqualValues(t, []string{"access_mock_value 101"}, idpMock.introspections)
+	require.EqualValues(t, []string{"access_mock_value 101"}, idpMock.recording)
+}
+
+func TestIntrospection_Success_Cached(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user calls endpoints twice with the same access token")
+	idToken := tstStaffIdToken()
+	response := tstPerformGetWithCookies("/v1/frontend-userinfo", idToken, "access_mock_value 101")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	response = tstPerformGetWithCookies("/v1/frontend-userinfo", idToken, "access_mock_value 101")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+
+	docs.Then("then the identity provider is only asked once")
+	require.EqualValues(t, []string{"access_mock_value 101"}, idpMock.introspections)
+}
+
+func TestIntrospection_Failure(t *testing.T) {
+	testcases := []struct {
+		name     string
+		modifier func(data *idp.TokenIntrospectionData)
+	}{
+		{name: "not active", modifier: func(data *idp.TokenIntrospectionData) { data.Active = false }},
+		{name: "expired", modifier: func(data *idp.TokenIntrospectionData) { data.Exp = time.Now().Add(-time.Minute).Unix() }},
+		{name: "not valid yet", modifier: func(data *idp.TokenIntrospectionData) { data.Nbf = time.Now().Add(time.Minute).Unix() }},
+		{name: "wrong issuer", modifier: func(data *idp.TokenIntrospectionData) { data.Iss = "https://identity.example.com" }},
+		{name: "other audience", modifier: func(data *idp.TokenIntrospectionData) { data.Aud = jwt.ClaimStrings{"IAmNotSoSecret."} }},
+		{name: "missing scope", modifier: func(data *idp.TokenIntrospectionData) { data.Scope = "profile email" }},
+		{name: "other subject than the id token", modifier: func(data *idp.TokenIntrospectionData) { data.Sub = "102" }},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			docs.Given("given the standard test configuration")
+			tstSetup(tstDefaultConfigFile)
+			defer tstShutdown()
+
+			docs.Given("given an access token that the token introspection endpoint does not vouch for: " + tc.name)
+			idpMock.introspectionModifier = tc.modifier
+
+			docs.When("when the user calls the userinfo endpoint")
+			response := tstPerformGetWithCookies("/v1/userinfo", tstStaffIdToken(), "access_mock_value 101")
+
+			docs.Then("then the request is rejected without calling the userinfo endpoint of the identity provider")
+			tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+			require.Empty(t, idpMock.recording)
+		})
+	}
+}
+
+func TestIntrospection_Failure_BearerToken(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an access token of the staff identity provider that is no longer active")
+	accessToken := tstSignWithIdpKey(jwt.MapClaims{
+		"iss": "https://staff.example.com",
+		"sub": "101",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, "at+jwt")
+
+	docs.When("when it is used in the authorization header")
+	rawResponse := tstPerformGetNoRedirectWithHeaders("/v1/userinfo", http.Header{"Authorization": []string{"Bearer " + accessToken}})
+	response := tstWebResponseFromResponse(&rawResponse)
+
+	docs.Then("then it is introspected with its identity provider, and the request is rejected")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+	require.EqualValues(t, []string{accessToken}, idpMock.introspections)
+	require.Empty(t, idpMock.recording)
+}
+
+func TestIntrospection_Failure_IdpDown(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user calls the userinfo endpoint while the token introspection endpoint is down")
+	response := tstPerformGetWithCookies("/v1/userinfo", tstStaffIdToken(), "idp_is_down")
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadGateway, "auth.idp.error", "identity provider could not be reached - see log for details")
+}
+
+// --- helpers
+
+func tstStaffIdToken() string {
+	return tstSignWithIdpKey(jwt.MapClaims{
+		"iss": "https://staff.example.com",
+		"aud": "IAmStaff.",
+		"sub": "101",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, "JWT")
+}
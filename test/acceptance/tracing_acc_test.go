@@ -0,0 +1,96 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------------------------------
+// acceptance tests for tracing
+// ---------------------------------
+
+/* Every request is wrapped in a server span. A W3C traceparent header sent by the caller is continued,
+ * and the trace context is handed on to the identity provider client.
+ */
+
+const tstTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func tstTracingHeaders(requestId string) http.Header {
+	headers := http.Header{}
+	headers.Set("traceparent", "00-"+tstTraceId+"-00f067aa0ba902b7-01")
+	if requestId != "" {
+		headers.Set("X-Request-Id", requestId)
+	}
+	return headers
+}
+
+func TestTracing_ContinuesIncomingTrace(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a login flow is completed with a traceparent header")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/dropoff?state="+tstAuthRequest.State+"&code="+tstAuthorizationCode, tstWithFlowCookie(tstTracingHeaders(""), tstAuthRequest.State))
+
+	docs.Then("then the request is successful and the trace id is used as the request id")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status")
+	require.Equal(t, tstTraceId, response.Header.Get("X-Request-Id"))
+
+	docs.Then("and the trace is passed on to the identity provider client")
+	require.Equal(t, tstTraceId, idpMock.lastTraceId)
+
+	docs.Then("and a server span named after the route is recorded as part of the incoming trace")
+	spans := tstSpans.GetSpans()
+	require.Equal(t, 1, len(spans))
+	require.Equal(t, "GET /v1/dropoff", spans[0].Name)
+	require.Equal(t, trace.SpanKindServer, spans[0].SpanKind)
+	require.Equal(t, tstTraceId, spans[0].SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+	require.True(t, spans[0].Parent.IsRemote())
+}
+
+func TestTracing_KeepsIncomingRequestId(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a request is made with a request id longer than 8 characters")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/auth?app_name=example-service", tstTracingHeaders("a1b2c3d4-e5f6-reg-attendee"))
+
+	docs.Then("then the request id is kept unchanged")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status")
+	require.Equal(t, "a1b2c3d4-e5f6-reg-attendee", response.Header.Get("X-Request-Id"))
+}
+
+func TestTracing_ReplacesInvalidRequestId(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a request is made with a request id containing unsafe characters")
+	response := tstPerformGetNoRedirectWithHeaders("/v1/auth?app_name=example-service", tstTracingHeaders("<script>"))
+
+	docs.Then("then the request id is replaced by the trace id")
+	require.Equal(t, http.StatusFound, response.StatusCode, "unexpected http response status")
+	require.Equal(t, tstTraceId, response.Header.Get("X-Request-Id"))
+}
+
+func TestTracing_ServerErrorMarksSpan(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user calls the userinfo endpoint while the idp is down")
+	response := tstPerformGetWithCookies("/v1/userinfo", valid_JWT_id_is_not_staff_sub101, "idp_is_down")
+
+	docs.Then("then the span records the status and is marked as failed")
+	require.Equal(t, http.StatusBadGateway, response.status, "unexpected http response status")
+	spans := tstSpans.GetSpans()
+	require.Equal(t, 1, len(spans))
+	require.Equal(t, "GET /v1/userinfo", spans[0].Name)
+	require.Equal(t, "Error", spans[0].Status.Code.String())
+}
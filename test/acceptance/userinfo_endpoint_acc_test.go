@@ -3,9 +3,11 @@ package acceptance
 import (
 	"github.com/eurofurence/reg-auth-service/docs"
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"testing"
+	"time"
 )
 
 const valid_JWT_id_is_not_staff_sub101 = `eyJhbGciOiJSUzUxMiIsInR5cCI6IkpXVCJ9.eyJhdF9oYXNoIjoidDdWYkV5NVQ3STdYSlh3VHZ4S3hLdyIsImF1ZCI6WyIxNGQ5ZjM3YS0xZWVjLTQ3YzktYTk0OS01ZjFlYmRmOWM4ZTUiXSwiYXV0aF90aW1lIjoxNTE2MjM5MDIyLCJlbWFpbCI6ImpzcXVpcnJlbF9naXRodWJfOWE2ZEBwYWNrZXRsb3NzLmRlIiwiZW1haWxfdmVyaWZpZWQiOnRydWUsImV4cCI6MjA3NTEyMDgxNiwiZ3JvdXBzIjpbInNvbWVncm91cCJdLCJpYXQiOjE1MTYyMzkwMjIsImlzcyI6Imh0dHA6Ly9pZGVudGl0eS5sb2NhbGhvc3QvIiwianRpIjoiNDA2YmUzZTQtZjRlOS00N2I3LWFjNWYtMDZiOTI3NDMyODQ4IiwibmFtZSI6IkpvaG4gRG9lIiwibm9uY2UiOiIzMGM4M2MxM2M5MTc5ODA0YWEwZjliMzkzNDI1OWQ3NSIsInJhdCI6MTY3NTExNzE3Nywic2lkIjoiZDdiOGZlN2EtMDc5YS00NTk2LThlNTMtYTYwZjg2YTA4YWM2Iiwic3ViIjoiMTAxIn0.ntHz3G7LLtHC3pJ1PoWJoG3mnzg96IIcP3LAV4V1CcKYMFoKVQfh7MiOdRXpiB-_j4QFE7O-za3mynwFqRbF3_Tw_Sp7Zsgk9OUPo2Mk3VBSl9yPIU4pmc8v7nrmaAVOQLyjglVG7NLRWLpx0oIG8SSN0d75PBI5iLyQ0H7Zu0npEu6xekHeAYAg9DHQxqZInzom72aLmHdtG7tOqOgN0XphiK7zmIqm5aCg7R9_J9s0UU0g16_Phxm3DaynufGCjEPE2YrSL7hY9UVT2nfrHO7MvVOEKMG3RaKUDjzqOkLawz9TcUJlUTBc1J-91zYbdXLHYT_2b4EW_qa1C-P3Ow`
@@ -23,6 +25,7 @@ var expected_response_by_token = map[string]userinfo.UserInfoDto{
 		Email:         "jsquirrel_github_9a6d@packetloss.de",
 		EmailVerified: true,
 		Groups:        []string{},
+		Roles:         []string{},
 	},
 	valid_JWT_id_is_staff_sub202: {
 		Subject:       "202",
@@ -30,6 +33,7 @@ var expected_response_by_token = map[string]userinfo.UserInfoDto{
 		Email:         "jsquirrel_github_9a6d@packetloss.de",
 		EmailVerified: true,
 		Groups:        []string{},
+		Roles:         []string{},
 	},
 	valid_JWT_id_is_staff_admin_sub1234567890: {
 		Subject:       "1234567890",
@@ -37,6 +41,7 @@ var expected_response_by_token = map[string]userinfo.UserInfoDto{
 		Email:         "jsquirrel_github_9a6d@packetloss.de",
 		EmailVerified: true,
 		Groups:        []string{"admin", "staff"},
+		Roles:         []string{"registration-admin", "staff"},
 	},
 	valid_JWT_id_is_staff_false_admin_sub444: {
 		Subject:       "444",
@@ -44,6 +49,7 @@ var expected_response_by_token = map[string]userinfo.UserInfoDto{
 		Email:         "jsquirrel_github_9a6d@packetloss.de",
 		EmailVerified: true,
 		Groups:        []string{"staff"}, // not admin because subject not in allowlist
+		Roles:         []string{"staff"},
 	},
 }
 
@@ -178,6 +184,47 @@ func TestUserinfo_IDPDown(t *testing.T) {
 	tstRequireErrorResponse(t, response, http.StatusBadGateway, "auth.idp.error", "identity provider could not be reached - see log for details")
 }
 
+func TestUserinfo_Success_SecondIdentityProvider(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user logged in with a second identity provider calls the userinfo endpoint")
+	idToken := tstSignWithIdpKey(jwt.MapClaims{
+		"iss": "https://staff.example.com",
+		"aud": "IAmStaff.",
+		"sub": "101",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, "JWT")
+	response := tstPerformGetWithCookies("/v1/userinfo", idToken, "access_mock_value 101")
+
+	docs.Then("then the request is successful, and the userinfo endpoint of that identity provider has been called")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	require.EqualValues(t, []string{"access_mock_value 101"}, idpMock.recording)
+	require.Equal(t, "staff", idpMock.lastUserInfoProvider)
+}
+
+func TestUserinfo_Failure_SecondIdentityProviderOtherAudience(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a user calls the userinfo endpoint with an id token of the second identity provider that was issued for another audience")
+	idToken := tstSignWithIdpKey(jwt.MapClaims{
+		"iss": "https://staff.example.com",
+		"aud": "IAmNotSoSecret.",
+		"sub": "101",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, "JWT")
+	response := tstPerformGetWithCookies("/v1/userinfo", idToken, "access_mock_value 101")
+
+	docs.Then("then the request is rejected, because the allowed_audience of that identity provider applies, not the one of the default identity provider")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+	require.Empty(t, idpMock.recording)
+}
+
 // --- helpers
 
 func tstRequireUserinfoResponse(t *testing.T, response tstWebResponse, expectedResponse userinfo.UserInfoDto) {
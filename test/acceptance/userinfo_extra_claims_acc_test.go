@@ -0,0 +1,85 @@
+package acceptance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// ------------------------------------------------------------
+// acceptance tests for passing through extra claims of the user
+// ------------------------------------------------------------
+
+/* In the test configuration, preferred_username, locale and badge_number are passed through.
+ */
+
+func tstIdTokenWithExtraClaims() string {
+	return tstSignWithIdpKey(jwt.MapClaims{
+		"iss":                "http://identity.localhost/",
+		"aud":                "14d9f37a-1eec-47c9-a949-5f1ebdf9c8e5",
+		"sub":                "303",
+		"name":               "John Badge",
+		"email":              "jsquirrel_github_9a6d@packetloss.de",
+		"email_verified":     true,
+		"preferred_username": "johnny",
+		"locale":             "de-DE",
+		"badge_number":       1234,
+		"zoneinfo":           "Europe/Berlin", // not in extra_claims
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}, "JWT")
+}
+
+func TestFrontendUserinfo_Success_ExtraClaims(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user whose id token has extra claims calls the frontend-userinfo endpoint")
+	response := tstPerformGetWithCookies("/v1/frontend-userinfo", tstIdTokenWithExtraClaims(), "access_mock_value 303")
+
+	docs.Then("then the configured extra claims are taken from the id token")
+	tstRequireUserinfoResponse(t, response, userinfo.UserInfoDto{
+		Subject:       "303",
+		Name:          "John Badge",
+		Email:         "jsquirrel_github_9a6d@packetloss.de",
+		EmailVerified: true,
+		Groups:        []string{},
+		Roles:         []string{},
+		ExtraClaims: map[string]interface{}{
+			"preferred_username": "johnny",
+			"locale":             "de-DE",
+			"badge_number":       float64(1234),
+		},
+	})
+	require.Empty(t, idpMock.recording)
+}
+
+func TestUserinfo_Success_ExtraClaims(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user with extra claims calls the userinfo endpoint")
+	response := tstPerformGetWithCookies("/v1/userinfo", tstIdTokenWithExtraClaims(), "access_mock_value 303")
+
+	docs.Then("then the configured extra claims are taken from the response of the identity provider")
+	tstRequireUserinfoResponse(t, response, userinfo.UserInfoDto{
+		Audiences:     []string{"12345-123"},
+		Subject:       "303",
+		Name:          "John Badge",
+		Email:         "jsquirrel_github_9a6d@packetloss.de",
+		EmailVerified: true,
+		Groups:        []string{},
+		Roles:         []string{},
+		ExtraClaims: map[string]interface{}{
+			"preferred_username": "johnny",
+			"badge_number":       float64(1234),
+		},
+	})
+	require.EqualValues(t, []string{"access_mock_value 303"}, idpMock.recording)
+}
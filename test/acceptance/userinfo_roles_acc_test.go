@@ -0,0 +1,92 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// ------------------------------------------------------------
+// acceptance tests for roles granted by claim values
+// ------------------------------------------------------------
+
+/* In the test configuration, the role registration is granted to users whose department claim
+ * is registration or security.
+ */
+
+func tstIdTokenWithDepartment(department string) string {
+	claims := jwt.MapClaims{
+		"iss":            "http://identity.localhost/",
+		"aud":            "14d9f37a-1eec-47c9-a949-5f1ebdf9c8e5",
+		"sub":            "505",
+		"name":           "John Security",
+		"email":          "jsquirrel_github_9a6d@packetloss.de",
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	if department != "" {
+		claims["department"] = department
+	}
+	return tstSignWithIdpKey(claims, "JWT")
+}
+
+func TestUserinfo_Success_RoleFromUserinfoClaim(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user calls the userinfo endpoint, and only the identity provider knows their department")
+	response := tstPerformGetWithCookies("/v1/userinfo", tstIdTokenWithDepartment(""), "access_mock_value 505")
+
+	docs.Then("then the role is granted based on the department claim in the response of the identity provider")
+	tstRequireUserinfoResponse(t, response, userinfo.UserInfoDto{
+		Audiences:     []string{"12345-123"},
+		Subject:       "505",
+		Name:          "John Security",
+		Email:         "jsquirrel_github_9a6d@packetloss.de",
+		EmailVerified: true,
+		Groups:        []string{},
+		Roles:         []string{"registration"},
+	})
+	require.EqualValues(t, []string{"access_mock_value 505"}, idpMock.recording)
+}
+
+func TestUserinfo_Success_RoleNotFromIdTokenClaim(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user calls the userinfo endpoint, and their id token has an outdated department claim")
+	response := tstPerformGetWithCookies("/v1/userinfo", tstIdTokenWithDepartment("finance"), "access_mock_value 505")
+
+	docs.Then("then the department claim in the response of the identity provider is what counts")
+	require.Equal(t, []string{"registration"}, tstParseUserinfoRoles(t, response))
+}
+
+func TestFrontendUserinfo_Success_RoleFromIdTokenClaim(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user whose id token has a department claim calls the frontend-userinfo endpoint")
+	response := tstPerformGetWithCookies("/v1/frontend-userinfo", tstIdTokenWithDepartment("registration"), "access_mock_value 505")
+
+	docs.Then("then the role is granted based on the department claim of the id token, without asking the identity provider")
+	require.Equal(t, []string{"registration"}, tstParseUserinfoRoles(t, response))
+	require.Empty(t, idpMock.recording)
+}
+
+// --- helpers
+
+func tstParseUserinfoRoles(t *testing.T, response tstWebResponse) []string {
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	actual := userinfo.UserInfoDto{}
+	tstParseJson(response.body, &actual)
+	return actual.Roles
+}
@@ -0,0 +1,203 @@
+package acceptance
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eurofurence/reg-auth-service/docs"
+	"github.com/eurofurence/reg-auth-service/internal/api/v1/userinfo"
+	"github.com/eurofurence/reg-auth-service/internal/web/util/audit"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// --------------------------------------------------------------
+// acceptance tests for the userinfo lookup endpoint for backend services
+// --------------------------------------------------------------
+
+/* In the test configuration, payment-service authenticates with an api key, mail-service with a
+ * client credentials access token, and both have the userinfo scope. scopeless-service has an api key,
+ * but no scopes. Only the default identity provider has an admin api.
+ */
+
+const tstPaymentServiceApiKey = "api-token-for-testing-must-be-pretty-long"
+
+const tstScopelessServiceApiKey = "api-key-without-any-scopes-for-testing"
+
+func TestUserinfoSubject_Success_ApiKey(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client with the userinfo scope looks up a user with its api key")
+	response := tstPerformGetWithApiKey("/v1/userinfo/101", tstPaymentServiceApiKey)
+
+	docs.Then("then the request is successful and the response is as expected")
+	tstRequireUserinfoResponse(t, response, userinfo.UserInfoDto{
+		Audiences:     []string{"12345-123"},
+		Subject:       "101",
+		Name:          "John Doe",
+		Email:         "jsquirrel_github_9a6d@packetloss.de",
+		EmailVerified: true,
+		Groups:        []string{},
+		Roles:         []string{},
+	})
+
+	docs.Then("and the admin api of the identity provider was asked, and the lookup was audited")
+	require.EqualValues(t, []string{"default 101"}, idpMock.adminLookups)
+	require.Empty(t, idpMock.recording)
+	require.Contains(t, tstAuditEvents(), audit.Event{Type: audit.ServiceUserinfoLookup, AppName: "payment-service", Subject: "101", UserAgent: "Go-http-client/1.1", Outcome: audit.OutcomeSuccess})
+}
+
+func TestUserinfoSubject_Success_ClientCredentials(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client with the userinfo scope looks up a user with a client credentials access token")
+	response := tstPerformGetWithBearerToken("/v1/userinfo/101", tstServiceToken("IAmTheMailService."))
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	require.EqualValues(t, []string{"default 101"}, idpMock.adminLookups)
+}
+
+func TestUserinfoSubject_Failure_UnknownSubject(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client looks up a subject the identity provider does not know")
+	response := tstPerformGetWithApiKey("/v1/userinfo/999", tstPaymentServiceApiKey)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusNotFound, "auth.userinfo.notfound", "subject is unknown to the identity provider")
+}
+
+func TestUserinfoSubject_Failure_NoAdminApi(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client looks up a user with an identity provider that has no admin api")
+	response := tstPerformGetWithApiKey("/v1/userinfo/101?identity_provider=staff", tstPaymentServiceApiKey)
+
+	docs.Then("then the request fails with the appropriate error, without calling the identity provider")
+	tstRequireErrorResponse(t, response, http.StatusNotFound, "auth.userinfo.notfound", "identity provider does not support looking up users")
+	require.Empty(t, idpMock.adminLookups)
+}
+
+func TestUserinfoSubject_Failure_UnknownIdentityProvider(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client looks up a user with an identity provider that does not exist")
+	response := tstPerformGetWithApiKey("/v1/userinfo/101?identity_provider=unknown", tstPaymentServiceApiKey)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "auth.userinfo.invalid", "identity_provider is unknown")
+}
+
+func TestUserinfoSubject_Failure_IdpDown(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client looks up a user while the admin api is down")
+	response := tstPerformGetWithApiKey("/v1/userinfo/idp_is_down", tstPaymentServiceApiKey)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadGateway, "auth.idp.error", "identity provider could not be reached - see log for details")
+}
+
+func TestUserinfoSubject_Failure_MissingScope(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client without the userinfo scope tries to look up a user")
+	response := tstPerformGetWithApiKey("/v1/userinfo/101", tstScopelessServiceApiKey)
+
+	docs.Then("then the request is forbidden, and the identity provider is not asked")
+	tstRequireErrorResponse(t, response, http.StatusForbidden, "auth.forbidden", "this endpoint is only available to service clients with the userinfo scope")
+	require.Empty(t, idpMock.adminLookups)
+	require.Contains(t, tstAuditEvents(), audit.Event{Type: audit.ServiceUserinfoLookup, AppName: "scopeless-service", Subject: "101", UserAgent: "Go-http-client/1.1", Outcome: audit.OutcomeFailure, Reason: "service client 'scopeless-service' is not allowed to look up users"})
+}
+
+func TestUserinfoSubject_Failure_User(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a logged in user tries to look up another user")
+	response := tstPerformGetWithCookies("/v1/userinfo/202", valid_JWT_id_is_not_staff_sub101, "access_mock_value 101")
+
+	docs.Then("then the request is forbidden")
+	tstRequireErrorResponse(t, response, http.StatusForbidden, "auth.forbidden", "this endpoint is only available to service clients with the userinfo scope")
+	require.Empty(t, idpMock.adminLookups)
+}
+
+func TestUserinfoSubject_Failure_UnknownApiKey(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when an api key is used that does not belong to any service client")
+	response := tstPerformGetWithApiKey("/v1/userinfo/101", "not-a-known-api-key")
+
+	docs.Then("then the request is rejected")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+	require.Empty(t, idpMock.adminLookups)
+}
+
+func TestUserinfoSubject_Failure_ExpiredServiceToken(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client uses an expired client credentials access token")
+	response := tstPerformGetWithBearerToken("/v1/userinfo/101", tstSignWithIdpKey(jwt.MapClaims{
+		"client_id": "IAmTheMailService.",
+		"exp":       time.Now().Add(-time.Minute).Unix(),
+	}, "at+jwt"))
+
+	docs.Then("then the request is rejected")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "authorization failed to check out during local validation - please see logs for details")
+	require.Empty(t, idpMock.adminLookups)
+}
+
+func TestUserinfo_Failure_ServiceClient(t *testing.T) {
+	docs.Given("given the standard test configuration")
+	tstSetup(tstDefaultConfigFile)
+	defer tstShutdown()
+
+	docs.When("when a service client calls the userinfo endpoint meant for users")
+	response := tstPerformGetWithApiKey("/v1/userinfo", tstPaymentServiceApiKey)
+
+	docs.Then("then the request is rejected, because there is no user")
+	require.Equal(t, http.StatusUnauthorized, response.status, "unexpected http response status")
+	require.Empty(t, idpMock.recording)
+}
+
+// --- helpers
+
+func tstServiceToken(clientId string) string {
+	return tstSignWithIdpKey(jwt.MapClaims{
+		"iss":       "http://identity.localhost/",
+		"client_id": clientId,
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	}, "at+jwt")
+}
+
+func tstPerformGetWithApiKey(relativeUrlWithLeadingSlash string, apiKey string) tstWebResponse {
+	rawResponse := tstPerformGetNoRedirectWithHeaders(relativeUrlWithLeadingSlash, http.Header{"X-Api-Key": []string{apiKey}})
+	return tstWebResponseFromResponse(&rawResponse)
+}
+
+func tstPerformGetWithBearerToken(relativeUrlWithLeadingSlash string, token string) tstWebResponse {
+	rawResponse := tstPerformGetNoRedirectWithHeaders(relativeUrlWithLeadingSlash, http.Header{"Authorization": []string{"Bearer " + token}})
+	return tstWebResponseFromResponse(&rawResponse)
+}
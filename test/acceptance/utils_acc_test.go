@@ -3,12 +3,14 @@ package acceptance
 import (
 	"encoding/json"
 	"github.com/eurofurence/reg-auth-service/internal/api/v1/errorapi"
+	"github.com/eurofurence/reg-auth-service/internal/web/controller"
 	"github.com/go-http-utils/headers"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -43,6 +45,146 @@ func tstPerformGetWithCookies(relativeUrlWithLeadingSlash string, idToken string
 	if err != nil {
 		log.Fatal(err)
 	}
+	tstAddCookies(request, idToken, accToken)
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tstWebResponseFromResponse(response)
+}
+
+func tstPerformGetNoRedirectWithHeaders(relativeUrlWithLeadingSlash string, headers http.Header) http.Response {
+	request, err := http.NewRequest(http.MethodGet, ts.URL+relativeUrlWithLeadingSlash, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, values := range headers {
+		request.Header[name] = values
+	}
+
+	// create a client that doesn't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *response
+}
+
+func tstPerformGetNoRedirectWithCookies(relativeUrlWithLeadingSlash string, idToken string, accToken string) http.Response {
+	request, err := http.NewRequest(http.MethodGet, ts.URL+relativeUrlWithLeadingSlash, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tstAddCookies(request, idToken, accToken)
+
+	// create a client that doesn't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *response
+}
+
+func tstPerformPostForm(relativeUrlWithLeadingSlash string, values url.Values) tstWebResponse {
+	response, err := http.PostForm(ts.URL+relativeUrlWithLeadingSlash, values)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tstWebResponseFromResponse(response)
+}
+
+func tstPerformPostFormNoRedirect(relativeUrlWithLeadingSlash string, values url.Values) http.Response {
+	// create a client that doesn't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.PostForm(ts.URL+relativeUrlWithLeadingSlash, values)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *response
+}
+
+func tstPerformPostFormNoRedirectWithHeaders(relativeUrlWithLeadingSlash string, values url.Values, headers http.Header) http.Response {
+	request, err := http.NewRequest(http.MethodPost, ts.URL+relativeUrlWithLeadingSlash, strings.NewReader(values.Encode()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, values := range headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// create a client that doesn't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *response
+}
+
+func tstPerformPostNoRedirectWithCookies(relativeUrlWithLeadingSlash string, cookies []*http.Cookie) http.Response {
+	request, err := http.NewRequest(http.MethodPost, ts.URL+relativeUrlWithLeadingSlash, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+
+	// create a client that doesn't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *response
+}
+
+func tstResponseCookie(response *http.Response, name string) *http.Cookie {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// tstWithFlowCookie adds the flow cookie that the auth endpoint sets for the given state, as if the browser that
+// started the flow was calling the dropoff endpoint
+func tstWithFlowCookie(headers http.Header, state string) http.Header {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	cookie := controller.NewFlowCookie(state, false)
+	headers.Add("Cookie", cookie.Name+"="+cookie.Value)
+	return headers
+}
+
+func tstAddCookies(request *http.Request, idToken string, accToken string) {
 	expire := time.Now().AddDate(0, 0, 1)
 	idCookie := http.Cookie{
 		Name:       "JWT",
@@ -79,13 +221,6 @@ func tstPerformGetWithCookies(relativeUrlWithLeadingSlash string, idToken string
 	if accToken != "" {
 		request.AddCookie(&accCookie)
 	}
-
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return tstWebResponseFromResponse(response)
 }
 
 func tstWebResponseFromResponse(response *http.Response) tstWebResponse {